@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// checkAccess asks Consul what the token may do with ACLs before planning. A
+// plan needs to read them, anything that applies it to write them; failing
+// here beats failing on the first request, or midway through an apply. A plan
+// with a token that can only read is read-only throughout: it does not write
+// its run history either. Clients that cannot ask, and Consul versions that
+// do not answer, are trusted with whatever the run needs.
+func (s *session) checkAccess() error {
+	a, ok := s.client.(consul.Authorizer)
+	if !ok {
+		return nil
+	}
+	access, err := a.ACLAccess()
+	if err != nil {
+		if s.debug {
+			debugf("could not check the ACL permissions of the token: %v", err)
+		}
+		return nil
+	}
+	switch {
+	case !access.Read:
+		return fmt.Errorf("the Consul token cannot read ACLs; %s needs a token with acl = \"read\" or more", s.command)
+	case !access.Write && s.command != "plan":
+		return fmt.Errorf("the Consul token can only read ACLs; %s needs a token with acl = \"write\"", s.command)
+	}
+	s.readOnly = !access.Write
+	return nil
+}
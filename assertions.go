@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-yaml"
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// assertionFile is a file of assertions about the config, checked by test.
+type assertionFile struct {
+	Tests []assertion `yaml:"tests"`
+}
+
+// assertion checks a token, a policy, or with who_can everything in the
+// config that grants an operation. Operations are written as in simulate's
+// -op, resource:access[:name]. An operation no rule matches is not allowed:
+// assertions assume the agents' default_policy is deny.
+type assertion struct {
+	Name string `yaml:"name"`
+
+	// Token is the accessor ID or description of a token of the config. Its
+	// policies and roles, and the operations it is allowed, count those it
+	// has through its roles.
+	Token       string   `yaml:"token"`
+	HasPolicies []string `yaml:"has_policies"`
+	HasRoles    []string `yaml:"has_roles"`
+
+	// Policy is the name of a policy of the config, checked on its own.
+	Policy string `yaml:"policy"`
+
+	Allows []string `yaml:"allows"`
+	Denies []string `yaml:"denies"`
+
+	// WhoCan is an operation that only the policies in OnlyPolicies, and,
+	// when it is set, only the tokens in OnlyTokens may be allowed.
+	WhoCan       string   `yaml:"who_can"`
+	OnlyPolicies []string `yaml:"only_policies"`
+	OnlyTokens   []string `yaml:"only_tokens"`
+}
+
+// loadAssertions reads an assertion file. Unknown keys are errors, so a
+// misspelled check fails rather than passing unchecked.
+func loadAssertions(path string) ([]assertion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f assertionFile
+	if err := yaml.UnmarshalWithOptions(data, &f, yaml.Strict()); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, yaml.FormatError(err, false, false))
+	}
+	for i, a := range f.Tests {
+		if err := a.validate(); err != nil {
+			return nil, fmt.Errorf("%s: test #%d %q: %w", path, i+1, a.Name, err)
+		}
+	}
+	return f.Tests, nil
+}
+
+func (a assertion) validate() error {
+	subjects := 0
+	for _, s := range []string{a.Token, a.Policy, a.WhoCan} {
+		if s != "" {
+			subjects++
+		}
+	}
+	switch {
+	case a.Name == "":
+		return fmt.Errorf("needs a name")
+	case subjects != 1:
+		return fmt.Errorf("needs exactly one of token, policy and who_can")
+	case a.Token == "" && (len(a.HasPolicies) > 0 || len(a.HasRoles) > 0):
+		return fmt.Errorf("has_policies and has_roles need a token")
+	case a.WhoCan == "" && (a.OnlyPolicies != nil || a.OnlyTokens != nil):
+		return fmt.Errorf("only_policies and only_tokens need who_can")
+	case a.WhoCan != "" && (len(a.Allows) > 0 || len(a.Denies) > 0):
+		return fmt.Errorf("allows and denies need a token or a policy")
+	}
+	for _, s := range append(append([]string{a.WhoCan}, a.Allows...), a.Denies...) {
+		if s == "" {
+			continue
+		}
+		if _, err := parseOperation(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns why cfg fails a, empty when it holds.
+func (a assertion) check(cfg *config.Config) ([]string, error) {
+	switch {
+	case a.Token != "":
+		return a.checkToken(cfg)
+	case a.Policy != "":
+		return a.checkPolicy(cfg)
+	default:
+		return a.checkWhoCan(cfg)
+	}
+}
+
+func (a assertion) checkToken(cfg *config.Config) ([]string, error) {
+	var token *config.Token
+	for i, t := range cfg.Tokens {
+		if t.AccessorID == a.Token || t.Description == a.Token {
+			if token != nil {
+				return nil, fmt.Errorf("several tokens have description %q; name the token by accessor ID", a.Token)
+			}
+			token = &cfg.Tokens[i]
+		}
+	}
+	if token == nil {
+		return []string{fmt.Sprintf("no token %q in the config", a.Token)}, nil
+	}
+
+	src, missing, err := tokenRules(cfg, token)
+	if err != nil {
+		return nil, err
+	}
+	var failures []string
+	for _, name := range missing {
+		failures = append(failures, fmt.Sprintf("token %s has %s, which the config does not define", token.Label(), name))
+	}
+	has := make(map[string]bool)
+	for _, name := range src.policy {
+		has["policy "+name] = true
+	}
+	for _, name := range token.Policies {
+		has["policy "+name] = true
+	}
+	for _, name := range token.Roles {
+		has["role "+name] = true
+	}
+	for _, name := range a.HasPolicies {
+		if !has["policy "+name] {
+			failures = append(failures, fmt.Sprintf("token %s does not have policy %q", token.Label(), name))
+		}
+	}
+	for _, name := range a.HasRoles {
+		if !has["role "+name] {
+			failures = append(failures, fmt.Sprintf("token %s does not have role %q", token.Label(), name))
+		}
+	}
+	return append(failures, a.checkOperations("token "+token.Label(), src)...), nil
+}
+
+func (a assertion) checkPolicy(cfg *config.Config) ([]string, error) {
+	for _, p := range cfg.Policies {
+		if p.Name != a.Policy && p.Key() != a.Policy {
+			continue
+		}
+		rules, err := acl.Parse(p.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", p.Key(), err)
+		}
+		var src sourcedRules
+		src.add(p.Key(), rules)
+		return a.checkOperations(fmt.Sprintf("policy %q", p.Key()), src), nil
+	}
+	return []string{fmt.Sprintf("no policy %q in the config", a.Policy)}, nil
+}
+
+// checkOperations checks the allows and denies of a against src, the rules of
+// subject.
+func (a assertion) checkOperations(subject string, src sourcedRules) []string {
+	var failures []string
+	for _, s := range a.Allows {
+		op, _ := parseOperation(s)
+		i := acl.Decide(src.rules, op.resource, op.name)
+		switch {
+		case i < 0:
+			failures = append(failures, fmt.Sprintf("%s is not allowed %s: no rule matches", subject, op))
+		case !acl.Allows(src.rules[i].Policy, op.access):
+			failures = append(failures, fmt.Sprintf("%s is not allowed %s: %q %s", subject, op, src.policy[i], src.rules[i]))
+		}
+	}
+	for _, s := range a.Denies {
+		op, _ := parseOperation(s)
+		if i := acl.Decide(src.rules, op.resource, op.name); i >= 0 && acl.Allows(src.rules[i].Policy, op.access) {
+			failures = append(failures, fmt.Sprintf("%s is allowed %s: %q %s", subject, op, src.policy[i], src.rules[i]))
+		}
+	}
+	return failures
+}
+
+func (a assertion) checkWhoCan(cfg *config.Config) ([]string, error) {
+	op, _ := parseOperation(a.WhoCan)
+	allowed := func(src sourcedRules) (int, bool) {
+		i := acl.Decide(src.rules, op.resource, op.name)
+		return i, i >= 0 && acl.Allows(src.rules[i].Policy, op.access)
+	}
+	listed := func(names []string, values ...string) bool {
+		for _, name := range names {
+			for _, v := range values {
+				if name == v {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var failures []string
+	for _, p := range cfg.Policies {
+		rules, err := acl.Parse(p.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", p.Key(), err)
+		}
+		var src sourcedRules
+		src.add(p.Key(), rules)
+		if i, ok := allowed(src); ok && !listed(a.OnlyPolicies, p.Name, p.Key()) {
+			failures = append(failures, fmt.Sprintf("policy %q is allowed %s: %s", p.Key(), op, src.rules[i]))
+		}
+	}
+	if a.OnlyTokens == nil {
+		return failures, nil
+	}
+	for i, t := range cfg.Tokens {
+		src, _, err := tokenRules(cfg, &cfg.Tokens[i])
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := allowed(src); ok && !listed(a.OnlyTokens, t.AccessorID, t.Description) {
+			failures = append(failures, fmt.Sprintf("token %s is allowed %s: %q %s", t.Label(), op, src.policy[i], src.rules[i]))
+		}
+	}
+	return failures, nil
+}
+
+// testCommand checks assertion files against the config, without contacting
+// Consul, and fails when any assertion does not hold, so guardrails on who
+// may do what can gate CI.
+func testCommand(fs *flag.FlagSet) func([]string) error {
+	var opts configOptions
+	opts.register(fs)
+	return func(files []string) error {
+		if len(files) == 0 {
+			return fmt.Errorf("pass one or more assertion files")
+		}
+		var assertions []assertion
+		for _, path := range files {
+			got, err := loadAssertions(path)
+			if err != nil {
+				return err
+			}
+			assertions = append(assertions, got...)
+		}
+		cfg, err := opts.load()
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, a := range assertions {
+			failures, err := a.check(cfg)
+			if err != nil {
+				return fmt.Errorf("test %q: %w", a.Name, err)
+			}
+			if len(failures) == 0 {
+				fmt.Printf("ok    %s\n", a.Name)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL  %s\n", a.Name)
+			for _, f := range failures {
+				fmt.Printf("        %s\n", f)
+			}
+		}
+		fmt.Printf("\n%d passed, %d failed.\n", len(assertions)-failed, failed)
+		if failed > 0 {
+			return fmt.Errorf("%d of %d tests failed", failed, len(assertions))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// auditRecord is one apply. Changes carry before and after values of the
+// compared fields; token secrets are never part of them.
+type auditRecord struct {
+	Time     time.Time     `json:"time"`
+	Operator string        `json:"operator"`
+	Config   string        `json:"config"`
+	Commit   string        `json:"commit,omitempty"`
+	PlanHash string        `json:"plan_hash"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+	Changes  []diff.Change `json:"changes"`
+}
+
+// writeAudit records an apply. commit is the Git commit the config came from,
+// if known, and applyErr the error the apply failed with, if any.
+func writeAudit(cfg config.AuditConfig, kv consul.KV, configPath, commit string, plan *diff.Plan, applyErr error) error {
+	rec := auditRecord{
+		Time:     time.Now().UTC(),
+		Operator: currentOperator(),
+		Config:   configPath,
+		Commit:   commit,
+		PlanHash: diff.Hash(plan),
+		Outcome:  "success",
+		Changes:  diff.Changes(plan),
+	}
+	if applyErr != nil {
+		rec.Outcome = "failure"
+		rec.Error = applyErr.Error()
+	}
+
+	if cfg.Path != "" {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	if cfg.ConsulKVPrefix != "" {
+		// Timestamped keys sort chronologically and never overwrite.
+		key := fmt.Sprintf("%s/%s-%s", cfg.ConsulKVPrefix, rec.Time.Format("20060102T150405.000000000Z"), rec.PlanHash[:12])
+		if err := kv.PutKV(key, rec); err != nil {
+			return fmt.Errorf("failed to write audit record to Consul KV: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/apply"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// backupVersion is the archive format version; restore refuses others.
+const backupVersion = 1
+
+// backupArchive is the ACL state of a cluster at one moment. Token secrets
+// are not part of it: the list endpoint does not return them, and an archive
+// lying around is not where they belong.
+type backupArchive struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Reason is "manual" for the backup command, and "pre-apply" or
+	// "pre-restore" for the archive an apply or a restore takes before
+	// changing anything.
+	Reason   string          `json:"reason"`
+	Policies []consul.Policy `json:"policies"`
+	Tokens   []consul.Token  `json:"tokens"`
+	Roles    []consul.Role   `json:"roles"`
+	// Changes are the changes of the plan about to be applied, in pre-apply
+	// and pre-restore archives; rollback limits itself to them.
+	Changes []diff.Change `json:"changes,omitempty"`
+}
+
+// takeBackup reads every policy with its rules, every token and every role.
+func takeBackup(api consul.API, reason string) (*backupArchive, error) {
+	policies, err := api.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	for i, p := range policies {
+		full, err := api.PolicyRules(p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy %q: %w", p.Name, err)
+		}
+		policies[i].Rules = full.Rules
+	}
+	tokens, err := api.ListTokens()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	roles, err := api.ListRoles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].AccessorID < tokens[j].AccessorID })
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return &backupArchive{
+		Version:  backupVersion,
+		Time:     time.Now().UTC(),
+		Reason:   reason,
+		Policies: policies,
+		Tokens:   tokens,
+		Roles:    roles,
+	}, nil
+}
+
+// writeBackup writes a to a new timestamped file in dir and returns its path.
+// Archives sort chronologically by name and are never overwritten. With
+// recipients in enc the archive is encrypted, and named .json.age.
+func writeBackup(dir string, a *backupArchive, enc config.Encryption) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	b = append(b, '\n')
+	path := filepath.Join(dir, fmt.Sprintf("consul-acl-backup-%s.json", a.Time.Format("20060102T150405.000000000Z")))
+	if len(enc.AgeRecipients) > 0 {
+		if b, err = enc.Encrypt(b); err != nil {
+			return "", fmt.Errorf("failed to write backup: %w", err)
+		}
+		path += ".age"
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+	if err := secrets.Restrict(path); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	return path, nil
+}
+
+func readBackup(path string) (*backupArchive, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if b, err = config.Decrypt("backup "+path, b); err != nil {
+		return nil, err
+	}
+	var a backupArchive
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("failed to parse backup %s: %w", path, err)
+	}
+	if a.Version != backupVersion {
+		return nil, fmt.Errorf("backup %s has format version %d, want %d", path, a.Version, backupVersion)
+	}
+	return &a, nil
+}
+
+// backupBeforeApply archives the ACL state into backup.dir before a plan with
+// changes is applied, so the apply can be undone with rollback or restore.
+// reason is "pre-apply" or "pre-restore".
+func (s *session) backupBeforeApply(plan *diff.Plan, reason string) error {
+	if s.cfg.Backup.Dir == "" || !plan.HasChanges() {
+		return nil
+	}
+	a, err := takeBackup(s.client, reason)
+	if err != nil {
+		return fmt.Errorf("%s backup: %w", reason, err)
+	}
+	a.Changes = diff.Changes(plan)
+	path, err := writeBackup(s.cfg.Backup.Dir, a, s.cfg.Encryption)
+	if err != nil {
+		return fmt.Errorf("%s backup: %w", reason, err)
+	}
+	fmt.Printf("Backed up the ACL state to %s.\n", path)
+	return nil
+}
+
+// restoreConfig turns an archive into a config that restore plans like any
+// other. Consul's built-in resources are left alone, and so are tokens it
+// cannot restore faithfully: those deleted since, whose secret the archive
+// does not hold. skipped describes each token left out.
+func restoreConfig(a *backupArchive, live []consul.Token) (cfg *config.Config, skipped []string) {
+	exists := make(map[string]bool, len(live))
+	for _, t := range live {
+		exists[t.AccessorID] = true
+	}
+	cfg = &config.Config{}
+	for _, p := range a.Policies {
+		if p.Builtin() {
+			continue
+		}
+		cfg.Policies = append(cfg.Policies, config.Policy{
+			Name:        p.Name,
+			Description: p.Description,
+			Rules:       p.Rules,
+			Datacenters: p.Datacenters,
+			Tenancy:     p.Tenancy(),
+		})
+	}
+	for _, r := range a.Roles {
+		cfg.Roles = append(cfg.Roles, restoreRole(r))
+	}
+	for _, t := range a.Tokens {
+		switch {
+		case t.Builtin():
+			continue
+		case !exists[t.AccessorID]:
+			skipped = append(skipped, fmt.Sprintf("token %s no longer exists and the backup has no secret to recreate it with", t.Label()))
+			continue
+		}
+		cfg.Tokens = append(cfg.Tokens, config.Token{
+			AccessorID:  t.AccessorID,
+			Description: t.Description,
+			Policies:    t.PolicyNames(),
+			Roles:       t.RoleNames(),
+			Tenancy:     t.Tenancy(),
+		})
+	}
+	return cfg, skipped
+}
+
+// restoreRole turns an archived role back into its config.
+func restoreRole(r consul.Role) config.Role {
+	role := config.Role{
+		Name:        r.Name,
+		Description: r.Description,
+		Policies:    r.PolicyNames(),
+		Tenancy:     r.Tenancy(),
+	}
+	for _, si := range r.ServiceIdentities {
+		role.ServiceIdentities = append(role.ServiceIdentities, config.ServiceIdentity{ServiceName: si.ServiceName, Datacenters: si.Datacenters})
+	}
+	for _, ni := range r.NodeIdentities {
+		role.NodeIdentities = append(role.NodeIdentities, config.NodeIdentity{NodeName: ni.NodeName, Datacenter: ni.Datacenter})
+	}
+	for _, tp := range r.TemplatedPolicies {
+		t := config.TemplatedPolicy{TemplateName: tp.TemplateName, Datacenters: tp.Datacenters}
+		if tp.TemplateVariables != nil {
+			t.TemplateVariables.Name = tp.TemplateVariables.Name
+		}
+		role.TemplatedPolicies = append(role.TemplatedPolicies, t)
+	}
+	return role
+}
+
+// backupCommand archives the ACL state of the cluster.
+func backupCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts options
+		dir  string
+	)
+	opts.register(fs)
+	fs.StringVar(&dir, "dir", "", "directory to write the archive to (default: backup.dir from the config, else the current directory)")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		s, err := opts.open("backup")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		if dir == "" {
+			dir = s.cfg.Backup.Dir
+		}
+		if dir == "" {
+			dir = "."
+		}
+		a, err := takeBackup(s.client, "manual")
+		if err != nil {
+			return err
+		}
+		path, err := writeBackup(dir, a, s.cfg.Encryption)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up %d policies, %d tokens and %d roles to %s.\n", len(a.Policies), len(a.Tokens), len(a.Roles), path)
+		return nil
+	}
+}
+
+// restoreCommand applies an archive back to the cluster. Like apply it only
+// creates and updates: resources created since the backup are left in place.
+func restoreCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		dryRun bool
+		verify bool
+	)
+	opts.register(fs)
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes the restore would make without making them")
+	fs.BoolVar(&verify, "verify", true, "re-read changed resources after the restore and check they match the backup")
+	return func(args []string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("usage: consul-acl-sync restore [flags] <backup file>")
+		}
+		a, err := readBackup(args[0])
+		if err != nil {
+			return err
+		}
+
+		s, err := opts.open("restore")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		return s.restore(args[0], a, dryRun, verify)
+	}
+}
+
+// restore plans the archive against the cluster and, unless dryRun, applies
+// the plan. source names the archive in the audit log.
+func (s *session) restore(source string, a *backupArchive, dryRun, verify bool) error {
+	live, err := s.client.ListTokens()
+	if err != nil {
+		return fmt.Errorf("failed to list tokens: %w", err)
+	}
+	cfg, skipped := restoreConfig(a, live)
+	for _, msg := range skipped {
+		fmt.Fprintln(os.Stderr, "warning: skipping", msg)
+	}
+	plan, err := diff.Calculate(s.client, cfg, nil, s.progress.status())
+	if err != nil {
+		return err
+	}
+	plan.ShowSecrets = s.red.Shows()
+	s.lastPlan = plan
+	diff.PrintText(os.Stdout, plan)
+	if dryRun || !plan.HasChanges() {
+		return nil
+	}
+	fmt.Println()
+	if err := s.backupBeforeApply(plan, "pre-restore"); err != nil {
+		return err
+	}
+
+	applied, err := apply.Apply(s.client, s.store, s.red, plan, 1, s.progress.lines())
+	s.applied = len(applied)
+	if err == nil && verify {
+		fmt.Fprint(os.Stderr, "verifying... ")
+		if err = apply.Verify(s.client, plan, s.progress.status()); err != nil {
+			fmt.Fprintln(os.Stderr, "failed")
+		} else {
+			fmt.Fprintln(os.Stderr, "ok")
+		}
+	}
+	if auditErr := writeAudit(s.cfg.Audit, s.kv, source, s.commit, plan, s.red.Error(err)); auditErr != nil && err == nil {
+		return auditErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nRestored: policies %d created, %d updated; roles %d created, %d updated; tokens %d created, %d updated.\n",
+		len(plan.PoliciesToCreate), len(plan.PoliciesToUpdate),
+		len(plan.RolesToCreate), len(plan.RolesToUpdate),
+		len(plan.TokensToCreate), len(plan.TokensToUpdate))
+	return nil
+}
+
+// latestPreApply returns the path of the newest pre-apply archive in dir.
+// Archive names sort chronologically.
+func latestPreApply(dir string) (string, *backupArchive, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "consul-acl-backup-*.json*"))
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		a, err := readBackup(path)
+		if err != nil {
+			return "", nil, err
+		}
+		if a.Reason == "pre-apply" {
+			return path, a, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no pre-apply backup in %s", dir)
+}
+
+// unarchived says, by change type, why an archive does not hold the
+// resources of that type, which rollback then cannot undo.
+var unarchived = map[string]string{
+	"auth-method": "backups do not hold auth methods, whose config carries credentials",
+	"namespace":   "backups do not hold namespaces",
+	"partition":   "backups do not hold admin partitions",
+}
+
+// touchedOnly narrows a pre-apply archive to the resources its apply
+// changed. Resources the apply created did not exist before it, and since
+// rollback never deletes, they are only described in created. Changes to
+// resources the archive does not hold are described in kept.
+func touchedOnly(a *backupArchive) (_ *backupArchive, created, kept []string) {
+	touched := make(map[string]bool, len(a.Changes))
+	for _, c := range a.Changes {
+		switch {
+		case c.Action == "create":
+			created = append(created, fmt.Sprintf("%s %s", c.Type, c.Name))
+		case unarchived[c.Type] != "":
+			kept = append(kept, fmt.Sprintf("%s %s was changed by that apply and is left as it is; %s", c.Type, c.Name, unarchived[c.Type]))
+		default:
+			touched[c.Type+" "+qualifiedChangeName(c)] = true
+		}
+	}
+	out := *a
+	out.Policies, out.Roles, out.Tokens = nil, nil, nil
+	for _, p := range a.Policies {
+		if touched["policy "+p.Tenancy().Qualify(p.Name)] {
+			out.Policies = append(out.Policies, p)
+		}
+	}
+	for _, r := range a.Roles {
+		if touched["role "+r.Tenancy().Qualify(r.Name)] {
+			out.Roles = append(out.Roles, r)
+		}
+	}
+	for _, t := range a.Tokens {
+		if touched["token "+t.AccessorID] {
+			out.Tokens = append(out.Tokens, t)
+		}
+	}
+	return &out, created, kept
+}
+
+// qualifiedChangeName returns the name of the resource c changed as
+// partition/namespace/name. A plan qualifies the names of policies and roles
+// only when it changes a resource outside the default tenancy, and names
+// hold no slash, so an unqualified name is in the default one. Tokens are
+// named by accessor ID, which needs no qualifying.
+func qualifiedChangeName(c diff.Change) string {
+	if c.Type == "token" || strings.Contains(c.Name, "/") {
+		return c.Name
+	}
+	return config.Tenancy{}.Qualify(c.Name)
+}
+
+// rollbackCommand undoes the last apply: it restores the resources that apply
+// updated to their state in its pre-apply backup.
+func rollbackCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		dir    string
+		dryRun bool
+		verify bool
+	)
+	opts.register(fs)
+	fs.StringVar(&dir, "dir", "", "directory holding the pre-apply backups (default: backup.dir from the config)")
+	fs.BoolVar(&dryRun, "dry-run", false, "print the changes the rollback would make without making them")
+	fs.BoolVar(&verify, "verify", true, "re-read changed resources after the rollback and check they match the backup")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		s, err := opts.open("rollback")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		if dir == "" {
+			dir = s.cfg.Backup.Dir
+		}
+		if dir == "" {
+			return fmt.Errorf("rollback needs -dir or backup.dir in the config")
+		}
+		path, a, err := latestPreApply(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolling back the apply of %s (backup %s).\n\n", a.Time.Format(time.RFC3339), path)
+		a, created, kept := touchedOnly(a)
+		for _, name := range created {
+			fmt.Fprintf(os.Stderr, "warning: %s was created by that apply and is left in place; rollback never deletes\n", name)
+		}
+		for _, msg := range kept {
+			fmt.Fprintln(os.Stderr, "warning:", msg)
+		}
+		return s.restore(path, a, dryRun, verify)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+const backupTestConfig = `
+policies:
+  - name: web-read
+    description: web
+    rules: 'service "web" { policy = "read" }'
+  - name: db-read
+    description: db
+    rules: 'service "db" { policy = "read" }'
+roles:
+  - name: web
+    description: web role
+    policies: [web-read]
+    service_identities:
+      - service_name: web
+        datacenters: [dc1]
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 9f1c7d00-0000-4000-8000-000000000001
+    description: web
+    roles: [web]
+`
+
+func TestRestoreRoles(t *testing.T) {
+	srv := consultest.NewServer(t)
+	cfg, err := config.Parse([]byte(backupTestConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, cfg)
+	a, err := takeBackup(srv.Client(t, cfg), "pre-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Roles[0].Policies = []string{"db-read"}
+	cfg.Roles[0].ServiceIdentities = nil
+	a.Changes = diff.Changes(srv.Sync(t, cfg))
+
+	touched, created, kept := touchedOnly(a)
+	if len(created) != 0 || len(kept) != 0 || len(touched.Policies) != 0 || len(touched.Tokens) != 0 || len(touched.Roles) != 1 {
+		t.Fatalf("touchedOnly = %d policies, %d roles, %d tokens, created %v; want the role only",
+			len(touched.Policies), len(touched.Roles), len(touched.Tokens), created)
+	}
+
+	restored, skipped := restoreConfig(touched, srv.Tokens())
+	if len(skipped) != 0 {
+		t.Fatalf("skipped %v", skipped)
+	}
+	if plan := srv.Sync(t, restored); len(plan.RolesToUpdate) != 1 {
+		t.Fatalf("RolesToUpdate = %v, want the changed role", plan.RolesToUpdate)
+	}
+	roles := srv.Roles()
+	if len(roles) != 1 {
+		t.Fatalf("roles = %+v, want one", roles)
+	}
+	if got := roles[0].PolicyNames(); len(got) != 1 || got[0] != "web-read" {
+		t.Errorf("role policies = %v, want [web-read]", got)
+	}
+	if si := roles[0].ServiceIdentities; len(si) != 1 || si[0].ServiceName != "web" {
+		t.Errorf("role service identities = %+v, want web", si)
+	}
+}
+
+func TestRestoreTenancy(t *testing.T) {
+	srv := consultest.NewServer(t)
+	cfg, err := config.Parse([]byte(`
+partitions:
+  - name: team-a
+namespaces:
+  - name: web
+    partition: team-a
+policies:
+  - name: web-read
+    partition: team-a
+    namespace: web
+    rules: 'service "web" { policy = "read" }'
+roles:
+  - name: web
+    partition: team-a
+    namespace: web
+    policies: [web-read]
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 9f1c7d00-0000-4000-8000-000000000001
+    partition: team-a
+    namespace: web
+    description: web
+    policies: [web-read]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, cfg)
+	client := srv.Client(t, cfg)
+	a, err := takeBackup(client, "pre-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Policies[0].Rules = `service "web" { policy = "write" }`
+	cfg.Roles[0].Description = "changed"
+	cfg.Tokens[0].Description = "changed"
+	a.Changes = diff.Changes(srv.Sync(t, cfg))
+
+	touched, _, _ := touchedOnly(a)
+	if len(touched.Policies) != 1 || len(touched.Roles) != 1 || len(touched.Tokens) != 1 {
+		t.Fatalf("touchedOnly = %d policies, %d roles, %d tokens; want one of each",
+			len(touched.Policies), len(touched.Roles), len(touched.Tokens))
+	}
+	restored, _ := restoreConfig(touched, srv.Tokens())
+	restored.AdminPartitions = cfg.AdminPartitions
+	restored.Namespaces = cfg.Namespaces
+	plan := srv.Sync(t, restored)
+	if len(plan.PoliciesToCreate)+len(plan.RolesToCreate)+len(plan.TokensToCreate) != 0 {
+		t.Errorf("the restore creates resources, so it lost their tenancy:\n%v", diff.Changes(plan))
+	}
+	for _, p := range srv.Policies() {
+		if p.Name == "web-read" && (p.Partition != "team-a" || p.Namespace != "web" || p.Rules != `service "web" { policy = "read" }`) {
+			t.Errorf("policy = %+v, want the archived rules in team-a/web", p)
+		}
+	}
+}
+
+func TestRollbackMixedTenancy(t *testing.T) {
+	srv := consultest.NewServer(t)
+	cfg, err := config.Parse([]byte(`
+partitions:
+  - name: team-a
+namespaces:
+  - name: web
+    partition: team-a
+policies:
+  - name: shared-read
+    rules: 'service "shared" { policy = "read" }'
+  - name: web-read
+    partition: team-a
+    namespace: web
+    rules: 'service "web" { policy = "read" }'
+roles:
+  - name: shared
+    policies: [shared-read]
+  - name: web
+    partition: team-a
+    namespace: web
+    policies: [web-read]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, cfg)
+	a, err := takeBackup(srv.Client(t, cfg), "pre-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cfg.Policies {
+		cfg.Policies[i].Rules = strings.Replace(cfg.Policies[i].Rules, "read", "write", 1)
+	}
+	for i := range cfg.Roles {
+		cfg.Roles[i].Description = "changed"
+	}
+	a.Changes = diff.Changes(srv.Sync(t, cfg))
+
+	touched, _, _ := touchedOnly(a)
+	if len(touched.Policies) != 2 || len(touched.Roles) != 2 {
+		t.Fatalf("touchedOnly = %d policies, %d roles; want both of each, in either tenancy", len(touched.Policies), len(touched.Roles))
+	}
+	restored, _ := restoreConfig(touched, srv.Tokens())
+	restored.AdminPartitions = cfg.AdminPartitions
+	restored.Namespaces = cfg.Namespaces
+	srv.Sync(t, restored)
+	for _, p := range srv.Policies() {
+		if p.Name != "global-management" && strings.Contains(p.Rules, "write") {
+			t.Errorf("policy %s/%s/%s = %q, want the archived rules", p.Partition, p.Namespace, p.Name, p.Rules)
+		}
+	}
+	for _, r := range srv.Roles() {
+		if r.Description == "changed" {
+			t.Errorf("role %s/%s/%s kept the changed description", r.Partition, r.Namespace, r.Name)
+		}
+	}
+}
+
+func TestRollbackReportsUnarchivedChanges(t *testing.T) {
+	srv := consultest.NewServer(t)
+	cfg, err := config.Parse([]byte(`
+partitions:
+  - name: team-a
+    description: before
+namespaces:
+  - name: web
+    description: before
+policies:
+  - name: web-read
+    rules: 'service "web" { policy = "read" }'
+auth_methods:
+  - name: ci
+    type: jwt
+    description: before
+    config:
+      JWKSURL: https://ci.example.com/jwks
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, cfg)
+	a, err := takeBackup(srv.Client(t, cfg), "pre-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Policies[0].Rules = `service "web" { policy = "write" }`
+	cfg.AuthMethods[0].Description = "after"
+	cfg.Namespaces[0].Description = "after"
+	cfg.AdminPartitions[0].Description = "after"
+	a.Changes = diff.Changes(srv.Sync(t, cfg))
+
+	touched, _, kept := touchedOnly(a)
+	if len(touched.Policies) != 1 {
+		t.Errorf("touchedOnly = %d policies, want the changed one", len(touched.Policies))
+	}
+	// A partition makes the plan tenanted, which qualifies the names.
+	want := []string{"partition team-a", "namespace web", "auth-method default/default/ci"}
+	if len(kept) != len(want) {
+		t.Fatalf("kept = %q, want %q reported", kept, want)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(kept[i], w+" was changed by that apply and is left as it is") {
+			t.Errorf("kept[%d] = %q, want %s reported", i, kept[i], w)
+		}
+	}
+}
+
+// rollbackTestConfig is backupTestConfig with backups kept in %s.
+const rollbackTestConfig = `
+backup:
+  dir: %s
+` + backupTestConfig
+
+// runCommand writes cfg to a file and runs the command against consulAddr,
+// returning its error and what it printed.
+func runCommand(t *testing.T, consulAddr, cfg string, args ...string) (string, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONSUL_HTTP_TOKEN", "")
+	var err error
+	out := captureOutput(t, func() {
+		err = run(append(args, "-config", path, "-consul-addr", consulAddr))
+	})
+	return out, err
+}
+
+// managedToken returns the token of backupTestConfig.
+func managedToken(t *testing.T, srv *consultest.Server) consul.Token {
+	t.Helper()
+	for _, tok := range srv.Tokens() {
+		if tok.AccessorID == "3b2a1c00-0000-4000-8000-000000000001" {
+			return tok
+		}
+	}
+	t.Fatal("the token of the config is gone")
+	return consul.Token{}
+}
+
+func TestRollback(t *testing.T) {
+	srv := consultest.NewServer(t)
+	dir := t.TempDir()
+	before := fmt.Sprintf(rollbackTestConfig, dir)
+	if out, err := runCommand(t, srv.URL, before, "apply"); err != nil {
+		t.Fatalf("apply: %v\n%s", err, out)
+	}
+
+	// The second apply updates the role and the token and creates a policy.
+	after := strings.Replace(before, "description: web role", "description: changed", 1)
+	after = strings.Replace(after, "    description: web\n    roles:", "    description: changed\n    roles:", 1)
+	after = strings.Replace(after, "roles:\n  - name: web", `  - name: api-read
+    rules: 'service "api" { policy = "read" }'
+roles:
+  - name: web`, 1)
+	if out, err := runCommand(t, srv.URL, after, "apply"); err != nil {
+		t.Fatalf("apply: %v\n%s", err, out)
+	}
+	// A change made since, to a resource the apply did not touch, stays.
+	cfg, err := config.Parse([]byte(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := srv.Client(t, cfg)
+	policies, err := client.ListPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range policies {
+		if p.Name == "db-read" {
+			if err := client.UpdatePolicy(p.ID, config.Policy{Name: "db-read", Description: "since", Rules: `service "db" { policy = "write" }`}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	out, err := runCommand(t, srv.URL, after, "rollback")
+	if err != nil {
+		t.Fatalf("rollback: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "warning: policy api-read was created by that apply and is left in place") {
+		t.Errorf("rollback output:\n%s\nwant the created policy reported", out)
+	}
+	if roles := srv.Roles(); len(roles) != 1 || roles[0].Description != "web role" {
+		t.Errorf("roles = %+v, want the role's description rolled back", roles)
+	}
+	if tok := managedToken(t, srv); tok.Description != "web" || len(tok.RoleNames()) != 1 {
+		t.Errorf("token = %+v, want its description rolled back and its role kept", tok)
+	}
+	names := map[string]string{}
+	for _, p := range srv.Policies() {
+		names[p.Name] = p.Description
+	}
+	if _, ok := names["api-read"]; !ok {
+		t.Errorf("policies = %v, want the created one left in place", names)
+	}
+	if names["db-read"] != "since" {
+		t.Errorf("db-read description = %q, want the change made since kept", names["db-read"])
+	}
+}
+
+func TestRollbackFailsPartway(t *testing.T) {
+	srv := consultest.NewServer(t)
+	// Consul refuses token updates once failing is set, after the role's.
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var failing atomic.Bool
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/acl/token/") {
+			http.Error(w, "rpc error: leadership lost", http.StatusInternalServerError)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer proxied.Close()
+
+	dir := t.TempDir()
+	before := fmt.Sprintf(rollbackTestConfig, dir)
+	if out, err := runCommand(t, proxied.URL, before, "apply"); err != nil {
+		t.Fatalf("apply: %v\n%s", err, out)
+	}
+	after := strings.Replace(before, "description: web role", "description: changed", 1)
+	after = strings.Replace(after, "    description: web\n    roles:", "    description: changed\n    roles:", 1)
+	if out, err := runCommand(t, proxied.URL, after, "apply"); err != nil {
+		t.Fatalf("apply: %v\n%s", err, out)
+	}
+
+	failing.Store(true)
+	out, err := runCommand(t, proxied.URL, after, "rollback")
+	if err == nil || !strings.Contains(err.Error(), "leadership lost") {
+		t.Fatalf("rollback = %v, want the refused token update\n%s", err, out)
+	}
+	if roles := srv.Roles(); roles[0].Description != "web role" {
+		t.Errorf("role description = %q, want it rolled back before the failure", roles[0].Description)
+	}
+	if tok := managedToken(t, srv); tok.Description != "changed" {
+		t.Errorf("token description = %q, want it left as the failed write found it", tok.Description)
+	}
+	// The state before the rollback is archived, so its half can be undone.
+	archives, err := filepath.Glob(filepath.Join(dir, "consul-acl-backup-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preRestore *backupArchive
+	for _, path := range archives {
+		a, err := readBackup(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Reason == "pre-restore" {
+			preRestore = a
+		}
+	}
+	if preRestore == nil || len(preRestore.Roles) != 1 || preRestore.Roles[0].Description != "changed" {
+		t.Errorf("pre-restore archive = %+v, want the role as the rollback found it", preRestore)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// flagValues are the accepted values of enumerated flags, offered as
+// completions. A "command flag" key applies to one command only and takes
+// precedence over the plain flag name.
+var flagValues = map[string][]string{
+	"plan output":                {"text", "markdown", "json"},
+	"plan diff-style":            {"unified", "side-by-side"},
+	"show output":                {"yaml", "json"},
+	"orphans output":             {"text", "json"},
+	"usage output":               {"text", "json"},
+	"audit output":               {"text", "json"},
+	"expiring output":            {"text", "json"},
+	"who-can output":             {"text", "json"},
+	"history output":             {"text", "json"},
+	"graph format":               {"dot", "mermaid"},
+	"report format":              {"markdown", "csv"},
+	"report table":               {"policies", "tokens"},
+	"export format":              {"terraform", "cli"},
+	"self-policy mode":           {"plan", "apply"},
+	"translate-rules translator": {"local", "consul"},
+	"severity":                   {"critical", "high", "medium", "low"},
+	"consul-client":              {"http", "api"},
+	"consistency":                {"default", "consistent", "stale"},
+	"replication-check":          {"warn", "fail", "off"},
+	"progress":                   {"auto", "bar", "off"},
+	"require-signature":          {"gpg", "ssh", "cosign"},
+}
+
+func valuesOf(cmd, flagName string) []string {
+	if v, ok := flagValues[cmd+" "+flagName]; ok {
+		return v
+	}
+	return flagValues[flagName]
+}
+
+// fileFlags take a path and complete file names.
+var fileFlags = map[string]bool{
+	"config":             true,
+	"state":              true,
+	"signature":          true,
+	"signature-key":      true,
+	"kubernetes-secrets": true,
+}
+
+// commandArgs are the first positional arguments of commands that take a
+// fixed set.
+var commandArgs = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"show":       {"policy", "token"},
+	"who-can":    {"read", "list", "write"},
+}
+
+// completePoliciesCommand is the hidden command completion scripts call for
+// the policy name after "show policy". It prints the live policy names from
+// the cluster in CONSUL_HTTP_ADDR, and nothing when it is not reachable
+// within a couple of seconds. There is no -target flag to complete policy
+// names for: a plan always covers the whole config, so show is the one
+// command that takes a policy name.
+const completePoliciesCommand = "__complete-policies"
+
+func completePolicies(w io.Writer) {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr != "" && !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	client := consul.NewClient(addr, os.Getenv("CONSUL_HTTP_TOKEN"))
+	done := make(chan []consul.Policy, 1)
+	go func() {
+		policies, _ := client.ListPolicies()
+		done <- policies
+	}()
+	select {
+	case policies := <-done:
+		for _, p := range policies {
+			fmt.Fprintln(w, p.Name)
+		}
+	case <-time.After(2 * time.Second):
+	}
+}
+
+// completionCommand prints a completion script for the named shell. The
+// scripts are generated from the command table, so they cover every
+// subcommand and flag of this build.
+func completionCommand(fs *flag.FlagSet) func([]string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: consul-acl-sync completion bash|zsh|fish")
+		}
+		switch args[0] {
+		case "bash":
+			writeBashCompletion(os.Stdout)
+		case "zsh":
+			writeZshCompletion(os.Stdout)
+		case "fish":
+			writeFishCompletion(os.Stdout)
+		default:
+			return fmt.Errorf("unknown shell %q (want bash, zsh or fish)", args[0])
+		}
+		return nil
+	}
+}
+
+// completionFlag is a flag as completion scripts see it.
+type completionFlag struct {
+	name   string
+	usage  string
+	isBool bool
+}
+
+// commandFlags lists the flags of c, sorted by name.
+func commandFlags(c command) []completionFlag {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.setup(fs)
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, isBool: ok && b.IsBoolFlag()})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# bash completion for consul-acl-sync")
+	fmt.Fprintln(w, "_consul_acl_sync() {")
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" cmd=apply`)
+	fmt.Fprintf(w, "    case \"${COMP_WORDS[1]}\" in %s) cmd=\"${COMP_WORDS[1]}\" ;; esac\n", strings.Join(commandNames(), "|"))
+	fmt.Fprintln(w, `    case "${prev#-}" in`)
+	var files []string
+	for name := range fileFlags {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(files, "|"))
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    case "$cmd ${prev#-}" in`)
+	for _, c := range commands {
+		for _, f := range commandFlags(c) {
+			if v := valuesOf(c.name, f.name); v != nil {
+				fmt.Fprintf(w, "        %q) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", c.name+" "+f.name, strings.Join(v, " "))
+			}
+		}
+	}
+	fmt.Fprintf(w, "        \"show policy\") COMPREPLY=($(compgen -W \"$(consul-acl-sync %s 2>/dev/null)\" -- \"$cur\")); return ;;\n", completePoliciesCommand)
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\")); return\n", strings.Join(commandNames(), " "))
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    local flags`)
+	fmt.Fprintln(w, `    case "$cmd" in`)
+	for _, c := range commands {
+		names := append([]string(nil), commandArgs[c.name]...)
+		for _, f := range commandFlags(c) {
+			names = append(names, "-"+f.name)
+		}
+		fmt.Fprintf(w, "        %s) flags=%q ;;\n", c.name, strings.Join(names, " "))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    COMPREPLY=($(compgen -W "$flags" -- "$cur"))`)
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _consul_acl_sync consul-acl-sync")
+}
+
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintln(w, "#compdef consul-acl-sync")
+	fmt.Fprintln(w, "_consul_acl_sync() {")
+	fmt.Fprintln(w, "    local -a commands")
+	fmt.Fprintln(w, "    commands=(")
+	for _, c := range commands {
+		fmt.Fprintf(w, "        %s\n", shellQuote(c.name+":"+c.summary))
+	}
+	fmt.Fprintln(w, "    )")
+	fmt.Fprintln(w, "    if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then")
+	fmt.Fprintln(w, "        _describe command commands")
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    local cmd=apply")
+	fmt.Fprintf(w, "    case $words[2] in %s) cmd=$words[2]; shift words; (( CURRENT-- )) ;; esac\n", strings.Join(commandNames(), "|"))
+	fmt.Fprintln(w, "    case $cmd in")
+	for _, c := range commands {
+		fmt.Fprintf(w, "        %s)\n            _arguments \\\n", c.name)
+		for _, f := range commandFlags(c) {
+			spec := "-" + f.name + "[" + zshEscape(f.usage) + "]"
+			switch {
+			case f.isBool:
+			case fileFlags[f.name]:
+				spec += ":file:_files"
+			case valuesOf(c.name, f.name) != nil:
+				spec += ":value:(" + strings.Join(valuesOf(c.name, f.name), " ") + ")"
+			default:
+				spec += ":value:"
+			}
+			fmt.Fprintf(w, "                %s \\\n", shellQuote(spec))
+		}
+		if c.name == "show" {
+			fmt.Fprintf(w, "                '1:kind:(%s)' \\\n", strings.Join(commandArgs[c.name], " "))
+			fmt.Fprintf(w, "                '2:name:{[[ $words[CURRENT-1] == policy ]] && compadd -- ${(f)\"$(consul-acl-sync %s 2>/dev/null)\"}}' ;;\n", completePoliciesCommand)
+		} else if args := commandArgs[c.name]; args != nil {
+			fmt.Fprintf(w, "                '*::arg:(%s)' ;;\n", strings.Join(args, " "))
+		} else {
+			fmt.Fprintln(w, "                '*::arg:_default' ;;")
+		}
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _consul_acl_sync consul-acl-sync")
+}
+
+func writeFishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion for consul-acl-sync")
+	fmt.Fprintln(w, "complete -c consul-acl-sync -f")
+	names := strings.Join(commandNames(), " ")
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c consul-acl-sync -n 'not __fish_seen_subcommand_from %s' -a %s -d %s\n", names, c.name, fishQuote(c.summary))
+	}
+	for _, c := range commands {
+		cond := "__fish_seen_subcommand_from " + c.name
+		if c.name == "apply" {
+			// apply is also what runs without a subcommand.
+			var others []string
+			for _, name := range commandNames() {
+				if name != "apply" {
+					others = append(others, name)
+				}
+			}
+			cond = "not __fish_seen_subcommand_from " + strings.Join(others, " ")
+		}
+		if args := commandArgs[c.name]; args != nil {
+			fmt.Fprintf(w, "complete -c consul-acl-sync -n %s -a %s\n", fishQuote(cond), fishQuote(strings.Join(args, " ")))
+		}
+		if c.name == "show" {
+			fmt.Fprintf(w, "complete -c consul-acl-sync -n %s -a %s\n",
+				fishQuote("__fish_seen_subcommand_from show; and __fish_seen_subcommand_from policy"),
+				fishQuote("(consul-acl-sync "+completePoliciesCommand+" 2>/dev/null)"))
+		}
+		for _, f := range commandFlags(c) {
+			line := fmt.Sprintf("complete -c consul-acl-sync -n %s -o %s -d %s", fishQuote(cond), f.name, fishQuote(f.usage))
+			switch {
+			case f.isBool:
+			case fileFlags[f.name]:
+				line += " -r -F"
+			case valuesOf(c.name, f.name) != nil:
+				line += " -x -a " + fishQuote(strings.Join(valuesOf(c.name, f.name), " "))
+			default:
+				line += " -x"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// shellQuote single-quotes s for sh and zsh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote single-quotes s for fish, which escapes quotes with a backslash.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// zshEscape escapes the characters _arguments treats specially in a flag
+// description.
+func zshEscape(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+)
+
+// completionScript returns the completion script for shell.
+func completionScript(shell string) string {
+	var b strings.Builder
+	map[string]func(io.Writer){
+		"bash": writeBashCompletion,
+		"zsh":  writeZshCompletion,
+		"fish": writeFishCompletion,
+	}[shell](&b)
+	return b.String()
+}
+
+func TestCompletionCommands(t *testing.T) {
+	var want []string
+	for _, c := range commands {
+		want = append(want, c.name)
+	}
+	sort.Strings(want)
+
+	// The command names each script offers in the first position.
+	offered := map[string]func(script string) []string{
+		"bash": func(script string) []string {
+			m := regexp.MustCompile(`(?m)^ +COMPREPLY=\(\$\(compgen -W "([^"]*)" -- "\$cur"\)\); return$`).FindStringSubmatch(script)
+			if m == nil {
+				return nil
+			}
+			return strings.Fields(m[1])
+		},
+		"zsh": func(script string) []string {
+			var names []string
+			for _, m := range regexp.MustCompile(`(?m)^        '([a-z-]+):`).FindAllStringSubmatch(script, -1) {
+				names = append(names, m[1])
+			}
+			return names
+		},
+		"fish": func(script string) []string {
+			var names []string
+			for _, m := range regexp.MustCompile(`(?m)^complete -c consul-acl-sync -n 'not __fish_seen_subcommand_from [^']*' -a ([a-z-]+) -d `).FindAllStringSubmatch(script, -1) {
+				names = append(names, m[1])
+			}
+			return names
+		},
+	}
+	for shell, names := range offered {
+		t.Run(shell, func(t *testing.T) {
+			got := names(completionScript(shell))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s completes the commands %v, want the registered %v", shell, got, want)
+			}
+		})
+	}
+}
+
+func TestCompletionFlags(t *testing.T) {
+	// Every script completes the values of an enumerated flag of one command,
+	// and file names for a path. … stands for a flag's description.
+	for shell, wants := range map[string][]string{
+		"bash": {
+			`"plan output") COMPREPLY=($(compgen -W "text markdown json" -- "$cur")); return ;;`,
+			`"show output") COMPREPLY=($(compgen -W "yaml json" -- "$cur")); return ;;`,
+			`config|kubernetes-secrets|signature|signature-key|state) COMPREPLY=($(compgen -f -- "$cur")); return ;;`,
+		},
+		"zsh": {
+			`:value:(text markdown json)'`,
+			`'-config[…]:file:_files'`,
+		},
+		"fish": {
+			`-n '__fish_seen_subcommand_from plan' -o output -d '…' -x -a 'text markdown json'`,
+			`-o config -d '…' -r -F`,
+		},
+	} {
+		script := completionScript(shell)
+		for _, want := range wants {
+			parts := strings.Split(want, "…")
+			for i, part := range parts {
+				parts[i] = regexp.QuoteMeta(part)
+			}
+			if !regexp.MustCompile(strings.Join(parts, `[^'\]]*`)).MatchString(script) {
+				t.Errorf("%s completion does not contain %s", shell, want)
+			}
+		}
+	}
+}
+
+func TestCompletionShowPolicy(t *testing.T) {
+	// Each script completes the name after "show policy" from the hidden
+	// command.
+	for shell, want := range map[string]string{
+		"bash": `"show policy") COMPREPLY=($(compgen -W "$(consul-acl-sync ` + completePoliciesCommand + ` 2>/dev/null)" -- "$cur")); return ;;`,
+		"zsh":  `'2:name:{[[ $words[CURRENT-1] == policy ]] && compadd -- ${(f)"$(consul-acl-sync ` + completePoliciesCommand + ` 2>/dev/null)"}}'`,
+		"fish": `-n '__fish_seen_subcommand_from show; and __fish_seen_subcommand_from policy' -a '(consul-acl-sync ` + completePoliciesCommand + ` 2>/dev/null)'`,
+	} {
+		if !strings.Contains(completionScript(shell), want) {
+			t.Errorf("%s completion does not complete policy names after show policy", shell)
+		}
+	}
+
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	// Run the bash script, with a consul-acl-sync on PATH that lists two
+	// policies.
+	dir := t.TempDir()
+	fake := "#!/bin/sh\n[ \"$1\" = " + completePoliciesCommand + " ] && printf 'db-read\\nweb-read\\n'\n"
+	if err := os.WriteFile(filepath.Join(dir, "consul-acl-sync"), []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "completion.bash")
+	if err := os.WriteFile(script, []byte(completionScript("bash")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for line, want := range map[string]string{
+		"consul-acl-sync sho":            "show",
+		"consul-acl-sync show pol":       "policy",
+		"consul-acl-sync show policy w":  "web-read",
+		"consul-acl-sync show policy ":   "db-read web-read",
+		"consul-acl-sync plan -output j": "json",
+	} {
+		words := strings.Fields(line)
+		if strings.HasSuffix(line, " ") {
+			words = append(words, "")
+		}
+		cmd := exec.Command(bash, "-c", `. "$1"; shift; COMP_WORDS=("$@"); COMP_CWORD=$(($# - 1)); _consul_acl_sync; echo "${COMPREPLY[*]}"`, "bash", script)
+		cmd.Args = append(cmd.Args, words...)
+		cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", line, err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != want {
+			t.Errorf("%q completes %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestCompletePolicies(t *testing.T) {
+	srv := consultest.NewServer(t)
+	cfg, err := config.Parse([]byte(`
+policies:
+  - name: web-read
+    rules: 'service "web" { policy = "read" }'
+  - name: db-read
+    rules: 'service "db" { policy = "read" }'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, cfg)
+
+	t.Setenv("CONSUL_HTTP_ADDR", strings.TrimPrefix(srv.URL, "http://"))
+	t.Setenv("CONSUL_HTTP_TOKEN", "")
+	var b strings.Builder
+	completePolicies(&b)
+	if got, want := b.String(), "db-read\nglobal-management\nweb-read\n"; got != want {
+		t.Errorf("completePolicies printed %q, want %q", got, want)
+	}
+
+	// An unreachable cluster completes nothing rather than fail.
+	t.Setenv("CONSUL_HTTP_ADDR", "127.0.0.1:1")
+	b.Reset()
+	completePolicies(&b)
+	if b.Len() != 0 {
+		t.Errorf("completePolicies printed %q for an unreachable cluster, want nothing", b.String())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// Environment variables that stand in for -auto-approve and -input, for CI
+// systems that set those more easily than flags.
+const (
+	autoApproveEnv = "CONSUL_ACL_SYNC_AUTO_APPROVE"
+	inputEnv       = "CONSUL_ACL_SYNC_INPUT"
+)
+
+// boolFromEnv sets *value from the environment variable env unless the flag
+// name was given, which wins.
+func boolFromEnv(fs *flag.FlagSet, name, env string, value *bool) error {
+	v := os.Getenv(env)
+	if v == "" {
+		return nil
+	}
+	given := false
+	fs.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	if given {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s=%q: want true or false", env, v)
+	}
+	*value = b
+	return nil
+}
+
+// confirmPlan asks the operator to type the number of changes before a plan
+// is applied that deletes tokens, or makes more than threshold token changes,
+// so a stray keystroke cannot approve it. Tokens -replace or an expiry
+// recreates are deleted before they are created again, so a plan with any
+// asks whatever the threshold; otherwise a threshold of 0 never asks. When in
+// is nil, as with -input=false, or a file that is not a terminal, as in CI, it
+// fails at once instead of waiting on input nobody will type.
+func confirmPlan(in io.Reader, out io.Writer, plan *diff.Plan, threshold int) error {
+	deletes := len(plan.TokensToReplace)
+	tokens := len(plan.TokensToCreate) + len(plan.TokensToUpdate) + deletes
+	var does string
+	switch over := threshold > 0 && tokens > threshold; {
+	case over && deletes > 0:
+		does = fmt.Sprintf("makes %d token changes, more than -confirm-threshold %d, and deletes %d of them to create them again", tokens, threshold, deletes)
+	case over:
+		does = fmt.Sprintf("makes %d token changes, more than -confirm-threshold %d", tokens, threshold)
+	case deletes > 0:
+		does = fmt.Sprintf("deletes %d of its tokens to create them again", deletes)
+	default:
+		return nil
+	}
+	changes := len(diff.Steps(plan))
+	if in == nil {
+		return fmt.Errorf("apply not confirmed: the plan %s, and input is off; review the plan and pass -auto-approve or set %s=true", does, autoApproveEnv)
+	}
+	if f, ok := in.(*os.File); ok && !isTerminal(f) {
+		return fmt.Errorf("apply not confirmed: the plan %s, and stdin is not a terminal to confirm it on; review the plan and pass -auto-approve or set %s=true", does, autoApproveEnv)
+	}
+
+	diff.PrintText(out, plan)
+	fmt.Fprintf(out, "\nThis plan %s.\n", does)
+	fmt.Fprintf(out, "Type the number of changes (%d) to apply: ", changes)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("apply not confirmed: no input (the plan needs a typed confirmation)")
+	}
+	if got := strings.TrimSpace(line); got != strconv.Itoa(changes) {
+		return fmt.Errorf("apply not confirmed: typed %q, want %d", got, changes)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+func TestBoolFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string // the variable's value; "" leaves it unset
+		args    []string
+		def     bool
+		want    bool
+		wantErr string
+	}{
+		{"unset keeps the default", "", nil, true, true, ""},
+		{"false", "false", nil, true, false, ""},
+		{"true", "true", nil, false, true, ""},
+		{"0", "0", nil, true, false, ""},
+		{"1", "1", nil, false, true, ""},
+		{"invalid", "nope", nil, true, true, `="nope": want true or false`},
+		{"flag wins over env", "false", []string{"-flag=true"}, true, true, ""},
+		{"flag false wins over env true", "true", []string{"-flag=false"}, false, false, ""},
+		{"flag wins over invalid env", "nope", []string{"-flag"}, false, true, ""},
+	}
+	for _, env := range []string{inputEnv, autoApproveEnv} {
+		for _, tt := range tests {
+			t.Run(env+"/"+tt.name, func(t *testing.T) {
+				t.Setenv(env, tt.env)
+				fs := flag.NewFlagSet("test", flag.ContinueOnError)
+				fs.SetOutput(io.Discard)
+				value := fs.Bool("flag", tt.def, "")
+				if err := fs.Parse(tt.args); err != nil {
+					t.Fatal(err)
+				}
+				err := boolFromEnv(fs, "flag", env, value)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), env+tt.wantErr) {
+						t.Fatalf("error = %v, want one containing %q", err, env+tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *value != tt.want {
+					t.Errorf("value = %v, want %v", *value, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestApplyRejectsInvalidEnv(t *testing.T) {
+	for _, env := range []string{inputEnv, autoApproveEnv} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, "maybe")
+			err := run([]string{"apply", "-config", "c.yaml"})
+			if err == nil || !strings.Contains(err.Error(), env+`="maybe"`) {
+				t.Errorf("apply with %s=maybe: %v, want an error naming the variable", env, err)
+			}
+		})
+	}
+}
+
+func TestConfirmPlan(t *testing.T) {
+	plan := func(creates, replaces int) *diff.Plan {
+		p := &diff.Plan{}
+		for i := 0; i < creates; i++ {
+			p.TokensToCreate = append(p.TokensToCreate, config.Token{AccessorID: fmt.Sprintf("create-%d", i)})
+		}
+		for i := 0; i < replaces; i++ {
+			t := config.Token{AccessorID: fmt.Sprintf("replace-%d", i)}
+			p.TokensToReplace = append(p.TokensToReplace, diff.TokenUpdate{Desired: t, Reason: "requested"})
+		}
+		return p
+	}
+	tests := []struct {
+		name      string
+		plan      *diff.Plan
+		threshold int
+		input     string // "" is no input at all
+		wantAsk   string // the reason asked for, "" when it does not ask
+		wantErr   bool
+	}{
+		{"no threshold, nothing deleted", plan(3, 0), 0, "", "", false},
+		{"under the threshold", plan(3, 0), 3, "", "", false},
+		{"over the threshold", plan(4, 0), 3, "4\n", "makes 4 token changes, more than -confirm-threshold 3.", false},
+		{"over the threshold, wrong number", plan(4, 0), 3, "y\n", "makes 4 token changes", true},
+		{"replace without a threshold", plan(0, 1), 0, "1\n", "deletes 1 of its tokens to create them again.", false},
+		{"replace under the threshold", plan(2, 1), 5, "3\n", "deletes 1 of its tokens to create them again.", false},
+		{"replace counts once", plan(2, 1), 3, "3\n", "deletes 1 of its tokens", false},
+		{"replace over the threshold", plan(3, 2), 4, "5\n", "makes 5 token changes, more than -confirm-threshold 4, and deletes 2 of them to create them again.", false},
+		{"replace, no input", plan(0, 1), 0, "", "deletes 1 of its tokens", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := confirmPlan(strings.NewReader(tt.input), &out, tt.plan, tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("confirmPlan = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantAsk == "" {
+				if out.Len() != 0 {
+					t.Errorf("confirmPlan asked:\n%s", out.String())
+				}
+				return
+			}
+			if !strings.Contains(out.String(), "This plan "+tt.wantAsk) {
+				t.Errorf("confirmPlan printed\n%s\nwant it to say the plan %s", out.String(), tt.wantAsk)
+			}
+		})
+	}
+}
+
+func TestConfirmPlanWithoutInput(t *testing.T) {
+	p := &diff.Plan{TokensToReplace: []diff.TokenUpdate{{Desired: config.Token{AccessorID: "a"}, Reason: "expired"}}}
+	err := confirmPlan(nil, io.Discard, p, 0)
+	if err == nil || !strings.Contains(err.Error(), "the plan deletes 1 of its tokens to create them again, and input is off") {
+		t.Errorf("confirmPlan with input off = %v, want it to fail naming the deletion", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+)
+
+// devServerCommand serves an in-memory Consul ACL API, so plan and apply can
+// run in CI, or be tried out, without a Consul cluster. It keeps nothing once
+// it stops.
+func devServerCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		listen     string
+		datacenter string
+	)
+	fs.StringVar(&listen, "listen", "127.0.0.1:8500", "address to listen on")
+	fs.StringVar(&datacenter, "datacenter", "dc1", "name of the datacenter it serves")
+	return func([]string) error {
+		c := consultest.New()
+		c.Datacenter = datacenter
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		hs := &http.Server{
+			Addr:              listen,
+			Handler:           c,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- hs.ListenAndServe() }()
+		fmt.Fprintf(os.Stderr, "serving an in-memory Consul ACL API for datacenter %s on %s; any token is accepted and nothing is kept\n", datacenter, listen)
+
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+		}
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return hs.Shutdown(shutdown)
+	}
+}
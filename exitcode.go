@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// Exit codes. Flag errors exit 2, as the flag package does; every other
+// failure that is not one of these exits 1.
+const (
+	exitError        = 1
+	exitUnreachable  = 3
+	exitACLDisabled  = 4
+	exitNotBootstrap = 5
+	exitDenied       = 6
+	exitLegacyACL    = 7
+)
+
+// failure is a known kind of Consul failure: how to spot it in an error, the
+// exit code it gets, and what the operator can do about it.
+type failure struct {
+	match []string // lowercase substrings of the error message
+	code  int
+	hint  string
+}
+
+// failures are checked in order. The messages are Consul's, so they match
+// whichever client made the request, and survive the redaction of the error.
+var failures = []failure{
+	{[]string{"acl support disabled"}, exitACLDisabled,
+		"ACLs are disabled on this agent; set acl.enabled = true in the Consul config and restart it"},
+	{[]string{"must be bootstrapped"}, exitNotBootstrap,
+		"the ACL system is not bootstrapped; run `consul acl bootstrap` and use the token it prints"},
+	{[]string{"legacy mode", "legacy acl"}, exitLegacyACL,
+		"the cluster still runs the legacy ACL system, which this tool does not support; finish the ACL migration first"},
+	{[]string{"acl not found"}, exitDenied,
+		"Consul does not know the token; check CONSUL_HTTP_TOKEN"},
+	{[]string{"permission denied"}, exitDenied,
+		"the token lacks a permission this run needs; managing ACLs needs acl = \"write\""},
+	// Before the unreachable check, which the provider's network errors
+	// would otherwise match.
+	{[]string{"failed the discovery check"}, exitError,
+		"the OIDC provider failed -check-oidc; check OIDCDiscoveryURL and OIDCDiscoveryCACert of the auth method"},
+	{[]string{"consecutive failed requests to consul", "connection refused", "no such host", "i/o timeout", "certificate"}, exitUnreachable,
+		"cannot reach Consul; check -consul-addr, the network and, for HTTPS, the CA"},
+}
+
+// classifyError returns the exit code for err and a hint for the operator,
+// empty when the failure is not a known one.
+func classifyError(err error) (int, string) {
+	var be *consul.BreakerError
+	if errors.As(err, &be) {
+		return exitUnreachable, failures[len(failures)-1].hint
+	}
+	msg := strings.ToLower(err.Error())
+	for _, f := range failures {
+		for _, m := range f.match {
+			if strings.Contains(msg, m) {
+				return f.code, f.hint
+			}
+		}
+	}
+	return exitError, ""
+}
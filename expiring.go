@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// expiringToken is a token whose expiration time falls inside the window.
+type expiringToken struct {
+	AccessorID     string    `json:"accessor_id"`
+	Description    string    `json:"description"`
+	Managed        bool      `json:"managed"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	// RemainingHours is whole hours until expiry, negative once it has passed
+	// and Consul has not reaped the token yet.
+	RemainingHours int `json:"remaining_hours"`
+}
+
+// findExpiring returns the tokens that expire before now+within, soonest
+// first. Tokens without an expiration time never appear.
+func findExpiring(inv *inventory, now time.Time, within time.Duration) []expiringToken {
+	out := []expiringToken{}
+	for _, t := range inv.tokens {
+		if t.ExpirationTime == nil || t.ExpirationTime.After(now.Add(within)) {
+			continue
+		}
+		out = append(out, expiringToken{
+			AccessorID:     t.AccessorID,
+			Description:    t.Description,
+			Managed:        inv.managedTokens[t.AccessorID],
+			ExpirationTime: *t.ExpirationTime,
+			RemainingHours: int(t.ExpirationTime.Sub(now).Hours()),
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].ExpirationTime.Before(out[j].ExpirationTime) })
+	return out
+}
+
+// expiringCommand lists the tokens that expire within a window, so they can
+// be rotated before the services using them lose access.
+func expiringCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		output string
+		within time.Duration
+	)
+	opts.register(fs)
+	fs.StringVar(&output, "output", "text", "report format: text or json")
+	fs.DurationVar(&within, "within", 30*24*time.Hour, "report tokens expiring within this duration")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want text or json)", output)
+		}
+		s, err := opts.open("expiring")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		tokens := findExpiring(inv, time.Now(), within)
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(tokens)
+		}
+		printExpiring(os.Stdout, tokens, within)
+		return nil
+	}
+}
+
+func printExpiring(w io.Writer, tokens []expiringToken, within time.Duration) {
+	if len(tokens) == 0 {
+		fmt.Fprintf(w, "No tokens expire within %s.\n", windowLabel(within))
+		return
+	}
+	fmt.Fprintf(w, "Tokens expiring within %s (%d):\n", windowLabel(within), len(tokens))
+	for _, t := range tokens {
+		label := t.AccessorID
+		if t.Description != "" {
+			label += fmt.Sprintf(" %q", t.Description)
+		}
+		var when string
+		switch {
+		case t.RemainingHours < 0:
+			when = "already expired"
+		case t.RemainingHours < 48:
+			when = fmt.Sprintf("in %d hours", t.RemainingHours)
+		default:
+			when = fmt.Sprintf("in %d days", t.RemainingHours/24)
+		}
+		fmt.Fprintf(w, "  %-9s %s, expires %s (%s)\n", managedLabel(t.Managed), label, t.ExpirationTime.Format(time.RFC3339), when)
+	}
+}
+
+// windowLabel prints whole-day windows in days, which is how -within is
+// usually thought of.
+func windowLabel(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	return d.String()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// tfNames hands out Terraform resource names: lowercase letters, digits and
+// underscores, starting with a letter, unique within one type.
+type tfNames map[string]bool
+
+func (n tfNames) name(typ, s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "_"):
+			b.WriteByte('_')
+		}
+	}
+	base := strings.TrimSuffix(b.String(), "_")
+	if base == "" || base[0] < 'a' {
+		base = "r_" + base
+	}
+	name := base
+	for i := 2; n[typ+"."+name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	n[typ+"."+name] = true
+	return name
+}
+
+// hclQuote quotes s as an HCL string, escaping template sequences so they
+// stay literal.
+func hclQuote(s string) string {
+	return `"` + hclEscape(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)) + `"`
+}
+
+func hclEscape(s string) string {
+	return strings.NewReplacer("${", "$${", "%{", "%%{").Replace(s)
+}
+
+// writeTerraform renders the live policies, roles and tokens as
+// consul_acl_policy, consul_acl_role and consul_acl_token resources of the
+// Terraform Consul provider, followed by the terraform import commands that
+// adopt them. Resources outside the default partition and namespace carry
+// theirs, and are named after their qualified address. Consul's built-in
+// resources are left out; token secrets are never part of the output.
+func writeTerraform(w io.Writer, inv *inventory, roles []consul.Role, rules map[string]string) {
+	names := tfNames{}
+	policyRef := make(map[string]string, len(inv.policies)) // by ID
+	roleRef := make(map[string]string, len(roles))          // by ID
+	var imports []string
+
+	for _, p := range inv.policies {
+		if p.Builtin() {
+			continue
+		}
+		name := names.name("consul_acl_policy", config.Policy{Name: p.Name, Tenancy: p.Tenancy()}.Key())
+		policyRef[p.ID] = "consul_acl_policy." + name + ".name"
+		imports = append(imports, fmt.Sprintf("terraform import consul_acl_policy.%s %s", name, p.ID))
+
+		fmt.Fprintf(w, "resource \"consul_acl_policy\" %q {\n", name)
+		fmt.Fprintf(w, "  name        = %s\n", hclQuote(p.Name))
+		if p.Description != "" {
+			fmt.Fprintf(w, "  description = %s\n", hclQuote(p.Description))
+		}
+		writeTerraformTenancy(w, p.Tenancy())
+		body := rules[p.ID]
+		if !strings.HasSuffix(body, "\n") {
+			body += "\n"
+		}
+		marker := "EOT"
+		for strings.Contains(body, marker) {
+			marker += "_"
+		}
+		fmt.Fprintf(w, "  rules       = <<-%s\n", marker)
+		for _, line := range strings.SplitAfter(strings.TrimSuffix(body, "\n"), "\n") {
+			if strings.TrimSpace(line) == "" {
+				fmt.Fprint(w, strings.TrimLeft(line, " \t"))
+				continue
+			}
+			fmt.Fprintf(w, "    %s", hclEscape(line))
+		}
+		fmt.Fprintf(w, "\n  %s\n", marker)
+		if len(p.Datacenters) > 0 {
+			fmt.Fprintf(w, "  datacenters = %s\n", hclList(p.Datacenters, hclQuote))
+		}
+		fmt.Fprint(w, "}\n\n")
+	}
+	policy := func(l consul.PolicyLink) string {
+		if ref, ok := policyRef[l.ID]; ok {
+			return ref
+		}
+		return hclQuote(l.Name)
+	}
+
+	for _, r := range roles {
+		name := names.name("consul_acl_role", config.Role{Name: r.Name, Tenancy: r.Tenancy()}.Key())
+		roleRef[r.ID] = "consul_acl_role." + name + ".name"
+		imports = append(imports, fmt.Sprintf("terraform import consul_acl_role.%s %s", name, r.ID))
+
+		fmt.Fprintf(w, "resource \"consul_acl_role\" %q {\n", name)
+		fmt.Fprintf(w, "  name        = %s\n", hclQuote(r.Name))
+		if r.Description != "" {
+			fmt.Fprintf(w, "  description = %s\n", hclQuote(r.Description))
+		}
+		writeTerraformTenancy(w, r.Tenancy())
+		if len(r.Policies) > 0 {
+			fmt.Fprintf(w, "  policies    = %s\n", hclList(r.Policies, policy))
+		}
+		for _, si := range r.ServiceIdentities {
+			fmt.Fprintf(w, "\n  service_identities {\n    service_name = %s\n", hclQuote(si.ServiceName))
+			if len(si.Datacenters) > 0 {
+				fmt.Fprintf(w, "    datacenters  = %s\n", hclList(si.Datacenters, hclQuote))
+			}
+			fmt.Fprint(w, "  }\n")
+		}
+		for _, ni := range r.NodeIdentities {
+			fmt.Fprintf(w, "\n  node_identities {\n    node_name  = %s\n    datacenter = %s\n  }\n",
+				hclQuote(ni.NodeName), hclQuote(ni.Datacenter))
+		}
+		for _, tp := range r.TemplatedPolicies {
+			fmt.Fprintf(w, "\n  templated_policies {\n    template_name = %s\n", hclQuote(tp.TemplateName))
+			if len(tp.Datacenters) > 0 {
+				fmt.Fprintf(w, "    datacenters   = %s\n", hclList(tp.Datacenters, hclQuote))
+			}
+			if tp.TemplateVariables != nil {
+				fmt.Fprintf(w, "\n    template_variables {\n      name = %s\n    }\n", hclQuote(tp.TemplateVariables.Name))
+			}
+			fmt.Fprint(w, "  }\n")
+		}
+		fmt.Fprint(w, "}\n\n")
+	}
+
+	for _, t := range inv.tokens {
+		if t.Builtin() {
+			continue
+		}
+		label := t.Description
+		if label == "" {
+			label = "token " + t.AccessorID[:8]
+		}
+		name := names.name("consul_acl_token", label)
+		imports = append(imports, fmt.Sprintf("terraform import consul_acl_token.%s %s", name, t.AccessorID))
+
+		fmt.Fprintf(w, "resource \"consul_acl_token\" %q {\n", name)
+		fmt.Fprintf(w, "  accessor_id = %s\n", hclQuote(t.AccessorID))
+		if t.Description != "" {
+			fmt.Fprintf(w, "  description = %s\n", hclQuote(t.Description))
+		}
+		writeTerraformTenancy(w, t.Tenancy())
+		if len(t.Policies) > 0 {
+			fmt.Fprintf(w, "  policies    = %s\n", hclList(t.Policies, policy))
+		}
+		if len(t.Roles) > 0 {
+			fmt.Fprintf(w, "  roles       = %s\n", hclList(t.Roles, func(l consul.RoleLink) string {
+				if ref, ok := roleRef[l.ID]; ok {
+					return ref
+				}
+				return hclQuote(l.Name)
+			}))
+		}
+		if t.Local {
+			fmt.Fprintln(w, "  local       = true")
+		}
+		if t.ExpirationTime != nil {
+			fmt.Fprintf(w, "  expiration_time = %s\n", hclQuote(t.ExpirationTime.UTC().Format("2006-01-02T15:04:05Z07:00")))
+		}
+		fmt.Fprint(w, "}\n\n")
+	}
+
+	fmt.Fprintln(w, "# Adopt the existing resources into the Terraform state:")
+	for _, cmd := range imports {
+		fmt.Fprintln(w, "#   "+cmd)
+	}
+}
+
+// writeTerraformTenancy writes the partition and namespace attributes of a
+// resource in t, leaving out the defaults.
+func writeTerraformTenancy(w io.Writer, t config.Tenancy) {
+	if t.Partition != "" && t.Partition != "default" {
+		fmt.Fprintf(w, "  partition   = %s\n", hclQuote(t.Partition))
+	}
+	if t.Namespace != "" && t.Namespace != "default" {
+		fmt.Fprintf(w, "  namespace   = %s\n", hclQuote(t.Namespace))
+	}
+}
+
+func hclList[T any](items []T, render func(T) string) string {
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		parts = append(parts, render(item))
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// shQuote quotes s for a POSIX shell.
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// secretEnv names the variable a CLI script reads a token's SecretID from.
+func secretEnv(accessorID string) string {
+	return "CONSUL_ACL_SECRET_" + strings.ToUpper(strings.ReplaceAll(accessorID, "-", "_"))
+}
+
+// cliTenancy returns the -partition and -namespace arguments of a consul
+// command addressing a resource in t, empty for the defaults.
+func cliTenancy(t config.Tenancy) string {
+	var args string
+	if t.Partition != "" {
+		args += " -partition " + shQuote(t.Partition)
+	}
+	if t.Namespace != "" {
+		args += " -namespace " + shQuote(t.Namespace)
+	}
+	return args
+}
+
+// writeCLIScript renders the config as a shell script of consul acl commands
+// that creates or updates each policy and role and creates each missing
+// token, so the config can be applied where only the consul binary is
+// available. Running it again changes nothing. SecretIDs are read from the
+// environment unless showSecrets inlines the ones pinned in the file.
+func writeCLIScript(w io.Writer, cfg *config.Config, source string, showSecrets bool) {
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintf(w, "# Generated by consul-acl-sync export -format cli from %s.\n", source)
+	fmt.Fprintln(w, "# The consul CLI reads CONSUL_HTTP_ADDR and CONSUL_HTTP_TOKEN as usual.")
+	fmt.Fprintln(w, "set -eu")
+
+	for _, p := range cfg.Policies {
+		rules := p.Rules
+		if !strings.HasSuffix(rules, "\n") {
+			rules += "\n"
+		}
+		marker := "RULES"
+		for strings.Contains(rules, marker) {
+			marker += "_"
+		}
+		args := " -description " + shQuote(p.Description)
+		for _, dc := range p.Datacenters {
+			args += " -valid-datacenter " + shQuote(dc)
+		}
+		name := shQuote(p.Name) + cliTenancy(p.Tenancy)
+		fmt.Fprintf(w, "\n# policy %s\n", p.Key())
+		fmt.Fprintf(w, "if consul acl policy read -name %s >/dev/null 2>&1; then\n", name)
+		fmt.Fprintf(w, "  verb=update\nelse\n  verb=create\nfi\n")
+		fmt.Fprintf(w, "consul acl policy \"$verb\" -name %s%s -rules - >/dev/null <<'%s'\n%s%s\n", name, args, marker, rules, marker)
+	}
+
+	for _, r := range cfg.Roles {
+		args := " -description " + shQuote(r.Description)
+		for _, name := range r.Policies {
+			args += " -policy-name " + shQuote(name)
+		}
+		for _, si := range r.ServiceIdentities {
+			id := si.ServiceName
+			if len(si.Datacenters) > 0 {
+				id += ":" + strings.Join(si.Datacenters, ",")
+			}
+			args += " -service-identity " + shQuote(id)
+		}
+		for _, ni := range r.NodeIdentities {
+			args += " -node-identity " + shQuote(ni.NodeName+":"+ni.Datacenter)
+		}
+		for _, tp := range r.TemplatedPolicies {
+			args += " -templated-policy " + shQuote(tp.TemplateName)
+			if tp.TemplateVariables.Name != "" {
+				args += " -var " + shQuote("name:"+tp.TemplateVariables.Name)
+			}
+		}
+		// role update takes the ID, the first "ID" of the JSON read returns.
+		name := shQuote(r.Name) + cliTenancy(r.Tenancy)
+		fmt.Fprintf(w, "\n# role %s\n", r.Key())
+		fmt.Fprintf(w, "id=$(consul acl role read -name %s -format json 2>/dev/null | sed -n 's/^ *\"ID\": \"\\([^\"]*\\)\".*/\\1/p' | head -n 1)\n", name)
+		fmt.Fprintf(w, "if [ -n \"$id\" ]; then\n")
+		fmt.Fprintf(w, "  consul acl role update -id \"$id\" -no-merge -name %s%s >/dev/null\n", name, args)
+		fmt.Fprintf(w, "else\n")
+		fmt.Fprintf(w, "  consul acl role create -name %s%s >/dev/null\n", name, args)
+		fmt.Fprintf(w, "fi\n")
+	}
+
+	for _, t := range cfg.Tokens {
+		var links string
+		for _, name := range t.Policies {
+			links += " -policy-name " + shQuote(name)
+		}
+		for _, name := range t.Roles {
+			links += " -role-name " + shQuote(name)
+		}
+		secret := fmt.Sprintf(`"${%s:?}"`, secretEnv(t.AccessorID))
+		if showSecrets && t.SecretID != "" {
+			secret = shQuote(t.SecretID)
+		}
+		id := shQuote(t.AccessorID) + cliTenancy(t.Tenancy)
+		fmt.Fprintf(w, "\n# token %s\n", t.Label())
+		fmt.Fprintf(w, "if consul acl token read -accessor-id %s >/dev/null 2>&1; then\n", id)
+		fmt.Fprintf(w, "  consul acl token update -accessor-id %s -description %s%s >/dev/null\n", id, shQuote(t.Description), links)
+		fmt.Fprintf(w, "else\n")
+		fmt.Fprintf(w, "  consul acl token create -accessor %s -secret %s -description %s%s >/dev/null\n", id, secret, shQuote(t.Description), links)
+		fmt.Fprintf(w, "fi\n")
+	}
+}
+
+// exportCommand renders ACL resources in another tool's format, for teams
+// moving to or from this tool: the live policies, roles and tokens as
+// Terraform, or the config as a consul CLI script.
+func exportCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		format string
+	)
+	opts.register(fs)
+	fs.StringVar(&format, "format", "terraform", "output format: terraform (the live policies, roles and tokens) or cli (a consul CLI script applying the config)")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		switch format {
+		case "terraform":
+		case "cli":
+			// The script is rendered from the config alone.
+			cfg, err := opts.load()
+			if err != nil {
+				return err
+			}
+			writeCLIScript(os.Stdout, cfg, opts.configPath, opts.showSecrets)
+			return nil
+		default:
+			return fmt.Errorf("unknown -format %q (want terraform or cli)", format)
+		}
+		s, err := opts.open("export")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		roles, err := s.client.ListRoles()
+		if err != nil {
+			return fmt.Errorf("failed to list roles: %w", err)
+		}
+		rules, err := loadPolicyRules(s.client, inv)
+		if err != nil {
+			return err
+		}
+		writeTerraform(os.Stdout, inv, roles, rules)
+		return nil
+	}
+}
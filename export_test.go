@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+)
+
+func TestExportTerraform(t *testing.T) {
+	srv := consultest.NewServer(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+partitions:
+  - name: team-a
+namespaces:
+  - name: web
+    partition: team-a
+policies:
+  - name: shared-read
+    rules: 'service "shared" { policy = "read" }'
+  - name: web-read
+    partition: team-a
+    namespace: web
+    rules: 'service "web" { policy = "read" }'
+roles:
+  - name: web
+    description: Web services
+    partition: team-a
+    namespace: web
+    policies: [web-read]
+    service_identities:
+      - service_name: web
+        datacenters: [dc1]
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 3b2a1c00-0000-4000-8000-0000000000f1
+    description: web
+    partition: team-a
+    namespace: web
+    policies: [web-read]
+    roles: [web]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, consultest.Load(t, path))
+	t.Setenv("CONSUL_HTTP_TOKEN", "")
+
+	var runErr error
+	out := captureOutput(t, func() {
+		runErr = run([]string{"export", "-config", path, "-consul-addr", srv.URL, "-format", "terraform"})
+	})
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	role := srv.Roles()[0]
+	for _, want := range []string{
+		`resource "consul_acl_policy" "shared_read" {` + "\n" + `  name        = "shared-read"` + "\n  rules",
+		`resource "consul_acl_policy" "team_a_web_web_read" {` + "\n" + `  name        = "web-read"` + "\n" +
+			`  partition   = "team-a"` + "\n" + `  namespace   = "web"` + "\n",
+		`resource "consul_acl_role" "team_a_web_web" {` + "\n" + `  name        = "web"` + "\n" +
+			`  description = "Web services"` + "\n" + `  partition   = "team-a"` + "\n" + `  namespace   = "web"` + "\n" +
+			`  policies    = [consul_acl_policy.team_a_web_web_read.name]` + "\n\n" +
+			"  service_identities {\n" + `    service_name = "web"` + "\n" + `    datacenters  = ["dc1"]` + "\n  }\n}\n",
+		`  partition   = "team-a"` + "\n" + `  namespace   = "web"` + "\n" +
+			`  policies    = [consul_acl_policy.team_a_web_web_read.name]` + "\n" +
+			`  roles       = [consul_acl_role.team_a_web_web.name]` + "\n",
+		"#   terraform import consul_acl_role.team_a_web_web " + role.ID + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("export does not contain\n%s\nin\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "3b2a1c00-0000-4000-8000-0000000000f1") {
+		t.Error("export contains a token secret")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// globalManagementID is the ID Consul gives the built-in global-management
+// policy.
+const globalManagementID = "00000000-0000-0000-0000-000000000001"
+
+// severities in report order, most severe first.
+var severities = []string{"critical", "high", "medium", "low"}
+
+func severityRank(s string) int {
+	for i, v := range severities {
+		if v == s {
+			return i
+		}
+	}
+	return len(severities)
+}
+
+// finding is one risky pattern in the live ACL state.
+type finding struct {
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"` // "policy" or "token"
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Managed  bool   `json:"managed"`
+	Message  string `json:"message"`
+}
+
+// auditPolicies flags policies that grant ACL write, which can mint any
+// token, and blanket write over the whole KV store. rules maps policy ID to
+// its rules.
+func auditPolicies(inv *inventory, rules map[string]string) []finding {
+	var out []finding
+	for _, p := range inv.policies {
+		if p.ID == globalManagementID {
+			continue
+		}
+		f := finding{Kind: "policy", ID: p.ID, Name: p.Name, Managed: inv.managedPolicies[p.Name]}
+		parsed, err := acl.Parse(rules[p.ID])
+		if err != nil {
+			f.Severity, f.Message = "medium", fmt.Sprintf("rules could not be parsed and were not audited: %v", err)
+			out = append(out, f)
+			continue
+		}
+		for _, r := range parsed {
+			switch {
+			case r.Resource == "acl" && r.Policy == "write":
+				f.Severity, f.Message = "high", `grants acl = "write", which can create tokens with any privilege`
+			case r.Resource == "key" && r.Prefix && r.Name == "" && r.Policy == "write":
+				f.Severity, f.Message = "high", `grants write on every key (key_prefix "")`
+			default:
+				continue
+			}
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// auditTokens flags tokens that hold global-management and tokens that never
+// expire. Built-in tokens are skipped.
+func auditTokens(inv *inventory) []finding {
+	var out []finding
+	for _, t := range inv.tokens {
+		f := finding{Kind: "token", ID: t.AccessorID, Name: t.Description, Managed: inv.managedTokens[t.AccessorID]}
+		for _, l := range t.Policies {
+			if l.ID == globalManagementID {
+				f.Severity, f.Message = "critical", "has the global-management policy"
+				out = append(out, f)
+			}
+		}
+		if t.Builtin() {
+			continue
+		}
+		if t.ExpirationTime == nil {
+			f.Severity, f.Message = "low", "never expires"
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// loadPolicyRules reads the rules of every policy in inv, keyed by policy ID.
+// The policy list does not carry them, so this is one request per policy.
+func loadPolicyRules(api consul.API, inv *inventory) (map[string]string, error) {
+	rules := make(map[string]string, len(inv.policies))
+	for _, p := range inv.policies {
+		full, err := api.PolicyRules(p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy %q: %w", p.Name, err)
+		}
+		rules[p.ID] = full.Rules
+	}
+	return rules, nil
+}
+
+// auditCommand scans the live ACL state for risky patterns and prints them,
+// most severe first. It is read-only.
+func auditCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts     options
+		output   string
+		severity string
+	)
+	opts.register(fs)
+	fs.StringVar(&output, "output", "text", "report format: text or json")
+	fs.StringVar(&severity, "severity", "low", "lowest severity to report: critical, high, medium or low")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want text or json)", output)
+		}
+		if severityRank(severity) == len(severities) {
+			return fmt.Errorf("unknown -severity %q (want critical, high, medium or low)", severity)
+		}
+		s, err := opts.open("audit")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		rules, err := loadPolicyRules(s.client, inv)
+		if err != nil {
+			return err
+		}
+
+		findings := []finding{}
+		for _, f := range append(auditPolicies(inv, rules), auditTokens(inv)...) {
+			if severityRank(f.Severity) <= severityRank(severity) {
+				findings = append(findings, f)
+			}
+		}
+		sort.SliceStable(findings, func(i, j int) bool {
+			return severityRank(findings[i].Severity) < severityRank(findings[j].Severity)
+		})
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(findings)
+		}
+		printFindings(os.Stdout, findings)
+		return nil
+	}
+}
+
+func printFindings(w io.Writer, findings []finding) {
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "No findings.")
+		return
+	}
+	counts := make(map[string]int)
+	for _, f := range findings {
+		label := f.ID
+		if f.Kind == "policy" {
+			label = fmt.Sprintf("%q", f.Name)
+		} else if f.Name != "" {
+			label += fmt.Sprintf(" %q", f.Name)
+		}
+		fmt.Fprintf(w, "%-8s %s %s (%s): %s\n", f.Severity, f.Kind, label, managedLabel(f.Managed), f.Message)
+		counts[f.Severity]++
+	}
+	fmt.Fprintln(w)
+	for i, s := range severities {
+		if i > 0 {
+			fmt.Fprint(w, ", ")
+		}
+		fmt.Fprintf(w, "%d %s", counts[s], s)
+	}
+	fmt.Fprintln(w, ".")
+}
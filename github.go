@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// githubActions writes results where a GitHub Actions workflow picks them up:
+// the step summary, step outputs and error annotations. It is nil outside
+// Actions, and every method is a no-op on nil.
+type githubActions struct {
+	summaryPath string
+	outputPath  string
+}
+
+// detectGitHubActions returns a writer when running inside GitHub Actions.
+func detectGitHubActions() *githubActions {
+	if os.Getenv("GITHUB_ACTIONS") != "true" {
+		return nil
+	}
+	return &githubActions{
+		summaryPath: os.Getenv("GITHUB_STEP_SUMMARY"),
+		outputPath:  os.Getenv("GITHUB_OUTPUT"),
+	}
+}
+
+// reportPlan adds the plan to the step summary and sets the outputs
+// describing it.
+func (g *githubActions) reportPlan(plan *diff.Plan) error {
+	if g == nil {
+		return nil
+	}
+	var md bytes.Buffer
+	diff.PrintMarkdown(&md, plan)
+	if err := appendFile(g.summaryPath, md.String()); err != nil {
+		return err
+	}
+	return g.setPlanOutputs(plan)
+}
+
+// reportApply adds the apply outcome to the step summary. applyErr is the
+// error the apply failed with, if any.
+func (g *githubActions) reportApply(plan *diff.Plan, applyErr error) error {
+	if g == nil {
+		return nil
+	}
+	var md bytes.Buffer
+	diff.PrintMarkdown(&md, plan)
+	md.WriteString("\n")
+	if applyErr != nil {
+		fmt.Fprintf(&md, "**Apply failed:** `%s`\n", strings.ReplaceAll(applyErr.Error(), "`", "'"))
+	} else if plan.HasChanges() {
+		md.WriteString("**Applied.**\n")
+	}
+	if err := appendFile(g.summaryPath, md.String()); err != nil {
+		return err
+	}
+	if err := g.setPlanOutputs(plan); err != nil {
+		return err
+	}
+	return g.setOutput("applied", fmt.Sprint(applyErr == nil && plan.HasChanges()))
+}
+
+func (g *githubActions) setPlanOutputs(plan *diff.Plan) error {
+	outputs := []struct {
+		name  string
+		value interface{}
+	}{
+		{"changes", plan.HasChanges()},
+		{"policies_to_create", len(plan.PoliciesToCreate)},
+		{"policies_to_update", len(plan.PoliciesToUpdate)},
+		{"roles_to_create", len(plan.RolesToCreate)},
+		{"roles_to_update", len(plan.RolesToUpdate)},
+		{"tokens_to_create", len(plan.TokensToCreate)},
+		{"tokens_to_update", len(plan.TokensToUpdate)},
+		{"tokens_to_replace", len(plan.TokensToReplace)},
+		{"auth_methods_to_create", len(plan.AuthMethodsToCreate)},
+		{"auth_methods_to_update", len(plan.AuthMethodsToUpdate)},
+		{"partitions_to_create", len(plan.PartitionsToCreate)},
+		{"partitions_to_update", len(plan.PartitionsToUpdate)},
+		{"namespaces_to_create", len(plan.NamespacesToCreate)},
+		{"namespaces_to_update", len(plan.NamespacesToUpdate)},
+	}
+	for _, o := range outputs {
+		if err := g.setOutput(o.name, fmt.Sprint(o.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *githubActions) setOutput(name, value string) error {
+	return appendFile(g.outputPath, name+"="+value+"\n")
+}
+
+// annotateError prints err as a workflow error annotation, so it shows on the
+// run page and the pull request. Actions reads annotations from stderr too,
+// which keeps them out of redirected output.
+func (g *githubActions) annotateError(err error) {
+	if g == nil || err == nil {
+		return
+	}
+	msg := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(err.Error())
+	fmt.Fprintf(os.Stderr, "::error title=consul-acl-sync::%s\n", msg)
+}
+
+// appendFile appends to one of the files Actions provides. An empty path,
+// as when the variable is unset, is skipped.
+func appendFile(path, text string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write GitHub Actions file: %w", err)
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write GitHub Actions file: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// aclGraph is the live tokens, roles and policies and the links between them.
+// Node IDs are stable within one graph: p0, r0, t0 and so on.
+type aclGraph struct {
+	nodes []graphNode
+	edges [][2]string // from, to
+}
+
+type graphNode struct {
+	id, kind, label string
+	managed         bool
+	refs            int // incoming links, for policies and roles
+}
+
+func buildGraph(inv *inventory, roles []consul.Role) *aclGraph {
+	g := &aclGraph{}
+	policyNode := make(map[string]int, len(inv.policies))
+	for i, p := range inv.policies {
+		policyNode[p.ID] = len(g.nodes)
+		g.nodes = append(g.nodes, graphNode{id: fmt.Sprintf("p%d", i), kind: "policy", label: p.Name, managed: inv.managedPolicies[p.Name]})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	roleNode := make(map[string]int, len(roles))
+	for i, r := range roles {
+		roleNode[r.ID] = len(g.nodes)
+		g.nodes = append(g.nodes, graphNode{id: fmt.Sprintf("r%d", i), kind: "role", label: r.Name})
+		for _, l := range r.Policies {
+			g.link(len(g.nodes)-1, policyNode, l.ID)
+		}
+	}
+	for i, t := range inv.tokens {
+		label := t.Description
+		if label == "" {
+			label = t.AccessorID
+		}
+		g.nodes = append(g.nodes, graphNode{id: fmt.Sprintf("t%d", i), kind: "token", label: label, managed: inv.managedTokens[t.AccessorID]})
+		from := len(g.nodes) - 1
+		for _, l := range t.Policies {
+			g.link(from, policyNode, l.ID)
+		}
+		for _, l := range t.Roles {
+			g.link(from, roleNode, l.ID)
+		}
+	}
+	return g
+}
+
+// link adds an edge from node from to the node targets maps id to, if any.
+func (g *aclGraph) link(from int, targets map[string]int, id string) {
+	to, ok := targets[id]
+	if !ok {
+		return
+	}
+	g.edges = append(g.edges, [2]string{g.nodes[from].id, g.nodes[to].id})
+	g.nodes[to].refs++
+}
+
+// nodeLabel is the label drawn for n: its name and, for policies and roles,
+// how many links point at it, so over-connected ones stand out.
+func (n graphNode) nodeLabel() string {
+	if n.kind == "token" {
+		return n.label
+	}
+	return fmt.Sprintf("%s (%d)", n.label, n.refs)
+}
+
+func writeDOT(w io.Writer, g *aclGraph) {
+	shapes := map[string]string{"policy": "box", "role": "hexagon", "token": "ellipse"}
+	fmt.Fprintln(w, "digraph acl {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, n := range g.nodes {
+		style := ""
+		if !n.managed {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(w, "  %s [label=%s, shape=%s%s];\n", n.id, dotQuote(n.nodeLabel()), shapes[n.kind], style)
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "  %s -> %s;\n", e[0], e[1])
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func writeMermaid(w io.Writer, g *aclGraph) {
+	shapes := map[string][2]string{"policy": {"[", "]"}, "role": {"{{", "}}"}, "token": {"([", "])"}}
+	fmt.Fprintln(w, "flowchart LR")
+	var unmanaged []string
+	for _, n := range g.nodes {
+		s := shapes[n.kind]
+		fmt.Fprintf(w, "  %s%s%s%s\n", n.id, s[0], mermaidQuote(n.nodeLabel()), s[1])
+		if !n.managed {
+			unmanaged = append(unmanaged, n.id)
+		}
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(w, "  %s --> %s\n", e[0], e[1])
+	}
+	if len(unmanaged) > 0 {
+		fmt.Fprintln(w, "  classDef unmanaged stroke-dasharray: 5 5")
+		fmt.Fprintf(w, "  class %s unmanaged\n", strings.Join(unmanaged, ","))
+	}
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// mermaidQuote quotes a label; Mermaid has no escape for a double quote
+// inside one, only the #quot; entity.
+func mermaidQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+}
+
+// graphCommand prints the live tokens, roles and policies and their links as
+// a Graphviz DOT or Mermaid graph. Resources the config does not manage are
+// drawn dashed.
+func graphCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		format string
+	)
+	opts.register(fs)
+	fs.StringVar(&format, "format", "dot", "graph format: dot or mermaid")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if format != "dot" && format != "mermaid" {
+			return fmt.Errorf("unknown -format %q (want dot or mermaid)", format)
+		}
+		s, err := opts.open("graph")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		roles, err := s.client.ListRoles()
+		if err != nil {
+			return fmt.Errorf("failed to list roles: %w", err)
+		}
+		g := buildGraph(inv, roles)
+		if format == "mermaid" {
+			writeMermaid(os.Stdout, g)
+		} else {
+			writeDOT(os.Stdout, g)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// historyCommands record their runs under history.consul_kv_prefix: the ones
+// that plan against the cluster and may change it.
+var historyCommands = map[string]bool{"plan": true, "apply": true, "restore": true, "rollback": true}
+
+// historyRecord is one run. Unlike an audit record it is written for every
+// run, with or without changes, and holds a summary rather than every change.
+type historyRecord struct {
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	Operator string    `json:"operator"`
+	Config   string    `json:"config"`
+	PlanHash string    `json:"plan_hash,omitempty"`
+	Summary  string    `json:"summary,omitempty"`
+	Applied  int       `json:"applied"`
+	Outcome  string    `json:"outcome"` // success or failure
+	Error    string    `json:"error,omitempty"`
+}
+
+// writeHistory records a run. runErr is the error it ended with, if any, and
+// must already be redacted.
+func writeHistory(cfg config.HistoryConfig, kv consul.KV, command, configPath string, plan *diff.Plan, applied int, runErr error) error {
+	if cfg.ConsulKVPrefix == "" {
+		return nil
+	}
+	rec := historyRecord{
+		Time:     time.Now().UTC(),
+		Command:  command,
+		Operator: currentOperator(),
+		Config:   configPath,
+		Applied:  applied,
+		Outcome:  "success",
+	}
+	if plan != nil {
+		rec.PlanHash = diff.Hash(plan)
+		rec.Summary = diff.Summary(plan)
+	}
+	if runErr != nil {
+		rec.Outcome = "failure"
+		rec.Error = runErr.Error()
+	}
+	// Timestamped keys sort chronologically and never overwrite.
+	key := fmt.Sprintf("%s/%s-%s", cfg.ConsulKVPrefix, rec.Time.Format("20060102T150405.000000000Z"), command)
+	if err := kv.PutKV(key, rec); err != nil {
+		return fmt.Errorf("failed to write run history to Consul KV: %w", err)
+	}
+	return nil
+}
+
+// readHistory returns the recorded runs, newest first.
+func readHistory(kv consul.KV, prefix string) ([]historyRecord, error) {
+	pairs, err := kv.ListKV(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run history from Consul KV: %w", err)
+	}
+	records := make([]historyRecord, 0, len(pairs))
+	for i := len(pairs) - 1; i >= 0; i-- {
+		var rec historyRecord
+		if err := json.Unmarshal(pairs[i].Value, &rec); err != nil {
+			return nil, fmt.Errorf("run history key %s: %w", pairs[i].Key, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// historyCommand prints the runs recorded under history.consul_kv_prefix,
+// newest first.
+func historyCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts    options
+		limit   int
+		output  string
+		changed bool
+	)
+	opts.register(fs)
+	fs.IntVar(&limit, "limit", 20, "number of runs to show (0: all)")
+	fs.StringVar(&output, "output", "text", "report format: text or json")
+	fs.BoolVar(&changed, "changed", false, "only show runs that applied changes")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want text or json)", output)
+		}
+		s, err := opts.open("history")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		prefix := s.cfg.History.ConsulKVPrefix
+		if prefix == "" {
+			return fmt.Errorf("history needs history.consul_kv_prefix in the config")
+		}
+		records, err := readHistory(s.kv, prefix)
+		if err != nil {
+			return err
+		}
+		if changed {
+			kept := records[:0]
+			for _, rec := range records {
+				if rec.Applied > 0 {
+					kept = append(kept, rec)
+				}
+			}
+			records = kept
+		}
+		if limit > 0 && len(records) > limit {
+			records = records[:limit]
+		}
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(records)
+		}
+		printHistory(os.Stdout, records)
+		return nil
+	}
+}
+
+func printHistory(w io.Writer, records []historyRecord) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "No runs recorded.")
+		return
+	}
+	for _, rec := range records {
+		fmt.Fprintf(w, "%s  %-8s %-7s %s  %s\n", rec.Time.Format(time.RFC3339), rec.Command, rec.Outcome, rec.Operator, rec.Config)
+		if rec.Summary != "" {
+			fmt.Fprintf(w, "    %s", rec.Summary)
+			if rec.Applied > 0 {
+				fmt.Fprintf(w, " Applied %d.", rec.Applied)
+			}
+			fmt.Fprintf(w, " (plan %s)\n", rec.PlanHash[:12])
+		}
+		if rec.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", rec.Error)
+		}
+	}
+}
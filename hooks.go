@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// runHooks runs the commands of one hook point in order, stopping at the
+// first failure. plan is nil for pre_plan hooks, which run before there is
+// one; otherwise it is passed as JSON on stdin and summarized in the
+// environment. outcome is set for post_apply hooks only.
+func runHooks(point string, commands []string, configPath string, plan *diff.Plan, outcome string) error {
+	env := append(os.Environ(),
+		"CONSUL_ACL_SYNC_HOOK="+point,
+		"CONSUL_ACL_SYNC_CONFIG="+configPath,
+	)
+	var stdin []byte
+	if plan != nil {
+		doc := diff.NewDocument(plan)
+		hash := doc.PlanHash
+		var err error
+		if stdin, err = json.Marshal(doc); err != nil {
+			return err
+		}
+		env = append(env,
+			"CONSUL_ACL_SYNC_PLAN_HASH="+hash,
+			fmt.Sprintf("CONSUL_ACL_SYNC_CHANGES=%t", plan.HasChanges()),
+		)
+	}
+	if outcome != "" {
+		env = append(env, "CONSUL_ACL_SYNC_OUTCOME="+outcome)
+	}
+
+	for _, command := range commands {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(stdin)
+		// Hook output is diagnostics, not part of the plan.
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q failed: %w", point, command, err)
+		}
+	}
+	return nil
+}
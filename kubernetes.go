@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data"`
+}
+
+type k8sMetadata struct {
+	Name        string            `yaml:"name"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// renderKubernetesSecrets renders one Secret manifest per token that asks for
+// one, as a multi-document YAML stream.
+func renderKubernetesSecrets(tokens []config.Token) ([]byte, error) {
+	var docs []string
+	for _, t := range tokens {
+		if t.KubernetesSecret == nil {
+			continue
+		}
+		name, err := config.ExpandTemplate(t.KubernetesSecret.Name, t)
+		if err != nil {
+			return nil, fmt.Errorf("token %s: kubernetes_secret.name: %w", t.AccessorID, err)
+		}
+		namespace, err := config.ExpandTemplate(t.KubernetesSecret.Namespace, t)
+		if err != nil {
+			return nil, fmt.Errorf("token %s: kubernetes_secret.namespace: %w", t.AccessorID, err)
+		}
+
+		secret := k8sSecret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata: k8sMetadata{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      map[string]string{"app.kubernetes.io/managed-by": "consul-acl-sync"},
+				Annotations: map[string]string{"consul-acl-sync/accessor-id": t.AccessorID},
+			},
+			Type: "Opaque",
+			Data: map[string]string{
+				"token":       base64.StdEncoding.EncodeToString([]byte(t.SecretID)),
+				"accessor_id": base64.StdEncoding.EncodeToString([]byte(t.AccessorID)),
+			},
+		}
+		b, err := yaml.Marshal(secret)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, string(b))
+	}
+	return []byte(strings.Join(docs, "---\n")), nil
+}
+
+// createdTokens returns the tokens of plan that applied created, replaced
+// ones included since they have new secrets.
+func createdTokens(plan *diff.Plan, applied []diff.Change) []config.Token {
+	done := make(map[string]bool)
+	for _, c := range applied {
+		if c.Type == "token" && (c.Action == "create" || c.Action == "replace") {
+			done[c.Name] = true
+		}
+	}
+	var created []config.Token
+	for _, t := range plan.TokensToCreate {
+		if done[t.AccessorID] {
+			created = append(created, t)
+		}
+	}
+	for _, u := range plan.TokensToReplace {
+		if done[u.Desired.AccessorID] {
+			created = append(created, u.Desired)
+		}
+	}
+	return created
+}
+
+// writeKubernetesSecrets writes the manifests for the tokens created this run.
+// The file holds secrets, so it is readable by the current user only, and
+// encrypted when enc has recipients.
+func writeKubernetesSecrets(path string, created []config.Token, enc config.Encryption) error {
+	data, err := renderKubernetesSecrets(created)
+	if err != nil {
+		return err
+	}
+	if data, err = enc.Encrypt(data); err != nil {
+		return fmt.Errorf("failed to write Kubernetes secrets: %w", err)
+	}
+	if err := secrets.WriteFile(path, data); err != nil {
+		return fmt.Errorf("failed to write Kubernetes secrets: %w", err)
+	}
+	return nil
+}
+
+// serviceAccountDir is where Kubernetes mounts a pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesCredentials are what a kubernetes auth method needs to reach the
+// cluster's TokenReview API.
+type kubernetesCredentials struct {
+	host, caCert, jwt string
+}
+
+// discoverKubernetes fills in the Config of the kubernetes auth methods that
+// ask for it, keeping any Host, CACert or ServiceAccountJWT the config sets.
+func discoverKubernetes(cfg *config.Config) error {
+	for i := range cfg.AuthMethods {
+		m := &cfg.AuthMethods[i]
+		if m.Kubernetes == nil {
+			continue
+		}
+		var creds kubernetesCredentials
+		var err error
+		if m.Kubernetes.InCluster {
+			creds, err = inClusterCredentials()
+		} else {
+			creds, err = kubeconfigCredentials(m.Kubernetes.Kubeconfig, m.Kubernetes.Context)
+		}
+		if err != nil {
+			return fmt.Errorf("auth method %s: %w", m.Key(), err)
+		}
+		conf := make(map[string]interface{}, len(m.Config)+3)
+		for k, v := range m.Config {
+			conf[k] = v
+		}
+		for k, v := range map[string]string{"Host": creds.host, "CACert": creds.caCert, "ServiceAccountJWT": creds.jwt} {
+			if _, ok := conf[k]; !ok && v != "" {
+				conf[k] = v
+			}
+		}
+		m.Config = conf
+	}
+	return nil
+}
+
+// inClusterCredentials reads the credentials of the pod the tool runs in. Its
+// service account is then the one Consul reviews tokens with, so it needs the
+// system:auth-delegator cluster role.
+func inClusterCredentials() (kubernetesCredentials, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return kubernetesCredentials{}, fmt.Errorf("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return kubernetesCredentials{}, fmt.Errorf("failed to read the cluster CA: %w", err)
+	}
+	jwt, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return kubernetesCredentials{}, fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	return kubernetesCredentials{
+		host:   "https://" + net.JoinHostPort(host, port),
+		caCert: string(ca),
+		jwt:    strings.TrimSpace(string(jwt)),
+	}, nil
+}
+
+// kubeconfig is the part of a kubeconfig file discovery reads.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token     string `yaml:"token"`
+			TokenFile string `yaml:"tokenFile"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeconfigCredentials reads the server, CA and token of context, or of
+// the current context, from the kubeconfig at path. Files it names are
+// relative to its directory, as kubectl resolves them.
+func kubeconfigCredentials(path, context string) (kubernetesCredentials, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return kubernetesCredentials{}, err
+		}
+		path = filepath.Join(home, rest)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return kubernetesCredentials{}, fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return kubernetesCredentials{}, fmt.Errorf("failed to parse kubeconfig %s: %s", path, yaml.FormatError(err, false, false))
+	}
+	dir := filepath.Dir(path)
+	readRelative := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return kubernetesCredentials{}, fmt.Errorf("kubeconfig %s has no context %q", path, context)
+	}
+
+	var creds kubernetesCredentials
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		creds.host = c.Cluster.Server
+		switch {
+		case c.Cluster.CertificateAuthorityData != "":
+			ca, err := base64.StdEncoding.DecodeString(c.Cluster.CertificateAuthorityData)
+			if err != nil {
+				return kubernetesCredentials{}, fmt.Errorf("cluster %s has invalid certificate-authority-data: %w", clusterName, err)
+			}
+			creds.caCert = string(ca)
+		case c.Cluster.CertificateAuthority != "":
+			ca, err := readRelative(c.Cluster.CertificateAuthority)
+			if err != nil {
+				return kubernetesCredentials{}, fmt.Errorf("failed to read the CA of cluster %s: %w", clusterName, err)
+			}
+			creds.caCert = string(ca)
+		}
+	}
+	if !found {
+		return kubernetesCredentials{}, fmt.Errorf("kubeconfig %s has no cluster %q", path, clusterName)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		switch {
+		case u.User.Token != "":
+			creds.jwt = u.User.Token
+		case u.User.TokenFile != "":
+			jwt, err := readRelative(u.User.TokenFile)
+			if err != nil {
+				return kubernetesCredentials{}, fmt.Errorf("failed to read the token of user %s: %w", userName, err)
+			}
+			creds.jwt = strings.TrimSpace(string(jwt))
+		}
+	}
+	if creds.jwt == "" {
+		return kubernetesCredentials{}, fmt.Errorf("user %q of kubeconfig %s has no token; Consul reviews logins with a service account token", userName, path)
+	}
+	return creds, nil
+}
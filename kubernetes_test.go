@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+)
+
+func TestKubernetesSecretsAfterFailedApply(t *testing.T) {
+	srv := consultest.NewServer(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	// The second token references a policy nothing defines, so its create
+	// fails after the first token was created.
+	err := os.WriteFile(path, []byte(`
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 9f1c7d00-0000-4000-8000-000000000001
+    description: created
+    kubernetes_secret:
+      name: "consul-{{.Description}}"
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000002
+    secret_id: 9f1c7d00-0000-4000-8000-000000000002
+    description: failed
+    policies: [missing]
+    kubernetes_secret:
+      name: "consul-{{.Description}}"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONSUL_HTTP_TOKEN", "")
+	out := filepath.Join(dir, "secrets.yaml")
+	err = run([]string{"apply", "-config", path, "-consul-addr", srv.URL, "-kubernetes-secrets", out})
+	if err == nil {
+		t.Fatal("apply succeeded, want the token with a missing policy to fail")
+	}
+	data, rerr := os.ReadFile(out)
+	if rerr != nil {
+		t.Fatalf("no manifests after a failed apply: %v", rerr)
+	}
+	if !strings.Contains(string(data), "name: consul-created") || strings.Contains(string(data), "consul-failed") {
+		t.Errorf("manifests =\n%s\nwant the created token's only", data)
+	}
+}
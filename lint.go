@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// lintCheck is one built-in check over the config. Its severity can be
+// changed, or the check turned off, under lint.rules.
+type lintCheck struct {
+	name     string
+	severity string // default
+	run      func(cfg *config.Config, parsed map[string][]acl.Rule) []lintIssue
+}
+
+// lintIssue is one problem a check found.
+type lintIssue struct {
+	check, severity string
+	subject         string
+	message         string
+}
+
+var lintChecks = []lintCheck{
+	{"invalid-rules", "warning", nil}, // reported while parsing
+	{"over-broad", "error", lintOverBroad},
+	{"deny-overridden-by-write", "warning", lintDenyOverridden},
+	{"missing-description", "warning", lintMissingDescription},
+	{"unreferenced-policy", "warning", lintUnreferenced},
+}
+
+func lintOverBroad(cfg *config.Config, parsed map[string][]acl.Rule) []lintIssue {
+	var out []lintIssue
+	for _, p := range cfg.Policies {
+		for _, r := range parsed[p.Name] {
+			switch {
+			case r.Resource == "acl" && r.Policy == "write":
+				out = append(out, lintIssue{subject: fmt.Sprintf("policy %q", p.Name), message: `grants acl = "write", which can create tokens with any privilege`})
+			case !r.Scalar() && r.Prefix && r.Name == "" && r.Policy == "write":
+				out = append(out, lintIssue{subject: fmt.Sprintf("policy %q", p.Name), message: fmt.Sprintf("grants write on every %s (%s)", r.Resource, r)})
+			}
+		}
+	}
+	return out
+}
+
+// lintDenyOverridden finds deny prefix rules that a more specific write rule
+// punches through, within one policy or across the policies of one token.
+// The write wins for the names it covers, which is easy to miss when reading
+// the deny.
+func lintDenyOverridden(cfg *config.Config, parsed map[string][]acl.Rule) []lintIssue {
+	var out []lintIssue
+	for _, p := range cfg.Policies {
+		var src sourcedRules
+		src.add(p.Name, parsed[p.Name])
+		for _, msg := range denyOverrides(src, false) {
+			out = append(out, lintIssue{subject: fmt.Sprintf("policy %q", p.Name), message: msg})
+		}
+	}
+	for _, t := range cfg.Tokens {
+		var src sourcedRules
+		for _, name := range t.Policies {
+			src.add(name, parsed[name])
+		}
+		for _, msg := range denyOverrides(src, true) {
+			out = append(out, lintIssue{subject: "token " + t.Label(), message: msg})
+		}
+	}
+	return out
+}
+
+// denyOverrides describes each write rule in src that overrides a deny prefix
+// rule. With crossOnly, only pairs from different policies are reported, since
+// the pairs inside one policy are reported for the policy itself.
+func denyOverrides(src sourcedRules, crossOnly bool) []string {
+	var out []string
+	for i, d := range src.rules {
+		if d.Policy != "deny" || !d.Prefix {
+			continue
+		}
+		for j, w := range src.rules {
+			if w.Policy != "write" || w.Resource != d.Resource || w.Namespace != d.Namespace || w.Partition != d.Partition {
+				continue
+			}
+			if !strings.HasPrefix(w.Name, d.Name) || (w.Prefix && len(w.Name) == len(d.Name)) {
+				continue
+			}
+			if crossOnly && src.policy[i] == src.policy[j] {
+				continue
+			}
+			if crossOnly {
+				out = append(out, fmt.Sprintf("%s in %q overrides %s in %q", w, src.policy[j], d, src.policy[i]))
+			} else {
+				out = append(out, fmt.Sprintf("%s overrides %s", w, d))
+			}
+		}
+	}
+	return out
+}
+
+func lintMissingDescription(cfg *config.Config, _ map[string][]acl.Rule) []lintIssue {
+	var out []lintIssue
+	for _, p := range cfg.Policies {
+		if strings.TrimSpace(p.Description) == "" {
+			out = append(out, lintIssue{subject: fmt.Sprintf("policy %q", p.Name), message: "has no description"})
+		}
+	}
+	for _, t := range cfg.Tokens {
+		if strings.TrimSpace(t.Description) == "" {
+			out = append(out, lintIssue{subject: "token " + t.AccessorID, message: "has no description"})
+		}
+	}
+	return out
+}
+
+func lintUnreferenced(cfg *config.Config, _ map[string][]acl.Rule) []lintIssue {
+	used := make(map[string]bool)
+	for _, t := range cfg.Tokens {
+		for _, name := range t.Policies {
+			used[name] = true
+		}
+	}
+	for _, r := range cfg.Roles {
+		for _, name := range r.Policies {
+			used[name] = true
+		}
+	}
+	var out []lintIssue
+	for _, p := range cfg.Policies {
+		if !used[p.Name] {
+			out = append(out, lintIssue{subject: fmt.Sprintf("policy %q", p.Name), message: "is not attached to any token or role in the config"})
+		}
+	}
+	return out
+}
+
+// lintConfig runs every check that is not off, with the severities from
+// lint.rules, errors first.
+func lintConfig(cfg *config.Config) ([]lintIssue, error) {
+	severity := make(map[string]string, len(lintChecks))
+	for _, c := range lintChecks {
+		severity[c.name] = c.severity
+	}
+	for name, s := range cfg.Lint.Rules {
+		if _, ok := severity[name]; !ok {
+			names := make([]string, 0, len(lintChecks))
+			for _, c := range lintChecks {
+				names = append(names, c.name)
+			}
+			return nil, fmt.Errorf("unknown lint check %q (want one of %s)", name, strings.Join(names, ", "))
+		}
+		severity[name] = s
+	}
+
+	var issues []lintIssue
+	parsed := make(map[string][]acl.Rule, len(cfg.Policies))
+	for _, p := range cfg.Policies {
+		rules, err := acl.Parse(p.Rules)
+		if err != nil {
+			issues = append(issues, lintIssue{check: "invalid-rules", subject: fmt.Sprintf("policy %q", p.Name), message: fmt.Sprintf("rules do not parse, so other checks skip them: %v", err)})
+			continue
+		}
+		parsed[p.Name] = rules
+	}
+	for _, c := range lintChecks {
+		if c.run == nil {
+			continue
+		}
+		for _, issue := range c.run(cfg, parsed) {
+			issue.check = c.name
+			issues = append(issues, issue)
+		}
+	}
+
+	kept := issues[:0]
+	for _, issue := range issues {
+		issue.severity = severity[issue.check]
+		if issue.severity != "off" {
+			kept = append(kept, issue)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].severity == "error" && kept[j].severity != "error" })
+	return kept, nil
+}
+
+// lintCommand checks the config against the built-in lint checks. It reads
+// only the config and fails when any check at error severity finds something,
+// so it can gate CI; warnings are informative.
+func lintCommand(fs *flag.FlagSet) func([]string) error {
+	var opts configOptions
+	opts.register(fs)
+	return func([]string) error {
+		cfg, err := opts.load()
+		if err != nil {
+			return err
+		}
+		issues, err := lintConfig(cfg)
+		if err != nil {
+			return err
+		}
+		errors := printLint(os.Stdout, issues)
+		if errors > 0 {
+			return fmt.Errorf("lint found %d errors", errors)
+		}
+		return nil
+	}
+}
+
+// printLint prints the issues and returns how many are errors.
+func printLint(w io.Writer, issues []lintIssue) int {
+	errors := 0
+	for _, issue := range issues {
+		if issue.severity == "error" {
+			errors++
+		}
+		fmt.Fprintf(w, "%-7s %s: %s [%s]\n", issue.severity, issue.subject, issue.message, issue.check)
+	}
+	if len(issues) > 0 {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "%d errors, %d warnings.\n", errors, len(issues)-errors)
+	return errors
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// inventory is everything in the cluster, split by whether the config
+// declares it.
+type inventory struct {
+	policies []consul.Policy
+	tokens   []consul.Token
+
+	managedPolicies map[string]bool // by name
+	managedTokens   map[string]bool // by accessor ID
+}
+
+func loadInventory(api consul.API, cfg *config.Config) (*inventory, error) {
+	policies, err := api.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	tokens, err := api.ListTokens()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].AccessorID < tokens[j].AccessorID })
+
+	inv := &inventory{
+		policies:        policies,
+		tokens:          tokens,
+		managedPolicies: make(map[string]bool, len(cfg.Policies)),
+		managedTokens:   make(map[string]bool, len(cfg.Tokens)),
+	}
+	for _, p := range cfg.Policies {
+		inv.managedPolicies[p.Name] = true
+	}
+	for _, t := range cfg.Tokens {
+		inv.managedTokens[t.AccessorID] = true
+	}
+	return inv, nil
+}
+
+// listCommand prints every policy and token in the cluster, marked managed
+// when the config declares it.
+func listCommand(fs *flag.FlagSet) func([]string) error {
+	var opts options
+	opts.register(fs)
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		s, err := opts.open("list")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		printInventory(os.Stdout, inv)
+		return nil
+	}
+}
+
+func printInventory(w io.Writer, inv *inventory) {
+	managed := 0
+	for _, p := range inv.policies {
+		if inv.managedPolicies[p.Name] {
+			managed++
+		}
+	}
+	fmt.Fprintf(w, "Policies (%d of %d managed):\n", managed, len(inv.policies))
+	for _, p := range inv.policies {
+		fmt.Fprintf(w, "  %-9s %q%s\n", managedLabel(inv.managedPolicies[p.Name]), p.Name, builtinLabel(p.Builtin()))
+	}
+
+	managed = 0
+	for _, t := range inv.tokens {
+		if inv.managedTokens[t.AccessorID] {
+			managed++
+		}
+	}
+	fmt.Fprintf(w, "\nTokens (%d of %d managed):\n", managed, len(inv.tokens))
+	for _, t := range inv.tokens {
+		fmt.Fprintf(w, "  %-9s %s%s\n", managedLabel(inv.managedTokens[t.AccessorID]), t.Label(), builtinLabel(t.Builtin()))
+	}
+}
+
+func managedLabel(managed bool) string {
+	if managed {
+		return "managed"
+	}
+	return "unmanaged"
+}
+
+func builtinLabel(builtin bool) string {
+	if builtin {
+		return " (built-in)"
+	}
+	return ""
+}
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/apply"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
 )
 
 // Injected at build time by goreleaser via -ldflags -X.
@@ -14,54 +28,861 @@ var (
 )
 
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); err != nil {
+		detectGitHubActions().annotateError(err)
 		fmt.Fprintln(os.Stderr, "consul-acl-sync:", err)
-		os.Exit(1)
+		code, hint := classifyError(err)
+		if hint != "" {
+			fmt.Fprintln(os.Stderr, "hint:", hint)
+		}
+		os.Exit(code)
+	}
+}
+
+// command is a subcommand. setup registers its flags and returns the function
+// that runs it once they are parsed, so completion can list the flags without
+// running anything.
+type command struct {
+	name    string
+	summary string
+	setup   func(fs *flag.FlagSet) func(args []string) error
+}
+
+// commands is filled in by init, since completion refers back to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"plan", "show the changes an apply would make", planCommand},
+		{"apply", "apply the config to Consul (the default)", applyCommand},
+		{"backup", "archive every policy, token and role to a timestamped file", backupCommand},
+		{"restore", "apply a backup archive back to Consul", restoreCommand},
+		{"rollback", "undo the last apply from its pre-apply backup", rollbackCommand},
+		{"history", "show the runs recorded in Consul KV, newest first", historyCommand},
+		{"serve", "serve plan and apply over an authenticated HTTP API", serveCommand},
+		{"reconcile", "apply each new commit of a config in a Git repository", reconcileCommand},
+		{"pr-webhook", "comment plans on GitHub pull requests and apply them on merge", prWebhookCommand},
+		{"list", "list every policy and token in Consul, marked managed or not", listCommand},
+		{"show", "print one live policy or token", showCommand},
+		{"orphans", "report resources in Consul that are not in the config", orphansCommand},
+		{"usage", "report which tokens and roles reference each policy", usageCommand},
+		{"audit", "report risky patterns in the live ACL state, most severe first", auditCommand},
+		{"expiring", "list tokens that expire within a window", expiringCommand},
+		{"who-can", "report the policies and tokens that grant an access", whoCanCommand},
+		{"simulate", "evaluate a token from the config against operations", simulateCommand},
+		{"graph", "print tokens, roles and policies as a DOT or Mermaid graph", graphCommand},
+		{"report", "print an inventory of policies and tokens as Markdown or CSV", reportCommand},
+		{"export", "render the live ACLs as Terraform, or the config as a consul CLI script", exportCommand},
+		{"lint", "check the config against built-in lint checks", lintCommand},
+		{"test", "check assertion files about who may do what against the config", testCommand},
+		{"self-policy", "print the ACL rules the tool's own token needs to plan or apply the config", selfPolicyCommand},
+		{"translate-rules", "rewrite policy rules of the config from the legacy syntax", translateRulesCommand},
+		{"dev-server", "serve an in-memory Consul ACL API for tests and CI", devServerCommand},
+		{"completion", "print a bash, zsh or fish completion script", completionCommand},
 	}
 }
 
-func run() error {
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// run dispatches to a subcommand. Without one it applies, as it always has.
+// Flags may come before the subcommand as well as after it.
+func run(args []string) error {
+	if len(args) == 1 && args[0] == completePoliciesCommand {
+		completePolicies(os.Stdout)
+		return nil
+	}
+	c := findCommand("apply")
+	if len(args) > 0 {
+		if named := findCommand(args[0]); named != nil {
+			c, args = named, args[1:]
+		} else if named, rest := commandAfterFlags(args); named != nil {
+			c, args = named, rest
+		}
+	}
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	runCommand := c.setup(fs)
+	_ = fs.Parse(args)
+	return runCommand(fs.Args())
+}
+
+// commandAfterFlags finds a subcommand named after leading flags, as in
+// consul-acl-sync -config c.yaml plan, and returns it with its arguments,
+// the leading flags first. Without this the run would apply, with the
+// subcommand name a stray argument. The leading flags must all be flags of
+// the subcommand, so a flag value that happens to be a command name is not
+// taken for one.
+func commandAfterFlags(args []string) (*command, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		c := findCommand(arg)
+		if c == nil {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		c.setup(fs)
+		if fs.Parse(args[:i]) == nil && fs.NArg() == 0 {
+			return c, append(append([]string(nil), args[:i]...), args[i+1:]...)
+		}
+	}
+	return nil, nil
+}
+
+const defaultConsulAddr = "http://127.0.0.1:8500"
+
+// configOptions are the flags that locate and verify the config. Subcommands
+// that only read the config use them on their own.
+type configOptions struct {
+	configPath string
+	sig        config.SignatureCheck
+}
+
+func (o *configOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.configPath, "config", "", "path to configuration file (required)")
+	fs.StringVar(&o.sig.Mode, "require-signature", "", "refuse configs without a valid detached signature: gpg, ssh or cosign")
+	fs.StringVar(&o.sig.Signature, "signature", "", "signature file (default: config path plus .asc for gpg, .sig otherwise)")
+	fs.StringVar(&o.sig.Key, "signature-key", "", "gpg keyring, ssh allowed_signers file or cosign public key")
+}
+
+func (o *configOptions) load() (*config.Config, error) {
+	if o.configPath == "" {
+		return nil, fmt.Errorf("-config is required")
+	}
+	return config.Load(o.configPath, o.sig)
+}
+
+// options are the flags shared by every subcommand that talks to Consul.
+type options struct {
+	configOptions
+	consulAddr   string
+	consulClient string
+	proxy        string
+	consistency  string
+	datacenter   string
+	rateLimit    float64
+	debug        bool
+	statePath    string
+	showSecrets  bool
+	showVersion  bool
+	strict       bool
+	checkOIDC    bool
+	validate     bool
+	policyCheck  string
+	profile      bool
+	progress     string
+	runRecord    string
+
+	// replicationCheck and maxReplicationLag tune the preflight of plans
+	// against a -datacenter.
+	replicationCheck  string
+	maxReplicationLag time.Duration
+
+	// commit is the Git commit the config was checked out at, set by
+	// reconcile rather than a flag.
+	commit string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	o.configOptions.register(fs)
+	o.registerConnection(fs)
+	fs.StringVar(&o.statePath, "state", "", "state file recording resources found in sync, to skip unchanged ones on the next run")
+	fs.BoolVar(&o.showSecrets, "show-secrets", false, "print token SecretIDs and auth method credentials instead of redacting them")
+	fs.StringVar(&o.progress, "progress", "auto", "show how far planning, applying and verifying are on stderr: auto (phases of 100 resources or more), bar (every phase, with a bar) or off")
+	fs.BoolVar(&o.profile, "profile", false, "print the number and time of Consul requests by endpoint to stderr when the run ends")
+	fs.StringVar(&o.runRecord, "run-record", "", "when the run ends, append a one-line JSON record of it (command, changes, exit code, duration, plan hash) to this file, or - for stderr")
+	fs.BoolVar(&o.strict, "strict", false, "fail the plan when a token references a policy neither the config nor Consul defines (also strict: true in the config)")
+	fs.BoolVar(&o.checkOIDC, "check-oidc", false, "before planning, fetch the discovery document of each oidc auth method and check it names the configured issuer")
+	fs.BoolVar(&o.validate, "validate-rules", false, "after planning, have Consul check the rules of each created or changed policy by writing and deleting a scratch policy (needs acl = \"write\")")
+	fs.StringVar(&o.policyCheck, "policy-check", "", "after planning, evaluate the plan against the Rego policies in this directory with opa and fail on their deny rules (package "+policyCheckPackage+")")
+	fs.BoolVar(&o.showVersion, "version", false, "print version and exit")
+}
+
+// registerConnection registers the flags that say how to reach Consul.
+func (o *options) registerConnection(fs *flag.FlagSet) {
+	fs.StringVar(&o.consulAddr, "consul-addr", defaultConsulAddr, "Consul HTTP API address")
+	fs.StringVar(&o.consulClient, "consul-client", "http", "Consul client: http (built in) or api (hashicorp/consul/api, needs the consulapi build tag)")
+	fs.StringVar(&o.proxy, "proxy", "", "proxy URL (http, https or socks5) for Consul requests, instead of HTTP_PROXY/HTTPS_PROXY/NO_PROXY")
+	fs.StringVar(&o.consistency, "consistency", "", "consistency mode of reads: default, consistent or stale (overrides consul.consistency in the config)")
+	fs.StringVar(&o.datacenter, "datacenter", os.Getenv("CONSUL_DATACENTER"), "datacenter to send every request to, through the local agent (default: $CONSUL_DATACENTER, else the agent's own)")
+	fs.StringVar(&o.replicationCheck, "replication-check", "warn", "with -datacenter, what a plan does when the datacenter's ACL replication is off, failing or lagging: warn, fail or off")
+	fs.DurationVar(&o.maxReplicationLag, "max-replication-lag", 15*time.Minute, "with -datacenter, how long since the last successful ACL replication round counts as lagging (0: never)")
+	fs.Float64Var(&o.rateLimit, "rate-limit", 0, "maximum Consul requests a second (overrides consul.rate_limit in the config; 0: use the config)")
+	fs.BoolVar(&o.debug, "debug", false, "print debug messages to stderr")
+}
+
+// session is everything a subcommand needs once the config is loaded.
+type session struct {
+	command    string
+	started    time.Time
+	configPath string
+	consulAddr string
+	commit     string
+	datacenter string
+	cfg        *config.Config
+	store      secrets.Store
+	red        *secrets.Redactor
+	state      *diff.State
+	client     consul.API
+	kv         consul.KV
+	tracer     *trace.Tracer
+
+	// Preflight of plans against a -datacenter.
+	replicationCheck  string
+	maxReplicationLag time.Duration
+
+	// strict fails plans on references nothing defines.
+	strict bool
+
+	// checkOIDCDiscovery fetches the discovery documents of oidc auth
+	// methods before planning.
+	checkOIDCDiscovery bool
+
+	// validateRulesInConsul has Consul check the rules of changed policies
+	// after planning.
+	validateRulesInConsul bool
+
+	// policyCheck is the directory of Rego policies plans are checked
+	// against.
+	policyCheck string
+
+	// readOnly marks a plan with a token that cannot write ACLs, which then
+	// writes nothing to Consul. debug prints -debug messages.
+	readOnly bool
+	debug    bool
+
+	// Requests sent to Consul, summed up when the run ends, and the meter
+	// of the long phases.
+	stats     *consul.Stats
+	profile   bool
+	progress  *progressMeter
+	runRecord string
+
+	// Outcome of the run, for metrics.
+	lastPlan *diff.Plan
+	applied  int
+}
+
+// open loads the config, resolves secrets and connects to Consul. command
+// names the subcommand in metrics.
+func (o *options) open(command string) (*session, error) {
+	started := time.Now()
+	cfg, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	s, err := o.connect(command, o.configPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.started = started
+	s.printTarget()
+	return s, nil
+}
+
+// connect resolves the secrets of a loaded config and connects to Consul.
+// configPath names the config in records of the run.
+func (o *options) connect(command, configPath string, cfg *config.Config) (*session, error) {
+	store, err := secrets.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("CONSUL_HTTP_TOKEN")
+	if cfg.ManagementTokenPath != "" {
+		if token, err = secrets.ManagementToken(store, cfg.ManagementTokenPath); err != nil {
+			return nil, err
+		}
+	}
+	if store != nil {
+		if err := secrets.Resolve(store, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := discoverKubernetes(cfg); err != nil {
+		return nil, err
+	}
+
+	var state *diff.State
+	if o.statePath != "" {
+		if state, err = diff.LoadState(o.statePath); err != nil {
+			return nil, err
+		}
+		state.Encryption = cfg.Encryption
+	}
+
+	requestID, err := secrets.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	clientOpts := consul.Options{
+		Headers:     make(http.Header),
+		UserAgent:   "consul-acl-sync/" + version,
+		RequestID:   requestID,
+		Consistency: cfg.Consul.Consistency,
+		RateLimit:   cfg.Consul.RateLimit,
+		Datacenter:  o.datacenter,
+		Partitions:  cfg.Partitions(),
+		// A plan or apply stops at its first error anyway; this ends runs
+		// that carry on past failed requests once Consul is clearly gone.
+		FailureThreshold: 5,
+	}
+	if clientOpts.Marker, err = descriptionMarker(cfg.DescriptionMarker, o.commit, configPath); err != nil {
+		return nil, err
+	}
+	if o.rateLimit < 0 {
+		return nil, fmt.Errorf("-rate-limit cannot be negative")
+	} else if o.rateLimit > 0 {
+		clientOpts.RateLimit = o.rateLimit
+	}
+	if o.debug {
+		clientOpts.Logf = debugf
+	}
+	progress, err := newProgressMeter(o.progress)
+	if err != nil {
+		return nil, err
+	}
+	if o.replicationCheck != "warn" && o.replicationCheck != "fail" && o.replicationCheck != "off" {
+		return nil, fmt.Errorf("unknown -replication-check %q (want warn, fail or off)", o.replicationCheck)
+	}
+	if o.consistency != "" {
+		if !consul.ValidConsistency(o.consistency) {
+			return nil, fmt.Errorf("unknown -consistency %q (want default, consistent or stale)", o.consistency)
+		}
+		clientOpts.Consistency = o.consistency
+	}
+	for name, value := range cfg.Consul.Headers {
+		clientOpts.Headers.Set(name, value)
+	}
+	// Header values from the environment are credentials, so they are
+	// redacted like the Consul token.
+	redacted := []string{token, os.Getenv("VAULT_TOKEN")}
+	for name, env := range cfg.Consul.HeadersEnv {
+		value := os.Getenv(env)
+		if value == "" {
+			return nil, fmt.Errorf("consul header %s: environment variable %s is not set", name, env)
+		}
+		clientOpts.Headers.Set(name, value)
+		redacted = append(redacted, value)
+	}
+	if o.proxy != "" {
+		u, err := url.Parse(o.proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			return nil, fmt.Errorf("invalid -proxy %q: want an http, https or socks5 URL", o.proxy)
+		}
+		clientOpts.Proxy = u
+	}
+
+	consulAddr := o.consulAddr
+	tracer := trace.New(version)
+	stats := &consul.Stats{}
+	var client interface {
+		consul.API
+		consul.KV
+	}
+	switch o.consulClient {
+	case "http":
+		c := consul.NewClientWithOptions(o.consulAddr, token, clientOpts)
+		c.Tracer, c.Stats = tracer, stats
+		client = c
+	case "api":
+		// Leave the address to CONSUL_HTTP_ADDR unless -consul-addr was
+		// changed, like the consul CLI.
+		addr := o.consulAddr
+		if addr == defaultConsulAddr {
+			addr = ""
+			if env := os.Getenv("CONSUL_HTTP_ADDR"); env != "" {
+				consulAddr = env
+			}
+		}
+		c, err := consul.NewOfficialClient(addr, token, clientOpts)
+		if err != nil {
+			return nil, err
+		}
+		c.Tracer, c.Stats = tracer, stats
+		client = c
+	default:
+		return nil, fmt.Errorf("unknown -consul-client %q", o.consulClient)
+	}
+	// Lists span the partitions of the config, and those it declares may
+	// not exist yet; listing partitions keeps the client off the missing.
+	if len(cfg.AdminPartitions) > 0 {
+		if _, err := client.ListPartitions(); err != nil {
+			return nil, fmt.Errorf("failed to list partitions: %w", err)
+		}
+	}
+
+	return &session{
+		command:    command,
+		started:    time.Now(),
+		configPath: configPath,
+		consulAddr: consulAddr,
+		commit:     o.commit,
+		datacenter: o.datacenter,
+		cfg:        cfg,
+		store:      store,
+		red:        secrets.NewRedactor(cfg, o.showSecrets, redacted...),
+		state:      state,
+		client:     client,
+		kv:         client,
+		tracer:     tracer,
+
+		replicationCheck:  o.replicationCheck,
+		maxReplicationLag: o.maxReplicationLag,
+
+		strict: o.strict || cfg.Strict,
+
+		checkOIDCDiscovery:    o.checkOIDC,
+		validateRulesInConsul: o.validate,
+		policyCheck:           o.policyCheck,
+
+		debug: o.debug,
+
+		stats:     stats,
+		profile:   o.profile,
+		progress:  progress,
+		runRecord: o.runRecord,
+	}, nil
+}
+
+// close prints the Consul requests of the run and exports its traces and
+// metrics. It records the run in the run history and -run-record, with runErr
+// as its outcome. Losing telemetry or history must not fail the run.
+func (s *session) close(runErr error) {
+	s.progress.clear()
+	s.printStats()
+	if err := s.tracer.Export(); err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", s.red.String(err.Error()))
+	}
+	if s.runRecord != "" {
+		if err := s.writeRunRecord(s.runRecord, runErr); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: -run-record:", s.red.String(err.Error()))
+		}
+	}
+	if historyCommands[s.command] && !s.readOnly {
+		if err := writeHistory(s.cfg.History, s.kv, s.command, s.configPath, s.lastPlan, s.applied, runErr); err != nil {
+			fmt.Fprintln(os.Stderr, "warning:", s.red.String(err.Error()))
+		}
+	}
+	if !meteredCommands[s.command] {
+		return
+	}
+	m := runMetrics{
+		command:  s.command,
+		duration: time.Since(s.started),
+		plan:     s.lastPlan,
+		applied:  s.applied,
+		failed:   runErr != nil,
+	}
+	if err := pushMetrics(s.cfg.Metrics, m); err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", s.red.String(err.Error()))
+	}
+}
+
+// printTarget says which config a plan or apply runs and against which
+// Consul, on stderr like printStats, so a run's log names them.
+func (s *session) printTarget() {
+	verb := map[string]string{"plan": "Planning", "apply": "Applying"}[s.command]
+	if verb == "" {
+		return
+	}
+	target := s.consulAddr
+	if s.datacenter != "" {
+		target += ", datacenter " + s.datacenter
+	}
+	fmt.Fprintf(os.Stderr, "%s %s against %s.\n", verb, s.configPath, target)
+}
+
+// printStats sums up the requests sent to Consul after a plan or apply, and
+// after any run with -profile, which breaks them down by endpoint. It goes to
+// stderr to keep the plan output clean.
+func (s *session) printStats() {
+	if !s.profile && s.command != "plan" && s.command != "apply" {
+		return
+	}
+	n, total := s.stats.Requests()
+	fmt.Fprintf(os.Stderr, "Consul: %d requests, %s in requests; run took %s.\n", n, total.Round(time.Millisecond), time.Since(s.started).Round(time.Millisecond))
+	if !s.profile {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "requests\terrors\ttotal\tmax\t\tendpoint")
+	for _, e := range s.stats.Endpoints() {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t\t%s\n", e.Requests, e.Errors, e.Total.Round(time.Millisecond), e.Max.Round(time.Millisecond), e.Endpoint)
+	}
+	w.Flush()
+}
+
+// plan calculates the plan and saves the state. Only resources found in sync
+// are recorded, so the state is valid whether or not an apply follows.
+func (s *session) plan(statePath string) (*diff.Plan, error) {
+	if err := s.checkAccess(); err != nil {
+		return nil, err
+	}
+	if err := s.checkReplication(); err != nil {
+		return nil, err
+	}
+	if err := runHooks("pre_plan", s.cfg.Hooks.PrePlan, s.configPath, nil, ""); err != nil {
+		return nil, err
+	}
+	if err := s.checkReferences(); err != nil {
+		return nil, err
+	}
+	s.warnLegacyRules()
+	if err := s.checkOIDC(); err != nil {
+		return nil, err
+	}
+	plan, err := diff.Calculate(s.client, s.cfg, s.state, s.progress.status())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validateRules(plan); err != nil {
+		return nil, err
+	}
+	if err := s.checkPolicies(plan); err != nil {
+		return nil, err
+	}
+	plan.Datacenter = s.datacenter
+	plan.ShowSecrets = s.red.Shows()
+	s.lastPlan = plan
+	if s.state != nil {
+		if err := s.state.Save(statePath); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// recordSynced fingerprints the live state and saves it in the state file as
+// in sync with the config.
+func (s *session) recordSynced(statePath string) error {
+	live, err := diff.LiveFingerprint(s.client, s.cfg)
+	if err != nil {
+		return err
+	}
+	s.state.RecordSynced(s.cfg, live)
+	return s.state.Save(statePath)
+}
+
+// descriptionMarker renders the description_marker of the config, nil when
+// it has none. The commit is the one reconcile or pr-webhook checked out, or
+// the one a GitHub Actions run is for.
+func descriptionMarker(m config.DescriptionMarker, commit, configPath string) (*consul.Marker, error) {
+	if m.Prefix == "" && m.Suffix == "" {
+		return nil, nil
+	}
+	if commit == "" {
+		commit = os.Getenv("GITHUB_SHA")
+	}
+	prefix, suffix, err := m.Render(config.MarkerData{Commit: commit, Config: configPath})
+	if err != nil {
+		return nil, err
+	}
+	prefixPattern, suffixPattern, err := m.Patterns()
+	if err != nil {
+		return nil, err
+	}
+	return &consul.Marker{Prefix: prefix, Suffix: suffix, PrefixPattern: prefixPattern, SuffixPattern: suffixPattern}, nil
+}
+
+// debugf prints a -debug message to stderr.
+func debugf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "debug: "+format+"\n", args...)
+}
+
+func printVersion() {
+	fmt.Printf("consul-acl-sync %s (commit %s, built %s)\n", version, commit, date)
+}
+
+// planCommand prints the changes an apply would make, without making them.
+func planCommand(fs *flag.FlagSet) func([]string) error {
 	var (
-		configPath  string
-		consulAddr  string
-		showVersion bool
+		opts        options
+		ui          bool
+		output      string
+		refreshOnly bool
+		requests    bool
+		diffStyle   string
+		noPager     bool
+		summary     bool
 	)
-	flag.StringVar(&configPath, "config", "", "path to configuration file (required)")
-	flag.StringVar(&consulAddr, "consul-addr", "http://127.0.0.1:8500", "Consul HTTP API address")
-	flag.BoolVar(&showVersion, "version", false, "print version and exit")
-	flag.Parse()
+	opts.register(fs)
+	fs.BoolVar(&ui, "ui", false, "review the plan in an interactive terminal UI")
+	fs.StringVar(&output, "output", "text", "plan format: text, markdown or json (versioned, see pkg/diff/plan.schema.json)")
+	fs.BoolVar(&summary, "summary", false, "print only the number of changes per resource type and action")
+	fs.StringVar(&diffStyle, "diff-style", "unified", "how text output shows rule changes: unified or side-by-side, in columns as wide as $COLUMNS or the terminal")
+	fs.BoolVar(&noPager, "no-pager", false, "do not page a plan taller than the terminal through $PAGER")
+	fs.BoolVar(&refreshOnly, "refresh-only", false, "instead of planning, report the resources changed or deleted in Consul since the state recorded them in sync (needs -state)")
+	fs.BoolVar(&requests, "show-requests", false, "also list the requests apply would send to Consul, with their bodies, secrets redacted")
+	return func(args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %q", args)
+		}
+		return runPlan(&opts, ui, output, diffStyle, noPager, summary, refreshOnly, requests)
+	}
+}
+
+func runPlan(opts *options, ui bool, output, diffStyle string, noPager, summary, refreshOnly, showRequests bool) (err error) {
+	if opts.showVersion {
+		printVersion()
+		return nil
+	}
+	if output != "text" && output != "markdown" && output != "json" {
+		return fmt.Errorf("unknown -output %q (want text, markdown or json)", output)
+	}
+	if diffStyle != "unified" && diffStyle != "side-by-side" {
+		return fmt.Errorf("unknown -diff-style %q (want unified or side-by-side)", diffStyle)
+	}
+	if diffStyle == "side-by-side" && (ui || output != "text") {
+		return fmt.Errorf("-diff-style side-by-side is for text output")
+	}
+	if summary && (ui || refreshOnly || showRequests || diffStyle != "unified") {
+		return fmt.Errorf("-summary cannot be combined with -ui, -refresh-only, -show-requests or -diff-style")
+	}
+	if refreshOnly && opts.statePath == "" {
+		return fmt.Errorf("-refresh-only needs -state")
+	}
+	if refreshOnly && (ui || output != "text") {
+		return fmt.Errorf("-refresh-only prints text only")
+	}
+	if showRequests && (ui || refreshOnly) {
+		return fmt.Errorf("-show-requests cannot be combined with -ui or -refresh-only")
+	}
+	if output == "json" && (ui || summary || showRequests) {
+		return fmt.Errorf("-output json cannot be combined with -ui, -summary or -show-requests")
+	}
+
+	s, err := opts.open("plan")
+	if err != nil {
+		return err
+	}
+	defer func() { s.close(err) }()
+	defer func() { err = s.red.Error(err) }()
 
-	if showVersion {
-		fmt.Printf("consul-acl-sync %s (commit %s, built %s)\n", version, commit, date)
+	if refreshOnly {
+		drift, err := diff.Drift(s.client, s.cfg, s.state)
+		if err != nil {
+			return err
+		}
+		diff.PrintDrift(os.Stdout, drift)
 		return nil
 	}
 
-	if configPath == "" {
-		return fmt.Errorf("-config is required")
+	plan, err := s.plan(opts.statePath)
+	if err != nil {
+		return err
+	}
+	if err := detectGitHubActions().reportPlan(plan); err != nil {
+		return err
+	}
+	if diffStyle == "side-by-side" {
+		plan.SideBySide = outputWidth()
+	}
+	if ui {
+		return reviewPlan(plan)
+	}
+	var out bytes.Buffer
+	switch {
+	case summary && output == "markdown":
+		diff.PrintMarkdownSummary(&out, plan)
+	case summary:
+		diff.PrintSummary(&out, plan)
+	case output == "markdown":
+		diff.PrintMarkdown(&out, plan)
+	case output == "json":
+		if err := diff.PrintJSON(&out, plan); err != nil {
+			return err
+		}
+	default:
+		diff.PrintText(&out, plan)
+	}
+	if showRequests {
+		requests, err := s.previewRequests(plan)
+		if err != nil {
+			return err
+		}
+		s.printRequests(&out, requests, output == "markdown")
+	}
+	return page(out.Bytes(), noPager)
+}
+
+func applyCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts             options
+		k8sSecrets       string
+		verify           bool
+		confirmThreshold int
+		skipUnchanged    bool
+		parallelism      int
+		replace          listFlag
+		autoApprove      bool
+		input            bool
+	)
+	opts.register(fs)
+	fs.StringVar(&k8sSecrets, "kubernetes-secrets", "", "write Kubernetes Secret manifests for created tokens to this file")
+	fs.BoolVar(&verify, "verify", true, "re-read changed resources after apply and check they match the config")
+	fs.IntVar(&confirmThreshold, "confirm-threshold", 0, "ask for the number of changes to be typed before applying a plan with more than this many token changes (0: only for plans that delete and recreate tokens)")
+	fs.BoolVar(&autoApprove, "auto-approve", false, "apply without asking for confirmation, even over -confirm-threshold or with tokens to recreate (also "+autoApproveEnv+"=true)")
+	fs.BoolVar(&input, "input", true, "ask for confirmation when one is needed; with -input=false such an apply fails instead (also "+inputEnv+"=false)")
+	fs.BoolVar(&skipUnchanged, "skip-unchanged", false, "exit without planning when neither the config nor any policy or token in Consul changed since the last successful run (needs -state)")
+	fs.Var(&replace, "replace", "delete and recreate a token even if it is in sync, e.g. to rotate a leaked secret: token:<accessor ID or description> (repeatable)")
+	fs.IntVar(&parallelism, "parallelism", 1, "number of changes to apply at once; a token still waits for the policies it references")
+	return func(args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %q", args)
+		}
+		if err := boolFromEnv(fs, "auto-approve", autoApproveEnv, &autoApprove); err != nil {
+			return err
+		}
+		if err := boolFromEnv(fs, "input", inputEnv, &input); err != nil {
+			return err
+		}
+		var stdin io.Reader = os.Stdin
+		if !input {
+			stdin = nil
+		}
+		return runApply(&opts, stdin, k8sSecrets, verify, confirmThreshold, autoApprove, skipUnchanged, parallelism, replace)
+	}
+}
+
+func runApply(opts *options, stdin io.Reader, k8sSecrets string, verify bool, confirmThreshold int, autoApprove, skipUnchanged bool, parallelism int, replace []string) (err error) {
+	if opts.showVersion {
+		printVersion()
+		return nil
+	}
+	if parallelism < 1 {
+		return fmt.Errorf("-parallelism must be at least 1")
+	}
+	if skipUnchanged && opts.statePath == "" {
+		return fmt.Errorf("-skip-unchanged needs -state")
 	}
 
-	cfg, err := LoadConfig(configPath)
+	s, err := opts.open("apply")
 	if err != nil {
 		return err
 	}
+	defer func() { s.close(err) }()
+	defer func() { err = s.red.Error(err) }()
 
-	client := NewConsulClient(consulAddr, os.Getenv("CONSUL_HTTP_TOKEN"))
-	plan, err := CalculatePlan(client, cfg)
+	if skipUnchanged {
+		live, err := diff.LiveFingerprint(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		if s.state.Unchanged(s.cfg, live) {
+			fmt.Println("No changes since the last run. Consul is up to date.")
+			return nil
+		}
+	}
+
+	replacing, err := replaceTargets(s.cfg, replace)
+	if err != nil {
+		return err
+	}
+	plan, err := s.plan(opts.statePath)
 	if err != nil {
 		return err
 	}
+	if err := s.replace(plan, replacing); err != nil {
+		return err
+	}
+	if !autoApprove {
+		if err := confirmPlan(stdin, os.Stderr, plan, confirmThreshold); err != nil {
+			return err
+		}
+	}
+	if err := s.backupBeforeApply(plan, "pre-apply"); err != nil {
+		return err
+	}
+
+	applyErr := s.apply(plan, k8sSecrets, verify, parallelism)
+	if plan.HasChanges() {
+		if err := writeAudit(s.cfg.Audit, s.kv, opts.configPath, s.commit, plan, s.red.Error(applyErr)); err != nil && applyErr == nil {
+			return err
+		}
+		outcome := "success"
+		if applyErr != nil {
+			outcome = "failure"
+		}
+		if err := runHooks("post_apply", s.cfg.Hooks.PostApply, opts.configPath, plan, outcome); err != nil && applyErr == nil {
+			return err
+		}
+	}
+	if err := detectGitHubActions().reportApply(plan, s.red.Error(applyErr)); err != nil && applyErr == nil {
+		return err
+	}
+	if err := notify(s.cfg.Notifications, newRunReport(opts.configPath, plan, s.red.Error(applyErr))); err != nil {
+		// The apply itself is done; a lost notification must not fail it.
+		fmt.Fprintln(os.Stderr, "warning:", s.red.String(err.Error()))
+	}
+	if applyErr == nil && skipUnchanged {
+		// Fingerprint after the apply, which changed the Hashes it touched.
+		return s.recordSynced(opts.statePath)
+	}
+	return applyErr
+}
 
+// apply applies and verifies the plan and writes the outputs of the tokens
+// it created.
+func (s *session) apply(plan *diff.Plan, k8sSecrets string, verify bool, parallelism int) error {
 	if !plan.HasChanges() {
 		fmt.Println("No changes. Consul is up to date.")
 		return nil
 	}
+	if err := runHooks("pre_apply", s.cfg.Hooks.PreApply, s.configPath, plan, ""); err != nil {
+		return err
+	}
 
-	if err := Apply(client, plan); err != nil {
+	applied, err := apply.Apply(s.client, s.store, s.red, plan, parallelism, s.progress.lines())
+	s.applied = len(applied)
+	// The next run plans nothing for the tokens this one created, replaced
+	// ones included, so their Secrets are written even when the apply failed
+	// partway, and before verifying, which may fail.
+	if created := createdTokens(plan, applied); k8sSecrets != "" && len(created) > 0 {
+		if werr := writeKubernetesSecrets(k8sSecrets, created, s.cfg.Encryption); werr != nil {
+			return errors.Join(err, werr)
+		}
+	}
+	if err != nil {
 		return err
 	}
+	if verify {
+		fmt.Fprint(os.Stderr, "verifying... ")
+		if err := apply.Verify(s.client, plan, s.progress.status()); err != nil {
+			fmt.Fprintln(os.Stderr, "failed")
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "ok")
+	}
 
-	fmt.Printf("\nApplied: policies %d created, %d updated; tokens %d created, %d updated.\n",
-		len(plan.PoliciesToCreate), len(plan.PoliciesToUpdate),
-		len(plan.TokensToCreate), len(plan.TokensToUpdate))
+	replaced := ""
+	if n := len(plan.TokensToReplace); n > 0 {
+		replaced = fmt.Sprintf(", %d replaced", n)
+	}
+	roles := ""
+	if n := len(plan.RolesToCreate) + len(plan.RolesToUpdate); n > 0 {
+		roles = fmt.Sprintf("; roles %d created, %d updated", len(plan.RolesToCreate), len(plan.RolesToUpdate))
+	}
+	methods := ""
+	if n := len(plan.AuthMethodsToCreate) + len(plan.AuthMethodsToUpdate); n > 0 {
+		methods = fmt.Sprintf("; auth methods %d created, %d updated", len(plan.AuthMethodsToCreate), len(plan.AuthMethodsToUpdate))
+	}
+	tenants := ""
+	if n := len(plan.PartitionsToCreate) + len(plan.PartitionsToUpdate); n > 0 {
+		tenants = fmt.Sprintf("partitions %d created, %d updated; ", len(plan.PartitionsToCreate), len(plan.PartitionsToUpdate))
+	}
+	if n := len(plan.NamespacesToCreate) + len(plan.NamespacesToUpdate); n > 0 {
+		tenants += fmt.Sprintf("namespaces %d created, %d updated; ", len(plan.NamespacesToCreate), len(plan.NamespacesToUpdate))
+	}
+	fmt.Printf("\nApplied: %spolicies %d created, %d updated%s; tokens %d created, %d updated%s%s.\n",
+		tenants, len(plan.PoliciesToCreate), len(plan.PoliciesToUpdate), roles,
+		len(plan.TokensToCreate), len(plan.TokensToUpdate), replaced, methods)
 	return nil
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+)
+
+func TestCommandAfterFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCmd  string // "" when no subcommand is found
+		wantArgs []string
+	}{
+		{"flag value then command", []string{"-config", "c.yaml", "plan"}, "plan", []string{"-config", "c.yaml"}},
+		{"flag=value then command", []string{"-config=c.yaml", "plan"}, "plan", []string{"-config=c.yaml"}},
+		{"flags after the command too", []string{"-config", "c.yaml", "apply", "-parallelism", "4"}, "apply", []string{"-config", "c.yaml", "-parallelism", "4"}},
+		{"bool flag then command", []string{"-strict", "-config", "c.yaml", "plan"}, "plan", []string{"-strict", "-config", "c.yaml"}},
+		{"bool flag with value", []string{"-auto-approve=true", "-config", "c.yaml", "apply"}, "apply", []string{"-auto-approve=true", "-config", "c.yaml"}},
+		{"flag value named like a command", []string{"-config", "plan"}, "", nil},
+		{"flag of another command", []string{"-ui", "-config", "c.yaml", "apply"}, "", nil},
+		{"after --", []string{"-config", "c.yaml", "--", "plan"}, "", nil},
+		{"no command", []string{"-config", "c.yaml"}, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, args := commandAfterFlags(tt.args)
+			got := ""
+			if c != nil {
+				got = c.name
+			}
+			if got != tt.wantCmd || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("commandAfterFlags(%q) = %q %q, want %q %q", tt.args, got, args, tt.wantCmd, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestRunRejectsStrayArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"plan", []string{"plan", "-config", "c.yaml", "extra"}},
+		{"apply", []string{"apply", "-config", "c.yaml", "extra"}},
+		{"flags before plan", []string{"-config", "c.yaml", "plan", "extra"}},
+		{"flags before apply", []string{"-config=c.yaml", "apply", "extra"}},
+		{"default apply", []string{"-config", "c.yaml", "extra"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := run(tt.args)
+			if err == nil || !strings.Contains(err.Error(), `unexpected arguments ["extra"]`) {
+				t.Errorf("run(%q) = %v, want an unexpected arguments error", tt.args, err)
+			}
+		})
+	}
+}
+
+// captureOutput returns what f writes to stdout and stderr.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestSecretsRedacted(t *testing.T) {
+	const (
+		tokenSecret  = "9f1c7d00-0000-4000-8000-00000000beef"
+		clientSecret = "oidc-client-secret-value"
+	)
+	srv := consultest.NewServer(t)
+	// Consul echoes the secret of the token it refuses, as some errors do.
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/v1/acl/token" {
+			http.Error(w, "Invalid SecretID "+tokenSecret, http.StatusBadRequest)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer consul.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	err = os.WriteFile(path, []byte(`
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: `+tokenSecret+`
+    description: web
+auth_methods:
+  - name: sso
+    type: oidc
+    config:
+      OIDCDiscoveryURL: https://sso.example.com
+      OIDCClientID: consul
+      OIDCClientSecret: `+clientSecret+`
+      AllowedRedirectURIs: [http://localhost:8550/oidc/callback]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONSUL_HTTP_TOKEN", "")
+	// A failed trace export names the endpoint, here one holding a secret.
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://127.0.0.1:1/v1/traces?key="+clientSecret)
+	base := []string{"-config", path, "-consul-addr", consul.URL}
+
+	for _, tt := range []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"plan", append([]string{"plan"}, base...), false},
+		{"plan json", append([]string{"plan", "-output=json"}, base...), false},
+		{"plan markdown", append([]string{"plan", "-output=markdown"}, base...), false},
+		{"apply", append([]string{"apply", "-auto-approve"}, base...), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var runErr error
+			out := captureOutput(t, func() { runErr = run(tt.args) })
+			if (runErr != nil) != tt.wantErr {
+				t.Fatalf("run = %v, want error %v", runErr, tt.wantErr)
+			}
+			if runErr != nil {
+				out += runErr.Error()
+			}
+			for _, secret := range []string{tokenSecret, clientSecret} {
+				if strings.Contains(out, secret) {
+					t.Errorf("output contains the secret %q:\n%s", secret, out)
+				}
+			}
+			if !strings.Contains(out, "<redacted>") {
+				t.Errorf("output does not show <redacted>:\n%s", out)
+			}
+		})
+	}
+
+	// -show-secrets shows the auth method's credential in the plan.
+	out := captureOutput(t, func() {
+		if err := run(append([]string{"plan", "-show-secrets"}, base...)); err != nil {
+			t.Error(err)
+		}
+	})
+	if !strings.Contains(out, "config.OIDCClientSecret: "+`"`+clientSecret+`"`) {
+		t.Errorf("plan -show-secrets does not show the client secret:\n%s", out)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// meteredCommands push run metrics. Read-only inspection commands are run by
+// hand and would only add noise to dashboards built around scheduled syncs.
+var meteredCommands = map[string]bool{"plan": true, "apply": true}
+
+// runMetrics is what one run reports.
+type runMetrics struct {
+	command  string
+	duration time.Duration
+	plan     *diff.Plan // nil when the run failed before planning
+	applied  int
+	failed   bool
+}
+
+// pushMetrics sends m to the configured sinks.
+func pushMetrics(cfg config.MetricsConfig, m runMetrics) error {
+	if cfg.Pushgateway != "" {
+		if err := pushGateway(cfg, m); err != nil {
+			return err
+		}
+	}
+	if cfg.StatsD != "" {
+		if err := pushStatsD(cfg, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// driftCounts is the number of planned changes per resource type and action.
+func (m runMetrics) driftCounts() [][3]string {
+	if m.plan == nil {
+		return nil
+	}
+	return [][3]string{
+		{"policy", "create", fmt.Sprint(len(m.plan.PoliciesToCreate))},
+		{"policy", "update", fmt.Sprint(len(m.plan.PoliciesToUpdate))},
+		{"role", "create", fmt.Sprint(len(m.plan.RolesToCreate))},
+		{"role", "update", fmt.Sprint(len(m.plan.RolesToUpdate))},
+		{"token", "create", fmt.Sprint(len(m.plan.TokensToCreate))},
+		{"token", "update", fmt.Sprint(len(m.plan.TokensToUpdate))},
+		{"auth-method", "create", fmt.Sprint(len(m.plan.AuthMethodsToCreate))},
+		{"auth-method", "update", fmt.Sprint(len(m.plan.AuthMethodsToUpdate))},
+		{"partition", "create", fmt.Sprint(len(m.plan.PartitionsToCreate))},
+		{"partition", "update", fmt.Sprint(len(m.plan.PartitionsToUpdate))},
+		{"namespace", "create", fmt.Sprint(len(m.plan.NamespacesToCreate))},
+		{"namespace", "update", fmt.Sprint(len(m.plan.NamespacesToUpdate))},
+	}
+}
+
+func pushGateway(cfg config.MetricsConfig, m runMetrics) error {
+	job := cfg.Job
+	if job == "" {
+		job = "consul-acl-sync"
+	}
+	success := 1
+	if m.failed {
+		success = 0
+	}
+
+	var b strings.Builder
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	gauge("consul_acl_sync_last_run_timestamp_seconds", "When the last run finished.", time.Now().Unix())
+	gauge("consul_acl_sync_last_run_duration_seconds", "How long the last run took.", m.duration.Seconds())
+	gauge("consul_acl_sync_last_run_success", "Whether the last run succeeded.", success)
+	gauge("consul_acl_sync_last_run_changes_applied", "Changes the last run applied.", m.applied)
+	if counts := m.driftCounts(); counts != nil {
+		b.WriteString("# HELP consul_acl_sync_last_run_drift Changes the last run planned.\n")
+		b.WriteString("# TYPE consul_acl_sync_last_run_drift gauge\n")
+		for _, c := range counts {
+			fmt.Fprintf(&b, "consul_acl_sync_last_run_drift{type=%q,action=%q} %s\n", c[0], c[1], c[2])
+		}
+	}
+
+	u := strings.TrimRight(cfg.Pushgateway, "/") + "/metrics/job/" + url.PathEscape(job) + "/command/" + url.PathEscape(m.command)
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewBufferString(b.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to push metrics: pushgateway returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func pushStatsD(cfg config.MetricsConfig, m runMetrics) error {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "consul_acl_sync"
+	}
+	prefix += "." + m.command
+
+	lines := []string{
+		fmt.Sprintf("%s.duration:%d|ms", prefix, m.duration.Milliseconds()),
+		fmt.Sprintf("%s.runs:1|c", prefix),
+		fmt.Sprintf("%s.changes_applied:%d|c", prefix, m.applied),
+	}
+	if m.failed {
+		lines = append(lines, prefix+".failures:1|c")
+	}
+	for _, c := range m.driftCounts() {
+		lines = append(lines, fmt.Sprintf("%s.drift.%s.%s:%s|g", prefix, c[0], c[1], c[2]))
+	}
+
+	conn, err := net.Dial("udp", cfg.StatsD)
+	if err != nil {
+		return fmt.Errorf("failed to send metrics: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		return fmt.Errorf("failed to send metrics: %w", err)
+	}
+	return nil
+}
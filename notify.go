@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// runReport is the apply outcome sent to notification endpoints.
+type runReport struct {
+	Tool     string   `json:"tool"`
+	Version  string   `json:"version"`
+	Operator string   `json:"operator"`
+	Config   string   `json:"config"`
+	Outcome  string   `json:"outcome"`
+	Error    string   `json:"error,omitempty"`
+	Summary  string   `json:"summary"`
+	Changes  []string `json:"changes"`
+}
+
+func newRunReport(configPath string, plan *diff.Plan, applyErr error) runReport {
+	r := runReport{
+		Tool:     "consul-acl-sync",
+		Version:  version,
+		Operator: currentOperator(),
+		Config:   configPath,
+		Outcome:  "success",
+		Summary:  diff.Summary(plan),
+		Changes:  []string{},
+	}
+	for _, item := range diff.Items(plan) {
+		r.Changes = append(r.Changes, item.Title)
+	}
+	switch {
+	case applyErr != nil:
+		r.Outcome = "failure"
+		r.Error = applyErr.Error()
+	case !plan.HasChanges():
+		r.Outcome = "no_changes"
+	}
+	return r
+}
+
+// notify sends the report to every notification subscribed to its outcome.
+// Delivery failures are returned together but never stop at the first one.
+func notify(notifications []config.Notification, report runReport) error {
+	var failed []string
+	client := &http.Client{Timeout: 10 * time.Second}
+	for i, n := range notifications {
+		if !subscribed(n, report.Outcome) {
+			continue
+		}
+		if err := send(client, n, report); err != nil {
+			failed = append(failed, fmt.Sprintf("notification #%d: %v", i+1, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to send notifications: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func subscribed(n config.Notification, outcome string) bool {
+	on := n.On
+	if len(on) == 0 {
+		on = []string{"success", "failure"}
+	}
+	for _, o := range on {
+		if o == outcome {
+			return true
+		}
+	}
+	return false
+}
+
+func notificationURL(n config.Notification) string {
+	if n.URLEnv != "" {
+		return os.Getenv(n.URLEnv)
+	}
+	return n.URL
+}
+
+func send(client *http.Client, n config.Notification, report runReport) error {
+	url := notificationURL(n)
+	if url == "" {
+		return fmt.Errorf("no URL (is %s set?)", n.URLEnv)
+	}
+
+	var payload interface{} = report
+	if n.Type == "slack" || n.Type == "teams" {
+		payload = map[string]string{"text": report.text()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error quotes the URL, which is a credential for chat webhooks.
+		return fmt.Errorf("request failed: %v", strings.ReplaceAll(err.Error(), url, config.Redacted))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// text renders the report as a chat message.
+func (r runReport) text() string {
+	var b strings.Builder
+	switch r.Outcome {
+	case "failure":
+		fmt.Fprintf(&b, "consul-acl-sync apply of %s by %s failed: %s\n", r.Config, r.Operator, r.Error)
+	case "no_changes":
+		fmt.Fprintf(&b, "consul-acl-sync apply of %s by %s: no changes\n", r.Config, r.Operator)
+	default:
+		fmt.Fprintf(&b, "consul-acl-sync apply of %s by %s succeeded\n", r.Config, r.Operator)
+	}
+	if len(r.Changes) > 0 {
+		b.WriteString(r.Summary + "\n")
+		for _, c := range r.Changes {
+			b.WriteString("• " + c + "\n")
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// currentOperator identifies who ran the tool: the CI actor when there is
+// one, otherwise user@host.
+func currentOperator() string {
+	if actor := os.Getenv("GITHUB_ACTOR"); actor != "" {
+		return actor + " (GitHub Actions)"
+	}
+	if u := os.Getenv("GITLAB_USER_LOGIN"); u != "" {
+		return u + " (GitLab CI)"
+	}
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
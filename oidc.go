@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// oidcDiscovery is the part of an OpenID Provider's discovery document a
+// login needs.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// checkOIDC fetches the discovery document of every oidc auth method, as
+// Consul does at login, so a wrong OIDCDiscoveryURL or CA fails the plan
+// rather than the first login. It is only done with -check-oidc, since the
+// provider may not be reachable from where the tool runs.
+func (s *session) checkOIDC() error {
+	if !s.checkOIDCDiscovery {
+		return nil
+	}
+	var errs []error
+	for _, m := range s.cfg.AuthMethods {
+		if m.Type != "oidc" {
+			continue
+		}
+		if err := checkOIDCDiscovery(m); err != nil {
+			errs = append(errs, fmt.Errorf("oidc auth method %s failed the discovery check: %w", m.Key(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkOIDCDiscovery fetches the discovery document of m, trusting only
+// OIDCDiscoveryCACert when it is set, and checks that it names the issuer
+// it was fetched for. Providers behind a mismatched URL, e.g. missing a
+// trailing slash, fail logins with an issuer mismatch.
+func checkOIDCDiscovery(m config.AuthMethod) error {
+	issuer, _ := m.Config["OIDCDiscoveryURL"].(string)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if ca, _ := m.Config["OIDCDiscoveryCACert"].(string); ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return fmt.Errorf("config OIDCDiscoveryCACert holds no PEM certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	var doc oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to decode the discovery document at %s: %w", url, err)
+	}
+	if doc.Issuer != issuer {
+		return fmt.Errorf("the discovery document names issuer %q, not the OIDCDiscoveryURL %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.JWKSURI == "" {
+		return fmt.Errorf("the discovery document at %s has no authorization_endpoint or jwks_uri", url)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// orphanReport lists the live resources the config neither declares nor
+// ignores. Built-in resources are never orphans.
+type orphanReport struct {
+	Policies []orphanPolicy `json:"policies"`
+	Tokens   []orphanToken  `json:"tokens"`
+	Ignored  int            `json:"ignored"`
+	Builtin  int            `json:"builtin"`
+}
+
+type orphanPolicy struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type orphanToken struct {
+	AccessorID  string    `json:"accessor_id"`
+	Description string    `json:"description"`
+	CreateTime  time.Time `json:"create_time"`
+	// AgeDays is whole days since the token was created, or -1 when Consul
+	// did not report a creation time.
+	AgeDays int `json:"age_days"`
+}
+
+func findOrphans(inv *inventory, ignore config.Ignore, now time.Time) orphanReport {
+	r := orphanReport{Policies: []orphanPolicy{}, Tokens: []orphanToken{}}
+	for _, p := range inv.policies {
+		switch {
+		case inv.managedPolicies[p.Name]:
+		case p.Builtin():
+			r.Builtin++
+		case ignore.Policy(p.Name):
+			r.Ignored++
+		default:
+			r.Policies = append(r.Policies, orphanPolicy{ID: p.ID, Name: p.Name})
+		}
+	}
+	for _, t := range inv.tokens {
+		switch {
+		case inv.managedTokens[t.AccessorID]:
+		case t.Builtin():
+			r.Builtin++
+		case ignore.Token(t.AccessorID, t.Description):
+			r.Ignored++
+		default:
+			age := -1
+			if !t.CreateTime.IsZero() {
+				age = int(now.Sub(t.CreateTime).Hours() / 24)
+			}
+			r.Tokens = append(r.Tokens, orphanToken{AccessorID: t.AccessorID, Description: t.Description, CreateTime: t.CreateTime, AgeDays: age})
+		}
+	}
+	return r
+}
+
+// orphansCommand reports live resources that are not in the config. It is
+// read-only: the tool never deletes what the config does not name.
+func orphansCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		output string
+	)
+	opts.register(fs)
+	fs.StringVar(&output, "output", "text", "report format: text or json")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want text or json)", output)
+		}
+		s, err := opts.open("orphans")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		r := findOrphans(inv, s.cfg.Ignore, time.Now())
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(r)
+		}
+		printOrphans(os.Stdout, r)
+		return nil
+	}
+}
+
+func printOrphans(w io.Writer, r orphanReport) {
+	if len(r.Policies) == 0 && len(r.Tokens) == 0 {
+		fmt.Fprintln(w, "No orphans. Every resource in Consul is in the config, ignored or built in.")
+	}
+	if len(r.Policies) > 0 {
+		fmt.Fprintf(w, "Orphaned policies (%d):\n", len(r.Policies))
+		for _, p := range r.Policies {
+			fmt.Fprintf(w, "  %q\n", p.Name)
+		}
+	}
+	if len(r.Tokens) > 0 {
+		if len(r.Policies) > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Orphaned tokens (%d):\n", len(r.Tokens))
+		for _, t := range r.Tokens {
+			label := t.AccessorID
+			if t.Description != "" {
+				label += fmt.Sprintf(" %q", t.Description)
+			}
+			if t.AgeDays >= 0 {
+				label += fmt.Sprintf(", created %s (%d days ago)", t.CreateTime.Format("2006-01-02"), t.AgeDays)
+			}
+			fmt.Fprintf(w, "  %s\n", label)
+		}
+	}
+	fmt.Fprintf(w, "\n%d ignored, %d built-in not shown.\n", r.Ignored, r.Builtin)
+}
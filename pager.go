@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+)
+
+// page writes out to stdout, through a pager when stdout is a terminal that
+// out does not fit in, as git does. The pager is $PAGER, run with sh -c, or
+// less; less gets LESS=FRX unless LESS is set, so it keeps colors and leaves
+// the plan on screen when it quits. Should the pager not be found, out is
+// written as is.
+func page(out []byte, noPager bool) error {
+	pager, set := os.LookupEnv("PAGER")
+	if !set {
+		pager = "less"
+	}
+	rows, _ := terminalSize()
+	if noPager || !isTerminal(os.Stdout) || pager == "" || pager == "cat" || bytes.Count(out, []byte("\n")) < rows {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = bytes.NewReader(out)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); err != nil && (!ok || exit.ExitCode() == 127) {
+		// sh did not start, or did not find the pager.
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	// Quitting the pager early is not a failure of the plan.
+	return nil
+}
@@ -0,0 +1,54 @@
+package acl
+
+import "strings"
+
+// precedence orders policies the way Consul merges them when several rules
+// cover the same name: deny wins, then write, list and read.
+var precedence = map[string]int{"read": 1, "list": 2, "write": 3, "deny": 4}
+
+// Decide finds the rule that governs resource name under rules, the way a
+// Consul agent would for a token holding all of them: an exact rule beats any
+// prefix rule, a longer prefix beats a shorter one, and between rules for the
+// same name the one with the higher precedence wins. Scalar resources ignore
+// name. It returns the winning rule's index, or -1 when no rule applies and
+// the agent's default policy decides.
+//
+// Only rules outside namespace and partition blocks are considered.
+func Decide(rules []Rule, resource, name string) int {
+	winner, best := -1, -1
+	exact := false
+	for i, r := range rules {
+		if r.Resource != resource || r.Namespace != "" || r.Partition != "" || precedence[r.Policy] == 0 {
+			continue
+		}
+		var isExact bool
+		var length int
+		switch {
+		case r.Scalar():
+			isExact = true
+		case !r.Prefix && r.Name == name:
+			isExact = true
+		case r.Prefix && strings.HasPrefix(name, r.Name):
+			length = len(r.Name)
+		default:
+			continue
+		}
+		switch {
+		case winner < 0,
+			isExact && !exact,
+			isExact == exact && length > best,
+			isExact == exact && length == best && precedence[r.Policy] > precedence[rules[winner].Policy]:
+			winner, best, exact = i, length, isExact
+		}
+	}
+	return winner
+}
+
+// Allows reports whether a rule granting policy permits access, one of read,
+// list or write. Write implies list and read, list implies read.
+func Allows(policy, access string) bool {
+	if policy == "deny" {
+		return false
+	}
+	return precedence[policy] >= precedence[access] && precedence[access] > 0
+}
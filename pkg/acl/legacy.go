@@ -0,0 +1,84 @@
+package acl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// prefixResources are the resources whose named rules matched by prefix in
+// the legacy syntax of Consul before 1.4, and are written <resource>_prefix
+// now.
+var prefixResources = map[string]bool{
+	"agent":   true,
+	"event":   true,
+	"key":     true,
+	"node":    true,
+	"query":   true,
+	"service": true,
+	"session": true,
+}
+
+// Legacy returns the rules of src that look written in the legacy syntax:
+// exact rules on an empty name, which now match only a resource named "",
+// and exact key rules on a folder, ending in "/". Both parse in the current
+// syntax, so this is a guess; rules that do not parse have none.
+func Legacy(src string) []Rule {
+	rules, err := Parse(src)
+	if err != nil {
+		return nil
+	}
+	var legacy []Rule
+	for _, r := range rules {
+		if r.Prefix || !prefixResources[r.Resource] {
+			continue
+		}
+		if r.Name == "" || (r.Resource == "key" && strings.HasSuffix(r.Name, "/")) {
+			legacy = append(legacy, r)
+		}
+	}
+	return legacy
+}
+
+// Translate rewrites HCL rules from the legacy syntax to the current one, as
+// Consul's rules translate endpoint did: every exact rule on a resource the
+// legacy syntax matched by prefix becomes a _prefix rule. The rest of src,
+// layout and comments included, is kept. n counts the blocks rewritten.
+func Translate(src string) (out string, n int, err error) {
+	if strings.HasPrefix(strings.TrimSpace(src), "{") {
+		return "", 0, fmt.Errorf("JSON rules cannot be translated")
+	}
+	tokens, ok := scan(src)
+	if !ok {
+		return "", 0, fmt.Errorf("unterminated string or comment")
+	}
+	var b strings.Builder
+	last := 0
+	for i, tok := range tokens {
+		if !prefixResources[tok.text] || (i > 0 && tokens[i-1].text == "=") {
+			continue
+		}
+		// key "web/" { ... }, or the map form key = { "web/" = { ... } }.
+		next := spanText(tokens, i+1)
+		if !isString(next) && next != "{" && !(next == "=" && spanText(tokens, i+2) == "{") {
+			continue
+		}
+		end := tok.pos + len(tok.text)
+		b.WriteString(src[last:end])
+		b.WriteString("_prefix")
+		last = end
+		n++
+	}
+	b.WriteString(src[last:])
+	out = b.String()
+	if _, err := Parse(out); err != nil {
+		return "", 0, fmt.Errorf("translated rules do not parse: %w", err)
+	}
+	return out, n, nil
+}
+
+func spanText(tokens []span, i int) string {
+	if i < len(tokens) {
+		return tokens[i].text
+	}
+	return ""
+}
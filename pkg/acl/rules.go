@@ -0,0 +1,365 @@
+// Package acl reads Consul ACL policy rules, in HCL or JSON, into a flat list
+// of grants.
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule grants access to one resource: a named one, every one whose name
+// starts with Name when Prefix is set, or the whole resource for the scalar
+// resources (acl, keyring, mesh, operator, peering), which have no name.
+type Rule struct {
+	Partition string
+	Namespace string
+
+	Resource   string // "key", "service", "acl", ...
+	Name       string
+	Prefix     bool
+	Policy     string // "read", "list", "write" or "deny"
+	Intentions string // service rules only
+
+	// Sentinel further restricts writes to the key (Consul Enterprise).
+	Sentinel Sentinel
+}
+
+// Sentinel is the Sentinel policy of a key rule: code a write must pass, at
+// an enforcement level of "advisory", "soft-mandatory" or "hard-mandatory".
+type Sentinel struct {
+	Code             string
+	EnforcementLevel string
+}
+
+var enforcementLevels = map[string]bool{"advisory": true, "soft-mandatory": true, "hard-mandatory": true}
+
+// scalarResources are set with a plain assignment, like acl = "write".
+var scalarResources = map[string]bool{
+	"acl":      true,
+	"keyring":  true,
+	"mesh":     true,
+	"operator": true,
+	"peering":  true,
+}
+
+// Scalar reports whether r is one of the resources without names.
+func (r Rule) Scalar() bool { return scalarResources[r.Resource] }
+
+// String renders r the way it is written in HCL.
+func (r Rule) String() string {
+	if r.Scalar() {
+		return fmt.Sprintf("%s = %q", r.Resource, r.Policy)
+	}
+	block := r.Resource
+	if r.Prefix {
+		block += "_prefix"
+	}
+	attrs := fmt.Sprintf("policy = %q", r.Policy)
+	if r.Intentions != "" {
+		attrs += fmt.Sprintf(" intentions = %q", r.Intentions)
+	}
+	if r.Sentinel.Code != "" {
+		attrs += fmt.Sprintf(" sentinel { code = %q enforcementlevel = %q }", r.Sentinel.Code, r.Sentinel.EnforcementLevel)
+	}
+	s := fmt.Sprintf("%s %q { %s }", block, r.Name, attrs)
+	if r.Namespace != "" {
+		s = fmt.Sprintf("namespace %q { %s }", r.Namespace, s)
+	}
+	if r.Partition != "" {
+		s = fmt.Sprintf("partition %q { %s }", r.Partition, s)
+	}
+	return s
+}
+
+// Parse reads policy rules. Rules starting with a brace are JSON, anything
+// else HCL. Empty rules grant nothing.
+func Parse(src string) ([]Rule, error) {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(src, "{") {
+		return parseJSON(src)
+	}
+	tokens, ok := Tokens(src)
+	if !ok {
+		return nil, fmt.Errorf("unterminated string or comment")
+	}
+	p := &parser{tokens: tokens}
+	rules, err := p.body("", "")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return rules, nil
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *parser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		if got == "" {
+			return fmt.Errorf("expected %q, got end of rules", tok)
+		}
+		return fmt.Errorf("expected %q, got %q", tok, got)
+	}
+	return nil
+}
+
+// body reads items up to a closing brace or the end of the rules.
+func (p *parser) body(partition, namespace string) ([]Rule, error) {
+	var rules []Rule
+	for p.pos < len(p.tokens) && p.peek() != "}" {
+		if p.peek() == "," {
+			p.pos++
+			continue
+		}
+		ident := unquote(p.next())
+		switch {
+		case p.peek() == "=" && isString(p.tokenAt(p.pos+1)):
+			// acl = "write"
+			p.pos++
+			rules = append(rules, Rule{Partition: partition, Namespace: namespace, Resource: ident, Policy: unquote(p.next())})
+		case isString(p.peek()):
+			// key_prefix "web/" { ... }
+			label := unquote(p.next())
+			got, err := p.labeled(ident, label, partition, namespace)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, got...)
+		case p.peek() == "=" || p.peek() == "{":
+			// key = { "web/" = { ... } }
+			if p.peek() == "=" {
+				p.pos++
+			}
+			if err := p.expect("{"); err != nil {
+				return nil, fmt.Errorf("%s: %w", ident, err)
+			}
+			for p.peek() != "}" {
+				if p.peek() == "," {
+					p.pos++
+					continue
+				}
+				if !isString(p.peek()) {
+					return nil, fmt.Errorf("%s: expected a quoted name, got %q", ident, p.peek())
+				}
+				label := unquote(p.next())
+				got, err := p.labeled(ident, label, partition, namespace)
+				if err != nil {
+					return nil, err
+				}
+				rules = append(rules, got...)
+			}
+			p.pos++
+		default:
+			return nil, fmt.Errorf("%s: unexpected %q", ident, p.peek())
+		}
+	}
+	return rules, nil
+}
+
+// labeled reads the block after ident "label", with an optional "=".
+func (p *parser) labeled(ident, label, partition, namespace string) ([]Rule, error) {
+	if p.peek() == "=" {
+		p.pos++
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, fmt.Errorf("%s %q: %w", ident, label, err)
+	}
+	switch ident {
+	case "partition":
+		rules, err := p.body(label, namespace)
+		if err != nil {
+			return nil, err
+		}
+		return rules, p.expect("}")
+	case "namespace", "namespace_prefix":
+		rules, err := p.body(partition, label)
+		if err != nil {
+			return nil, err
+		}
+		return rules, p.expect("}")
+	}
+
+	r := Rule{Partition: partition, Namespace: namespace, Resource: strings.TrimSuffix(ident, "_prefix"), Name: label, Prefix: strings.HasSuffix(ident, "_prefix")}
+	for p.peek() != "}" {
+		if p.peek() == "," {
+			p.pos++
+			continue
+		}
+		attr := unquote(p.next())
+		if attr == "sentinel" {
+			sentinel, err := p.sentinel()
+			if err != nil {
+				return nil, fmt.Errorf("%s %q: %w", ident, label, err)
+			}
+			r.Sentinel = sentinel
+			continue
+		}
+		if err := p.expect("="); err != nil {
+			return nil, fmt.Errorf("%s %q: %w", ident, label, err)
+		}
+		value := p.next()
+		if !isString(value) {
+			return nil, fmt.Errorf("%s %q: %s must be a quoted string", ident, label, attr)
+		}
+		switch attr {
+		case "policy":
+			r.Policy = unquote(value)
+		case "intentions":
+			r.Intentions = unquote(value)
+		}
+	}
+	p.pos++
+	if r.Policy == "" && r.Intentions == "" {
+		return nil, fmt.Errorf("%s %q: missing policy", ident, label)
+	}
+	return []Rule{r}, nil
+}
+
+// sentinel reads the block after "sentinel", with an optional "=".
+func (p *parser) sentinel() (Sentinel, error) {
+	if p.peek() == "=" {
+		p.pos++
+	}
+	if err := p.expect("{"); err != nil {
+		return Sentinel{}, fmt.Errorf("sentinel: %w", err)
+	}
+	attrs := make(map[string]interface{})
+	for p.peek() != "}" {
+		if p.peek() == "," {
+			p.pos++
+			continue
+		}
+		attr := unquote(p.next())
+		if err := p.expect("="); err != nil {
+			return Sentinel{}, fmt.Errorf("sentinel: %w", err)
+		}
+		value := p.next()
+		if !isString(value) {
+			return Sentinel{}, fmt.Errorf("sentinel: %s must be a string", attr)
+		}
+		attrs[attr] = unquote(value)
+	}
+	p.pos++
+	return sentinelOf(attrs)
+}
+
+// sentinelOf reads the attributes of a sentinel block, in HCL or JSON.
+func sentinelOf(attrs map[string]interface{}) (Sentinel, error) {
+	var s Sentinel
+	s.Code, _ = attrs["code"].(string)
+	s.EnforcementLevel, _ = attrs["enforcementlevel"].(string)
+	if strings.TrimSpace(s.Code) == "" {
+		return Sentinel{}, fmt.Errorf("sentinel: missing code")
+	}
+	if !enforcementLevels[s.EnforcementLevel] {
+		return Sentinel{}, fmt.Errorf("sentinel: enforcementlevel %q is not advisory, soft-mandatory or hard-mandatory", s.EnforcementLevel)
+	}
+	return s, nil
+}
+
+func (p *parser) tokenAt(i int) string {
+	if i < len(p.tokens) {
+		return p.tokens[i]
+	}
+	return ""
+}
+
+func isString(tok string) bool { return strings.HasPrefix(tok, `"`) }
+
+func unquote(tok string) string {
+	if s, err := strconv.Unquote(tok); err == nil {
+		return s
+	}
+	return strings.Trim(tok, `"`)
+}
+
+func parseJSON(src string) ([]Rule, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(src), &doc); err != nil {
+		return nil, err
+	}
+	return jsonBody(doc, "", "")
+}
+
+func jsonBody(doc map[string]interface{}, partition, namespace string) ([]Rule, error) {
+	var rules []Rule
+	for _, ident := range sortedKeys(doc) {
+		switch v := doc[ident].(type) {
+		case string:
+			rules = append(rules, Rule{Partition: partition, Namespace: namespace, Resource: ident, Policy: v})
+		case map[string]interface{}:
+			for _, label := range sortedKeys(v) {
+				block, ok := v[label].(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%s %q: expected an object", ident, label)
+				}
+				switch ident {
+				case "partition":
+					got, err := jsonBody(block, label, namespace)
+					if err != nil {
+						return nil, err
+					}
+					rules = append(rules, got...)
+					continue
+				case "namespace", "namespace_prefix":
+					got, err := jsonBody(block, partition, label)
+					if err != nil {
+						return nil, err
+					}
+					rules = append(rules, got...)
+					continue
+				}
+				r := Rule{Partition: partition, Namespace: namespace, Resource: strings.TrimSuffix(ident, "_prefix"), Name: label, Prefix: strings.HasSuffix(ident, "_prefix")}
+				r.Policy, _ = block["policy"].(string)
+				r.Intentions, _ = block["intentions"].(string)
+				if attrs, ok := block["sentinel"].(map[string]interface{}); ok {
+					sentinel, err := sentinelOf(attrs)
+					if err != nil {
+						return nil, fmt.Errorf("%s %q: %w", ident, label, err)
+					}
+					r.Sentinel = sentinel
+				}
+				if r.Policy == "" && r.Intentions == "" {
+					return nil, fmt.Errorf("%s %q: missing policy", ident, label)
+				}
+				rules = append(rules, r)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unexpected value", ident)
+		}
+	}
+	return rules, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
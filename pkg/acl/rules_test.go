@@ -0,0 +1,138 @@
+package acl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []Rule
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"scalar", `acl = "write"`, []Rule{{Resource: "acl", Policy: "write"}}, false},
+		{"block", `key_prefix "web/" { policy = "read" }`, []Rule{{Resource: "key", Name: "web/", Prefix: true, Policy: "read"}}, false},
+		{"exact with intentions", `
+			# comment
+			service "web" {
+			  policy     = "write"
+			  intentions = "read"
+			}`, []Rule{{Resource: "service", Name: "web", Policy: "write", Intentions: "read"}}, false},
+		{"map style", `key = { "a" = { policy = "deny" }, "b" = { policy = "list" } }`, []Rule{
+			{Resource: "key", Name: "a", Policy: "deny"},
+			{Resource: "key", Name: "b", Policy: "list"},
+		}, false},
+		{"namespace", `namespace "team" { node_prefix "" { policy = "read" } }`, []Rule{{Namespace: "team", Resource: "node", Prefix: true, Policy: "read"}}, false},
+		{"json", `{"key_prefix": {"": {"policy": "write"}}, "operator": "read"}`, []Rule{
+			{Resource: "key", Prefix: true, Policy: "write"},
+			{Resource: "operator", Policy: "read"},
+		}, false},
+		{"sentinel", `key "app/" {
+			  policy = "write"
+			  sentinel {
+			    code = <<EOF
+			      import "strings"
+			      main = rule { strings.has_suffix(value, "ok") }
+			    EOF
+			    enforcementlevel = "soft-mandatory"
+			  }
+			}`, []Rule{{Resource: "key", Name: "app/", Policy: "write", Sentinel: Sentinel{
+			Code:             "import \"strings\"\nmain = rule { strings.has_suffix(value, \"ok\") }",
+			EnforcementLevel: "soft-mandatory",
+		}}}, false},
+		{"json sentinel", `{"key": {"a": {"policy": "write", "sentinel": {"code": "main = rule { true }", "enforcementlevel": "advisory"}}}}`, []Rule{
+			{Resource: "key", Name: "a", Policy: "write", Sentinel: Sentinel{Code: "main = rule { true }", EnforcementLevel: "advisory"}},
+		}, false},
+		{"sentinel level", `key "a" { policy = "write" sentinel { code = "main = rule { true }" enforcementlevel = "strict" } }`, nil, true},
+		{"missing policy", `key "a" { }`, nil, true},
+		{"unterminated", `key "a { policy = "read" }`, nil, true},
+		{"unclosed block", `key "a" { policy = "read"`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	rules, err := Parse(`
+		key_prefix ""        { policy = "read" }
+		key_prefix "app/"    { policy = "write" }
+		key_prefix "app/sec" { policy = "deny" }
+		key "app/secret-ok"  { policy = "read" }
+		service_prefix "web" { policy = "read" }
+		service_prefix "web" { policy = "write" }
+		operator = "read"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		resource, name, access string
+		want                   bool
+	}{
+		{"key", "other", "read", true},
+		{"key", "other", "write", false},
+		{"key", "app/config", "write", true},
+		{"key", "app/config", "list", true},
+		{"key", "app/secrets", "read", false},
+		{"key", "app/secret-ok", "read", true},
+		{"key", "app/secret-ok", "write", false},
+		{"service", "web-1", "write", true},
+		{"service", "db", "read", false},
+		{"operator", "", "read", true},
+		{"operator", "", "write", false},
+		{"acl", "", "read", false},
+	}
+	for _, tt := range tests {
+		i := Decide(rules, tt.resource, tt.name)
+		got := i >= 0 && Allows(rules[i].Policy, tt.access)
+		if got != tt.want {
+			t.Errorf("%s %s %q = %v, want %v", tt.access, tt.resource, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	src := `# legacy
+key "" { policy = "read" }
+service_prefix "web" { policy = "write" }
+namespace "team" {
+  node "" { policy = "read" }
+}
+key = { "app/" = { policy = "write" } }
+operator = "read"
+`
+	want := `# legacy
+key_prefix "" { policy = "read" }
+service_prefix "web" { policy = "write" }
+namespace "team" {
+  node_prefix "" { policy = "read" }
+}
+key_prefix = { "app/" = { policy = "write" } }
+operator = "read"
+`
+	got, n, err := Translate(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want || n != 3 {
+		t.Errorf("Translate = %d blocks\n%s\nwant 3\n%s", n, got, want)
+	}
+	if legacy := Legacy(src); len(legacy) != 3 {
+		t.Errorf("Legacy = %+v, want the three exact rules", legacy)
+	}
+	if legacy := Legacy(got); len(legacy) != 0 {
+		t.Errorf("Legacy of the translation = %+v, want none", legacy)
+	}
+}
@@ -0,0 +1,117 @@
+package acl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Tokens splits HCL source into identifiers, numbers, quoted strings,
+// heredocs and punctuation, dropping whitespace and comments. ok is false on
+// an unterminated string, heredoc or block comment.
+func Tokens(src string) (tokens []string, ok bool) {
+	spans, ok := scan(src)
+	if !ok {
+		return nil, false
+	}
+	tokens = make([]string, len(spans))
+	for i, sp := range spans {
+		tokens[i] = sp.text
+	}
+	return tokens, true
+}
+
+// span is a token with the offset of its source in src.
+type span struct {
+	text string
+	pos  int
+}
+
+// scan tokenizes src as Tokens does, keeping where each token starts.
+func scan(src string) (tokens []span, ok bool) {
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, false
+			}
+			i += end + 4
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, false
+			}
+			tokens = append(tokens, span{src[i : j+1], i})
+			i = j + 1
+		case strings.HasPrefix(src[i:], "<<"):
+			tok, n, ok := heredoc(src[i:])
+			if !ok {
+				return nil, false
+			}
+			tokens = append(tokens, span{tok, i})
+			i += n
+		case isIdentByte(c):
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			tokens = append(tokens, span{src[i:j], i})
+			i = j
+		default:
+			tokens = append(tokens, span{string(c), i})
+			i++
+		}
+	}
+	return tokens, true
+}
+
+// heredoc reads a <<EOF or <<-EOF string at the start of src and returns it
+// as a quoted token, escaped like any other, plus the number of bytes
+// consumed. Lines are trimmed, so indentation does not count.
+func heredoc(src string) (tok string, n int, ok bool) {
+	nl := strings.IndexByte(src, '\n')
+	if nl < 0 {
+		return "", 0, false
+	}
+	marker := strings.TrimPrefix(strings.TrimSpace(src[2:nl]), "-")
+	if marker == "" {
+		return "", 0, false
+	}
+	var body []string
+	pos := nl + 1
+	for pos <= len(src) {
+		end := strings.IndexByte(src[pos:], '\n')
+		line := src[pos:]
+		if end >= 0 {
+			line = src[pos : pos+end]
+		}
+		if strings.TrimSpace(line) == marker {
+			return strconv.Quote(strings.Join(body, "\n")), pos + len(line), true
+		}
+		body = append(body, strings.TrimSpace(line))
+		if end < 0 {
+			break
+		}
+		pos += end + 1
+	}
+	return "", 0, false
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '-' || c == '.' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
@@ -0,0 +1,169 @@
+// Package apply performs a plan against Consul and verifies the result.
+package apply
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// Apply performs the plan in the order of its dependency graph: a policy is
+// written before the tokens that reference it, and a wave only once every
+// change of the earlier waves is done. Up to parallelism changes run at once,
+// each as soon as the changes it needs are done. It stops at the
+// first failure, letting the changes already under way finish. Every step is
+// idempotent, so a re-run resumes cleanly after a partial apply. Policy and
+// role links are written by ID, and those created earlier in the run are
+// resolved without asking Consul again. Generated token secrets are written
+// to store before their token is created. Secrets are shown in the output
+// only if red allows it. progress, when set, is told
+// of every finished change. applied lists the changes made, in the order they
+// finished, including on failure.
+func Apply(client consul.API, store secrets.Store, red *secrets.Redactor, plan *diff.Plan, parallelism int, progress diff.Progress) (applied []diff.Change, err error) {
+	ctx, sp := consul.TracerOf(client).Start(context.Background(), "apply", trace.KindInternal)
+	client = consul.WithContext(client, ctx)
+	defer func() { sp.Finish(err) }()
+	res := newResolver(client, plan)
+	client = recording{API: consul.WithResolver(client, res), resolver: res}
+
+	sched := newSchedule(plan)
+	steps := sched.steps
+
+	type result struct {
+		step diff.Step
+		err  error
+	}
+	results := make(chan result)
+	started := make([]bool, len(steps))
+	running, finished := 0, 0
+	for {
+		// Start the ready steps, in plan order, while there is room.
+		for i, step := range steps {
+			if running == parallelism || err != nil {
+				break
+			}
+			if started[i] || !sched.ready(step) {
+				continue
+			}
+			started[i] = true
+			running++
+			if parallelism == 1 {
+				// One change at a time: show what is being done while it is.
+				fmt.Print(describe(step, red) + "... ")
+			}
+			go func() { results <- result{step, step.Do(client, store)} }()
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		finished++
+		line := describe(r.step, red) + "... "
+		if parallelism == 1 {
+			line = ""
+		}
+		if r.err != nil {
+			fmt.Println(line + "failed")
+			if err == nil {
+				err = r.err
+			}
+		} else {
+			sched.finish(r.step)
+			applied = append(applied, r.step.Change)
+			fmt.Println(line + "ok")
+		}
+		progress.Report("applying", finished, len(steps))
+	}
+
+	if err == nil && len(applied) < len(steps) {
+		// The config is checked for cycles when it is loaded.
+		return applied, fmt.Errorf("%d changes depend on each other and were not applied", len(steps)-len(applied))
+	}
+	return applied, err
+}
+
+// schedule tracks which steps of a plan are done, to find those ready to
+// start.
+type schedule struct {
+	plan    *diff.Plan
+	steps   []diff.Step
+	planned map[config.Node]bool
+	done    map[config.Node]bool
+	pending map[int]int // the steps of each wave not done yet
+}
+
+func newSchedule(plan *diff.Plan) *schedule {
+	steps := diff.Steps(plan)
+	s := &schedule{plan: plan, steps: steps,
+		planned: make(map[config.Node]bool, len(steps)), done: make(map[config.Node]bool, len(steps)),
+		pending: make(map[int]int)}
+	for _, step := range steps {
+		s.planned[step.Node] = true
+		s.pending[plan.Graph.Wave(step.Node)]++
+	}
+	return s
+}
+
+// finish records step as done.
+func (s *schedule) finish(step diff.Step) {
+	s.done[step.Node] = true
+	s.pending[s.plan.Graph.Wave(step.Node)]--
+}
+
+// ready reports whether every change step needs, and every change of an
+// earlier wave, is done. Resources the plan does not change already exist.
+func (s *schedule) ready(step diff.Step) bool {
+	wave := s.plan.Graph.Wave(step.Node)
+	for w, n := range s.pending {
+		if w < wave && n > 0 {
+			return false
+		}
+	}
+	for _, n := range s.plan.Graph.Needs(step.Node) {
+		if s.planned[n] && !s.done[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// Order returns the steps of the plan in the order Apply makes them one at
+// a time. Steps caught in a dependency cycle are left out.
+func Order(plan *diff.Plan) []diff.Step {
+	sched := newSchedule(plan)
+	taken := make([]bool, len(sched.steps))
+	var order []diff.Step
+	for len(order) < len(sched.steps) {
+		next := -1
+		for i, step := range sched.steps {
+			if !taken[i] && sched.ready(step) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		taken[next] = true
+		sched.finish(sched.steps[next])
+		order = append(order, sched.steps[next])
+	}
+	return order
+}
+
+// describe is the progress line of a step, e.g. `creating policy "web"`.
+func describe(step diff.Step, red *secrets.Redactor) string {
+	verbs := map[string]string{"create": "creating", "update": "updating", "replace": "replacing"}
+	s := fmt.Sprintf("%s %s %s", verbs[step.Action], step.Kind, step.Label)
+	if step.Secret != "" {
+		s += fmt.Sprintf(" (secret %s)", red.SecretLabel(step.Secret))
+	}
+	return s
+}
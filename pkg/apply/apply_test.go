@@ -0,0 +1,290 @@
+package apply_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/apply"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/consultest"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// exportedSpan is the part of an OTLP/JSON span the test checks.
+type exportedSpan struct {
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+// collector receives the spans a tracer exports.
+func collector(t *testing.T) (url string, spans func() []exportedSpan) {
+	var (
+		mu  sync.Mutex
+		got []exportedSpan
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var doc struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []exportedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Errorf("export: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range doc.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				got = append(got, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []exportedSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+func TestApplyParallelSpans(t *testing.T) {
+	url, spans := collector(t)
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", url)
+	t.Setenv("TRACEPARENT", "")
+
+	var b strings.Builder
+	b.WriteString("policies:\n")
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&b, "  - name: p%d\n    rules: 'key_prefix \"p%d/\" { policy = \"read\" }'\n", i, i)
+	}
+	cfg, err := config.Parse([]byte(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := consultest.NewServer(t)
+	plan := srv.Plan(t, cfg)
+
+	client := srv.Client(t, cfg)
+	tracer := trace.New("test")
+	client.Tracer = tracer
+	if _, err := apply.Apply(client, nil, nil, plan, 8, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	var applyID string
+	for _, s := range spans() {
+		if s.Name == "apply" {
+			applyID = s.SpanID
+		}
+	}
+	if applyID == "" {
+		t.Fatal("no apply span exported")
+	}
+	requests := 0
+	for _, s := range spans() {
+		if s.Kind != trace.KindClient {
+			continue
+		}
+		requests++
+		if s.ParentSpanID != applyID {
+			t.Errorf("request span %s %q has parent %q, want the apply span %s", s.SpanID, s.Name, s.ParentSpanID, applyID)
+		}
+	}
+	if requests < 16 {
+		t.Errorf("%d request spans, want one per policy at least", requests)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const rules = `
+policies:
+  - name: kept
+    rules: 'key_prefix "kept/" { policy = "read" }'
+  - name: changed
+    rules: 'key_prefix "changed/" { policy = "%s" }'
+`
+	cfg, err := config.Parse([]byte(fmt.Sprintf(rules, "read") + `
+  - name: missing
+    rules: 'key_prefix "missing/" { policy = "read" }'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := consultest.NewServer(t)
+	plan := srv.Plan(t, cfg)
+	client := srv.Client(t, cfg)
+	if _, err := apply.Apply(client, nil, nil, plan, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply.Verify(client, plan, nil); err != nil {
+		t.Fatalf("Verify after a clean apply: %v", err)
+	}
+
+	// On a fresh Consul, write a config that leaves one policy of the plan
+	// out and stores another differently.
+	srv = consultest.NewServer(t)
+	other, err := config.Parse([]byte(fmt.Sprintf(rules, "write")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, other)
+	err = apply.Verify(srv.Client(t, cfg), plan, nil)
+	if err == nil {
+		t.Fatal("Verify = nil, want the changed and missing policies reported")
+	}
+	for _, want := range []string{
+		"2 resources do not match",
+		`policy "changed" still differs`,
+		`policy "missing" is missing`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Verify = %v, want it to contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), `"kept"`) {
+		t.Errorf("Verify = %v, reports the policy that matches", err)
+	}
+}
+
+// recorder serves srv, recording each request as "METHOD path" and the bodies
+// of token writes.
+func recorder(t *testing.T, srv *consultest.Server) (url string, requests func() []string, tokens func() []string) {
+	var (
+		mu           sync.Mutex
+		reqs, bodies []string
+	)
+	rec := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		mu.Lock()
+		reqs = append(reqs, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/acl/token") {
+			bodies = append(bodies, string(body))
+		}
+		mu.Unlock()
+		srv.Consul.ServeHTTP(w, r)
+	}))
+	t.Cleanup(rec.Close)
+	return rec.URL, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), reqs...)
+		}, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), bodies...)
+		}
+}
+
+func TestApplyLinksByID(t *testing.T) {
+	cfg, err := config.Parse([]byte(`
+policies:
+  - name: web
+    rules: 'key_prefix "web/" { policy = "read" }'
+roles:
+  - name: web
+    policies: [web]
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 3b2a1c00-0000-4000-8000-0000000000f1
+    description: web
+    policies: [web, global-management]
+    roles: [web]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := consultest.NewServer(t)
+	plan := srv.Plan(t, cfg)
+	url, requests, tokens := recorder(t, srv)
+	if _, err := apply.Apply(consul.NewClient(url, ""), nil, nil, plan, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The policy and role created by the run are resolved from Consul's
+	// answers; only global-management, which the plan does not touch, is
+	// looked up, and policies are listed once for it.
+	lists := map[string]int{}
+	for _, r := range requests() {
+		if r == "GET /v1/acl/policies" || r == "GET /v1/acl/roles" {
+			lists[r]++
+		}
+	}
+	if want := map[string]int{"GET /v1/acl/policies": 1}; !reflect.DeepEqual(lists, want) {
+		t.Errorf("listed %v during the apply, want %v", lists, want)
+	}
+
+	ids := map[string]string{}
+	for _, p := range srv.Policies() {
+		ids["policy "+p.Name] = p.ID
+	}
+	for _, r := range srv.Roles() {
+		ids["role "+r.Name] = r.ID
+	}
+	written := tokens()
+	if len(written) != 1 {
+		t.Fatalf("wrote %d tokens, want 1", len(written))
+	}
+	var body struct {
+		Policies, Roles []struct{ ID, Name string }
+	}
+	if err := json.Unmarshal([]byte(written[0]), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range body.Policies {
+		if want := ids["policy "+l.Name]; want == "" || l.ID != want {
+			t.Errorf("token links policy %q by ID %q, want %q", l.Name, l.ID, want)
+		}
+	}
+	for _, l := range body.Roles {
+		if want := ids["role "+l.Name]; want == "" || l.ID != want {
+			t.Errorf("token links role %q by ID %q, want %q", l.Name, l.ID, want)
+		}
+	}
+}
+
+func TestApplyLinkCreatedLater(t *testing.T) {
+	// The token links a policy of the default namespace, as Consul falls back
+	// to, which the graph does not order it after; the wave puts the policy
+	// last.
+	cfg, err := config.Parse([]byte(`
+namespaces:
+  - name: team
+policies:
+  - name: shared
+    rules: 'key_prefix "shared/" { policy = "read" }'
+    wave: 1
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 3b2a1c00-0000-4000-8000-0000000000f1
+    description: team
+    namespace: team
+    policies: [shared]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := consultest.NewServer(t)
+	plan := srv.Plan(t, cfg)
+	_, err = apply.Apply(srv.Client(t, cfg), nil, nil, plan, 1, nil)
+	if err == nil || !strings.Contains(err.Error(), `policy "shared" is not found: it will be created later this run`) {
+		t.Errorf("Apply = %v, want the policy reported as created later", err)
+	}
+}
@@ -0,0 +1,151 @@
+package apply
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// resolver resolves the policy and role links of an apply's writes to IDs.
+// It knows the IDs of the resources the plan updates, learns those of the
+// resources the apply creates from Consul's answers, and lists a kind in
+// Consul at most once, the first time a link names a resource it does not
+// know yet. A policy created earlier in the run is thus resolved without
+// asking Consul again.
+type resolver struct {
+	api consul.API
+
+	mu  sync.Mutex
+	ids map[config.Node]string
+	// pending are the resources the plan creates that are not created yet.
+	pending map[config.Node]bool
+	listed  map[string]bool
+}
+
+func newResolver(api consul.API, plan *diff.Plan) *resolver {
+	r := &resolver{api: api, ids: make(map[config.Node]string), pending: make(map[config.Node]bool),
+		listed: make(map[string]bool)}
+	for _, p := range plan.PoliciesToCreate {
+		r.pending[config.PolicyNode(p)] = true
+	}
+	for _, u := range plan.PoliciesToUpdate {
+		r.ids[config.PolicyNode(u.Desired)] = u.ID
+	}
+	for _, role := range plan.RolesToCreate {
+		r.pending[config.RoleNode(role)] = true
+	}
+	for _, u := range plan.RolesToUpdate {
+		r.ids[config.RoleNode(u.Desired)] = u.ID
+	}
+	return r
+}
+
+// linkNode is the node of the policy or role (kind) named name in tenancy.
+func linkNode(kind string, tenancy config.Tenancy, name string) config.Node {
+	if kind == "role" {
+		return config.RoleNode(config.Role{Name: name, Tenancy: tenancy})
+	}
+	return config.PolicyNode(config.Policy{Name: name, Tenancy: tenancy})
+}
+
+// Resolve looks name up in tenancy and then, as Consul does, in the default
+// namespace of its partition. A resource the plan creates but the apply has
+// not yet is an error rather than left to Consul, which would not find it
+// either. One that is nowhere to be found is left to Consul to resolve by
+// name, and to report.
+func (r *resolver) Resolve(kind string, tenancy config.Tenancy, name string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	candidates := []config.Node{linkNode(kind, tenancy, name)}
+	if orDefault(tenancy.Namespace) != "default" {
+		candidates = append(candidates, linkNode(kind, config.Tenancy{Partition: tenancy.Partition}, name))
+	}
+	for _, n := range candidates {
+		if _, ok := r.ids[n]; !ok && !r.pending[n] && !r.listed[kind] {
+			if err := r.list(kind); err != nil {
+				return "", err
+			}
+		}
+		if id, ok := r.ids[n]; ok {
+			return id, nil
+		}
+		if r.pending[n] {
+			return "", fmt.Errorf("%s is not found: it will be created later this run", n)
+		}
+	}
+	return "", nil
+}
+
+// list caches the IDs of every policy or role (kind) in Consul. The
+// resources the apply created already are known, and kept as they are.
+func (r *resolver) list(kind string) error {
+	r.listed[kind] = true
+	known := func(n config.Node, id string) {
+		if _, ok := r.ids[n]; !ok && !r.pending[n] {
+			r.ids[n] = id
+		}
+	}
+	if kind == "role" {
+		roles, err := r.api.ListRoles()
+		if err != nil {
+			return fmt.Errorf("failed to list roles: %w", err)
+		}
+		for _, role := range roles {
+			known(config.RoleNode(config.Role{Name: role.Name, Tenancy: role.Tenancy()}), role.ID)
+		}
+		return nil
+	}
+	policies, err := r.api.ListPolicies()
+	if err != nil {
+		return fmt.Errorf("failed to list policies: %w", err)
+	}
+	for _, p := range policies {
+		known(config.PolicyNode(config.Policy{Name: p.Name, Tenancy: p.Tenancy()}), p.ID)
+	}
+	return nil
+}
+
+// created records the ID Consul assigned the resource n. A create only
+// previewed has none, and its links go by name from then on.
+func (r *resolver) created(n config.Node, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, n)
+	if id != "" {
+		r.ids[n] = id
+	}
+}
+
+// recording is the client the steps of an apply write with: the resolver
+// learns the ID of every policy and role it creates.
+type recording struct {
+	consul.API
+	resolver *resolver
+}
+
+func (c recording) CreatePolicy(p config.Policy) (string, error) {
+	id, err := c.API.CreatePolicy(p)
+	if err == nil {
+		c.resolver.created(config.PolicyNode(p), id)
+	}
+	return id, err
+}
+
+func (c recording) CreateRole(role config.Role) (string, error) {
+	id, err := c.API.CreateRole(role)
+	if err == nil {
+		c.resolver.created(config.RoleNode(role), id)
+	}
+	return id, err
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
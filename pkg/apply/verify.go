@@ -0,0 +1,36 @@
+package apply
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// Verify re-reads every resource the plan changed and checks it now matches
+// the desired state, using the same comparison the planner does. It catches
+// writes Consul accepted but stored differently, which a re-run would report
+// as the same change forever. progress, when set, follows the reads.
+func Verify(client consul.API, plan *diff.Plan, progress diff.Progress) (err error) {
+	ctx, sp := consul.TracerOf(client).Start(context.Background(), "verify", trace.KindInternal)
+	client = consul.WithContext(client, ctx)
+	defer func() { sp.Finish(err) }()
+
+	var differ []string
+	for _, k := range diff.Kinds {
+		d, err := k.Verify(client, plan, progress)
+		if err != nil {
+			return err
+		}
+		differ = append(differ, d...)
+	}
+
+	if len(differ) > 0 {
+		return fmt.Errorf("verification failed, %d resources do not match the config after apply:\n  %s",
+			len(differ), strings.Join(differ, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+// Load reads and validates the YAML config file. The signature, when
+// required, is checked over the file as stored; those same bytes are then
+// decrypted if they are SOPS- or age-encrypted, and parsed.
+func Load(path string, sig SignatureCheck) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := sig.verify(path, data); err != nil {
+		return nil, err
+	}
+	if data, err = decryptConfig(data); err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates a plain YAML config. Anchors, aliases and merge
+// keys are expanded before validation, which sees the config as if written
+// out in full.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	// The default message of errors quotes the surrounding source, which may
+	// hold a secret_id, so they report the position only.
+	file, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %s", yaml.FormatError(err, false, false))
+	}
+	if len(file.Docs) > 0 && file.Docs[0].Body != nil {
+		if err := resolveMerges(file.Docs[0], make(map[string]ast.Node)); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %w", err)
+		}
+		if err := yaml.NodeToValue(file.Docs[0].Body, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %s", yaml.FormatError(err, false, false))
+		}
+	}
+	if err := validate(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func validate(cfg *Config) error {
+	if cfg.ManagementTokenPath != "" && cfg.SecretsBackend == "" {
+		return fmt.Errorf("management_token_path requires secrets_backend")
+	}
+
+	for name := range cfg.Consul.Headers {
+		if _, ok := cfg.Consul.HeadersEnv[name]; ok {
+			return fmt.Errorf("consul header %s is set in both headers and headers_env", name)
+		}
+	}
+	switch cfg.Consul.Consistency {
+	case "", "default", "consistent", "stale":
+	default:
+		return fmt.Errorf("consul consistency %q is not one of default, consistent or stale", cfg.Consul.Consistency)
+	}
+	if cfg.Consul.RateLimit < 0 {
+		return fmt.Errorf("consul rate_limit cannot be negative")
+	}
+	if _, _, err := cfg.DescriptionMarker.Patterns(); err != nil {
+		return err
+	}
+	for name, env := range cfg.Consul.HeadersEnv {
+		if env == "" {
+			return fmt.Errorf("consul header %s has an empty headers_env variable name", name)
+		}
+	}
+
+	for i, n := range cfg.Notifications {
+		switch n.Type {
+		case "", "webhook", "slack", "teams":
+		default:
+			return fmt.Errorf("notification #%d has unknown type %q", i+1, n.Type)
+		}
+		if (n.URL == "") == (n.URLEnv == "") {
+			return fmt.Errorf("notification #%d needs exactly one of url and url_env", i+1)
+		}
+		for _, o := range n.On {
+			if o != "success" && o != "failure" && o != "no_changes" {
+				return fmt.Errorf("notification #%d has unknown outcome %q in on", i+1, o)
+			}
+		}
+	}
+
+	for _, p := range append(append([]string(nil), cfg.Ignore.Policies...), cfg.Ignore.Tokens...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", p, err)
+		}
+	}
+
+	if err := cfg.IgnoreFields.validate(); err != nil {
+		return err
+	}
+
+	for check, severity := range cfg.Lint.Rules {
+		if severity != "error" && severity != "warning" && severity != "off" {
+			return fmt.Errorf("lint check %s has unknown severity %q (want error, warning or off)", check, severity)
+		}
+	}
+
+	for _, r := range cfg.Encryption.AgeRecipients {
+		if strings.TrimSpace(r) == "" {
+			return fmt.Errorf("encryption.age_recipients has an empty recipient")
+		}
+	}
+
+	partitions := make(map[string]bool)
+	for _, p := range cfg.AdminPartitions {
+		if p.Name == "" {
+			return fmt.Errorf("partition name cannot be empty")
+		}
+		if partitions[p.Name] {
+			return fmt.Errorf("duplicate partition name: %s", p.Name)
+		}
+		partitions[p.Name] = true
+		if err := validateOrdering(PartitionNode(p), Tenancy{}, p.Ordering); err != nil {
+			return err
+		}
+	}
+
+	namespaces := make(map[string]bool)
+	for _, n := range cfg.Namespaces {
+		if n.Name == "" {
+			return fmt.Errorf("namespace name cannot be empty")
+		}
+		if namespaces[n.Key()] {
+			return fmt.Errorf("duplicate namespace name: %s", n.Key())
+		}
+		namespaces[n.Key()] = true
+		if err := validateOrdering(NamespaceNode(n), n.Defaults(), n.Ordering); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, p := range cfg.Policies {
+		if p.Name == "" {
+			return fmt.Errorf("policy name cannot be empty")
+		}
+		if names[p.Key()] {
+			return fmt.Errorf("duplicate policy name: %s", p.Key())
+		}
+		names[p.Key()] = true
+		if err := validateOrdering(PolicyNode(p), p.Tenancy, p.Ordering); err != nil {
+			return err
+		}
+	}
+
+	roles := make(map[string]bool)
+	for _, r := range cfg.Roles {
+		if r.Name == "" {
+			return fmt.Errorf("role name cannot be empty")
+		}
+		if roles[r.Key()] {
+			return fmt.Errorf("duplicate role name: %s", r.Key())
+		}
+		roles[r.Key()] = true
+		if err := validateRole(r); err != nil {
+			return err
+		}
+		if err := validateOrdering(RoleNode(r), r.Tenancy, r.Ordering); err != nil {
+			return err
+		}
+	}
+
+	accessors := make(map[string]bool)
+	secrets := make(map[string]bool)
+	for i, t := range cfg.Tokens {
+		if t.AccessorID == "" {
+			return fmt.Errorf("token #%d (%q) has no accessor_id, which is its identity key", i+1, t.Description)
+		}
+		if t.SecretID == "" && t.SecretPath == "" {
+			return fmt.Errorf("token %s has no secret_id or secret_path", t.AccessorID)
+		}
+		if t.SecretID != "" && t.SecretPath != "" {
+			return fmt.Errorf("token %s sets both secret_id and secret_path", t.AccessorID)
+		}
+		if t.SecretPath != "" && cfg.SecretsBackend == "" {
+			return fmt.Errorf("token %s sets secret_path but no secrets_backend is configured", t.AccessorID)
+		}
+		// Consul only accepts UUIDs here, and would reject a bad one midway
+		// through an apply, after the policies were already written.
+		if !IsUUID(t.AccessorID) {
+			return fmt.Errorf("token accessor_id %q is not a UUID", t.AccessorID)
+		}
+		if t.SecretID != "" {
+			if !IsUUID(t.SecretID) {
+				return fmt.Errorf("token %s has a secret_id that is not a UUID", t.AccessorID)
+			}
+			if t.SecretID == t.AccessorID {
+				return fmt.Errorf("token %s uses its accessor_id as its secret_id", t.AccessorID)
+			}
+			if secrets[t.SecretID] {
+				return fmt.Errorf("token %s reuses the secret_id of another token", t.AccessorID)
+			}
+			secrets[t.SecretID] = true
+		}
+		if k := t.KubernetesSecret; k != nil {
+			if k.Name == "" {
+				return fmt.Errorf("token %s has kubernetes_secret without a name", t.AccessorID)
+			}
+			for _, text := range []string{k.Name, k.Namespace} {
+				if _, err := ExpandTemplate(text, t); err != nil {
+					return fmt.Errorf("token %s has an invalid kubernetes_secret template: %w", t.AccessorID, err)
+				}
+			}
+		}
+		if accessors[t.AccessorID] {
+			return fmt.Errorf("duplicate token accessor_id: %s", t.AccessorID)
+		}
+		accessors[t.AccessorID] = true
+		if err := validateOrdering(TokenNode(t), t.Tenancy, t.Ordering); err != nil {
+			return err
+		}
+	}
+
+	methods := make(map[string]bool)
+	for _, m := range cfg.AuthMethods {
+		if m.Name == "" {
+			return fmt.Errorf("auth method name cannot be empty")
+		}
+		if methods[m.Key()] {
+			return fmt.Errorf("duplicate auth method name: %s", m.Key())
+		}
+		methods[m.Key()] = true
+		if err := validateAuthMethod(m); err != nil {
+			return err
+		}
+		if err := validateOrdering(AuthMethodNode(m), m.Tenancy, m.Ordering); err != nil {
+			return err
+		}
+	}
+
+	g := BuildGraph(cfg)
+	if err := g.check(); err != nil {
+		return err
+	}
+	if cycle := g.Cycle(); cycle != nil {
+		return fmt.Errorf("dependency cycle: %s", formatCycle(cycle))
+	}
+	return nil
+}
+
+// validateRole checks the identities and templated policies of r, which
+// Consul would otherwise reject midway through an apply.
+func validateRole(r Role) error {
+	for _, si := range r.ServiceIdentities {
+		if si.ServiceName == "" {
+			return fmt.Errorf("role %s has a service identity without a service_name", r.Key())
+		}
+	}
+	for _, ni := range r.NodeIdentities {
+		if ni.NodeName == "" || ni.Datacenter == "" {
+			return fmt.Errorf("role %s has a node identity without a node_name and datacenter", r.Key())
+		}
+	}
+	for _, tp := range r.TemplatedPolicies {
+		if tp.TemplateName == "" {
+			return fmt.Errorf("role %s has a templated policy without a template_name", r.Key())
+		}
+	}
+	return nil
+}
+
+// validateAuthMethod checks the fields of m Consul would otherwise reject
+// midway through an apply.
+func validateAuthMethod(m AuthMethod) error {
+	if m.Type == "" {
+		return fmt.Errorf("auth method %s has no type", m.Key())
+	}
+	if m.MaxTokenTTL != "" {
+		ttl, err := time.ParseDuration(m.MaxTokenTTL)
+		if err != nil {
+			return fmt.Errorf("auth method %s has an invalid max_token_ttl: %w", m.Key(), err)
+		}
+		if ttl < time.Minute || ttl > 24*time.Hour {
+			return fmt.Errorf("auth method %s has max_token_ttl %s, outside the 1m to 24h Consul accepts", m.Key(), m.MaxTokenTTL)
+		}
+	}
+	switch m.TokenLocality {
+	case "", "local", "global":
+	default:
+		return fmt.Errorf("auth method %s has token_locality %q (want local or global)", m.Key(), m.TokenLocality)
+	}
+	if m.Type == "oidc" {
+		if err := validateOIDC(m); err != nil {
+			return fmt.Errorf("oidc auth method %s: %w", m.Key(), err)
+		}
+	}
+	if k := m.Kubernetes; k != nil {
+		if m.Type != "kubernetes" {
+			return fmt.Errorf("auth method %s sets kubernetes but is of type %s", m.Key(), m.Type)
+		}
+		if k.InCluster == (k.Kubeconfig != "") {
+			return fmt.Errorf("auth method %s needs exactly one of kubernetes in_cluster and kubeconfig", m.Key())
+		}
+		if k.Context != "" && k.Kubeconfig == "" {
+			return fmt.Errorf("auth method %s sets a kubernetes context without a kubeconfig", m.Key())
+		}
+	}
+	return nil
+}
+
+// validateOIDC checks that the Config of an oidc auth method has what a
+// login needs: Consul accepts the method without it, and the problem only
+// shows when someone logs in.
+func validateOIDC(m AuthMethod) error {
+	for _, k := range []string{"OIDCDiscoveryURL", "OIDCClientID", "OIDCClientSecret"} {
+		if s, _ := m.Config[k].(string); s == "" {
+			return fmt.Errorf("config %s is required", k)
+		}
+	}
+	if err := validateURL(m.Config["OIDCDiscoveryURL"].(string)); err != nil {
+		return fmt.Errorf("config OIDCDiscoveryURL: %w", err)
+	}
+	uris, _ := m.Config["AllowedRedirectURIs"].([]interface{})
+	if len(uris) == 0 {
+		return fmt.Errorf("config AllowedRedirectURIs needs at least one URI")
+	}
+	for _, u := range uris {
+		s, _ := u.(string)
+		if err := validateURL(s); err != nil {
+			return fmt.Errorf("config AllowedRedirectURIs: %w", err)
+		}
+	}
+	// Claims map to metadata a binding rule selects on, so each metadata
+	// name can come from only one claim.
+	targets := make(map[string]string)
+	for _, k := range []string{"ClaimMappings", "ListClaimMappings"} {
+		v, ok := m.Config[k]
+		if !ok {
+			continue
+		}
+		mappings, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config %s must map claims to metadata names", k)
+		}
+		claims := make([]string, 0, len(mappings))
+		for claim := range mappings {
+			claims = append(claims, claim)
+		}
+		sort.Strings(claims)
+		for _, claim := range claims {
+			name, _ := mappings[claim].(string)
+			if name == "" {
+				return fmt.Errorf("config %s maps claim %q to no metadata name", k, claim)
+			}
+			if other, ok := targets[name]; ok {
+				return fmt.Errorf("config %s maps claim %q to %q, which claim %q maps to as well", k, claim, name, other)
+			}
+			targets[name] = claim
+		}
+	}
+	return nil
+}
+
+// validateURL checks that s is an absolute http or https URL.
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", s)
+	}
+	return nil
+}
+
+// validateOrdering checks the wave and depends_on entries of resource n.
+func validateOrdering(n Node, tenancy Tenancy, o Ordering) error {
+	if o.Wave < 0 {
+		return fmt.Errorf("%s has a negative wave", n)
+	}
+	for _, dep := range o.DependsOn {
+		if _, err := dependencyNode(dep, tenancy); err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// IsUUID reports whether s is in the 8-4-4-4-12 hex form Consul requires for
+// token identifiers.
+func IsUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ExpandTemplate evaluates a text/template string against a token, as used by
+// the kubernetes_secret name and namespace.
+func ExpandTemplate(text string, t Token) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, t); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,355 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestValidateTokenIDs(t *testing.T) {
+	const (
+		accessor = "3b2a1c00-0000-4000-8000-000000000001"
+		secret   = "9f1c7d00-0000-4000-8000-000000000001"
+	)
+	tests := []struct {
+		name    string
+		tokens  []Token
+		wantErr bool
+	}{
+		{"pinned ids", []Token{{AccessorID: accessor, SecretID: secret}}, false},
+		{"accessor not a uuid", []Token{{AccessorID: "web", SecretID: secret}}, true},
+		{"secret not a uuid", []Token{{AccessorID: accessor, SecretID: "hunter2"}}, true},
+		{"secret equals accessor", []Token{{AccessorID: accessor, SecretID: accessor}}, true},
+		{"secret reused", []Token{
+			{AccessorID: accessor, SecretID: secret},
+			{AccessorID: "3b2a1c00-0000-4000-8000-000000000002", SecretID: secret},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(&Config{Tokens: tt.tokens})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	ignore := Ignore{
+		Policies: []string{"legacy-*"},
+		Tokens:   []string{"00000000-1111-*", "vault *"},
+	}
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"policy glob", ignore.Policy("legacy-read"), true},
+		{"policy other", ignore.Policy("web-read"), false},
+		{"token by accessor", ignore.Token("00000000-1111-4000-8000-000000000001", ""), true},
+		{"token by description", ignore.Token("3b2a1c00-0000-4000-8000-000000000001", "vault issued"), true},
+		{"token other", ignore.Token("3b2a1c00-0000-4000-8000-000000000001", "web"), false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if err := validate(&Config{Ignore: Ignore{Policies: []string{"["}}}); err == nil {
+		t.Error("validate accepted a malformed ignore pattern")
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	ns := Tenancy{Namespace: "team-a"}
+	cfg := &Config{
+		Policies: []Policy{{Name: "web"}, {Name: "db", Tenancy: ns}},
+		Tokens: []Token{
+			{AccessorID: "a", Policies: []string{"web", "legacy"}},
+			{AccessorID: "b", Policies: []string{"db", "web"}, Tenancy: ns},
+		},
+	}
+	g := BuildGraph(cfg)
+
+	needs := g.Needs(TokenNode(cfg.Tokens[0]))
+	if len(needs) != 1 || needs[0] != PolicyNode(cfg.Policies[0]) {
+		t.Errorf("token a needs %v, want [policy web]", needs)
+	}
+	needs = g.Needs(TokenNode(cfg.Tokens[1]))
+	if len(needs) != 1 || needs[0] != PolicyNode(cfg.Policies[1]) {
+		t.Errorf("token b needs %v, want [policy team-a db]", needs)
+	}
+
+	var undefined []string
+	for _, r := range g.Undefined() {
+		undefined = append(undefined, r.From.Key+" -> "+r.To.Key)
+	}
+	want := []string{"a -> legacy", "b -> " + ns.Qualify("web")}
+	if len(undefined) != len(want) || undefined[0] != want[0] || undefined[1] != want[1] {
+		t.Errorf("Undefined = %v, want %v", undefined, want)
+	}
+	if c := g.Cycle(); c != nil {
+		t.Errorf("Cycle = %v, want none", c)
+	}
+}
+
+func TestBuildGraphNamespaces(t *testing.T) {
+	cfg := &Config{
+		Namespaces: []Namespace{{Name: "team-a", PolicyDefaults: []string{"base"}}},
+		Policies:   []Policy{{Name: "base"}, {Name: "db", Tenancy: Tenancy{Namespace: "team-a"}}},
+	}
+	g := BuildGraph(cfg)
+
+	// The namespace needs its default policy, in the default namespace,
+	// and the policy in the namespace needs the namespace.
+	needs := g.Needs(NamespaceNode(cfg.Namespaces[0]))
+	if len(needs) != 1 || needs[0] != PolicyNode(cfg.Policies[0]) {
+		t.Errorf("namespace team-a needs %v, want [policy base]", needs)
+	}
+	needs = g.Needs(PolicyNode(cfg.Policies[1]))
+	if len(needs) != 1 || needs[0] != NamespaceNode(cfg.Namespaces[0]) {
+		t.Errorf("policy db needs %v, want [namespace team-a]", needs)
+	}
+	if u := g.Undefined(); len(u) != 0 {
+		t.Errorf("Undefined = %v, want none", u)
+	}
+}
+
+func TestBuildGraphPartitions(t *testing.T) {
+	cfg := &Config{
+		AdminPartitions: []Partition{{Name: "team-b"}},
+		Namespaces:      []Namespace{{Name: "web", Partition: "team-b"}},
+		Policies: []Policy{
+			{Name: "base", Tenancy: Tenancy{Partition: "team-b"}},
+			{Name: "app", Tenancy: Tenancy{Partition: "team-b", Namespace: "web"}},
+		},
+	}
+	g := BuildGraph(cfg)
+
+	// A resource needs its namespace of the config, or else its partition.
+	partition := PartitionNode(cfg.AdminPartitions[0])
+	for _, n := range []Node{NamespaceNode(cfg.Namespaces[0]), PolicyNode(cfg.Policies[0])} {
+		if needs := g.Needs(n); len(needs) != 1 || needs[0] != partition {
+			t.Errorf("%s needs %v, want [%s]", n, needs, partition)
+		}
+	}
+	if needs := g.Needs(PolicyNode(cfg.Policies[1])); len(needs) != 1 || needs[0] != NamespaceNode(cfg.Namespaces[0]) {
+		t.Errorf("policy app needs %v, want [namespace team-b/web]", needs)
+	}
+}
+
+func TestValidateOrdering(t *testing.T) {
+	const accessor = "3b2a1c00-0000-4000-8000-000000000001"
+	token := func(o Ordering) Token {
+		return Token{AccessorID: accessor, SecretID: "9f1c7d00-0000-4000-8000-000000000001", Policies: []string{"web"}, Ordering: o}
+	}
+	tests := []struct {
+		name     string
+		policies []Policy
+		tokens   []Token
+		wantErr  bool
+	}{
+		{"depends on policy", []Policy{{Name: "web"}, {Name: "replication", Ordering: Ordering{DependsOn: []string{"policy:web"}}}}, nil, false},
+		{"cycle", []Policy{{Name: "web", Ordering: Ordering{DependsOn: []string{"token:" + accessor}}}}, []Token{token(Ordering{})}, true},
+		{"undefined", []Policy{{Name: "web", Ordering: Ordering{DependsOn: []string{"policy:legacy"}}}}, nil, true},
+		{"malformed", []Policy{{Name: "web", Ordering: Ordering{DependsOn: []string{"web"}}}}, nil, true},
+		{"negative wave", []Policy{{Name: "web", Ordering: Ordering{Wave: -1}}}, nil, true},
+		{"later wave", []Policy{{Name: "web"}}, []Token{token(Ordering{Wave: 1})}, false},
+		{"earlier wave", []Policy{{Name: "web", Ordering: Ordering{Wave: 1}}}, []Token{token(Ordering{})}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(&Config{Policies: tt.policies, Tokens: tt.tokens})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	g := BuildGraph(&Config{Policies: []Policy{{Name: "web", Ordering: Ordering{Wave: 2}}}})
+	if w := g.Wave(PolicyNode(Policy{Name: "web"})); w != 2 {
+		t.Errorf("Wave = %d, want 2", w)
+	}
+}
+
+func TestEncryptionPlaintext(t *testing.T) {
+	// Without recipients nothing is encrypted, and plaintext reads as is.
+	data := []byte(`{"policies": {}}`)
+	out, err := Encryption{}.Encrypt(data)
+	if err != nil || string(out) != string(data) {
+		t.Errorf("Encrypt = %q, %v; want the data unchanged", out, err)
+	}
+	out, err = Decrypt("state", data)
+	if err != nil || string(out) != string(data) {
+		t.Errorf("Decrypt = %q, %v; want the data unchanged", out, err)
+	}
+	if !isAge([]byte("-----BEGIN AGE ENCRYPTED FILE-----\n")) {
+		t.Errorf("isAge did not recognize an armored age file")
+	}
+}
+
+func TestValidateAuthMethod(t *testing.T) {
+	oidc := func(extra map[string]interface{}) AuthMethod {
+		conf := map[string]interface{}{
+			"OIDCDiscoveryURL":    "https://sso.example.com/realm",
+			"OIDCClientID":        "consul",
+			"OIDCClientSecret":    "secret",
+			"AllowedRedirectURIs": []interface{}{"http://localhost:8550/oidc/callback"},
+		}
+		for k, v := range extra {
+			conf[k] = v
+		}
+		return AuthMethod{Name: "sso", Type: "oidc", Config: conf}
+	}
+	tests := []struct {
+		name    string
+		method  AuthMethod
+		wantErr bool
+	}{
+		{"oidc", oidc(map[string]interface{}{"ClaimMappings": map[string]interface{}{"email": "email"}}), false},
+		{"oidc without redirect URIs", oidc(map[string]interface{}{"AllowedRedirectURIs": []interface{}{}}), true},
+		{"oidc with a relative discovery URL", oidc(map[string]interface{}{"OIDCDiscoveryURL": "sso/realm"}), true},
+		{"oidc mapping two claims to one name", oidc(map[string]interface{}{
+			"ClaimMappings":     map[string]interface{}{"email": "user"},
+			"ListClaimMappings": map[string]interface{}{"groups": "user"},
+		}), true},
+		{"valid", AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "8h", TokenLocality: "global"}, false},
+		{"no type", AuthMethod{Name: "k8s"}, true},
+		{"bad ttl", AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "8"}, true},
+		{"ttl too long", AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "48h"}, true},
+		{"bad locality", AuthMethod{Name: "k8s", Type: "kubernetes", TokenLocality: "remote"}, true},
+		{"kubernetes discovery", AuthMethod{Name: "k8s", Type: "kubernetes", Kubernetes: &KubernetesDiscovery{InCluster: true}}, false},
+		{"discovery without a source", AuthMethod{Name: "k8s", Type: "kubernetes", Kubernetes: &KubernetesDiscovery{}}, true},
+		{"discovery for jwt", AuthMethod{Name: "jwt", Type: "jwt", Kubernetes: &KubernetesDiscovery{Kubeconfig: "kubeconfig"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(&Config{AuthMethods: []AuthMethod{tt.method}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMergeKeys(t *testing.T) {
+	const head = `
+x-token: &token
+  description: shared
+  policies: &read [web-read]
+x-roles: &roles
+  roles: [web]
+policies:
+  - name: web-read
+    rules: 'key_prefix "web/" { policy = "read" }'
+roles:
+  - name: web
+    policies: *read
+`
+	cfg, err := Parse([]byte(head + `
+tokens:
+  - <<: *token
+    description: after
+    accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 9f1c7d00-0000-4000-8000-000000000001
+  - description: before
+    <<: *token
+    accessor_id: 3b2a1c00-0000-4000-8000-000000000002
+    secret_id: 9f1c7d00-0000-4000-8000-000000000002
+  - <<: [*roles, *token]
+    accessor_id: 3b2a1c00-0000-4000-8000-000000000003
+    secret_id: 9f1c7d00-0000-4000-8000-000000000003
+    policies: *read
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tok := range cfg.Tokens {
+		got = append(got, fmt.Sprintf("%s %v %v", tok.Description, tok.Policies, tok.Roles))
+	}
+	want := "after [web-read] []; before [web-read] []; shared [web-read] [web]"
+	if strings.Join(got, "; ") != want {
+		t.Errorf("tokens = %s, want %s", strings.Join(got, "; "), want)
+	}
+
+	// Validation sees the expanded config.
+	_, err = Parse([]byte(head + `
+x-pinned: &pinned
+  accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+tokens:
+  - <<: [*pinned, *token]
+    secret_id: 9f1c7d00-0000-4000-8000-000000000001
+  - <<: *pinned
+    secret_id: 9f1c7d00-0000-4000-8000-000000000002
+`))
+	if err == nil || !strings.Contains(err.Error(), "duplicate token accessor_id") {
+		t.Errorf("a merged duplicate accessor_id: err = %v", err)
+	}
+	if _, err := Parse([]byte(head + "tokens:\n  - <<: *missing\n")); err == nil {
+		t.Error("Parse accepted a merge of an unknown anchor")
+	}
+}
+
+func TestLoadDecryptsVerifiedBytes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake sops is a shell script")
+	}
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	signed := "policies:\n  - name: signed\n    rules: 'key_prefix \"a/\" { policy = \"read\" }'\nsops:\n  version: 3.8.1\n"
+	if err := os.WriteFile(path, []byte(signed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "key")
+	for _, args := range [][]string{
+		{"-q", "-t", "ed25519", "-N", "", "-f", key},
+		{"-q", "-Y", "sign", "-n", sshSignatureNamespace, "-f", key, path},
+	} {
+		if out, err := exec.Command("ssh-keygen", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ssh-keygen %v: %v: %s", args, err, out)
+		}
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := filepath.Join(dir, "allowed_signers")
+	if err := os.WriteFile(allowed, []byte("ops@example.com "+string(pub)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake sops swaps the config file, as an attacker would once the
+	// signature has been checked, then decrypts the file it was given by
+	// dropping the sops metadata.
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(signed, "signed", "tampered", 1)
+	script := fmt.Sprintf("#!/bin/sh\nprintf '%%s' '%s' > %q\nfor f; do :; done\nsed '/^sops:/,$d' \"$f\"\n", tampered, path)
+	if err := os.WriteFile(filepath.Join(bin, "sops"), []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg, err := Load(path, SignatureCheck{Mode: "ssh", Key: allowed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !strings.Contains(string(got), "tampered") {
+		t.Fatal("the fake sops did not swap the config")
+	}
+	if len(cfg.Policies) != 1 || cfg.Policies[0].Name != "signed" {
+		t.Errorf("Load parsed %d policies, the first %q; want the signed policy only", len(cfg.Policies), cfg.Policies[0].Name)
+	}
+}
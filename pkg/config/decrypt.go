@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// ageHeaders start every age-encrypted file, binary and armored.
+var ageHeaders = [][]byte{
+	[]byte("age-encryption.org/v1\n"),
+	[]byte("-----BEGIN AGE ENCRYPTED FILE-----"),
+}
+
+// decryptConfig returns the plaintext of an encrypted config, or data
+// unchanged when it is not encrypted. Decryption is delegated to the sops and
+// age binaries so key handling (KMS, PGP, age identities) follows their usual
+// environment variables. Both read data on stdin rather than the file, which
+// may have changed since its signature was verified.
+func decryptConfig(data []byte) ([]byte, error) {
+	if isAge(data) {
+		return decryptAge("config", data)
+	}
+	if isSOPS(data) {
+		return decryptWith("config", "sops", []string{"--decrypt", "--input-type", "yaml", "--output-type", "yaml", "/dev/stdin"}, data)
+	}
+	return data, nil
+}
+
+// isAge reports whether data is an age ciphertext.
+func isAge(data []byte) bool {
+	for _, h := range ageHeaders {
+		if bytes.HasPrefix(data, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt returns the plaintext of a file the tool wrote, which is encrypted
+// when the config that wrote it had encryption set; what names the file in
+// errors. data is returned unchanged when it is not encrypted, so files
+// written before encryption was set still read.
+func Decrypt(what string, data []byte) ([]byte, error) {
+	if !isAge(data) {
+		return data, nil
+	}
+	return decryptAge(what, data)
+}
+
+// Encrypt encrypts data to the recipients of e with the age binary, ASCII
+// armored so the file stays text. Without recipients data is returned as is.
+func (e Encryption) Encrypt(data []byte) ([]byte, error) {
+	if len(e.AgeRecipients) == 0 {
+		return data, nil
+	}
+	args := []string{"--encrypt", "--armor"}
+	for _, r := range e.AgeRecipients {
+		args = append(args, "--recipient", r)
+	}
+	out, err := runExternal("age", args, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+	return out, nil
+}
+
+// isSOPS reports whether data is a SOPS-encrypted YAML document, which carries
+// its key metadata under a top-level sops key.
+func isSOPS(data []byte) bool {
+	var doc struct {
+		SOPS map[string]interface{} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	return doc.SOPS != nil
+}
+
+// decryptAge decrypts a whole-file age ciphertext with the identity file named
+// by AGE_IDENTITY, or SOPS_AGE_KEY_FILE so one key serves both formats. what
+// names the file in errors.
+func decryptAge(what string, data []byte) ([]byte, error) {
+	identity := os.Getenv("AGE_IDENTITY")
+	if identity == "" {
+		identity = os.Getenv("SOPS_AGE_KEY_FILE")
+	}
+	if identity == "" {
+		return nil, fmt.Errorf("%s is age-encrypted but neither AGE_IDENTITY nor SOPS_AGE_KEY_FILE is set", what)
+	}
+	return decryptWith(what, "age", []string{"--decrypt", "--identity", identity}, data)
+}
+
+func decryptWith(what, name string, args []string, stdin []byte) ([]byte, error) {
+	out, err := runExternal(name, args, stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", what, err)
+	}
+	return out, nil
+}
+
+// runExternal runs a helper binary and returns its stdout. Its stderr is
+// folded into the error so the helper's own diagnosis is not lost.
+func runExternal(name string, args []string, stdin []byte) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
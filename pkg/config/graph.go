@@ -0,0 +1,289 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Node is a resource of the config in the dependency graph.
+type Node struct {
+	Kind string // "namespace", "policy", "role", "token" or "auth-method"
+	Key  string // Namespace.Key, Policy.Key, Role.Key, Token.AccessorID or AuthMethod.Key
+}
+
+func (n Node) String() string {
+	return fmt.Sprintf("%s %q", n.Kind, n.Key)
+}
+
+// PolicyNode is the node of p.
+func PolicyNode(p Policy) Node { return Node{Kind: "policy", Key: p.Key()} }
+
+// RoleNode is the node of r.
+func RoleNode(r Role) Node { return Node{Kind: "role", Key: r.Key()} }
+
+// TokenNode is the node of t.
+func TokenNode(t Token) Node { return Node{Kind: "token", Key: t.AccessorID} }
+
+// NamespaceNode is the node of n.
+func NamespaceNode(n Namespace) Node { return Node{Kind: "namespace", Key: n.Key()} }
+
+// PartitionNode is the node of p.
+func PartitionNode(p Partition) Node { return Node{Kind: "partition", Key: p.Name} }
+
+// AuthMethodNode is the node of m.
+func AuthMethodNode(m AuthMethod) Node { return Node{Kind: "auth-method", Key: m.Key()} }
+
+// Reference is an edge of the graph: From needs To to exist before it is
+// written.
+type Reference struct {
+	From, To Node
+	// Defined reports whether the config declares To. A resource it does
+	// not declare must already exist in Consul.
+	Defined bool
+	// Declared marks a depends_on entry, as opposed to a link the config
+	// implies, and must name a resource of the config.
+	Declared bool
+}
+
+// Graph holds the dependencies between the resources of a config: a role
+// depends on each policy it references, and a token on each policy and role,
+// looked up in the role's or token's partition and namespace; a namespace on
+// its default policies and roles, and a resource on the namespace of the
+// config it lives in, or else on its partition of the config; and any
+// resource on those it lists in depends_on.
+// Apply ordering follows it, wave by wave, so a resource is written only
+// once everything it needs exists.
+type Graph struct {
+	nodes []Node
+	refs  map[Node][]Reference
+	waves map[Node]int
+}
+
+// BuildGraph returns the dependency graph of cfg.
+func BuildGraph(cfg *Config) *Graph {
+	g := &Graph{refs: make(map[Node][]Reference), waves: make(map[Node]int)}
+	defined := make(map[Node]bool)
+	add := func(n Node, tenancy Tenancy, o Ordering) {
+		g.nodes = append(g.nodes, n)
+		defined[n] = true
+		g.waves[n] = o.Wave
+		for _, dep := range o.DependsOn {
+			// validate reports malformed entries before the graph is used.
+			if to, err := dependencyNode(dep, tenancy); err == nil {
+				g.refs[n] = append(g.refs[n], Reference{From: n, To: to, Declared: true})
+			}
+		}
+	}
+	link := func(n Node, to Node) {
+		g.refs[n] = append(g.refs[n], Reference{From: n, To: to})
+	}
+	// A resource in a namespace or partition of the config is written once
+	// it exists. The default namespace and partition always do.
+	partitions := make(map[string]Node)
+	for _, p := range cfg.AdminPartitions {
+		n := PartitionNode(p)
+		add(n, Tenancy{}, p.Ordering)
+		if orDefault(p.Name) != "default" {
+			partitions[p.Name] = n
+		}
+	}
+	inPartition := func(n Node, partition string) {
+		if p, ok := partitions[orDefault(partition)]; ok {
+			link(n, p)
+		}
+	}
+	namespaces := make(map[Tenancy]Node)
+	for _, ns := range cfg.Namespaces {
+		n := NamespaceNode(ns)
+		add(n, ns.Defaults(), ns.Ordering)
+		inPartition(n, ns.Partition)
+		for _, name := range ns.PolicyDefaults {
+			link(n, PolicyNode(Policy{Name: name, Tenancy: ns.Defaults()}))
+		}
+		for _, name := range ns.RoleDefaults {
+			link(n, RoleNode(Role{Name: name, Tenancy: ns.Defaults()}))
+		}
+		if orDefault(ns.Name) != "default" {
+			namespaces[Tenancy{Partition: orDefault(ns.Partition), Namespace: ns.Name}] = n
+		}
+	}
+	inNamespace := func(n Node, t Tenancy) {
+		if ns, ok := namespaces[Tenancy{Partition: orDefault(t.Partition), Namespace: orDefault(t.Namespace)}]; ok {
+			link(n, ns)
+			return
+		}
+		inPartition(n, t.Partition)
+	}
+	for _, p := range cfg.Policies {
+		add(PolicyNode(p), p.Tenancy, p.Ordering)
+		inNamespace(PolicyNode(p), p.Tenancy)
+	}
+	for _, r := range cfg.Roles {
+		n := RoleNode(r)
+		add(n, r.Tenancy, r.Ordering)
+		inNamespace(n, r.Tenancy)
+		for _, name := range r.Policies {
+			link(n, PolicyNode(Policy{Name: name, Tenancy: r.Tenancy}))
+		}
+	}
+	for _, t := range cfg.Tokens {
+		n := TokenNode(t)
+		add(n, t.Tenancy, t.Ordering)
+		inNamespace(n, t.Tenancy)
+		for _, name := range t.Policies {
+			link(n, PolicyNode(Policy{Name: name, Tenancy: t.Tenancy}))
+		}
+		for _, name := range t.Roles {
+			link(n, RoleNode(Role{Name: name, Tenancy: t.Tenancy}))
+		}
+	}
+	for _, m := range cfg.AuthMethods {
+		add(AuthMethodNode(m), m.Tenancy, m.Ordering)
+		inNamespace(AuthMethodNode(m), m.Tenancy)
+	}
+	for n, refs := range g.refs {
+		for i := range refs {
+			refs[i].Defined = defined[refs[i].To]
+		}
+		g.refs[n] = refs
+	}
+	return g
+}
+
+// dependencyNode parses a depends_on entry of a resource in tenancy.
+func dependencyNode(dep string, tenancy Tenancy) (Node, error) {
+	kind, key, ok := strings.Cut(dep, ":")
+	switch {
+	case !ok || key == "":
+	case kind == "token":
+		return Node{Kind: "token", Key: key}, nil
+	case kind == "partition":
+		return PartitionNode(Partition{Name: key}), nil
+	case kind == "namespace":
+		n := Namespace{Name: key, Partition: tenancy.Partition}
+		if partition, name, ok := strings.Cut(key, "/"); ok {
+			n = Namespace{Name: name, Partition: partition}
+		}
+		return NamespaceNode(n), nil
+	case kind == "policy", kind == "role", kind == "auth-method":
+		name := key
+		if parts := strings.Split(key, "/"); len(parts) == 3 {
+			name, tenancy = parts[2], Tenancy{Partition: parts[0], Namespace: parts[1]}
+		}
+		switch kind {
+		case "role":
+			return RoleNode(Role{Name: name, Tenancy: tenancy}), nil
+		case "auth-method":
+			return AuthMethodNode(AuthMethod{Name: name, Tenancy: tenancy}), nil
+		}
+		return PolicyNode(Policy{Name: name, Tenancy: tenancy}), nil
+	}
+	return Node{}, fmt.Errorf("invalid depends_on %q: want policy:<name>, role:<name>, auth-method:<name>, namespace:<name>, partition:<name> or token:<accessor_id>", dep)
+}
+
+// Wave returns the wave of n: 0 unless the config sets one.
+func (g *Graph) Wave(n Node) int {
+	if g == nil {
+		return 0
+	}
+	return g.waves[n]
+}
+
+// Needs returns the resources of the config n depends on. A nil graph has
+// no dependencies.
+func (g *Graph) Needs(n Node) []Node {
+	if g == nil {
+		return nil
+	}
+	var needs []Node
+	for _, r := range g.refs[n] {
+		if r.Defined {
+			needs = append(needs, r.To)
+		}
+	}
+	return needs
+}
+
+// Undefined returns the implied references to resources the config does
+// not declare, in config order.
+func (g *Graph) Undefined() []Reference {
+	var undefined []Reference
+	for _, n := range g.nodes {
+		for _, r := range g.refs[n] {
+			if !r.Defined && !r.Declared {
+				undefined = append(undefined, r)
+			}
+		}
+	}
+	return undefined
+}
+
+// check reports the depends_on entries naming resources the config does not
+// declare, and the resources that need one of a later wave, which apply
+// would wait for forever.
+func (g *Graph) check() error {
+	var errs []error
+	for _, n := range g.nodes {
+		for _, r := range g.refs[n] {
+			switch {
+			case r.Declared && !r.Defined:
+				errs = append(errs, fmt.Errorf("%s depends on %s, which the config does not define", n, r.To))
+			case r.Defined && g.waves[r.To] > g.waves[n]:
+				errs = append(errs, fmt.Errorf("%s in wave %d needs %s of the later wave %d", n, g.waves[n], r.To, g.waves[r.To]))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Cycle returns a dependency cycle, its first node repeated at the end, or
+// nil when the graph has none.
+func (g *Graph) Cycle() []Node {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[Node]int)
+	var path []Node
+	var visit func(Node) []Node
+	visit = func(n Node) []Node {
+		state[n] = visiting
+		path = append(path, n)
+		for _, m := range g.Needs(n) {
+			switch state[m] {
+			case visiting:
+				for i := range path {
+					if path[i] == m {
+						return append(append([]Node(nil), path[i:]...), m)
+					}
+				}
+			case unvisited:
+				if c := visit(m); c != nil {
+					return c
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[n] = visited
+		return nil
+	}
+	for _, n := range g.nodes {
+		if state[n] == unvisited {
+			if c := visit(n); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// formatCycle renders a cycle as a -> b -> a.
+func formatCycle(c []Node) string {
+	parts := make([]string, len(c))
+	for i, n := range c {
+		parts[i] = n.String()
+	}
+	return strings.Join(parts, " -> ")
+}
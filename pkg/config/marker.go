@@ -0,0 +1,84 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DescriptionMarker is text added before and after the description of every
+// resource written, such as "managed-by: consul-acl-sync", so live resources
+// say where they come from. Both are templates rendered with MarkerData and
+// an env function. Descriptions read back are compared without them, so a
+// marker that renders differently, for another commit, is no change.
+type DescriptionMarker struct {
+	Prefix string `yaml:"prefix"`
+	Suffix string `yaml:"suffix"`
+}
+
+// MarkerData is what description markers are rendered with.
+type MarkerData struct {
+	// Commit is the Git commit the config came from, when known.
+	Commit string
+	// Config is the path of the config.
+	Config string
+}
+
+// markerHole stands in for every value while a marker is turned into a
+// pattern; it cannot appear in YAML text.
+const markerHole = "\x00"
+
+// Render renders the prefix and suffix.
+func (m DescriptionMarker) Render(data MarkerData) (prefix, suffix string, err error) {
+	if prefix, err = renderMarker(m.Prefix, data, os.Getenv); err != nil {
+		return "", "", fmt.Errorf("description_marker prefix: %w", err)
+	}
+	if suffix, err = renderMarker(m.Suffix, data, os.Getenv); err != nil {
+		return "", "", fmt.Errorf("description_marker suffix: %w", err)
+	}
+	return prefix, suffix, nil
+}
+
+// Patterns returns patterns matching the prefix at the start of a
+// description and the suffix at its end, whatever their values rendered to;
+// nil for those that are not set.
+func (m DescriptionMarker) Patterns() (prefix, suffix *regexp.Regexp, err error) {
+	hole := MarkerData{Commit: markerHole, Config: markerHole}
+	holes := func(string) string { return markerHole }
+	pattern := func(text, anchored string) (*regexp.Regexp, error) {
+		if text == "" {
+			return nil, nil
+		}
+		out, err := renderMarker(text, hole, holes)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.Split(out, markerHole)
+		for i, p := range parts {
+			parts[i] = regexp.QuoteMeta(p)
+		}
+		return regexp.Compile(strings.Replace(anchored, "%s", strings.Join(parts, ".*?"), 1))
+	}
+	if prefix, err = pattern(m.Prefix, "^(?:%s)"); err != nil {
+		return nil, nil, fmt.Errorf("description_marker prefix: %w", err)
+	}
+	if suffix, err = pattern(m.Suffix, "(?:%s)$"); err != nil {
+		return nil, nil, fmt.Errorf("description_marker suffix: %w", err)
+	}
+	return prefix, suffix, nil
+}
+
+func renderMarker(text string, data MarkerData, env func(string) string) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(template.FuncMap{"env": env}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/goccy/go-yaml/ast"
+)
+
+// resolveMerges expands the << merge keys under node in place, as the YAML
+// merge key type has them: keys written in the mapping win over merged ones
+// wherever the << is, and of a list of merged mappings the earlier wins. The
+// decoder instead takes a written key that a merge also sets for a duplicate,
+// which rules out the main use of merging, overriding a shared default.
+// Once expanded, validation sees every token, role and policy as if written
+// out in full. anchors collects the anchors met so far, in document order.
+func resolveMerges(node ast.Node, anchors map[string]ast.Node) error {
+	switch n := node.(type) {
+	case *ast.DocumentNode:
+		return resolveMerges(n.Body, anchors)
+	case *ast.AnchorNode:
+		if err := resolveMerges(n.Value, anchors); err != nil {
+			return err
+		}
+		anchors[n.Name.GetToken().Value] = n.Value
+	case *ast.TagNode:
+		return resolveMerges(n.Value, anchors)
+	case *ast.SequenceNode:
+		for _, v := range n.Values {
+			if err := resolveMerges(v, anchors); err != nil {
+				return err
+			}
+		}
+	case *ast.MappingValueNode:
+		return resolveMerges(n.Value, anchors)
+	case *ast.MappingNode:
+		for _, mv := range n.Values {
+			if err := resolveMerges(mv.Value, anchors); err != nil {
+				return err
+			}
+		}
+		return mergeMapping(n, anchors)
+	}
+	return nil
+}
+
+// mergeMapping replaces the << entries of n with the entries they merge.
+func mergeMapping(n *ast.MappingNode, anchors map[string]ast.Node) error {
+	set := make(map[string]bool)
+	merges := false
+	for _, mv := range n.Values {
+		if mv.Key.IsMergeKey() {
+			merges = true
+		} else {
+			set[keyName(mv.Key)] = true
+		}
+	}
+	if !merges {
+		return nil
+	}
+
+	var values []*ast.MappingValueNode
+	for _, mv := range n.Values {
+		if !mv.Key.IsMergeKey() {
+			values = append(values, mv)
+			continue
+		}
+		sources := []ast.Node{mv.Value}
+		if seq, ok := mv.Value.(*ast.SequenceNode); ok {
+			sources = seq.Values
+		}
+		for _, src := range sources {
+			m, err := mergeSource(src, anchors)
+			if err != nil {
+				return err
+			}
+			for _, merged := range m.Values {
+				if name := keyName(merged.Key); !set[name] {
+					set[name] = true
+					values = append(values, merged)
+				}
+			}
+		}
+	}
+	n.Values = values
+	return nil
+}
+
+// mergeSource returns the mapping a << entry merges: an alias of one, or one
+// written in place.
+func mergeSource(src ast.Node, anchors map[string]ast.Node) (*ast.MappingNode, error) {
+	switch s := src.(type) {
+	case *ast.AliasNode:
+		name := s.Value.GetToken().Value
+		target, ok := anchors[name]
+		if !ok {
+			return nil, fmt.Errorf("line %d: << merges unknown anchor %q", s.GetToken().Position.Line, name)
+		}
+		return mergeSource(target, anchors)
+	case *ast.AnchorNode:
+		return mergeSource(s.Value, anchors)
+	case *ast.MappingNode:
+		return s, nil
+	case *ast.MappingValueNode:
+		// A mapping of one entry.
+		return &ast.MappingNode{BaseNode: &ast.BaseNode{}, Values: []*ast.MappingValueNode{s}}, nil
+	}
+	return nil, fmt.Errorf("line %d: << merges a mapping or a list of them, not %s", src.GetToken().Position.Line, src.Type())
+}
+
+func keyName(k ast.MapKeyNode) string {
+	if s, ok := k.(*ast.StringNode); ok {
+		return s.Value
+	}
+	return k.GetToken().Value
+}
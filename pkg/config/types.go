@@ -0,0 +1,564 @@
+// Package config loads, verifies and validates the consul-acl-sync YAML
+// configuration.
+package config
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Config is the YAML configuration consul-acl-sync applies. The same file is
+// read by consul-acl-diff.
+type Config struct {
+	// SecretsBackend selects where token secrets and the management token
+	// live when they are kept out of the file: "vault" or "aws".
+	SecretsBackend      string      `yaml:"secrets_backend"`
+	ManagementTokenPath string      `yaml:"management_token_path"`
+	Vault               VaultConfig `yaml:"vault"`
+	AWS                 AWSConfig   `yaml:"aws"`
+	Consul              Consul      `yaml:"consul"`
+
+	Notifications []Notification `yaml:"notifications"`
+	Audit         AuditConfig    `yaml:"audit"`
+	Backup        BackupConfig   `yaml:"backup"`
+	History       HistoryConfig  `yaml:"history"`
+	Hooks         Hooks          `yaml:"hooks"`
+	Metrics       MetricsConfig  `yaml:"metrics"`
+	Ignore        Ignore         `yaml:"ignore"`
+	IgnoreFields  IgnoreFields   `yaml:"ignore_fields"`
+	Lint          Lint           `yaml:"lint"`
+	Encryption    Encryption     `yaml:"encryption"`
+
+	// Strict fails every plan on a token referencing a policy that neither
+	// this config nor Consul defines, as -strict does.
+	Strict bool `yaml:"strict"`
+
+	// DescriptionMarker is added to the description of every resource
+	// written.
+	DescriptionMarker DescriptionMarker `yaml:"description_marker"`
+
+	// AdminPartitions are the admin partitions the config declares, named
+	// "partitions" in the file.
+	AdminPartitions []Partition  `yaml:"partitions"`
+	Namespaces      []Namespace  `yaml:"namespaces"`
+	Policies        []Policy     `yaml:"policies"`
+	Roles           []Role       `yaml:"roles"`
+	Tokens          []Token      `yaml:"tokens"`
+	AuthMethods     []AuthMethod `yaml:"auth_methods"`
+}
+
+// Encryption encrypts the files the tool writes locally at rest: the state
+// file, backups and Kubernetes secret manifests.
+type Encryption struct {
+	// AgeRecipients are the age recipients the files are encrypted to: age
+	// public keys, SSH public keys or plugin recipients. Reading the files
+	// back takes an identity, found as for an age-encrypted config.
+	AgeRecipients []string `yaml:"age_recipients"`
+}
+
+// VaultConfig locates the Vault server. The Vault token itself is read from
+// VAULT_TOKEN only.
+type VaultConfig struct {
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+	// KVVersion is the version of the KV secrets engine the secret paths
+	// are in, 1 or 2. Unset, Vault is asked the engine of each mount.
+	KVVersion int `yaml:"kv_version"`
+}
+
+// AWSConfig selects the AWS service holding secrets, "secretsmanager" (the
+// default) or "ssm". Credentials come from the standard AWS environment
+// variables, the ECS task role or the EC2 instance profile.
+type AWSConfig struct {
+	Service  string `yaml:"service"`
+	Region   string `yaml:"region"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Consul tunes the requests sent to the cluster this config applies to.
+type Consul struct {
+	// Headers are added to every request, e.g. for an authenticating proxy in
+	// front of the cluster. Values that are credentials can come from the
+	// environment instead, through HeadersEnv, which maps a header name to
+	// the variable holding its value.
+	Headers    map[string]string `yaml:"headers"`
+	HeadersEnv map[string]string `yaml:"headers_env"`
+
+	// Consistency is the consistency mode of reads: "default", "consistent"
+	// or "stale". The -consistency flag overrides it.
+	Consistency string `yaml:"consistency"`
+
+	// RateLimit caps requests a second to the cluster; 0 is unlimited. The
+	// -rate-limit flag overrides it.
+	RateLimit float64 `yaml:"rate_limit"`
+}
+
+// Notification is a destination told about apply results.
+type Notification struct {
+	// Type is "webhook" (the default, a JSON document), "slack" or "teams".
+	Type string `yaml:"type"`
+	// URL is the endpoint. Chat webhook URLs are credentials, so URLEnv can
+	// name an environment variable holding it instead.
+	URL    string `yaml:"url"`
+	URLEnv string `yaml:"url_env"`
+	// On lists the outcomes that fire it: "success" (changes applied),
+	// "failure" and "no_changes". It defaults to success and failure.
+	On []string `yaml:"on"`
+}
+
+// AuditConfig says where apply records go. Either or both may be set.
+type AuditConfig struct {
+	// Path is a local JSON Lines file, appended to and never rewritten.
+	Path string `yaml:"path"`
+	// ConsulKVPrefix stores each record under its own key below this prefix.
+	ConsulKVPrefix string `yaml:"consul_kv_prefix"`
+}
+
+// BackupConfig says where ACL state backups go.
+type BackupConfig struct {
+	// Dir receives the archives of the backup command and, when set, an
+	// archive taken before every apply that has changes.
+	Dir string `yaml:"dir"`
+}
+
+// HistoryConfig records every run that plans against the cluster, with or
+// without changes, so the history command can show it from any machine.
+type HistoryConfig struct {
+	// ConsulKVPrefix stores each run under its own key below this prefix.
+	ConsulKVPrefix string `yaml:"consul_kv_prefix"`
+}
+
+// Hooks are shell commands run around a sync. Each runs with sh -c; a
+// non-zero exit from a pre hook stops the run before anything is changed.
+type Hooks struct {
+	PrePlan   []string `yaml:"pre_plan"`
+	PreApply  []string `yaml:"pre_apply"`
+	PostApply []string `yaml:"post_apply"`
+}
+
+// MetricsConfig pushes run metrics for scheduled one-shot runs, which live
+// too briefly to be scraped. Either or both sinks may be set.
+type MetricsConfig struct {
+	// Pushgateway is the Prometheus Pushgateway base URL.
+	Pushgateway string `yaml:"pushgateway"`
+	// Job is the Pushgateway job label; it defaults to consul-acl-sync.
+	Job string `yaml:"job"`
+	// StatsD is the host:port of a StatsD server, reached over UDP.
+	StatsD string `yaml:"statsd"`
+	// Prefix is prepended to StatsD metric names; it defaults to
+	// consul_acl_sync.
+	Prefix string `yaml:"prefix"`
+}
+
+// Ignore lists live resources that are deliberately left out of the config,
+// so they are not reported as orphans. Entries are path.Match patterns.
+type Ignore struct {
+	// Policies match policy names.
+	Policies []string `yaml:"policies"`
+	// Tokens match token accessor IDs or descriptions.
+	Tokens []string `yaml:"tokens"`
+}
+
+// Policy reports whether the policy named name is ignored.
+func (i Ignore) Policy(name string) bool {
+	return matchAny(i.Policies, name)
+}
+
+// Token reports whether the token is ignored.
+func (i Ignore) Token(accessorID, description string) bool {
+	return matchAny(i.Tokens, accessorID) || (description != "" && matchAny(i.Tokens, description))
+}
+
+// IgnoreFields lists, per kind, the fields of managed resources that are left
+// as they are in Consul, for those another system also writes. An ignored
+// field is only set when the resource is created.
+type IgnoreFields struct {
+	// Policies may ignore description and datacenters.
+	Policies []string `yaml:"policies"`
+	// Roles and Tokens may ignore description.
+	Roles  []string `yaml:"roles"`
+	Tokens []string `yaml:"tokens"`
+	// AuthMethods may ignore display_name, description, max_token_ttl and
+	// token_locality.
+	AuthMethods []string `yaml:"auth_methods"`
+	// Namespaces may ignore description and meta.
+	Namespaces []string `yaml:"namespaces"`
+	// Partitions may ignore description.
+	Partitions []string `yaml:"partitions"`
+}
+
+// ignorableFields are the fields each list of IgnoreFields may name. Links
+// and rules are what the config is for, and cannot be ignored.
+var ignorableFields = []struct {
+	key    string
+	fields []string
+	list   func(IgnoreFields) []string
+}{
+	{"policies", []string{"description", "datacenters"}, func(f IgnoreFields) []string { return f.Policies }},
+	{"roles", []string{"description"}, func(f IgnoreFields) []string { return f.Roles }},
+	{"tokens", []string{"description"}, func(f IgnoreFields) []string { return f.Tokens }},
+	{"auth_methods", []string{"display_name", "description", "max_token_ttl", "token_locality"}, func(f IgnoreFields) []string { return f.AuthMethods }},
+	{"namespaces", []string{"description", "meta"}, func(f IgnoreFields) []string { return f.Namespaces }},
+	{"partitions", []string{"description"}, func(f IgnoreFields) []string { return f.Partitions }},
+}
+
+func (f IgnoreFields) validate() error {
+	for _, k := range ignorableFields {
+		for _, field := range k.list(f) {
+			if !contains(k.fields, field) {
+				return fmt.Errorf("ignore_fields.%s has unknown field %q (want one of %s)", k.key, field, strings.Join(k.fields, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// Policy reports whether field is ignored on policies.
+func (f IgnoreFields) Policy(field string) bool { return contains(f.Policies, field) }
+
+// Role reports whether field is ignored on roles.
+func (f IgnoreFields) Role(field string) bool { return contains(f.Roles, field) }
+
+// Token reports whether field is ignored on tokens.
+func (f IgnoreFields) Token(field string) bool { return contains(f.Tokens, field) }
+
+// AuthMethod reports whether field is ignored on auth methods.
+func (f IgnoreFields) AuthMethod(field string) bool { return contains(f.AuthMethods, field) }
+
+// Namespace reports whether field is ignored on namespaces.
+func (f IgnoreFields) Namespace(field string) bool { return contains(f.Namespaces, field) }
+
+// Partition reports whether field is ignored on partitions.
+func (f IgnoreFields) Partition(field string) bool { return contains(f.Partitions, field) }
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Lint sets the severity of each lint check: "error" fails the lint command,
+// "warning" is only reported and "off" disables the check. Checks not listed
+// keep their default severity.
+type Lint struct {
+	Rules map[string]string `yaml:"rules"`
+}
+
+// Tenancy is where a resource lives in Consul Enterprise: its admin
+// partition and namespace. Empty means "default", the only partition and
+// namespace Consul Community Edition has.
+type Tenancy struct {
+	Partition string `yaml:"partition"`
+	Namespace string `yaml:"namespace"`
+}
+
+// IsDefault reports whether t is the default partition and namespace.
+func (t Tenancy) IsDefault() bool {
+	return orDefault(t.Partition) == "default" && orDefault(t.Namespace) == "default"
+}
+
+// String is "partition/namespace".
+func (t Tenancy) String() string {
+	return orDefault(t.Partition) + "/" + orDefault(t.Namespace)
+}
+
+// Qualify returns the fully qualified address of the resource named name:
+// partition/namespace/name.
+func (t Tenancy) Qualify(name string) string {
+	return t.String() + "/" + name
+}
+
+// Partitions returns the admin partitions the config places resources in,
+// sorted, or nil when everything is in the default partition and namespace.
+func (c *Config) Partitions() []string {
+	var tenancies []Tenancy
+	for _, p := range c.Policies {
+		tenancies = append(tenancies, p.Tenancy)
+	}
+	for _, r := range c.Roles {
+		tenancies = append(tenancies, r.Tenancy)
+	}
+	for _, t := range c.Tokens {
+		tenancies = append(tenancies, t.Tenancy)
+	}
+	for _, m := range c.AuthMethods {
+		tenancies = append(tenancies, m.Tenancy)
+	}
+	for _, n := range c.Namespaces {
+		tenancies = append(tenancies, Tenancy{Partition: n.Partition, Namespace: n.Name})
+	}
+	for _, p := range c.AdminPartitions {
+		tenancies = append(tenancies, Tenancy{Partition: p.Name})
+	}
+	seen := map[string]bool{"default": true}
+	tenanted := false
+	for _, t := range tenancies {
+		tenanted = tenanted || !t.IsDefault()
+		seen[orDefault(t.Partition)] = true
+	}
+	if !tenanted {
+		return nil
+	}
+	partitions := make([]string, 0, len(seen))
+	for p := range seen {
+		partitions = append(partitions, p)
+	}
+	sort.Strings(partitions)
+	return partitions
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
+
+// Partition is a Consul Enterprise admin partition, keyed by name.
+type Partition struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+
+	Ordering `yaml:",inline"`
+}
+
+// Namespace is a Consul Enterprise namespace, keyed by name within its
+// admin partition. Its policy and role defaults are linked to every token in
+// it, and live in the default namespace of the partition.
+type Namespace struct {
+	Name           string            `yaml:"name"`
+	Partition      string            `yaml:"partition"`
+	Description    string            `yaml:"description"`
+	PolicyDefaults []string          `yaml:"policy_defaults"`
+	RoleDefaults   []string          `yaml:"role_defaults"`
+	Meta           map[string]string `yaml:"meta"`
+
+	Ordering `yaml:",inline"`
+}
+
+// Key identifies the namespace among those of the config: its name,
+// qualified with its partition outside the default one.
+func (n Namespace) Key() string {
+	if orDefault(n.Partition) == "default" {
+		return n.Name
+	}
+	return n.Partition + "/" + n.Name
+}
+
+// Defaults is where the namespace's policy and role defaults live.
+func (n Namespace) Defaults() Tenancy {
+	return Tenancy{Partition: n.Partition}
+}
+
+// Policy is a Consul ACL policy, keyed by Name within its Tenancy.
+type Policy struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Rules       string   `yaml:"rules"`
+	Datacenters []string `yaml:"datacenters"`
+
+	// Tenancy overrides the default partition and namespace for this
+	// policy (Consul Enterprise).
+	Tenancy `yaml:",inline"`
+
+	Ordering `yaml:",inline"`
+}
+
+// Key identifies the policy among those of the config: its name, qualified
+// when it lives outside the default partition and namespace.
+func (p Policy) Key() string {
+	if p.Tenancy.IsDefault() {
+		return p.Name
+	}
+	return p.Tenancy.Qualify(p.Name)
+}
+
+// Role is a Consul ACL role, keyed by name like a policy. Besides policies,
+// linked by name, it can carry service and node identities and templated
+// policies, which Consul expands into policies of their own.
+type Role struct {
+	Name              string            `yaml:"name"`
+	Description       string            `yaml:"description"`
+	Policies          []string          `yaml:"policies"`
+	ServiceIdentities []ServiceIdentity `yaml:"service_identities"`
+	NodeIdentities    []NodeIdentity    `yaml:"node_identities"`
+	TemplatedPolicies []TemplatedPolicy `yaml:"templated_policies"`
+
+	// Tenancy overrides the default partition and namespace for this role
+	// (Consul Enterprise). Its policies are looked up in the same namespace.
+	Tenancy `yaml:",inline"`
+
+	Ordering `yaml:",inline"`
+}
+
+// Key identifies the role among those of the config, as Policy.Key does.
+func (r Role) Key() string {
+	if r.Tenancy.IsDefault() {
+		return r.Name
+	}
+	return r.Tenancy.Qualify(r.Name)
+}
+
+// ServiceIdentity grants what a service named ServiceName and its sidecar
+// need, in Datacenters or, when empty, all of them.
+type ServiceIdentity struct {
+	ServiceName string   `yaml:"service_name"`
+	Datacenters []string `yaml:"datacenters"`
+}
+
+// NodeIdentity grants what the agent of the node named NodeName in
+// Datacenter needs.
+type NodeIdentity struct {
+	NodeName   string `yaml:"node_name"`
+	Datacenter string `yaml:"datacenter"`
+}
+
+// TemplatedPolicy is one of Consul's built-in policy templates, such as
+// builtin/service, filled in with TemplateVariables and valid in Datacenters
+// or, when empty, all of them.
+type TemplatedPolicy struct {
+	TemplateName      string            `yaml:"template_name"`
+	TemplateVariables TemplateVariables `yaml:"template_variables"`
+	Datacenters       []string          `yaml:"datacenters"`
+}
+
+// TemplateVariables are the inputs of a policy template. Name is the service
+// or node the template is for; templates that take no input leave it empty.
+type TemplateVariables struct {
+	Name string `yaml:"name"`
+}
+
+// AuthMethod is a Consul ACL auth method, keyed by name like a policy. The
+// tokens a login through it issues take their lifetime and locality from it.
+type AuthMethod struct {
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type"`
+	DisplayName string `yaml:"display_name"`
+	Description string `yaml:"description"`
+	// MaxTokenTTL bounds the lifetime of the tokens a login issues, as a
+	// duration from 1m to 24h such as "8h". Empty issues tokens that do not
+	// expire.
+	MaxTokenTTL string `yaml:"max_token_ttl"`
+	// TokenLocality is "local", the default, for tokens valid only in the
+	// datacenter of the login, or "global" for tokens replicated to all.
+	TokenLocality string `yaml:"token_locality"`
+	// Config is the configuration of the method's type, passed to Consul as
+	// is, e.g. Host and CACert for kubernetes.
+	Config map[string]interface{} `yaml:"config"`
+	// Kubernetes, for a kubernetes auth method, fills in the Host, CACert
+	// and ServiceAccountJWT that Config leaves out from a cluster's
+	// credentials.
+	Kubernetes *KubernetesDiscovery `yaml:"kubernetes"`
+
+	// Tenancy overrides the default partition and namespace for this auth
+	// method (Consul Enterprise).
+	Tenancy `yaml:",inline"`
+
+	Ordering `yaml:",inline"`
+}
+
+// Key identifies the auth method among those of the config, as Policy.Key
+// does.
+func (m AuthMethod) Key() string {
+	if m.Tenancy.IsDefault() {
+		return m.Name
+	}
+	return m.Tenancy.Qualify(m.Name)
+}
+
+// KubernetesDiscovery reads the address, CA certificate and service account
+// JWT of a Kubernetes cluster, from the pod the tool runs in or a kubeconfig.
+type KubernetesDiscovery struct {
+	// InCluster reads them from the service account mounted into the pod and
+	// the KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT variables.
+	InCluster bool `yaml:"in_cluster"`
+	// Kubeconfig reads them from the cluster and user of Context, or of the
+	// current context, in this kubeconfig file. The user needs a token.
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
+}
+
+// CredentialKey reports whether the auth method Config key k holds a
+// credential, such as the kubernetes ServiceAccountJWT or the
+// OIDCClientSecret, which is never shown.
+func CredentialKey(k string) bool {
+	return k == "ServiceAccountJWT" || strings.Contains(strings.ToLower(k), "secret")
+}
+
+// Token is a Consul ACL token, keyed by AccessorID. SecretID is the credential,
+// pinned in the config so creation is deterministic. Both AccessorID and
+// SecretID are set at create time and immutable afterward. With SecretPath the
+// SecretID lives in the secrets backend instead of the file.
+type Token struct {
+	AccessorID  string   `yaml:"accessor_id"`
+	SecretID    string   `yaml:"secret_id"`
+	SecretPath  string   `yaml:"secret_path"`
+	Description string   `yaml:"description"`
+	Policies    []string `yaml:"policies"`
+	Roles       []string `yaml:"roles"`
+
+	// KubernetesSecret, when set, renders the token into a Secret manifest
+	// after it is created. See -kubernetes-secrets.
+	KubernetesSecret *KubernetesSecret `yaml:"kubernetes_secret"`
+
+	// Tenancy overrides the default partition and namespace for this token
+	// (Consul Enterprise). Its policies are looked up in the same namespace.
+	Tenancy `yaml:",inline"`
+
+	Ordering `yaml:",inline"`
+
+	// SecretGenerated marks a SecretID minted this run because the backend
+	// had none yet. It must be stored before the token is created.
+	SecretGenerated bool `yaml:"-"`
+}
+
+// Ordering constrains when apply writes a resource, beyond the links the
+// dependency graph derives from the config, e.g. a token's policies.
+type Ordering struct {
+	// Wave groups resources: apply finishes every change of a wave before it
+	// starts the next. Resources without one are in wave 0.
+	Wave int `yaml:"wave"`
+	// DependsOn lists resources of the config to write first, each as
+	// policy:<name>, role:<name>, auth-method:<name>, namespace:<name>,
+	// partition:<name> or token:<accessor_id>. A name is looked up in the
+	// resource's partition and namespace, unless qualified.
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// KubernetesSecret names the Secret a created token is rendered into. Name and
+// Namespace are text/template strings evaluated against the token, e.g.
+// "consul-{{.AccessorID}}".
+type KubernetesSecret struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+// Redacted replaces secret values in output.
+const Redacted = "<redacted>"
+
+// String keeps the SecretID out of anything that formats a Token with %v.
+func (t Token) String() string {
+	return fmt.Sprintf("{AccessorID:%s SecretID:%s Description:%q Policies:%v}", t.AccessorID, Redacted, t.Description, t.Policies)
+}
+
+// Label annotates an opaque accessor id with its description when present.
+func (t Token) Label() string {
+	if t.Description != "" {
+		return fmt.Sprintf("%s %q", t.AccessorID, t.Description)
+	}
+	return t.AccessorID
+}
@@ -0,0 +1,187 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// API is the part of Consul the planner and applier need. Client implements it
+// over HTTP; tests substitute a fake.
+type API interface {
+	ListPolicies() ([]Policy, error)
+	PolicyRules(id string) (Policy, error)
+	ListTokens() ([]Token, error)
+	// ReadToken returns the token with the given accessor ID, or ok false
+	// when there is none.
+	ReadToken(accessorID string) (_ Token, ok bool, err error)
+	ListRoles() ([]Role, error)
+	// ListPartitions lists the admin partitions (Consul Enterprise). The
+	// client then only spans those of its partitions that exist, so a plan
+	// for a partition not yet created does not fail listing it.
+	ListPartitions() ([]Partition, error)
+	// ListNamespaces lists the namespaces of every partition the client
+	// spans (Consul Enterprise).
+	ListNamespaces() ([]Namespace, error)
+	ListAuthMethods() ([]AuthMethod, error)
+	// ReadAuthMethod returns m, as listed, with its Config.
+	ReadAuthMethod(m AuthMethod) (AuthMethod, error)
+	// CreatePolicy creates p and returns the ID Consul assigned it, or ""
+	// when the write was only previewed.
+	CreatePolicy(p config.Policy) (id string, err error)
+	UpdatePolicy(id string, p config.Policy) error
+	// CreateRole creates r and returns its ID, like CreatePolicy.
+	CreateRole(r config.Role) (id string, err error)
+	UpdateRole(id string, r config.Role) error
+	CreatePartition(p config.Partition) error
+	UpdatePartition(p config.Partition) error
+	CreateNamespace(n config.Namespace) error
+	UpdateNamespace(n config.Namespace) error
+	CreateAuthMethod(m config.AuthMethod) error
+	UpdateAuthMethod(m config.AuthMethod) error
+	CreateToken(t config.Token) error
+	UpdateToken(t config.Token) error
+	// DeleteToken deletes the token with the given accessor ID. It is only
+	// used to recreate a token on request, with apply -replace.
+	DeleteToken(accessorID string) error
+}
+
+// KV is the key/value access the audit log and the run history use.
+type KV interface {
+	PutKV(key string, value interface{}) error
+	// ListKV returns the keys below prefix with their values, sorted by key.
+	ListKV(prefix string) ([]KVPair, error)
+}
+
+// Replication reports on ACL replication, checked before planning against a
+// secondary datacenter.
+type Replication interface {
+	ReplicationStatus() (ReplicationStatus, error)
+}
+
+// Authorizer tells what the client's token may do with ACLs, checked before
+// a plan or apply so that a read-only token is recognized up front.
+type Authorizer interface {
+	ACLAccess() (ACLAccess, error)
+}
+
+// Translator has Consul rewrite legacy ACL rules in the current syntax.
+// Consul dropped the endpoint along with legacy ACLs in 1.11.
+type Translator interface {
+	TranslateRules(rules string) (string, error)
+}
+
+// RulesValidator has Consul check the rules of a policy before it is
+// written, by creating a scratch policy with them and deleting it again.
+type RulesValidator interface {
+	ValidateRules(p config.Policy) error
+}
+
+// SecretReader reads the SecretID of a token, which apply -replace checks
+// a token with an inline secret_id is not recreated with.
+type SecretReader interface {
+	TokenSecret(accessorID string) (string, error)
+}
+
+// Resolver resolves the policy and role links a write sends to IDs.
+type Resolver interface {
+	// Resolve returns the ID of the policy or role (kind) named name that a
+	// resource in tenancy links to, or "" to leave the link to Consul to
+	// resolve by name.
+	Resolve(kind string, tenancy config.Tenancy, name string) (string, error)
+}
+
+// ACLAccess is what a token may do with ACLs.
+type ACLAccess struct {
+	Read, Write bool
+}
+
+var (
+	_ API = (*Client)(nil)
+	_ API = (*OfficialClient)(nil)
+	_ KV  = (*Client)(nil)
+	_ KV  = (*OfficialClient)(nil)
+
+	_ Replication = (*Client)(nil)
+	_ Replication = (*OfficialClient)(nil)
+
+	_ Translator = (*Client)(nil)
+
+	_ RulesValidator = (*Client)(nil)
+	_ RulesValidator = (*OfficialClient)(nil)
+
+	_ SecretReader = (*Client)(nil)
+	_ SecretReader = (*OfficialClient)(nil)
+)
+
+// traced is implemented by backends that record spans.
+type traced interface {
+	tracer() *trace.Tracer
+}
+
+// TracerOf returns the tracer api records its requests with, or nil when it
+// does not trace, so callers can nest their own spans around its calls.
+func TracerOf(api API) *trace.Tracer {
+	if t, ok := api.(traced); ok {
+		return t.tracer()
+	}
+	return nil
+}
+
+// contextual is implemented by backends whose request spans can be nested
+// under a span of the caller.
+type contextual interface {
+	withContext(ctx context.Context) API
+}
+
+// resolving is implemented by backends whose writes can link by ID.
+type resolving interface {
+	withResolver(r Resolver) API
+}
+
+// WithResolver returns api with the policy and role links of its writes
+// resolved by r. A link r does not know goes by name, and an error from r
+// fails the write before it is sent. The copy shares everything else with
+// api. Other backends are returned as they are and link by name.
+func WithResolver(api API, r Resolver) API {
+	if c, ok := api.(resolving); ok {
+		return c.withResolver(r)
+	}
+	return api
+}
+
+// link is a policy or role link as written: by ID when it was resolved, and
+// by name always.
+type link struct {
+	ID, Name string
+}
+
+// resolveLinks resolves the links to names of kind, "policy" or "role", that
+// a resource in tenancy writes, through r when it is set.
+func resolveLinks(r Resolver, kind string, tenancy config.Tenancy, names []string) ([]link, error) {
+	links := make([]link, 0, len(names))
+	for _, name := range names {
+		l := link{Name: name}
+		if r != nil {
+			id, err := r.Resolve(kind, tenancy, name)
+			if err != nil {
+				return nil, err
+			}
+			l.ID = id
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// WithContext returns api with its request spans made children of the span
+// in ctx, rather than of whatever span happens to be open, which parallel
+// changes would get wrong. The copy shares everything else with api. Other
+// backends, such as test fakes, are returned as they are.
+func WithContext(api API, ctx context.Context) API {
+	if c, ok := api.(contextual); ok {
+		return c.withContext(ctx)
+	}
+	return api
+}
@@ -0,0 +1,101 @@
+package consul
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+)
+
+// BreakerError is returned for every request once the circuit breaker has
+// tripped: after Count consecutive failed requests the cluster is taken to be
+// unreachable, and the run should stop instead of failing once per resource.
+type BreakerError struct {
+	Count int
+	// Route is the endpoint of the last failure, with IDs replaced.
+	Route string
+	// Class names the kind of the last failure, e.g. "connection refused".
+	Class string
+	Last  error
+}
+
+func (e *BreakerError) Error() string {
+	return fmt.Sprintf("giving up after %d consecutive failed requests to Consul (last: %s, %s): %v", e.Count, e.Route, e.Class, e.Last)
+}
+
+func (e *BreakerError) Unwrap() error { return e.Last }
+
+// breaker is an http.RoundTripper that counts consecutive failures, meaning
+// transport errors and 5xx or 429 responses, and trips after threshold of
+// them. A one-shot run has nothing to wait out, so it stays tripped.
+type breaker struct {
+	base      http.RoundTripper
+	threshold int
+
+	mu       sync.Mutex
+	failures int
+	tripped  *BreakerError
+}
+
+func (b *breaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	tripped := b.tripped
+	b.mu.Unlock()
+	if tripped != nil {
+		return nil, tripped
+	}
+
+	resp, err := b.base.RoundTrip(req)
+
+	var failure error
+	switch {
+	case err != nil:
+		failure = err
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		failure = fmt.Errorf("%s %s returned %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failure == nil {
+		b.failures = 0
+		return resp, err
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.tripped = &BreakerError{Count: b.failures, Route: req.Method + " " + route(req.URL.Path), Class: errorClass(err, resp), Last: failure}
+	}
+	return resp, err
+}
+
+// errorClass names the kind of a failed request for a diagnosis.
+func errorClass(err error, resp *http.Response) string {
+	if err == nil {
+		return fmt.Sprintf("HTTP %d", resp.StatusCode)
+	}
+	var (
+		dnsErr  *net.DNSError
+		netErr  net.Error
+		certErr *tls.CertificateVerificationError
+		unknown x509.UnknownAuthorityError
+		opErr   *net.OpError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return "DNS lookup failed"
+	case errors.As(err, &certErr), errors.As(err, &unknown):
+		return "TLS certificate rejected"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "cannot connect"
+	default:
+		return "connection error"
+	}
+}
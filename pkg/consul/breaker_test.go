@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBreaker(t *testing.T) {
+	status := http.StatusInternalServerError
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	c := NewClientWithOptions(srv.URL, "", Options{FailureThreshold: 3})
+
+	// A success in between resets the count.
+	_, _ = c.ListPolicies()
+	_, _ = c.ListPolicies()
+	status = http.StatusOK
+	if _, err := c.ListPolicies(); err != nil {
+		t.Fatalf("ListPolicies: %v", err)
+	}
+	status = http.StatusInternalServerError
+	for i := 0; i < 3; i++ {
+		_, _ = c.PolicyRules("3b2a1c00-0000-4000-8000-000000000001")
+	}
+
+	before := calls
+	_, err := c.ListTokens()
+	var be *BreakerError
+	if !errors.As(err, &be) {
+		t.Fatalf("ListTokens error = %v, want a *BreakerError", err)
+	}
+	if be.Count != 3 || be.Route != "GET /v1/acl/policy/{id}" || be.Class != "HTTP 500" {
+		t.Errorf("BreakerError = %+v", be)
+	}
+	if calls != before {
+		t.Errorf("request sent after the breaker tripped")
+	}
+}
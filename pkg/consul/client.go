@@ -0,0 +1,872 @@
+// Package consul is a small client for the parts of the Consul ACL HTTP API
+// consul-acl-sync uses.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// Client is a client for the Consul ACL HTTP API.
+type Client struct {
+	addr        string
+	token       string
+	header      http.Header
+	consistency string
+	datacenter  string
+	tenancies   *tenancies
+	marker      *Marker
+	limiter     *limiter
+	logf        func(string, ...interface{})
+	client      *http.Client
+	// ctx carries the span request spans are children of; see WithContext.
+	ctx context.Context
+	// resolver, when set, resolves the links of writes; see WithResolver.
+	resolver Resolver
+
+	// Tracer, when set, records a client span per request.
+	Tracer *trace.Tracer
+	// Stats, when set, counts and times every request.
+	Stats *Stats
+	// Preview, when set, receives every request that would change Consul
+	// instead of Consul: its method, path with query and JSON body. Reads
+	// are still sent.
+	Preview func(method, path string, body []byte)
+}
+
+// Options tune how a client reaches Consul. The zero value is the default
+// behaviour.
+type Options struct {
+	// Proxy, when set, carries every request instead of the proxy chosen by
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY. http, https and socks5 URLs work.
+	Proxy *url.URL
+
+	// Headers are added to every request.
+	Headers http.Header
+	// UserAgent defaults to "consul-acl-sync".
+	UserAgent string
+	// RequestID, when set, is sent as X-Request-ID on every request, so all
+	// the requests of one run can be found together in proxy and audit logs.
+	RequestID string
+
+	// Consistency is the consistency mode of reads: "consistent" has the
+	// leader confirm it is still the leader before answering, "stale" lets
+	// any server answer from its possibly lagging copy, and "" leaves
+	// Consul's default.
+	Consistency string
+
+	// Datacenter, when set, is sent as the dc parameter of every request, so
+	// another datacenter of a federation is targeted through the local
+	// agent; "" is the agent's own.
+	Datacenter string
+
+	// Partitions, when set, widen the policy, token and role lists to every
+	// namespace of each of these admin partitions (Consul Enterprise); the
+	// single reads that follow address the partition and namespace the list
+	// found the resource in. Consul Community Edition rejects such requests.
+	Partitions []string
+
+	// FailureThreshold is the number of consecutive failed requests after
+	// which every further request fails at once with a *BreakerError; 0
+	// never gives up.
+	FailureThreshold int
+
+	// Marker, when set, is added to the description of every resource
+	// written and taken off those read.
+	Marker *Marker
+
+	// RateLimit caps requests a second; 0 is unlimited.
+	RateLimit float64
+	// Logf, when set, receives debug messages, such as how long the rate
+	// limit held a request back.
+	Logf func(format string, args ...interface{})
+}
+
+// throttle waits for l and reports a wait through logf.
+func throttle(l *limiter, logf func(string, ...interface{}), method, path string) {
+	if d := l.wait(); d > 0 && logf != nil {
+		logf("rate limit held %s %s back %s", method, path, d.Round(time.Millisecond))
+	}
+}
+
+// ValidConsistency reports whether mode is a known Options.Consistency.
+func ValidConsistency(mode string) bool {
+	return mode == "" || mode == "default" || mode == "consistent" || mode == "stale"
+}
+
+// header is the headers opts add to every request.
+func (o Options) header() http.Header {
+	h := o.Headers.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	ua := o.UserAgent
+	if ua == "" {
+		ua = "consul-acl-sync"
+	}
+	h.Set("User-Agent", ua)
+	if o.RequestID != "" {
+		h.Set("X-Request-ID", o.RequestID)
+	}
+	return h
+}
+
+// transport is the http.DefaultTransport with opts applied.
+func (o Options) transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if o.Proxy != nil {
+		t.Proxy = http.ProxyURL(o.Proxy)
+	}
+	return o.wrap(t)
+}
+
+// wrap adds the circuit breaker, if any, in front of base.
+func (o Options) wrap(base http.RoundTripper) http.RoundTripper {
+	if o.FailureThreshold <= 0 {
+		return base
+	}
+	return &breaker{base: base, threshold: o.FailureThreshold}
+}
+
+// NewClient returns a client for the agent at addr, authenticating with token.
+func NewClient(addr, token string) *Client {
+	return NewClientWithOptions(addr, token, Options{})
+}
+
+// NewClientWithOptions is NewClient with opts applied.
+func NewClientWithOptions(addr, token string, opts Options) *Client {
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	addr = strings.TrimRight(addr, "/")
+	consistency := opts.Consistency
+	if consistency == "default" {
+		consistency = ""
+	}
+	return &Client{
+		addr:        addr,
+		token:       token,
+		header:      opts.header(),
+		consistency: consistency,
+		datacenter:  opts.Datacenter,
+		tenancies:   newTenancies(opts.Partitions),
+		marker:      opts.Marker,
+		limiter:     newLimiter(opts.RateLimit),
+		logf:        opts.Logf,
+		client:      &http.Client{Transport: opts.transport()},
+		ctx:         context.Background(),
+	}
+}
+
+func (c *Client) tracer() *trace.Tracer { return c.Tracer }
+
+func (c *Client) withContext(ctx context.Context) API {
+	cp := *c
+	cp.ctx = ctx
+	return &cp
+}
+
+func (c *Client) withResolver(r Resolver) API {
+	cp := *c
+	cp.resolver = r
+	return &cp
+}
+
+func (c *Client) do(method, path string, body, out interface{}) (err error) {
+	_, sp := c.Tracer.Start(c.ctx, method+" "+route(path), trace.KindClient)
+	sp.Set("http.request.method", method)
+	sp.Set("url.path", path)
+	defer func() { sp.Finish(err) }()
+
+	var b []byte
+	if raw, ok := body.(rawBody); ok {
+		b = raw
+	} else if body != nil {
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	var params []string
+	if method == http.MethodGet && c.consistency != "" {
+		params = append(params, c.consistency)
+	}
+	if c.datacenter != "" {
+		params = append(params, "dc="+url.QueryEscape(c.datacenter))
+	}
+	target := path
+	if len(params) > 0 {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		target += sep + strings.Join(params, "&")
+	}
+	if c.Preview != nil && method != http.MethodGet {
+		c.Preview(method, target, b)
+		return nil
+	}
+
+	throttle(c.limiter, c.logf, method, path)
+	start := time.Now()
+	defer func() { c.Stats.record(method+" "+route(path), time.Since(start), err) }()
+
+	var reader io.Reader
+	if b != nil {
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.addr+target, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	if tp := sp.Traceparent(); tp != "" {
+		req.Header.Set("traceparent", tp)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	sp.Set("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return &StatusError{Method: method, Path: path, Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	if raw, ok := out.(*rawBody); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// rawBody is a request or response body sent or read as is, not as JSON.
+type rawBody []byte
+
+// StatusError is a response other than 200 OK.
+type StatusError struct {
+	Method string
+	Path   string
+	Code   int
+	Body   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.Path, e.Code, e.Body)
+}
+
+// route is path with identifiers replaced by placeholders, a span name that
+// groups requests to the same endpoint.
+func route(path string) string {
+	if strings.HasPrefix(path, "/v1/kv/") {
+		return "/v1/kv/{key}"
+	}
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if config.IsUUID(p) {
+			parts[i] = "{id}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// ListPolicies returns all policies. The list endpoint does not include Rules,
+// so PolicyRules fills them in per policy.
+func (c *Client) ListPolicies() ([]Policy, error) {
+	var policies []Policy
+	for _, path := range c.listPaths("/v1/acl/policies") {
+		var page []Policy
+		if err := c.do(http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		policies = append(policies, page...)
+	}
+	for i, p := range policies {
+		c.tenancies.remember(p.ID, p.Partition, p.Namespace)
+		policies[i].Description = c.marker.strip(p.Description)
+	}
+	return policies, nil
+}
+
+// PolicyRules fetches a single policy so its Rules can be compared.
+func (c *Client) PolicyRules(id string) (Policy, error) {
+	var p Policy
+	if err := c.do(http.MethodGet, c.scoped("/v1/acl/policy/"+id, id), nil, &p); err != nil {
+		return Policy{}, err
+	}
+	p.Description = c.marker.strip(p.Description)
+	return p, nil
+}
+
+// ListTokens returns all tokens. Each entry already carries its policy links.
+func (c *Client) ListTokens() ([]Token, error) {
+	var tokens []Token
+	for _, path := range c.listPaths("/v1/acl/tokens") {
+		var page []Token
+		if err := c.do(http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, page...)
+	}
+	for i, t := range tokens {
+		c.tenancies.remember(t.AccessorID, t.Partition, t.Namespace)
+		tokens[i].Description = c.marker.strip(t.Description)
+	}
+	return tokens, nil
+}
+
+// ListRoles returns all roles with their policy links.
+func (c *Client) ListRoles() ([]Role, error) {
+	var roles []Role
+	for _, path := range c.listPaths("/v1/acl/roles") {
+		var page []Role
+		if err := c.do(http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		roles = append(roles, page...)
+	}
+	for i := range roles {
+		roles[i].Description = c.marker.strip(roles[i].Description)
+	}
+	return roles, nil
+}
+
+// ListPartitions returns all admin partitions, and narrows the partitions
+// lists span to those found.
+func (c *Client) ListPartitions() ([]Partition, error) {
+	var partitions []Partition
+	if err := c.do(http.MethodGet, "/v1/partitions", nil, &partitions); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(partitions))
+	for i, p := range partitions {
+		partitions[i].Description = c.marker.strip(p.Description)
+		if p.DeletedAt == nil {
+			names = append(names, p.Name)
+		}
+	}
+	c.tenancies.exist(names...)
+	return partitions, nil
+}
+
+// ListNamespaces returns all namespaces, one request per partition when the
+// client spans several.
+func (c *Client) ListNamespaces() ([]Namespace, error) {
+	paths := []string{"/v1/namespaces"}
+	if c.tenancies.spanning() {
+		paths = paths[:0]
+		for _, p := range c.tenancies.spanned() {
+			paths = append(paths, "/v1/namespaces?partition="+url.QueryEscape(p))
+		}
+	}
+	var namespaces []Namespace
+	for _, path := range paths {
+		var page []Namespace
+		if err := c.do(http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, page...)
+	}
+	for i := range namespaces {
+		namespaces[i].Description = c.marker.strip(namespaces[i].Description)
+	}
+	return namespaces, nil
+}
+
+// ListAuthMethods returns all auth methods, without their Config.
+func (c *Client) ListAuthMethods() ([]AuthMethod, error) {
+	var methods []AuthMethod
+	for _, path := range c.listPaths("/v1/acl/auth-methods") {
+		var page []AuthMethod
+		if err := c.do(http.MethodGet, path, nil, &page); err != nil {
+			return nil, err
+		}
+		methods = append(methods, page...)
+	}
+	for i := range methods {
+		methods[i].Description = c.marker.strip(methods[i].Description)
+	}
+	return methods, nil
+}
+
+// ReadAuthMethod fetches m, in the partition and namespace it was listed in,
+// so its Config can be compared.
+func (c *Client) ReadAuthMethod(m AuthMethod) (AuthMethod, error) {
+	path := "/v1/acl/auth-method/" + url.PathEscape(m.Name)
+	if c.tenancies.spanning() {
+		path += "?ns=" + url.QueryEscape(orDefault(m.Namespace)) + "&partition=" + url.QueryEscape(orDefault(m.Partition))
+	}
+	var read AuthMethod
+	if err := c.do(http.MethodGet, path, nil, &read); err != nil {
+		return AuthMethod{}, err
+	}
+	read.Description = c.marker.strip(read.Description)
+	return read, nil
+}
+
+type authorizeCheck struct {
+	Resource string `json:"Resource"`
+	Access   string `json:"Access"`
+	Allow    bool   `json:"Allow,omitempty"`
+}
+
+// ACLAccess asks Consul whether the token may read and write ACLs. The
+// endpoint only answers for the token it is given, so it needs no permission
+// of its own.
+func (c *Client) ACLAccess() (ACLAccess, error) {
+	checks := []authorizeCheck{{Resource: "acl", Access: "read"}, {Resource: "acl", Access: "write"}}
+	var results []authorizeCheck
+	if err := c.do(http.MethodPost, "/v1/internal/acl/authorize", checks, &results); err != nil {
+		return ACLAccess{}, err
+	}
+	if len(results) != len(checks) {
+		return ACLAccess{}, fmt.Errorf("POST /v1/internal/acl/authorize answered %d of %d checks", len(results), len(checks))
+	}
+	return ACLAccess{Read: results[0].Allow, Write: results[1].Allow}, nil
+}
+
+// listPaths returns the requests that list path: one, or one per partition
+// covering all its namespaces.
+func (c *Client) listPaths(path string) []string {
+	if !c.tenancies.spanning() {
+		return []string{path}
+	}
+	paths := make([]string, 0, len(c.tenancies.partitions))
+	for _, p := range c.tenancies.spanned() {
+		paths = append(paths, path+"?ns=*&partition="+url.QueryEscape(p))
+	}
+	return paths
+}
+
+// scoped addresses path, a read of the resource with the given ID, to the
+// partition and namespace a list found it in.
+func (c *Client) scoped(path, id string) string {
+	t, ok := c.tenancies.of(id)
+	if !ok || !c.tenancies.spanning() {
+		return path
+	}
+	return path + "?ns=" + url.QueryEscape(orDefault(t.Namespace)) + "&partition=" + url.QueryEscape(orDefault(t.Partition))
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
+
+// TranslateRules posts legacy rules to Consul's translate endpoint, which
+// answers with the rules in the current syntax.
+func (c *Client) TranslateRules(rules string) (string, error) {
+	var out rawBody
+	if err := c.do(http.MethodPost, "/v1/acl/rules/translate", rawBody(rules), &out); err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func (c *Client) ReplicationStatus() (ReplicationStatus, error) {
+	var st ReplicationStatus
+	if err := c.do(http.MethodGet, "/v1/acl/replication", nil, &st); err != nil {
+		return ReplicationStatus{}, err
+	}
+	return st, nil
+}
+
+// ReadToken fetches a single token. The response carries the SecretID, which
+// Token has no field for, so it is dropped while decoding.
+func (c *Client) ReadToken(accessorID string) (Token, bool, error) {
+	var t Token
+	err := c.do(http.MethodGet, c.scoped("/v1/acl/token/"+accessorID, accessorID), nil, &t)
+	// Consul before 1.11 answers a missing token with 403 "ACL not found".
+	if e, ok := err.(*StatusError); ok && (e.Code == http.StatusNotFound || strings.Contains(e.Body, "ACL not found")) {
+		return Token{}, false, nil
+	}
+	if err != nil {
+		return Token{}, false, err
+	}
+	t.Description = c.marker.strip(t.Description)
+	return t, true, nil
+}
+
+// TokenSecret returns the SecretID of the token with the given accessor ID,
+// which ReadToken drops.
+func (c *Client) TokenSecret(accessorID string) (string, error) {
+	var t struct{ SecretID string }
+	if err := c.do(http.MethodGet, c.scoped("/v1/acl/token/"+accessorID, accessorID), nil, &t); err != nil {
+		return "", err
+	}
+	return t.SecretID, nil
+}
+
+type policyRequest struct {
+	ID          string   `json:"ID,omitempty"`
+	Name        string   `json:"Name"`
+	Description string   `json:"Description,omitempty"`
+	Rules       string   `json:"Rules"`
+	Datacenters []string `json:"Datacenters"`
+	Partition   string   `json:"Partition,omitempty"`
+	Namespace   string   `json:"Namespace,omitempty"`
+}
+
+// CreatePolicy creates p; Consul assigns its ID.
+func (c *Client) CreatePolicy(p config.Policy) (string, error) {
+	p.Description = c.marker.add(p.Description)
+	body := policyRequest{Name: p.Name, Description: p.Description, Rules: p.Rules, Datacenters: p.Datacenters,
+		Partition: p.Partition, Namespace: p.Namespace}
+	var out Policy
+	err := c.do(http.MethodPut, "/v1/acl/policy", body, &out)
+	return out.ID, err
+}
+
+// UpdatePolicy replaces the policy with the given ID. Datacenters is always
+// sent, so an update lifting the restriction clears it.
+func (c *Client) UpdatePolicy(id string, p config.Policy) error {
+	p.Description = c.marker.add(p.Description)
+	body := policyRequest{ID: id, Name: p.Name, Description: p.Description, Rules: p.Rules, Datacenters: p.Datacenters,
+		Partition: p.Partition, Namespace: p.Namespace}
+	return c.do(http.MethodPut, "/v1/acl/policy/"+id, body, nil)
+}
+
+type roleRequest struct {
+	ID                string              `json:"ID,omitempty"`
+	Name              string              `json:"Name"`
+	Description       string              `json:"Description,omitempty"`
+	Policies          []policyLinkRequest `json:"Policies"`
+	ServiceIdentities []ServiceIdentity   `json:"ServiceIdentities,omitempty"`
+	NodeIdentities    []NodeIdentity      `json:"NodeIdentities,omitempty"`
+	TemplatedPolicies []TemplatedPolicy   `json:"TemplatedPolicies,omitempty"`
+	Partition         string              `json:"Partition,omitempty"`
+	Namespace         string              `json:"Namespace,omitempty"`
+}
+
+func (c *Client) roleBody(id string, r config.Role) (roleRequest, error) {
+	policies, err := c.links("policy", r.Tenancy, r.Policies)
+	if err != nil {
+		return roleRequest{}, err
+	}
+	body := roleRequest{ID: id, Name: r.Name, Description: r.Description, Policies: policies,
+		Partition: r.Partition, Namespace: r.Namespace}
+	for _, si := range r.ServiceIdentities {
+		body.ServiceIdentities = append(body.ServiceIdentities, ServiceIdentity{ServiceName: si.ServiceName, Datacenters: si.Datacenters})
+	}
+	for _, ni := range r.NodeIdentities {
+		body.NodeIdentities = append(body.NodeIdentities, NodeIdentity{NodeName: ni.NodeName, Datacenter: ni.Datacenter})
+	}
+	for _, tp := range r.TemplatedPolicies {
+		t := TemplatedPolicy{TemplateName: tp.TemplateName, Datacenters: tp.Datacenters}
+		if tp.TemplateVariables.Name != "" {
+			t.TemplateVariables = &TemplateVariables{Name: tp.TemplateVariables.Name}
+		}
+		body.TemplatedPolicies = append(body.TemplatedPolicies, t)
+	}
+	return body, nil
+}
+
+// CreateRole creates r; Consul assigns its ID. Like token links, its policy
+// links go by ID when the resolver knows it, and by name otherwise.
+func (c *Client) CreateRole(r config.Role) (string, error) {
+	r.Description = c.marker.add(r.Description)
+	body, err := c.roleBody("", r)
+	if err != nil {
+		return "", err
+	}
+	var out Role
+	err = c.do(http.MethodPut, "/v1/acl/role", body, &out)
+	return out.ID, err
+}
+
+// UpdateRole replaces the role with the given ID. Identities and templated
+// policies left out are removed.
+func (c *Client) UpdateRole(id string, r config.Role) error {
+	r.Description = c.marker.add(r.Description)
+	body, err := c.roleBody(id, r)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/v1/acl/role/"+id, body, nil)
+}
+
+type partitionRequest struct {
+	Name        string `json:"Name"`
+	Description string `json:"Description,omitempty"`
+}
+
+// CreatePartition creates p. Lists span it from then on.
+func (c *Client) CreatePartition(p config.Partition) error {
+	p.Description = c.marker.add(p.Description)
+	if err := c.do(http.MethodPut, "/v1/partition", partitionRequest{Name: p.Name, Description: p.Description}, nil); err != nil {
+		return err
+	}
+	c.tenancies.exist(p.Name)
+	return nil
+}
+
+// UpdatePartition replaces the description of the partition named p.Name.
+func (c *Client) UpdatePartition(p config.Partition) error {
+	p.Description = c.marker.add(p.Description)
+	return c.do(http.MethodPut, "/v1/partition/"+url.PathEscape(p.Name), partitionRequest{Name: p.Name, Description: p.Description}, nil)
+}
+
+type namespaceRequest struct {
+	Name        string               `json:"Name"`
+	Description string               `json:"Description,omitempty"`
+	ACLs        namespaceACLsRequest `json:"ACLs"`
+	Meta        map[string]string    `json:"Meta,omitempty"`
+	Partition   string               `json:"Partition,omitempty"`
+}
+
+type namespaceACLsRequest struct {
+	PolicyDefaults []policyLinkRequest `json:"PolicyDefaults"`
+	RoleDefaults   []policyLinkRequest `json:"RoleDefaults"`
+}
+
+func (c *Client) namespaceBody(n config.Namespace) (namespaceRequest, error) {
+	policies, err := c.links("policy", n.Defaults(), n.PolicyDefaults)
+	if err != nil {
+		return namespaceRequest{}, err
+	}
+	roles, err := c.links("role", n.Defaults(), n.RoleDefaults)
+	if err != nil {
+		return namespaceRequest{}, err
+	}
+	return namespaceRequest{Name: n.Name, Description: n.Description, Meta: n.Meta, Partition: n.Partition,
+		ACLs: namespaceACLsRequest{PolicyDefaults: policies, RoleDefaults: roles}}, nil
+}
+
+// CreateNamespace creates n.
+func (c *Client) CreateNamespace(n config.Namespace) error {
+	n.Description = c.marker.add(n.Description)
+	body, err := c.namespaceBody(n)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/v1/namespace", body, nil)
+}
+
+// UpdateNamespace replaces the namespace named n.Name. Defaults left out
+// are unlinked.
+func (c *Client) UpdateNamespace(n config.Namespace) error {
+	n.Description = c.marker.add(n.Description)
+	body, err := c.namespaceBody(n)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/v1/namespace/"+url.PathEscape(n.Name), body, nil)
+}
+
+type authMethodRequest struct {
+	Name          string                 `json:"Name"`
+	Type          string                 `json:"Type"`
+	DisplayName   string                 `json:"DisplayName,omitempty"`
+	Description   string                 `json:"Description,omitempty"`
+	MaxTokenTTL   string                 `json:"MaxTokenTTL,omitempty"`
+	TokenLocality string                 `json:"TokenLocality,omitempty"`
+	Config        map[string]interface{} `json:"Config"`
+	Partition     string                 `json:"Partition,omitempty"`
+	Namespace     string                 `json:"Namespace,omitempty"`
+}
+
+func authMethodBody(m config.AuthMethod) authMethodRequest {
+	return authMethodRequest{Name: m.Name, Type: m.Type, DisplayName: m.DisplayName, Description: m.Description,
+		MaxTokenTTL: m.MaxTokenTTL, TokenLocality: m.TokenLocality, Config: m.Config,
+		Partition: m.Partition, Namespace: m.Namespace}
+}
+
+// CreateAuthMethod creates m.
+func (c *Client) CreateAuthMethod(m config.AuthMethod) error {
+	m.Description = c.marker.add(m.Description)
+	return c.do(http.MethodPut, "/v1/acl/auth-method", authMethodBody(m), nil)
+}
+
+// UpdateAuthMethod replaces the auth method named m.Name. Its type cannot
+// change.
+func (c *Client) UpdateAuthMethod(m config.AuthMethod) error {
+	m.Description = c.marker.add(m.Description)
+	return c.do(http.MethodPut, "/v1/acl/auth-method/"+url.PathEscape(m.Name), authMethodBody(m), nil)
+}
+
+type tokenRequest struct {
+	AccessorID  string              `json:"AccessorID,omitempty"`
+	SecretID    string              `json:"SecretID,omitempty"`
+	Description string              `json:"Description,omitempty"`
+	Policies    []policyLinkRequest `json:"Policies"`
+	Roles       []policyLinkRequest `json:"Roles,omitempty"`
+	Partition   string              `json:"Partition,omitempty"`
+	Namespace   string              `json:"Namespace,omitempty"`
+}
+
+type policyLinkRequest struct {
+	ID   string `json:"ID,omitempty"`
+	Name string `json:"Name"`
+}
+
+// links builds the policy or role (kind) links to names of a resource in
+// tenancy: by ID when the resolver knows it, and by name for Consul to
+// resolve otherwise.
+func (c *Client) links(kind string, tenancy config.Tenancy, names []string) ([]policyLinkRequest, error) {
+	resolved, err := resolveLinks(c.resolver, kind, tenancy, names)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]policyLinkRequest, 0, len(resolved))
+	for _, l := range resolved {
+		links = append(links, policyLinkRequest{ID: l.ID, Name: l.Name})
+	}
+	return links, nil
+}
+
+// tokenBody builds a token request.
+func (c *Client) tokenBody(t config.Token) (tokenRequest, error) {
+	policies, err := c.links("policy", t.Tenancy, t.Policies)
+	if err != nil {
+		return tokenRequest{}, err
+	}
+	body := tokenRequest{
+		AccessorID:  t.AccessorID,
+		SecretID:    t.SecretID,
+		Description: t.Description,
+		Policies:    policies,
+		Partition:   t.Partition,
+		Namespace:   t.Namespace,
+	}
+	if len(t.Roles) > 0 {
+		if body.Roles, err = c.links("role", t.Tenancy, t.Roles); err != nil {
+			return tokenRequest{}, err
+		}
+	}
+	return body, nil
+}
+
+// CreateToken creates t with its pinned AccessorID and SecretID.
+func (c *Client) CreateToken(t config.Token) error {
+	t.Description = c.marker.add(t.Description)
+	body, err := c.tokenBody(t)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/v1/acl/token", body, nil)
+}
+
+// UpdateToken addresses the token by AccessorID in the path. Consul replaces
+// the whole token, so it is read first and written back with only the
+// description and the policy and role links changed: the fields the config
+// does not model, such as identities, expiration and locality, are kept.
+// SecretID is omitted because it is immutable after creation.
+func (c *Client) UpdateToken(t config.Token) error {
+	t.Description = c.marker.add(t.Description)
+	policies, err := c.links("policy", t.Tenancy, t.Policies)
+	if err != nil {
+		return err
+	}
+	roles, err := c.links("role", t.Tenancy, t.Roles)
+	if err != nil {
+		return err
+	}
+	var live map[string]json.RawMessage
+	if err := c.do(http.MethodGet, c.scoped("/v1/acl/token/"+t.AccessorID, t.AccessorID), nil, &live); err != nil {
+		return err
+	}
+	for _, k := range []string{"SecretID", "Hash", "CreateIndex", "ModifyIndex"} {
+		delete(live, k)
+	}
+	for k, v := range map[string]interface{}{
+		"AccessorID":  t.AccessorID,
+		"Description": t.Description,
+		"Policies":    policies,
+		"Roles":       roles,
+	} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		live[k] = b
+	}
+	return c.do(http.MethodPut, "/v1/acl/token/"+t.AccessorID, live, nil)
+}
+
+// DeleteToken deletes the token, in the partition and namespace a list found
+// it in.
+func (c *Client) DeleteToken(accessorID string) error {
+	return c.do(http.MethodDelete, c.scoped("/v1/acl/token/"+accessorID, accessorID), nil, nil)
+}
+
+// ValidateRules creates a scratch policy with the rules of p, in its
+// partition and namespace, and deletes it again. Consul parses the rules as
+// it would for p, so its error is the one writing p would get.
+func (c *Client) ValidateRules(p config.Policy) error {
+	name, err := scratchPolicyName()
+	if err != nil {
+		return err
+	}
+	body := policyRequest{Name: name, Description: scratchDescription, Rules: p.Rules, Datacenters: p.Datacenters,
+		Partition: p.Partition, Namespace: p.Namespace}
+	var created Policy
+	if err := c.do(http.MethodPut, "/v1/acl/policy", body, &created); err != nil {
+		return err
+	}
+	path := "/v1/acl/policy/" + created.ID
+	if !p.Tenancy.IsDefault() {
+		path += "?ns=" + url.QueryEscape(orDefault(p.Namespace)) + "&partition=" + url.QueryEscape(orDefault(p.Partition))
+	}
+	if err := c.do(http.MethodDelete, path, nil, nil); err != nil {
+		return fmt.Errorf("failed to delete the scratch policy %s: %w", name, err)
+	}
+	return nil
+}
+
+// scratchDescription marks scratch policies, should one outlive its check.
+const scratchDescription = "consul-acl-sync rules check; safe to delete"
+
+// scratchPolicyName returns a policy name no config is expected to use.
+func scratchPolicyName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "consul-acl-sync-check-" + hex.EncodeToString(b), nil
+}
+
+// PutKV stores value, encoded as JSON, under key in the KV store.
+func (c *Client) PutKV(key string, value interface{}) error {
+	return c.do(http.MethodPut, "/v1/kv/"+strings.Trim(key, "/"), value, nil)
+}
+
+// ListKV returns the keys below prefix. Consul answers 404 when there are
+// none.
+func (c *Client) ListKV(prefix string) ([]KVPair, error) {
+	var pairs []KVPair
+	err := c.do(http.MethodGet, "/v1/kv/"+strings.Trim(prefix, "/")+"/?recurse", nil, &pairs)
+	if e, ok := err.(*StatusError); ok && e.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
@@ -0,0 +1,176 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+func TestPreview(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.Method+" "+r.URL.Path)
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	c := NewClientWithOptions(srv.URL, "", Options{Datacenter: "dc2"})
+	var previewed []string
+	c.Preview = func(method, path string, body []byte) {
+		previewed = append(previewed, method+" "+path+" "+string(body))
+	}
+
+	if _, err := c.ListPolicies(); err != nil {
+		t.Fatalf("ListPolicies: %v", err)
+	}
+	if _, err := c.CreatePolicy(config.Policy{Name: "web"}); err != nil {
+		t.Fatalf("CreatePolicy: %v", err)
+	}
+	if len(sent) != 1 || sent[0] != "GET /v1/acl/policies" {
+		t.Errorf("sent %v, want only the read", sent)
+	}
+	want := `PUT /v1/acl/policy?dc=dc2 {"Name":"web","Rules":"","Datacenters":null}`
+	if len(previewed) != 1 || previewed[0] != want {
+		t.Errorf("previewed %v, want [%s]", previewed, want)
+	}
+}
+
+func TestACLAccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/internal/acl/authorize" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`[{"Resource":"acl","Access":"read","Allow":true},{"Resource":"acl","Access":"write","Allow":false}]`))
+	}))
+	defer srv.Close()
+
+	access, err := NewClient(srv.URL, "").ACLAccess()
+	if err != nil {
+		t.Fatalf("ACLAccess: %v", err)
+	}
+	if access != (ACLAccess{Read: true}) {
+		t.Errorf("ACLAccess = %+v, want read only", access)
+	}
+}
+
+func TestListPartitionsNarrowsLists(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/partitions" {
+			_, _ = w.Write([]byte(`[{"Name":"default"},{"Name":"team-a"},{"Name":"gone","DeletedAt":"2026-10-01T00:00:00Z"}]`))
+			return
+		}
+		sent = append(sent, r.URL.Query().Get("partition"))
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	// team-b is declared by the config but not created yet.
+	c := NewClientWithOptions(srv.URL, "", Options{Partitions: []string{"default", "gone", "team-a", "team-b"}})
+	if _, err := c.ListPartitions(); err != nil {
+		t.Fatalf("ListPartitions: %v", err)
+	}
+	if _, err := c.ListPolicies(); err != nil {
+		t.Fatalf("ListPolicies: %v", err)
+	}
+	if len(sent) != 2 || sent[0] != "default" || sent[1] != "team-a" {
+		t.Errorf("listed partitions %v, want [default team-a]", sent)
+	}
+}
+
+func TestValidateRulesDeletesScratchPolicy(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.Method+" "+r.URL.RequestURI())
+		if r.Method == http.MethodPut {
+			_, _ = w.Write([]byte(`{"ID":"scratch-id"}`))
+		}
+	}))
+	defer srv.Close()
+
+	p := config.Policy{Name: "web", Rules: `service "web" { policy = "read" }`, Tenancy: config.Tenancy{Namespace: "team"}}
+	if err := NewClient(srv.URL, "").ValidateRules(p); err != nil {
+		t.Fatalf("ValidateRules: %v", err)
+	}
+	want := []string{"PUT /v1/acl/policy", "DELETE /v1/acl/policy/scratch-id?ns=team&partition=default"}
+	if len(sent) != 2 || sent[0] != want[0] || sent[1] != want[1] {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+}
+
+func TestMarker(t *testing.T) {
+	var written string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var p Policy
+			_ = json.NewDecoder(r.Body).Decode(&p)
+			written = p.Description
+			p.ID = "3b2a1c00-0000-4000-8000-0000000000aa"
+			_ = json.NewEncoder(w).Encode(p)
+			return
+		}
+		// Written for an earlier commit.
+		_, _ = w.Write([]byte(`[{"Name":"web","Description":"[ops] Web app (managed-by: consul-acl-sync @ 0123abc)"}]`))
+	}))
+	defer srv.Close()
+
+	m := config.DescriptionMarker{Prefix: "[ops] ", Suffix: " (managed-by: consul-acl-sync @ {{.Commit}})"}
+	prefix, suffix, err := m.Render(config.MarkerData{Commit: "4567def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixPattern, suffixPattern, err := m.Patterns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientWithOptions(srv.URL, "", Options{Marker: &Marker{prefix, suffix, prefixPattern, suffixPattern}})
+
+	if _, err := c.CreatePolicy(config.Policy{Name: "web", Description: "Web app"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[ops] Web app (managed-by: consul-acl-sync @ 4567def)"; written != want {
+		t.Errorf("wrote description %q, want %q", written, want)
+	}
+	policies, err := c.ListPolicies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].Description != "Web app" {
+		t.Errorf("ListPolicies = %+v, want the description without the marker", policies)
+	}
+}
+
+func TestUpdateTokenKeepsUnmodeledFields(t *testing.T) {
+	var written map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			_ = json.NewDecoder(r.Body).Decode(&written)
+			return
+		}
+		_, _ = w.Write([]byte(`{"AccessorID":"a1","SecretID":"s1","Description":"old","Hash":"aGFzaA==",
+			"Policies":[{"ID":"p1","Name":"old"}],"Roles":[{"ID":"r1","Name":"ops"}],
+			"ServiceIdentities":[{"ServiceName":"web"}],"ExpirationTime":"2030-01-01T00:00:00Z","Local":true}`))
+	}))
+	defer srv.Close()
+
+	if err := NewClient(srv.URL, "").UpdateToken(config.Token{AccessorID: "a1", SecretID: "s1", Description: "web", Policies: []string{"web"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"ServiceIdentities", "ExpirationTime", "Local"} {
+		if _, ok := written[k]; !ok {
+			t.Errorf("update dropped %s: %v", k, written)
+		}
+	}
+	for _, k := range []string{"SecretID", "Hash"} {
+		if _, ok := written[k]; ok {
+			t.Errorf("update sent %s: %v", k, written)
+		}
+	}
+	if written["Description"] != "web" || fmt.Sprint(written["Policies"]) != "[map[Name:web]]" || fmt.Sprint(written["Roles"]) != "[]" {
+		t.Errorf("update wrote %v, want the description and links of the config", written)
+	}
+}
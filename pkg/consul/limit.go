@@ -0,0 +1,43 @@
+package consul
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter spaces requests at least interval apart. It has no burst: a run is
+// a steady stream of requests, and the point is to keep it off the leader's
+// peak.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newLimiter returns a limiter for perSecond requests a second, or nil, which
+// never waits, when perSecond is not positive.
+func newLimiter(perSecond float64) *limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next request may go out and returns how long that
+// took.
+func (l *limiter) wait() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(d)
+	return d
+}
@@ -0,0 +1,37 @@
+package consul
+
+import "regexp"
+
+// Marker is text the clients add to the description of every resource they
+// write and take off those they read, so live resources can say where they
+// come from without differing from the config. A nil *Marker does nothing.
+type Marker struct {
+	Prefix, Suffix string
+	// PrefixPattern and SuffixPattern match any prefix and suffix the
+	// marker may have been rendered to, such as for earlier commits.
+	PrefixPattern, SuffixPattern *regexp.Regexp
+}
+
+func (m *Marker) add(description string) string {
+	if m == nil {
+		return description
+	}
+	return m.Prefix + description + m.Suffix
+}
+
+func (m *Marker) strip(description string) string {
+	if m == nil {
+		return description
+	}
+	if m.PrefixPattern != nil {
+		if loc := m.PrefixPattern.FindStringIndex(description); loc != nil {
+			description = description[loc[1]:]
+		}
+	}
+	if m.SuffixPattern != nil {
+		if loc := m.SuffixPattern.FindStringIndex(description); loc != nil {
+			description = description[:loc[0]]
+		}
+	}
+	return description
+}
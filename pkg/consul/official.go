@@ -0,0 +1,722 @@
+//go:build consulapi
+
+package consul
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// OfficialClient implements API with github.com/hashicorp/consul/api. It reads
+// the CONSUL_HTTP_* and CONSUL_* variables the consul CLI uses, so TLS,
+// CONSUL_HTTP_TOKEN_FILE and CONSUL_NAMESPACE work without extra flags. It is
+// compiled in only with the consulapi build tag.
+type OfficialClient struct {
+	api       *api.Client
+	query     *api.QueryOptions
+	tenancies *tenancies
+	marker    *Marker
+	limiter   *limiter
+	logf      func(string, ...interface{})
+	// ctx carries the span call spans are children of; see WithContext.
+	ctx context.Context
+	// resolver, when set, resolves the links of writes; see WithResolver.
+	resolver Resolver
+
+	// Tracer, when set, records a client span per call.
+	Tracer *trace.Tracer
+	// Stats, when set, counts and times every call.
+	Stats *Stats
+}
+
+// NewOfficialClient returns a client configured from the environment. A
+// non-empty addr or token overrides it, and opts apply on top. Hashes are
+// base64, as the HTTP API returns them, so a state file works with either
+// client.
+func NewOfficialClient(addr, token string, opts Options) (*OfficialClient, error) {
+	cfg := api.DefaultConfig()
+	if addr != "" {
+		cfg.Address = addr
+	}
+	if token != "" {
+		cfg.Token = token
+		cfg.TokenFile = ""
+	}
+	if opts.Datacenter != "" {
+		cfg.Datacenter = opts.Datacenter
+	}
+	if opts.Proxy != nil {
+		cfg.Transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+	httpClient, err := api.NewHttpClient(cfg.Transport, cfg.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %w", err)
+	}
+	httpClient.Transport = opts.wrap(httpClient.Transport)
+	cfg.HttpClient = httpClient
+	c, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %w", err)
+	}
+	c.SetHeaders(opts.header())
+	query := &api.QueryOptions{
+		RequireConsistent: opts.Consistency == "consistent",
+		AllowStale:        opts.Consistency == "stale",
+	}
+	return &OfficialClient{api: c, query: query, tenancies: newTenancies(opts.Partitions), marker: opts.Marker, limiter: newLimiter(opts.RateLimit), logf: opts.Logf, ctx: context.Background()}, nil
+}
+
+func (c *OfficialClient) tracer() *trace.Tracer { return c.Tracer }
+
+func (c *OfficialClient) withContext(ctx context.Context) API {
+	cp := *c
+	cp.ctx = ctx
+	return &cp
+}
+
+func (c *OfficialClient) withResolver(r Resolver) API {
+	cp := *c
+	cp.resolver = r
+	return &cp
+}
+
+// span starts the span of one call, once the rate limit lets it go out. The
+// returned func ends it with the call's error and records it in Stats.
+func (c *OfficialClient) span(method, route string) func(error) {
+	throttle(c.limiter, c.logf, method, route)
+	_, sp := c.Tracer.Start(c.ctx, method+" "+route, trace.KindClient)
+	sp.Set("http.request.method", method)
+	start := time.Now()
+	return func(err error) {
+		c.Stats.record(method+" "+route, time.Since(start), err)
+		sp.Finish(err)
+	}
+}
+
+// lists returns the query options of the requests that list a resource: one,
+// or one per partition covering all its namespaces.
+func (c *OfficialClient) lists() []*api.QueryOptions {
+	if !c.tenancies.spanning() {
+		return []*api.QueryOptions{c.query}
+	}
+	queries := make([]*api.QueryOptions, 0, len(c.tenancies.partitions))
+	for _, p := range c.tenancies.spanned() {
+		q := *c.query
+		q.Partition, q.Namespace = p, "*"
+		queries = append(queries, &q)
+	}
+	return queries
+}
+
+// scoped returns the query options of a read of the resource with the given
+// ID, addressed to the partition and namespace a list found it in.
+func (c *OfficialClient) scoped(id string) *api.QueryOptions {
+	t, ok := c.tenancies.of(id)
+	if !ok || !c.tenancies.spanning() {
+		return c.query
+	}
+	q := *c.query
+	q.Partition, q.Namespace = orDefault(t.Partition), orDefault(t.Namespace)
+	return &q
+}
+
+func (c *OfficialClient) ListPolicies() (_ []Policy, err error) {
+	finish := c.span("GET", "/v1/acl/policies")
+	defer func() { finish(err) }()
+
+	var policies []Policy
+	for _, q := range c.lists() {
+		entries, _, err := c.api.ACL().PolicyList(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			c.tenancies.remember(e.ID, e.Partition, e.Namespace)
+			policies = append(policies, Policy{
+				ID:          e.ID,
+				Hash:        base64.StdEncoding.EncodeToString(e.Hash),
+				Name:        e.Name,
+				Description: c.marker.strip(e.Description),
+				Datacenters: e.Datacenters,
+				CreateIndex: e.CreateIndex,
+				ModifyIndex: e.ModifyIndex,
+				Partition:   e.Partition,
+				Namespace:   e.Namespace,
+			})
+		}
+	}
+	return policies, nil
+}
+
+func (c *OfficialClient) PolicyRules(id string) (_ Policy, err error) {
+	finish := c.span("GET", "/v1/acl/policy/{id}")
+	defer func() { finish(err) }()
+
+	p, _, err := c.api.ACL().PolicyRead(id, c.scoped(id))
+	if err != nil {
+		return Policy{}, err
+	}
+	if p == nil {
+		return Policy{}, fmt.Errorf("policy %s not found", id)
+	}
+	return Policy{
+		ID:          p.ID,
+		Hash:        base64.StdEncoding.EncodeToString(p.Hash),
+		Name:        p.Name,
+		Description: c.marker.strip(p.Description),
+		Rules:       p.Rules,
+		Datacenters: p.Datacenters,
+		CreateIndex: p.CreateIndex,
+		ModifyIndex: p.ModifyIndex,
+		Partition:   p.Partition,
+		Namespace:   p.Namespace,
+	}, nil
+}
+
+func (c *OfficialClient) ListTokens() (_ []Token, err error) {
+	finish := c.span("GET", "/v1/acl/tokens")
+	defer func() { finish(err) }()
+
+	var tokens []Token
+	for _, q := range c.lists() {
+		entries, _, err := c.api.ACL().TokenList(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			c.tenancies.remember(e.AccessorID, e.Partition, e.Namespace)
+			t := Token{
+				AccessorID:     e.AccessorID,
+				Hash:           base64.StdEncoding.EncodeToString(e.Hash),
+				Description:    c.marker.strip(e.Description),
+				Local:          e.Local,
+				CreateTime:     e.CreateTime,
+				ExpirationTime: e.ExpirationTime,
+				CreateIndex:    e.CreateIndex,
+				ModifyIndex:    e.ModifyIndex,
+				Partition:      e.Partition,
+				Namespace:      e.Namespace,
+			}
+			for _, l := range e.Policies {
+				t.Policies = append(t.Policies, PolicyLink{ID: l.ID, Name: l.Name})
+			}
+			for _, l := range e.Roles {
+				t.Roles = append(t.Roles, RoleLink{ID: l.ID, Name: l.Name})
+			}
+			t.ServiceIdentities, t.NodeIdentities, t.TemplatedPolicies = identities(e.ServiceIdentities, e.NodeIdentities, e.TemplatedPolicies)
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (c *OfficialClient) ReadToken(accessorID string) (_ Token, _ bool, err error) {
+	finish := c.span("GET", "/v1/acl/token/{id}")
+	defer func() { finish(err) }()
+
+	e, _, err := c.api.ACL().TokenRead(accessorID, c.scoped(accessorID))
+	if err != nil {
+		if strings.Contains(err.Error(), "ACL not found") {
+			return Token{}, false, nil
+		}
+		return Token{}, false, err
+	}
+	t := Token{
+		AccessorID:     e.AccessorID,
+		Hash:           base64.StdEncoding.EncodeToString(e.Hash),
+		Description:    c.marker.strip(e.Description),
+		Local:          e.Local,
+		CreateTime:     e.CreateTime,
+		ExpirationTime: e.ExpirationTime,
+		CreateIndex:    e.CreateIndex,
+		ModifyIndex:    e.ModifyIndex,
+		Partition:      e.Partition,
+		Namespace:      e.Namespace,
+	}
+	for _, l := range e.Policies {
+		t.Policies = append(t.Policies, PolicyLink{ID: l.ID, Name: l.Name})
+	}
+	for _, l := range e.Roles {
+		t.Roles = append(t.Roles, RoleLink{ID: l.ID, Name: l.Name})
+	}
+	t.ServiceIdentities, t.NodeIdentities, t.TemplatedPolicies = identities(e.ServiceIdentities, e.NodeIdentities, e.TemplatedPolicies)
+	return t, true, nil
+}
+
+// identities converts the identities and templated policies of a role or
+// token.
+func identities(services []*api.ACLServiceIdentity, nodes []*api.ACLNodeIdentity, templated []*api.ACLTemplatedPolicy) (si []ServiceIdentity, ni []NodeIdentity, tp []TemplatedPolicy) {
+	for _, s := range services {
+		si = append(si, ServiceIdentity{ServiceName: s.ServiceName, Datacenters: s.Datacenters})
+	}
+	for _, n := range nodes {
+		ni = append(ni, NodeIdentity{NodeName: n.NodeName, Datacenter: n.Datacenter})
+	}
+	for _, p := range templated {
+		t := TemplatedPolicy{TemplateName: p.TemplateName, Datacenters: p.Datacenters}
+		if p.TemplateVariables != nil {
+			t.TemplateVariables = &TemplateVariables{Name: p.TemplateVariables.Name}
+		}
+		tp = append(tp, t)
+	}
+	return si, ni, tp
+}
+
+func (c *OfficialClient) ListRoles() (_ []Role, err error) {
+	finish := c.span("GET", "/v1/acl/roles")
+	defer func() { finish(err) }()
+
+	var roles []Role
+	for _, q := range c.lists() {
+		entries, _, err := c.api.ACL().RoleList(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			r := Role{ID: e.ID, Hash: base64.StdEncoding.EncodeToString(e.Hash), Name: e.Name, Description: c.marker.strip(e.Description),
+				Partition: e.Partition, Namespace: e.Namespace}
+			for _, l := range e.Policies {
+				r.Policies = append(r.Policies, PolicyLink{ID: l.ID, Name: l.Name})
+			}
+			r.ServiceIdentities, r.NodeIdentities, r.TemplatedPolicies = identities(e.ServiceIdentities, e.NodeIdentities, e.TemplatedPolicies)
+			roles = append(roles, r)
+		}
+	}
+	return roles, nil
+}
+
+func (c *OfficialClient) ListPartitions() (_ []Partition, err error) {
+	finish := c.span("GET", "/v1/partitions")
+	defer func() { finish(err) }()
+
+	entries, _, err := c.api.Partitions().List(context.Background(), c.query)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]Partition, 0, len(entries))
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		partitions = append(partitions, Partition{Name: e.Name, Description: c.marker.strip(e.Description), ModifyIndex: e.ModifyIndex, DeletedAt: e.DeletedAt})
+		if e.DeletedAt == nil {
+			names = append(names, e.Name)
+		}
+	}
+	c.tenancies.exist(names...)
+	return partitions, nil
+}
+
+func (c *OfficialClient) ListNamespaces() (_ []Namespace, err error) {
+	finish := c.span("GET", "/v1/namespaces")
+	defer func() { finish(err) }()
+
+	queries := []*api.QueryOptions{c.query}
+	if c.tenancies.spanning() {
+		queries = queries[:0]
+		for _, p := range c.tenancies.spanned() {
+			q := *c.query
+			q.Partition = p
+			queries = append(queries, &q)
+		}
+	}
+	var namespaces []Namespace
+	for _, q := range queries {
+		entries, _, err := c.api.Namespaces().List(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			n := Namespace{Name: e.Name, Description: c.marker.strip(e.Description), Meta: e.Meta, Partition: e.Partition,
+				ModifyIndex: e.ModifyIndex, DeletedAt: e.DeletedAt}
+			if e.ACLs != nil {
+				n.ACLs = &NamespaceACLConfig{}
+				for _, l := range e.ACLs.PolicyDefaults {
+					n.ACLs.PolicyDefaults = append(n.ACLs.PolicyDefaults, PolicyLink{ID: l.ID, Name: l.Name})
+				}
+				for _, l := range e.ACLs.RoleDefaults {
+					n.ACLs.RoleDefaults = append(n.ACLs.RoleDefaults, RoleLink{ID: l.ID, Name: l.Name})
+				}
+			}
+			namespaces = append(namespaces, n)
+		}
+	}
+	return namespaces, nil
+}
+
+func (c *OfficialClient) ListAuthMethods() (_ []AuthMethod, err error) {
+	finish := c.span("GET", "/v1/acl/auth-methods")
+	defer func() { finish(err) }()
+
+	var methods []AuthMethod
+	for _, q := range c.lists() {
+		entries, _, err := c.api.ACL().AuthMethodList(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			methods = append(methods, AuthMethod{Name: e.Name, Type: e.Type, DisplayName: e.DisplayName, Description: c.marker.strip(e.Description),
+				MaxTokenTTL: durationString(e.MaxTokenTTL), TokenLocality: e.TokenLocality, ModifyIndex: e.ModifyIndex,
+				Partition: e.Partition, Namespace: e.Namespace})
+		}
+	}
+	return methods, nil
+}
+
+func (c *OfficialClient) ReadAuthMethod(m AuthMethod) (_ AuthMethod, err error) {
+	finish := c.span("GET", "/v1/acl/auth-method/{name}")
+	defer func() { finish(err) }()
+
+	q := c.query
+	if c.tenancies.spanning() {
+		scoped := *c.query
+		scoped.Partition, scoped.Namespace = orDefault(m.Partition), orDefault(m.Namespace)
+		q = &scoped
+	}
+	e, _, err := c.api.ACL().AuthMethodRead(m.Name, q)
+	if err != nil {
+		return AuthMethod{}, err
+	}
+	if e == nil {
+		return AuthMethod{}, fmt.Errorf("auth method %s not found", m.Name)
+	}
+	return AuthMethod{Name: e.Name, Type: e.Type, DisplayName: e.DisplayName, Description: c.marker.strip(e.Description),
+		MaxTokenTTL: durationString(e.MaxTokenTTL), TokenLocality: e.TokenLocality, Config: e.Config,
+		ModifyIndex: e.ModifyIndex, Partition: e.Partition, Namespace: e.Namespace}, nil
+}
+
+// durationString renders d as the HTTP API does: empty when unset.
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func (c *OfficialClient) ReplicationStatus() (_ ReplicationStatus, err error) {
+	finish := c.span("GET", "/v1/acl/replication")
+	defer func() { finish(err) }()
+
+	st, _, err := c.api.ACL().Replication(c.query)
+	if err != nil {
+		return ReplicationStatus{}, err
+	}
+	return ReplicationStatus{
+		Enabled:          st.Enabled,
+		Running:          st.Running,
+		SourceDatacenter: st.SourceDatacenter,
+		ReplicationType:  st.ReplicationType,
+		LastSuccess:      st.LastSuccess,
+		LastError:        st.LastError,
+		LastErrorMessage: st.LastErrorMessage,
+	}, nil
+}
+
+func (c *OfficialClient) CreatePolicy(p config.Policy) (_ string, err error) {
+	finish := c.span("PUT", "/v1/acl/policy")
+	defer func() { finish(err) }()
+
+	p.Description = c.marker.add(p.Description)
+	created, _, err := c.api.ACL().PolicyCreate(officialPolicy("", p), nil)
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (c *OfficialClient) UpdatePolicy(id string, p config.Policy) (err error) {
+	finish := c.span("PUT", "/v1/acl/policy/{id}")
+	defer func() { finish(err) }()
+
+	p.Description = c.marker.add(p.Description)
+	_, _, err = c.api.ACL().PolicyUpdate(officialPolicy(id, p), nil)
+	return err
+}
+
+func (c *OfficialClient) TokenSecret(accessorID string) (_ string, err error) {
+	finish := c.span("GET", "/v1/acl/token/{id}")
+	defer func() { finish(err) }()
+
+	e, _, err := c.api.ACL().TokenRead(accessorID, c.scoped(accessorID))
+	if err != nil {
+		return "", err
+	}
+	return e.SecretID, nil
+}
+
+func (c *OfficialClient) ValidateRules(p config.Policy) (err error) {
+	finish := c.span("PUT", "/v1/acl/policy")
+	defer func() { finish(err) }()
+
+	name, err := scratchPolicyName()
+	if err != nil {
+		return err
+	}
+	scratch := officialPolicy("", p)
+	scratch.Name, scratch.Description = name, scratchDescription
+	created, _, err := c.api.ACL().PolicyCreate(scratch, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.api.ACL().PolicyDelete(created.ID, &api.WriteOptions{Partition: p.Partition, Namespace: p.Namespace}); err != nil {
+		return fmt.Errorf("failed to delete the scratch policy %s: %w", name, err)
+	}
+	return nil
+}
+
+func officialPolicy(id string, p config.Policy) *api.ACLPolicy {
+	return &api.ACLPolicy{ID: id, Name: p.Name, Description: p.Description, Rules: p.Rules, Datacenters: p.Datacenters,
+		Partition: p.Partition, Namespace: p.Namespace}
+}
+
+func (c *OfficialClient) CreateRole(r config.Role) (_ string, err error) {
+	finish := c.span("PUT", "/v1/acl/role")
+	defer func() { finish(err) }()
+
+	r.Description = c.marker.add(r.Description)
+	role, err := c.officialRole("", r)
+	if err != nil {
+		return "", err
+	}
+	created, _, err := c.api.ACL().RoleCreate(role, nil)
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (c *OfficialClient) UpdateRole(id string, r config.Role) (err error) {
+	finish := c.span("PUT", "/v1/acl/role/{id}")
+	defer func() { finish(err) }()
+
+	r.Description = c.marker.add(r.Description)
+	role, err := c.officialRole(id, r)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.api.ACL().RoleUpdate(role, nil)
+	return err
+}
+
+func (c *OfficialClient) officialRole(id string, r config.Role) (*api.ACLRole, error) {
+	policies, err := resolveLinks(c.resolver, "policy", r.Tenancy, r.Policies)
+	if err != nil {
+		return nil, err
+	}
+	role := &api.ACLRole{ID: id, Name: r.Name, Description: r.Description, Partition: r.Partition, Namespace: r.Namespace}
+	for _, l := range policies {
+		role.Policies = append(role.Policies, &api.ACLRolePolicyLink{ID: l.ID, Name: l.Name})
+	}
+	for _, si := range r.ServiceIdentities {
+		role.ServiceIdentities = append(role.ServiceIdentities, &api.ACLServiceIdentity{ServiceName: si.ServiceName, Datacenters: si.Datacenters})
+	}
+	for _, ni := range r.NodeIdentities {
+		role.NodeIdentities = append(role.NodeIdentities, &api.ACLNodeIdentity{NodeName: ni.NodeName, Datacenter: ni.Datacenter})
+	}
+	for _, tp := range r.TemplatedPolicies {
+		t := &api.ACLTemplatedPolicy{TemplateName: tp.TemplateName, Datacenters: tp.Datacenters}
+		if tp.TemplateVariables.Name != "" {
+			t.TemplateVariables = &api.ACLTemplatedPolicyVariables{Name: tp.TemplateVariables.Name}
+		}
+		role.TemplatedPolicies = append(role.TemplatedPolicies, t)
+	}
+	return role, nil
+}
+
+func (c *OfficialClient) CreatePartition(p config.Partition) (err error) {
+	finish := c.span("PUT", "/v1/partition")
+	defer func() { finish(err) }()
+
+	p.Description = c.marker.add(p.Description)
+	if _, _, err = c.api.Partitions().Create(context.Background(), &api.Partition{Name: p.Name, Description: p.Description}, nil); err != nil {
+		return err
+	}
+	c.tenancies.exist(p.Name)
+	return nil
+}
+
+func (c *OfficialClient) UpdatePartition(p config.Partition) (err error) {
+	finish := c.span("PUT", "/v1/partition/{name}")
+	defer func() { finish(err) }()
+
+	p.Description = c.marker.add(p.Description)
+	_, _, err = c.api.Partitions().Update(context.Background(), &api.Partition{Name: p.Name, Description: p.Description}, nil)
+	return err
+}
+
+func (c *OfficialClient) CreateNamespace(n config.Namespace) (err error) {
+	finish := c.span("PUT", "/v1/namespace")
+	defer func() { finish(err) }()
+
+	n.Description = c.marker.add(n.Description)
+	ns, err := c.officialNamespace(n)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.api.Namespaces().Create(ns, nil)
+	return err
+}
+
+func (c *OfficialClient) UpdateNamespace(n config.Namespace) (err error) {
+	finish := c.span("PUT", "/v1/namespace/{name}")
+	defer func() { finish(err) }()
+
+	n.Description = c.marker.add(n.Description)
+	ns, err := c.officialNamespace(n)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.api.Namespaces().Update(ns, nil)
+	return err
+}
+
+func (c *OfficialClient) officialNamespace(n config.Namespace) (*api.Namespace, error) {
+	policies, err := resolveLinks(c.resolver, "policy", n.Defaults(), n.PolicyDefaults)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := resolveLinks(c.resolver, "role", n.Defaults(), n.RoleDefaults)
+	if err != nil {
+		return nil, err
+	}
+	acls := &api.NamespaceACLConfig{PolicyDefaults: []api.ACLLink{}, RoleDefaults: []api.ACLLink{}}
+	for _, l := range policies {
+		acls.PolicyDefaults = append(acls.PolicyDefaults, api.ACLLink{ID: l.ID, Name: l.Name})
+	}
+	for _, l := range roles {
+		acls.RoleDefaults = append(acls.RoleDefaults, api.ACLLink{ID: l.ID, Name: l.Name})
+	}
+	return &api.Namespace{Name: n.Name, Description: n.Description, ACLs: acls, Meta: n.Meta, Partition: n.Partition}, nil
+}
+
+func (c *OfficialClient) CreateAuthMethod(m config.AuthMethod) (err error) {
+	finish := c.span("PUT", "/v1/acl/auth-method")
+	defer func() { finish(err) }()
+
+	m.Description = c.marker.add(m.Description)
+	_, _, err = c.api.ACL().AuthMethodCreate(officialAuthMethod(m), nil)
+	return err
+}
+
+func (c *OfficialClient) UpdateAuthMethod(m config.AuthMethod) (err error) {
+	finish := c.span("PUT", "/v1/acl/auth-method/{name}")
+	defer func() { finish(err) }()
+
+	m.Description = c.marker.add(m.Description)
+	_, _, err = c.api.ACL().AuthMethodUpdate(officialAuthMethod(m), nil)
+	return err
+}
+
+// officialAuthMethod converts m; validation has already checked MaxTokenTTL
+// parses.
+func officialAuthMethod(m config.AuthMethod) *api.ACLAuthMethod {
+	ttl, _ := time.ParseDuration(m.MaxTokenTTL)
+	return &api.ACLAuthMethod{Name: m.Name, Type: m.Type, DisplayName: m.DisplayName, Description: m.Description,
+		MaxTokenTTL: ttl, TokenLocality: m.TokenLocality, Config: m.Config, Partition: m.Partition, Namespace: m.Namespace}
+}
+
+func (c *OfficialClient) CreateToken(t config.Token) (err error) {
+	finish := c.span("PUT", "/v1/acl/token")
+	defer func() { finish(err) }()
+
+	t.Description = c.marker.add(t.Description)
+	token, err := c.officialToken(t)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.api.ACL().TokenCreate(token, nil)
+	return err
+}
+
+// UpdateToken reads the token and writes it back with only the description
+// and the policy and role links changed, as Client's does. SecretID is left
+// out, as it is immutable after creation.
+func (c *OfficialClient) UpdateToken(t config.Token) (err error) {
+	finish := c.span("PUT", "/v1/acl/token/{id}")
+	defer func() { finish(err) }()
+
+	t.Description = c.marker.add(t.Description)
+	desired, err := c.officialToken(t)
+	if err != nil {
+		return err
+	}
+	body, _, err := c.api.ACL().TokenRead(t.AccessorID, c.scoped(t.AccessorID))
+	if err != nil {
+		return err
+	}
+	body.SecretID = ""
+	body.Description, body.Policies, body.Roles = desired.Description, desired.Policies, desired.Roles
+	_, _, err = c.api.ACL().TokenUpdate(body, nil)
+	return err
+}
+
+// DeleteToken deletes the token, in the partition and namespace a list found
+// it in.
+func (c *OfficialClient) DeleteToken(accessorID string) (err error) {
+	finish := c.span("DELETE", "/v1/acl/token/{id}")
+	defer func() { finish(err) }()
+
+	q := c.scoped(accessorID)
+	_, err = c.api.ACL().TokenDelete(accessorID, &api.WriteOptions{Partition: q.Partition, Namespace: q.Namespace})
+	return err
+}
+
+func (c *OfficialClient) officialToken(t config.Token) (*api.ACLToken, error) {
+	policies, err := resolveLinks(c.resolver, "policy", t.Tenancy, t.Policies)
+	if err != nil {
+		return nil, err
+	}
+	roleLinks, err := resolveLinks(c.resolver, "role", t.Tenancy, t.Roles)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]*api.ACLTokenPolicyLink, 0, len(policies))
+	for _, l := range policies {
+		links = append(links, &api.ACLTokenPolicyLink{ID: l.ID, Name: l.Name})
+	}
+	var roles []*api.ACLTokenRoleLink
+	for _, l := range roleLinks {
+		roles = append(roles, &api.ACLTokenRoleLink{ID: l.ID, Name: l.Name})
+	}
+	return &api.ACLToken{AccessorID: t.AccessorID, SecretID: t.SecretID, Description: t.Description, Policies: links, Roles: roles,
+		Partition: t.Partition, Namespace: t.Namespace}, nil
+}
+
+// PutKV stores value, encoded as JSON, under key in the KV store.
+func (c *OfficialClient) PutKV(key string, value interface{}) (err error) {
+	finish := c.span("PUT", "/v1/kv/{key}")
+	defer func() { finish(err) }()
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.api.KV().Put(&api.KVPair{Key: strings.Trim(key, "/"), Value: b}, nil)
+	return err
+}
+
+// ListKV returns the keys below prefix.
+func (c *OfficialClient) ListKV(prefix string) (_ []KVPair, err error) {
+	finish := c.span("GET", "/v1/kv/{key}")
+	defer func() { finish(err) }()
+
+	list, _, err := c.api.KV().List(strings.Trim(prefix, "/")+"/", c.query)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([]KVPair, 0, len(list))
+	for _, p := range list {
+		pairs = append(pairs, KVPair{Key: p.Key, Value: p.Value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
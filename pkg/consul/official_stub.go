@@ -0,0 +1,61 @@
+//go:build !consulapi
+
+package consul
+
+import (
+	"context"
+	"errors"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// OfficialClient is a placeholder in builds without the consulapi tag, which
+// keeps the default binary free of the hashicorp/consul/api dependency.
+type OfficialClient struct {
+	Tracer *trace.Tracer
+	Stats  *Stats
+}
+
+var errNoOfficialClient = errors.New("this binary was built without the consul/api client; rebuild with -tags consulapi")
+
+// NewOfficialClient always fails in builds without the consulapi tag.
+func NewOfficialClient(addr, token string, opts Options) (*OfficialClient, error) {
+	return nil, errNoOfficialClient
+}
+
+func (c *OfficialClient) tracer() *trace.Tracer              { return c.Tracer }
+func (c *OfficialClient) withContext(context.Context) API    { return c }
+func (c *OfficialClient) ListPolicies() ([]Policy, error)    { return nil, errNoOfficialClient }
+func (c *OfficialClient) PolicyRules(string) (Policy, error) { return Policy{}, errNoOfficialClient }
+func (c *OfficialClient) ListTokens() ([]Token, error)       { return nil, errNoOfficialClient }
+func (c *OfficialClient) ReadToken(string) (Token, bool, error) {
+	return Token{}, false, errNoOfficialClient
+}
+func (c *OfficialClient) ListRoles() ([]Role, error)                 { return nil, errNoOfficialClient }
+func (c *OfficialClient) CreatePolicy(config.Policy) (string, error) { return "", errNoOfficialClient }
+func (c *OfficialClient) UpdatePolicy(string, config.Policy) error   { return errNoOfficialClient }
+func (c *OfficialClient) CreateRole(config.Role) (string, error)     { return "", errNoOfficialClient }
+func (c *OfficialClient) UpdateRole(string, config.Role) error       { return errNoOfficialClient }
+func (c *OfficialClient) ListPartitions() ([]Partition, error)       { return nil, errNoOfficialClient }
+func (c *OfficialClient) CreatePartition(config.Partition) error     { return errNoOfficialClient }
+func (c *OfficialClient) UpdatePartition(config.Partition) error     { return errNoOfficialClient }
+func (c *OfficialClient) ListNamespaces() ([]Namespace, error)       { return nil, errNoOfficialClient }
+func (c *OfficialClient) CreateNamespace(config.Namespace) error     { return errNoOfficialClient }
+func (c *OfficialClient) UpdateNamespace(config.Namespace) error     { return errNoOfficialClient }
+func (c *OfficialClient) ListAuthMethods() ([]AuthMethod, error)     { return nil, errNoOfficialClient }
+func (c *OfficialClient) ReadAuthMethod(AuthMethod) (AuthMethod, error) {
+	return AuthMethod{}, errNoOfficialClient
+}
+func (c *OfficialClient) CreateAuthMethod(config.AuthMethod) error { return errNoOfficialClient }
+func (c *OfficialClient) UpdateAuthMethod(config.AuthMethod) error { return errNoOfficialClient }
+func (c *OfficialClient) CreateToken(config.Token) error           { return errNoOfficialClient }
+func (c *OfficialClient) UpdateToken(config.Token) error           { return errNoOfficialClient }
+func (c *OfficialClient) DeleteToken(string) error                 { return errNoOfficialClient }
+func (c *OfficialClient) ValidateRules(config.Policy) error        { return errNoOfficialClient }
+func (c *OfficialClient) TokenSecret(string) (string, error)       { return "", errNoOfficialClient }
+func (c *OfficialClient) PutKV(string, interface{}) error          { return errNoOfficialClient }
+func (c *OfficialClient) ListKV(string) ([]KVPair, error)          { return nil, errNoOfficialClient }
+func (c *OfficialClient) ReplicationStatus() (ReplicationStatus, error) {
+	return ReplicationStatus{}, errNoOfficialClient
+}
@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats counts the requests a client sends to Consul and the time they take,
+// by endpoint. A nil Stats records nothing. It is safe for concurrent use.
+type Stats struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointStats
+}
+
+// EndpointStats are the requests to one endpoint, e.g. "GET /v1/acl/policy/{id}".
+type EndpointStats struct {
+	Endpoint string
+	Requests int
+	Errors   int
+	Total    time.Duration
+	Max      time.Duration
+}
+
+// record counts one request to the endpoint of route, which took d.
+func (s *Stats) record(route string, d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	route, _, _ = strings.Cut(route, "?")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.endpoints == nil {
+		s.endpoints = make(map[string]*EndpointStats)
+	}
+	e := s.endpoints[route]
+	if e == nil {
+		e = &EndpointStats{Endpoint: route}
+		s.endpoints[route] = e
+	}
+	e.Requests++
+	if err != nil {
+		e.Errors++
+	}
+	e.Total += d
+	e.Max = max(e.Max, d)
+}
+
+// Endpoints returns the endpoints requested, the slowest in total first.
+func (s *Stats) Endpoints() []EndpointStats {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]EndpointStats, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Total != out[j].Total {
+			return out[i].Total > out[j].Total
+		}
+		return out[i].Endpoint < out[j].Endpoint
+	})
+	return out
+}
+
+// Requests returns the number of requests sent and the time spent in them.
+// Concurrent requests each count their own time.
+func (s *Stats) Requests() (n int, total time.Duration) {
+	for _, e := range s.Endpoints() {
+		n += e.Requests
+		total += e.Total
+	}
+	return n, total
+}
@@ -0,0 +1,33 @@
+package consul
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	var s Stats
+	s.record("GET /v1/acl/policy/{id}", 10*time.Millisecond, nil)
+	s.record("GET /v1/acl/policy/{id}", 30*time.Millisecond, errors.New("boom"))
+	s.record("GET /v1/acl/policies?ns=*&partition=default", 5*time.Millisecond, nil)
+	s.record("GET /v1/acl/policies?ns=*&partition=team-a", 5*time.Millisecond, nil)
+
+	got := s.Endpoints()
+	want := []EndpointStats{
+		{Endpoint: "GET /v1/acl/policy/{id}", Requests: 2, Errors: 1, Total: 40 * time.Millisecond, Max: 30 * time.Millisecond},
+		{Endpoint: "GET /v1/acl/policies", Requests: 2, Total: 10 * time.Millisecond, Max: 5 * time.Millisecond},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Endpoints = %+v, want %+v", got, want)
+	}
+	if n, total := s.Requests(); n != 4 || total != 50*time.Millisecond {
+		t.Errorf("Requests = %d, %s, want 4, 50ms", n, total)
+	}
+
+	var nilStats *Stats
+	nilStats.record("GET /v1/acl/tokens", time.Millisecond, nil)
+	if n, _ := nilStats.Requests(); n != 0 {
+		t.Errorf("nil Stats counted %d requests", n)
+	}
+}
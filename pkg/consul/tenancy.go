@@ -0,0 +1,72 @@
+package consul
+
+import (
+	"sync"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// tenancies spans the lists of a client over admin partitions and namespaces
+// (Consul Enterprise). It remembers where each listed resource lives, so the
+// single reads that follow address the same partition and namespace.
+type tenancies struct {
+	partitions []string
+
+	mu   sync.Mutex
+	byID map[string]config.Tenancy
+	// existing holds the partitions a partition list found, once there was
+	// one; nil means all of partitions are assumed to exist.
+	existing map[string]bool
+}
+
+func newTenancies(partitions []string) *tenancies {
+	return &tenancies{partitions: partitions, byID: make(map[string]config.Tenancy)}
+}
+
+// spanning reports whether lists cover more than the client's own namespace.
+func (t *tenancies) spanning() bool {
+	return len(t.partitions) > 0
+}
+
+// spanned returns the partitions lists cover: all of partitions, less those a
+// partition list did not find.
+func (t *tenancies) spanned() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.existing == nil {
+		return t.partitions
+	}
+	var spanned []string
+	for _, p := range t.partitions {
+		if t.existing[p] {
+			spanned = append(spanned, p)
+		}
+	}
+	return spanned
+}
+
+// exist records partitions as existing, as listed or just created.
+func (t *tenancies) exist(partitions ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.existing == nil {
+		t.existing = make(map[string]bool)
+	}
+	for _, p := range partitions {
+		t.existing[p] = true
+	}
+}
+
+func (t *tenancies) remember(id, partition, namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byID[id] = config.Tenancy{Partition: partition, Namespace: namespace}
+}
+
+// of returns the tenancy a list found the resource with the given ID in.
+func (t *tenancies) of(id string) (config.Tenancy, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ten, ok := t.byID[id]
+	return ten, ok
+}
@@ -0,0 +1,255 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// Policy is the subset of the Consul policy API we read. The list endpoint
+// omits Rules, so it is filled in per policy on demand. Hash changes whenever
+// Consul stores a new version of the policy, and ModifyIndex is the Raft index
+// it was stored at.
+type Policy struct {
+	ID          string   `json:"ID"`
+	Hash        string   `json:"Hash"`
+	Name        string   `json:"Name"`
+	Description string   `json:"Description"`
+	Rules       string   `json:"Rules"`
+	Datacenters []string `json:"Datacenters"`
+	CreateIndex uint64   `json:"CreateIndex"`
+	ModifyIndex uint64   `json:"ModifyIndex"`
+	// Partition and Namespace are only reported by Consul Enterprise.
+	Partition string `json:"Partition,omitempty"`
+	Namespace string `json:"Namespace,omitempty"`
+}
+
+// Tenancy returns the partition and namespace the policy lives in.
+func (p Policy) Tenancy() config.Tenancy {
+	return config.Tenancy{Partition: p.Partition, Namespace: p.Namespace}
+}
+
+// Token is the subset of the Consul token API we read. The list endpoint
+// already carries the policy links.
+type Token struct {
+	AccessorID  string       `json:"AccessorID"`
+	Hash        string       `json:"Hash"`
+	Description string       `json:"Description"`
+	Policies    []PolicyLink `json:"Policies"`
+	Roles       []RoleLink   `json:"Roles"`
+	// The identities and templated policies are not managed, but are read
+	// to warn when recreating the token would drop them.
+	ServiceIdentities []ServiceIdentity `json:"ServiceIdentities"`
+	NodeIdentities    []NodeIdentity    `json:"NodeIdentities"`
+	TemplatedPolicies []TemplatedPolicy `json:"TemplatedPolicies"`
+	Local             bool              `json:"Local"`
+	CreateTime        time.Time         `json:"CreateTime"`
+	ExpirationTime    *time.Time        `json:"ExpirationTime"`
+	CreateIndex       uint64            `json:"CreateIndex"`
+	ModifyIndex       uint64            `json:"ModifyIndex"`
+	// Partition and Namespace are only reported by Consul Enterprise.
+	Partition string `json:"Partition,omitempty"`
+	Namespace string `json:"Namespace,omitempty"`
+}
+
+// Tenancy returns the partition and namespace the token lives in.
+func (t Token) Tenancy() config.Tenancy {
+	return config.Tenancy{Partition: t.Partition, Namespace: t.Namespace}
+}
+
+// PolicyLink is a token's reference to a policy.
+type PolicyLink struct {
+	ID   string `json:"ID"`
+	Name string `json:"Name"`
+}
+
+// RoleLink is a token's reference to a role.
+type RoleLink struct {
+	ID   string `json:"ID"`
+	Name string `json:"Name"`
+}
+
+// Role is the subset of the Consul role API we read. The list endpoint
+// carries every field compared.
+type Role struct {
+	ID                string            `json:"ID"`
+	Hash              string            `json:"Hash"`
+	Name              string            `json:"Name"`
+	Description       string            `json:"Description"`
+	Policies          []PolicyLink      `json:"Policies"`
+	ServiceIdentities []ServiceIdentity `json:"ServiceIdentities"`
+	NodeIdentities    []NodeIdentity    `json:"NodeIdentities"`
+	TemplatedPolicies []TemplatedPolicy `json:"TemplatedPolicies"`
+	// Partition and Namespace are only reported by Consul Enterprise.
+	Partition string `json:"Partition,omitempty"`
+	Namespace string `json:"Namespace,omitempty"`
+}
+
+// Tenancy returns the partition and namespace the role lives in.
+func (r Role) Tenancy() config.Tenancy {
+	return config.Tenancy{Partition: r.Partition, Namespace: r.Namespace}
+}
+
+// PolicyNames returns the names of the policies linked to r.
+func (r Role) PolicyNames() []string {
+	names := make([]string, 0, len(r.Policies))
+	for _, l := range r.Policies {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// ServiceIdentity is a role or token grant of what a service needs, as Consul
+// reads and writes it.
+type ServiceIdentity struct {
+	ServiceName string   `json:"ServiceName"`
+	Datacenters []string `json:"Datacenters,omitempty"`
+}
+
+// NodeIdentity is a role or token grant of what a node's agent needs.
+type NodeIdentity struct {
+	NodeName   string `json:"NodeName"`
+	Datacenter string `json:"Datacenter"`
+}
+
+// TemplatedPolicy is a role or token use of a built-in policy template.
+type TemplatedPolicy struct {
+	TemplateName      string             `json:"TemplateName"`
+	TemplateVariables *TemplateVariables `json:"TemplateVariables,omitempty"`
+	Datacenters       []string           `json:"Datacenters,omitempty"`
+}
+
+// TemplateVariables are the inputs of a policy template.
+type TemplateVariables struct {
+	Name string `json:"Name"`
+}
+
+// Partition is the subset of the Consul Enterprise admin partition API we
+// read.
+type Partition struct {
+	Name        string `json:"Name"`
+	Description string `json:"Description"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+	// DeletedAt is set on a partition Consul is still deleting.
+	DeletedAt *time.Time `json:"DeletedAt,omitempty"`
+}
+
+// Namespace is the subset of the Consul Enterprise namespace API we read.
+type Namespace struct {
+	Name        string              `json:"Name"`
+	Description string              `json:"Description"`
+	ACLs        *NamespaceACLConfig `json:"ACLs,omitempty"`
+	Meta        map[string]string   `json:"Meta,omitempty"`
+	Partition   string              `json:"Partition,omitempty"`
+	ModifyIndex uint64              `json:"ModifyIndex"`
+	// DeletedAt is set on a namespace Consul is still deleting.
+	DeletedAt *time.Time `json:"DeletedAt,omitempty"`
+}
+
+// NamespaceACLConfig holds the policies and roles linked to every token of a
+// namespace.
+type NamespaceACLConfig struct {
+	PolicyDefaults []PolicyLink `json:"PolicyDefaults"`
+	RoleDefaults   []RoleLink   `json:"RoleDefaults"`
+}
+
+// PolicyDefaultNames returns the names of the namespace's default policies.
+func (n Namespace) PolicyDefaultNames() []string {
+	var names []string
+	if n.ACLs != nil {
+		for _, l := range n.ACLs.PolicyDefaults {
+			names = append(names, l.Name)
+		}
+	}
+	return names
+}
+
+// RoleDefaultNames returns the names of the namespace's default roles.
+func (n Namespace) RoleDefaultNames() []string {
+	var names []string
+	if n.ACLs != nil {
+		for _, l := range n.ACLs.RoleDefaults {
+			names = append(names, l.Name)
+		}
+	}
+	return names
+}
+
+// AuthMethod is the subset of the Consul auth method API we read. The list
+// endpoint leaves out Config, which ReadAuthMethod fills in.
+type AuthMethod struct {
+	Name        string `json:"Name"`
+	Type        string `json:"Type"`
+	DisplayName string `json:"DisplayName"`
+	Description string `json:"Description"`
+	// MaxTokenTTL is a duration such as "8h0m0s", or empty when unset.
+	MaxTokenTTL   string                 `json:"MaxTokenTTL"`
+	TokenLocality string                 `json:"TokenLocality"`
+	Config        map[string]interface{} `json:"Config"`
+	ModifyIndex   uint64                 `json:"ModifyIndex"`
+	// Partition and Namespace are only reported by Consul Enterprise.
+	Partition string `json:"Partition,omitempty"`
+	Namespace string `json:"Namespace,omitempty"`
+}
+
+// Tenancy returns the partition and namespace the auth method lives in.
+func (m AuthMethod) Tenancy() config.Tenancy {
+	return config.Tenancy{Partition: m.Partition, Namespace: m.Namespace}
+}
+
+// ReplicationStatus is the ACL replication state of a datacenter, as
+// /v1/acl/replication reports it. The primary datacenter, which replicates
+// from nowhere, reports Enabled false.
+type ReplicationStatus struct {
+	Enabled          bool      `json:"Enabled"`
+	Running          bool      `json:"Running"`
+	SourceDatacenter string    `json:"SourceDatacenter"`
+	ReplicationType  string    `json:"ReplicationType"`
+	LastSuccess      time.Time `json:"LastSuccess"`
+	LastError        time.Time `json:"LastError"`
+	LastErrorMessage string    `json:"LastErrorMessage"`
+}
+
+// KVPair is a key in the KV store with its raw value.
+type KVPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+// PolicyNames returns the names of the policies linked to t.
+func (t Token) PolicyNames() []string {
+	names := make([]string, 0, len(t.Policies))
+	for _, l := range t.Policies {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// RoleNames returns the names of the roles linked to t.
+func (t Token) RoleNames() []string {
+	names := make([]string, 0, len(t.Roles))
+	for _, l := range t.Roles {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// Label annotates an opaque accessor id with its description when present.
+func (t Token) Label() string {
+	if t.Description != "" {
+		return fmt.Sprintf("%s %q", t.AccessorID, t.Description)
+	}
+	return t.AccessorID
+}
+
+// builtinPrefix starts the fixed IDs of the policies and tokens Consul creates
+// itself, such as global-management and the anonymous token.
+const builtinPrefix = "00000000-0000-0000-0000-"
+
+// Builtin reports whether p is a policy Consul creates itself.
+func (p Policy) Builtin() bool { return strings.HasPrefix(p.ID, builtinPrefix) }
+
+// Builtin reports whether t is a token Consul creates itself.
+func (t Token) Builtin() bool { return strings.HasPrefix(t.AccessorID, builtinPrefix) }
@@ -0,0 +1,535 @@
+package consultest
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// scope is where a request reads or writes: the ?partition= and ?ns= of its
+// query, or the Partition and Namespace of its body. A namespace of "*" lists
+// every namespace of the partition.
+type scope struct {
+	partition, namespace string
+}
+
+func queryScope(r *http.Request) scope {
+	q := r.URL.Query()
+	return scope{orDefault(q.Get("partition")), orDefault(q.Get("ns"))}
+}
+
+// bodyScope is the scope of a write: the tenancy of its body, else of its
+// query.
+func bodyScope(r *http.Request, partition, namespace string) scope {
+	sc := queryScope(r)
+	if partition != "" {
+		sc.partition = partition
+	}
+	if namespace != "" {
+		sc.namespace = namespace
+	}
+	return sc
+}
+
+func (sc scope) has(partition, namespace string) bool {
+	return orDefault(partition) == sc.partition && (sc.namespace == "*" || orDefault(namespace) == sc.namespace)
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
+
+// exists checks the partition, and unless listing every namespace the
+// namespace, of sc exist.
+func (c *Consul) exists(sc scope) error {
+	if _, ok := c.partitions[sc.partition]; !ok {
+		return badRequest("Partition %q does not exist", sc.partition)
+	}
+	if sc.namespace == "*" {
+		return nil
+	}
+	if _, ok := c.namespaces[sc.partition+"/"+sc.namespace]; !ok {
+		return badRequest("Namespace %q does not exist in partition %q", sc.namespace, sc.partition)
+	}
+	return nil
+}
+
+func (c *Consul) listPolicies(r *http.Request) (interface{}, error) {
+	sc := queryScope(r)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	policies := []consul.Policy{}
+	for _, p := range c.policies {
+		if sc.has(p.Partition, p.Namespace) {
+			// The list endpoint leaves out the rules.
+			listed := *p
+			listed.Rules = ""
+			policies = append(policies, listed)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+func (c *Consul) readPolicy(r *http.Request, id string) (interface{}, error) {
+	p, ok := c.policies[id]
+	if !ok || !queryScope(r).has(p.Partition, p.Namespace) {
+		return nil, notFound("ACL not found")
+	}
+	return p, nil
+}
+
+type policyBody struct {
+	ID          string
+	Name        string
+	Description string
+	Rules       string
+	Datacenters []string
+	Partition   string
+	Namespace   string
+}
+
+// putPolicy creates a policy, or with an ID in the path replaces it.
+func (c *Consul) putPolicy(r *http.Request, id string) (interface{}, error) {
+	var body policyBody
+	if err := decode(r, &body); err != nil {
+		return nil, err
+	}
+	sc := bodyScope(r, body.Partition, body.Namespace)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	if body.Name == "" {
+		return nil, badRequest("Invalid Policy: no Name is set")
+	}
+	if _, err := acl.Parse(body.Rules); err != nil {
+		return nil, badRequest("Failed to parse ACL rules: %v", err)
+	}
+
+	p := &consul.Policy{ID: id}
+	if id != "" {
+		current, ok := c.policies[id]
+		if !ok || !sc.has(current.Partition, current.Namespace) {
+			return nil, badRequest("Invalid Policy: ID %s not found", id)
+		}
+		p.CreateIndex = current.CreateIndex
+	} else {
+		var err error
+		if p.ID, err = newID(); err != nil {
+			return nil, err
+		}
+	}
+	for _, other := range c.policies {
+		if other.ID != p.ID && other.Name == body.Name && sc.has(other.Partition, other.Namespace) {
+			return nil, badRequest("Invalid Policy: A Policy with Name %q already exists", body.Name)
+		}
+	}
+	p.Name, p.Description, p.Rules, p.Datacenters = body.Name, body.Description, body.Rules, body.Datacenters
+	p.Partition, p.Namespace = sc.partition, sc.namespace
+	c.store(p)
+	return p, nil
+}
+
+// store stamps p with a new version and index and keeps it.
+func (c *Consul) store(p *consul.Policy) {
+	create := p.CreateIndex
+	p.Hash, p.CreateIndex, p.ModifyIndex = "", 0, 0
+	p.Hash = hash(p)
+	p.ModifyIndex = c.next()
+	if create == 0 {
+		create = p.ModifyIndex
+	}
+	p.CreateIndex = create
+	c.policies[p.ID] = p
+}
+
+func (c *Consul) deletePolicy(r *http.Request, id string) (interface{}, error) {
+	if id == GlobalManagementID {
+		return nil, badRequest("Deletion of the builtin global-management policy is not permitted")
+	}
+	if p, ok := c.policies[id]; ok && queryScope(r).has(p.Partition, p.Namespace) {
+		delete(c.policies, id)
+		c.next()
+	}
+	return true, nil
+}
+
+// resolvePolicies links names or IDs to the policies of sc, or of the
+// default namespace of its partition, as Consul resolves them on write.
+func (c *Consul) resolvePolicies(links []consul.PolicyLink, sc scope) ([]consul.PolicyLink, error) {
+	resolved := []consul.PolicyLink{}
+	seen := make(map[string]bool)
+	for _, l := range links {
+		p := c.findPolicy(l, sc)
+		if p == nil {
+			p = c.findPolicy(l, scope{sc.partition, "default"})
+		}
+		if p == nil {
+			return nil, badRequest("No such ACL policy with Name %q or ID %q", l.Name, l.ID)
+		}
+		if !seen[p.ID] {
+			seen[p.ID] = true
+			resolved = append(resolved, consul.PolicyLink{ID: p.ID, Name: p.Name})
+		}
+	}
+	return resolved, nil
+}
+
+func (c *Consul) findPolicy(l consul.PolicyLink, sc scope) *consul.Policy {
+	for _, p := range c.policies {
+		if (p.ID == l.ID || (l.ID == "" && p.Name == l.Name)) && sc.has(p.Partition, p.Namespace) {
+			return p
+		}
+	}
+	return nil
+}
+
+// policyLinks renames links after the policies they point to and drops those
+// to deleted policies, as Consul does when reading.
+func (c *Consul) policyLinks(links []consul.PolicyLink) []consul.PolicyLink {
+	out := []consul.PolicyLink{}
+	for _, l := range links {
+		if p, ok := c.policies[l.ID]; ok {
+			out = append(out, consul.PolicyLink{ID: p.ID, Name: p.Name})
+		}
+	}
+	return out
+}
+
+func (c *Consul) resolveRoles(links []consul.RoleLink, sc scope) ([]consul.RoleLink, error) {
+	resolved := []consul.RoleLink{}
+	seen := make(map[string]bool)
+	for _, l := range links {
+		var found *consul.Role
+		for _, try := range []scope{sc, {sc.partition, "default"}} {
+			for _, r := range c.roles {
+				if (r.ID == l.ID || (l.ID == "" && r.Name == l.Name)) && try.has(r.Partition, r.Namespace) {
+					found = r
+				}
+			}
+			if found != nil {
+				break
+			}
+		}
+		if found == nil {
+			return nil, badRequest("No such ACL role with Name %q or ID %q", l.Name, l.ID)
+		}
+		if !seen[found.ID] {
+			seen[found.ID] = true
+			resolved = append(resolved, consul.RoleLink{ID: found.ID, Name: found.Name})
+		}
+	}
+	return resolved, nil
+}
+
+func (c *Consul) roleLinks(links []consul.RoleLink) []consul.RoleLink {
+	out := []consul.RoleLink{}
+	for _, l := range links {
+		if r, ok := c.roles[l.ID]; ok {
+			out = append(out, consul.RoleLink{ID: r.ID, Name: r.Name})
+		}
+	}
+	return out
+}
+
+// role returns r as read, its links current.
+func (c *Consul) role(r *consul.Role) consul.Role {
+	read := *r
+	read.Policies = c.policyLinks(r.Policies)
+	return read
+}
+
+func (c *Consul) listRoles(r *http.Request) (interface{}, error) {
+	sc := queryScope(r)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	roles := []consul.Role{}
+	for _, role := range c.roles {
+		if sc.has(role.Partition, role.Namespace) {
+			roles = append(roles, c.role(role))
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+type roleBody struct {
+	Name              string
+	Description       string
+	Policies          []consul.PolicyLink
+	ServiceIdentities []consul.ServiceIdentity
+	NodeIdentities    []consul.NodeIdentity
+	TemplatedPolicies []consul.TemplatedPolicy
+	Partition         string
+	Namespace         string
+}
+
+// putRole creates a role, or with an ID in the path replaces it.
+func (c *Consul) putRole(r *http.Request, id string) (interface{}, error) {
+	var body roleBody
+	if err := decode(r, &body); err != nil {
+		return nil, err
+	}
+	sc := bodyScope(r, body.Partition, body.Namespace)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	if body.Name == "" {
+		return nil, badRequest("Invalid Role: no Name is set")
+	}
+	if id != "" {
+		current, ok := c.roles[id]
+		if !ok || !sc.has(current.Partition, current.Namespace) {
+			return nil, badRequest("Invalid Role: ID %s not found", id)
+		}
+	} else {
+		var err error
+		if id, err = newID(); err != nil {
+			return nil, err
+		}
+	}
+	for _, other := range c.roles {
+		if other.ID != id && other.Name == body.Name && sc.has(other.Partition, other.Namespace) {
+			return nil, badRequest("Invalid Role: A Role with Name %q already exists", body.Name)
+		}
+	}
+	policies, err := c.resolvePolicies(body.Policies, sc)
+	if err != nil {
+		return nil, err
+	}
+	role := &consul.Role{ID: id, Name: body.Name, Description: body.Description, Policies: policies,
+		ServiceIdentities: body.ServiceIdentities, NodeIdentities: body.NodeIdentities, TemplatedPolicies: body.TemplatedPolicies,
+		Partition: sc.partition, Namespace: sc.namespace}
+	role.Hash = hash(role)
+	c.roles[id] = role
+	c.next()
+	return c.role(role), nil
+}
+
+// token returns t as read, its links current.
+func (c *Consul) token(t *storedToken) storedToken {
+	read := *t
+	read.Policies = c.policyLinks(t.Policies)
+	read.Roles = c.roleLinks(t.Roles)
+	return read
+}
+
+func (c *Consul) listTokens(r *http.Request) (interface{}, error) {
+	sc := queryScope(r)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	tokens := []consul.Token{}
+	for _, t := range c.tokens {
+		if sc.has(t.Partition, t.Namespace) {
+			tokens = append(tokens, c.token(t).Token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].AccessorID < tokens[j].AccessorID })
+	return tokens, nil
+}
+
+func (c *Consul) readToken(r *http.Request, id string) (interface{}, error) {
+	t, ok := c.tokens[id]
+	if !ok || !queryScope(r).has(t.Partition, t.Namespace) {
+		return nil, notFound("ACL not found")
+	}
+	return c.token(t), nil
+}
+
+type tokenBody struct {
+	AccessorID  string
+	SecretID    string
+	Description string
+	Policies    []consul.PolicyLink
+	Roles       []consul.RoleLink
+	Local       bool
+	Partition   string
+	Namespace   string
+}
+
+// putToken creates a token, with the AccessorID and SecretID of the body
+// when set, or with an AccessorID in the path replaces it. The SecretID of a
+// token never changes.
+func (c *Consul) putToken(r *http.Request, id string) (interface{}, error) {
+	var body tokenBody
+	if err := decode(r, &body); err != nil {
+		return nil, err
+	}
+	sc := bodyScope(r, body.Partition, body.Namespace)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+
+	t := &storedToken{}
+	if id != "" {
+		current, ok := c.tokens[id]
+		if !ok || !sc.has(current.Partition, current.Namespace) {
+			return nil, badRequest("Cannot find token %s", id)
+		}
+		if body.AccessorID != "" && body.AccessorID != id {
+			return nil, badRequest("Token AccessorID in the path and the body differ")
+		}
+		if body.SecretID != "" && body.SecretID != current.SecretID {
+			return nil, badRequest("Changing a token's SecretID is not permitted")
+		}
+		t.AccessorID, t.SecretID, t.CreateTime, t.CreateIndex = id, current.SecretID, current.CreateTime, current.CreateIndex
+	} else {
+		if _, ok := c.tokens[body.AccessorID]; ok {
+			return nil, badRequest("Invalid Token: AccessorID is already in use")
+		}
+		for _, other := range c.tokens {
+			if body.SecretID != "" && other.SecretID == body.SecretID {
+				return nil, badRequest("Invalid Token: SecretID is already in use")
+			}
+		}
+		t.AccessorID, t.SecretID, t.CreateTime = body.AccessorID, body.SecretID, time.Now().UTC()
+		var err error
+		if t.AccessorID == "" {
+			if t.AccessorID, err = newID(); err != nil {
+				return nil, err
+			}
+		}
+		if t.SecretID == "" {
+			if t.SecretID, err = newID(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var err error
+	if t.Policies, err = c.resolvePolicies(body.Policies, sc); err != nil {
+		return nil, err
+	}
+	if t.Roles, err = c.resolveRoles(body.Roles, sc); err != nil {
+		return nil, err
+	}
+	t.Description, t.Local, t.Partition, t.Namespace = body.Description, body.Local, sc.partition, sc.namespace
+	c.storeToken(t)
+	return c.token(t), nil
+}
+
+// storeToken stamps t with a new version and index and keeps it.
+func (c *Consul) storeToken(t *storedToken) {
+	create := t.CreateIndex
+	t.Hash, t.CreateIndex, t.ModifyIndex = "", 0, 0
+	t.Hash = hash(t)
+	t.ModifyIndex = c.next()
+	if create == 0 {
+		create = t.ModifyIndex
+	}
+	t.CreateIndex = create
+	c.tokens[t.AccessorID] = t
+}
+
+func (c *Consul) deleteToken(r *http.Request, id string) (interface{}, error) {
+	if id == AnonymousTokenID {
+		return nil, badRequest("Deletion of the anonymous token is not permitted")
+	}
+	if t, ok := c.tokens[id]; ok && queryScope(r).has(t.Partition, t.Namespace) {
+		delete(c.tokens, id)
+		c.next()
+	}
+	return true, nil
+}
+
+func (c *Consul) listAuthMethods(r *http.Request) (interface{}, error) {
+	sc := queryScope(r)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	methods := []consul.AuthMethod{}
+	for _, m := range c.methods {
+		if sc.has(m.Partition, m.Namespace) {
+			// The list endpoint leaves out the config.
+			listed := *m
+			listed.Config = nil
+			methods = append(methods, listed)
+		}
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	return methods, nil
+}
+
+func (c *Consul) readAuthMethod(r *http.Request, name string) (interface{}, error) {
+	sc := queryScope(r)
+	m, ok := c.methods[sc.partition+"/"+sc.namespace+"/"+name]
+	if !ok {
+		return nil, notFound("ACL auth method not found")
+	}
+	return m, nil
+}
+
+// putAuthMethod creates an auth method, or with a name in the path replaces
+// it. Its type cannot change.
+func (c *Consul) putAuthMethod(r *http.Request, name string) (interface{}, error) {
+	var body consul.AuthMethod
+	if err := decode(r, &body); err != nil {
+		return nil, err
+	}
+	sc := bodyScope(r, body.Partition, body.Namespace)
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	if body.Name == "" || body.Type == "" {
+		return nil, badRequest("Invalid Auth Method: no Name or Type is set")
+	}
+	if name != "" && name != body.Name {
+		return nil, badRequest("Auth Method Name in the path and the body differ")
+	}
+	key := sc.partition + "/" + sc.namespace + "/" + body.Name
+	current, ok := c.methods[key]
+	switch {
+	case name == "" && ok:
+		return nil, badRequest("Invalid Auth Method: existing auth method with name %q", body.Name)
+	case name != "" && !ok:
+		return nil, badRequest("Cannot find auth method %q", name)
+	case ok && current.Type != body.Type:
+		return nil, badRequest("Auth Method %q cannot change its type from %q", name, current.Type)
+	}
+	body.Partition, body.Namespace, body.ModifyIndex = sc.partition, sc.namespace, c.next()
+	c.methods[key] = &body
+	return &body, nil
+}
+
+type checkBody struct {
+	Resource string
+	Segment  string `json:",omitempty"`
+	Access   string
+	Allow    bool
+}
+
+// authorize allows every check, as for a management token.
+func authorize(r *http.Request) (interface{}, error) {
+	var checks []checkBody
+	if err := decode(r, &checks); err != nil {
+		return nil, err
+	}
+	for i := range checks {
+		checks[i].Allow = true
+	}
+	return checks, nil
+}
+
+// translateRules answers as the rules translate endpoint of Consul before
+// 1.11 did.
+func translateRules(r *http.Request) (interface{}, error) {
+	src, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := acl.Translate(string(src))
+	if err != nil {
+		return nil, badRequest("Failed to parse legacy rules: %v", err)
+	}
+	return out, nil
+}
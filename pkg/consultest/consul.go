@@ -0,0 +1,282 @@
+// Package consultest serves an in-memory Consul ACL API, for acceptance tests
+// of configs and for plans and applies in CI without a Consul cluster.
+//
+// It answers the requests of consul.Client, and of the official client, as a
+// Consul Enterprise server would: policies, roles, tokens and auth methods in
+// admin partitions and namespaces, and the KV store the run history uses.
+// Rules are checked with the tool's own parser, links are resolved by name or
+// ID, and resources must be written to partitions and namespaces that exist,
+// so an apply in the wrong order fails as it would against Consul. Any token
+// is accepted, with every permission.
+package consultest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// Builtin IDs, as Consul assigns them when the ACL system is bootstrapped.
+const (
+	GlobalManagementID = "00000000-0000-0000-0000-000000000001"
+	AnonymousTokenID   = "00000000-0000-0000-0000-000000000002"
+)
+
+const globalManagementRules = `acl      = "write"
+operator = "write"
+mesh     = "write"
+peering  = "write"
+agent_prefix ""   { policy = "write" }
+event_prefix ""   { policy = "write" }
+key_prefix ""     { policy = "write" }
+node_prefix ""    { policy = "write" }
+query_prefix ""   { policy = "write" }
+service_prefix "" { policy = "write" intentions = "write" }
+session_prefix "" { policy = "write" }
+`
+
+// Consul is the in-memory state, served over HTTP as a http.Handler. It
+// starts as a freshly bootstrapped cluster: the global-management policy,
+// the anonymous token and the default partition and namespace.
+type Consul struct {
+	// Datacenter is the name of the only datacenter; requests for another
+	// one fail as Consul fails them without a path to it.
+	Datacenter string
+
+	mu         sync.Mutex
+	index      uint64
+	policies   map[string]*consul.Policy
+	roles      map[string]*consul.Role
+	tokens     map[string]*storedToken
+	methods    map[string]*consul.AuthMethod
+	partitions map[string]*consul.Partition
+	namespaces map[string]*consul.Namespace
+	kv         map[string][]byte
+}
+
+// storedToken is a token with its SecretID, which only single reads return.
+type storedToken struct {
+	consul.Token
+	SecretID string `json:"SecretID"`
+}
+
+// New returns a bootstrapped in-memory Consul in datacenter dc1.
+func New() *Consul {
+	c := &Consul{
+		Datacenter: "dc1",
+		policies:   make(map[string]*consul.Policy),
+		roles:      make(map[string]*consul.Role),
+		tokens:     make(map[string]*storedToken),
+		methods:    make(map[string]*consul.AuthMethod),
+		partitions: make(map[string]*consul.Partition),
+		namespaces: make(map[string]*consul.Namespace),
+		kv:         make(map[string][]byte),
+	}
+	c.partitions["default"] = &consul.Partition{Name: "default", Description: "Builtin Default Partition", ModifyIndex: c.next()}
+	c.namespaces["default/default"] = &consul.Namespace{Name: "default", Description: "Builtin Default Namespace", Partition: "default", ModifyIndex: c.next()}
+	c.store(&consul.Policy{ID: GlobalManagementID, Name: "global-management",
+		Description: "Builtin Policy that grants unlimited access", Rules: globalManagementRules})
+	c.storeToken(&storedToken{Token: consul.Token{AccessorID: AnonymousTokenID, Description: "Anonymous Token",
+		Policies: []consul.PolicyLink{}, CreateTime: time.Now().UTC()}, SecretID: "anonymous"})
+	return c
+}
+
+// Policies returns every policy, with its rules, across partitions and
+// namespaces.
+func (c *Consul) Policies() []consul.Policy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	policies := make([]consul.Policy, 0, len(c.policies))
+	for _, p := range c.policies {
+		policies = append(policies, *p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
+
+// Roles returns every role, its links naming the policies they point to.
+func (c *Consul) Roles() []consul.Role {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	roles := make([]consul.Role, 0, len(c.roles))
+	for _, r := range c.roles {
+		roles = append(roles, c.role(r))
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+// Tokens returns every token, its links naming the policies and roles they
+// point to.
+func (c *Consul) Tokens() []consul.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := make([]consul.Token, 0, len(c.tokens))
+	for _, t := range c.tokens {
+		tokens = append(tokens, c.token(t).Token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].AccessorID < tokens[j].AccessorID })
+	return tokens
+}
+
+// AuthMethods returns every auth method, with its config.
+func (c *Consul) AuthMethods() []consul.AuthMethod {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	methods := make([]consul.AuthMethod, 0, len(c.methods))
+	for _, m := range c.methods {
+		methods = append(methods, *m)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	return methods
+}
+
+// KV returns the value stored under key, and whether there is one.
+func (c *Consul) KV(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.kv[key]
+	return v, ok
+}
+
+// apiError is an error response, sent as Consul sends them: plain text.
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func (c *Consul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if dc := r.URL.Query().Get("dc"); dc != "" && dc != c.Datacenter {
+		http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+		return
+	}
+	c.mu.Lock()
+	out, err := c.route(r)
+	index := c.index
+	c.mu.Unlock()
+
+	if err != nil {
+		code := http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			code = e.code
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	if raw, ok := out.(string); ok {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, raw)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// route answers r; c.mu is held.
+func (c *Consul) route(r *http.Request) (interface{}, error) {
+	path := r.URL.Path
+	if key, ok := strings.CutPrefix(path, "/v1/kv/"); ok {
+		return c.serveKV(r, key)
+	}
+	switch r.Method + " " + path {
+	case "POST /v1/internal/acl/authorize":
+		return authorize(r)
+	case "POST /v1/acl/rules/translate":
+		return translateRules(r)
+	case "GET /v1/acl/replication":
+		// The only datacenter is the primary, which replicates from nowhere.
+		return consul.ReplicationStatus{}, nil
+	}
+	// /v1/acl/policy/<id> is collection acl/policy and name <id>.
+	rest, isACL := strings.CutPrefix(strings.TrimPrefix(path, "/v1/"), "acl/")
+	collection, name, _ := strings.Cut(rest, "/")
+	if isACL {
+		collection = "acl/" + collection
+	}
+
+	switch r.Method + " " + collection {
+	case "GET acl/policies":
+		return c.listPolicies(r)
+	case "GET acl/policy":
+		return c.readPolicy(r, name)
+	case "PUT acl/policy":
+		return c.putPolicy(r, name)
+	case "DELETE acl/policy":
+		return c.deletePolicy(r, name)
+	case "GET acl/roles":
+		return c.listRoles(r)
+	case "PUT acl/role":
+		return c.putRole(r, name)
+	case "GET acl/tokens":
+		return c.listTokens(r)
+	case "GET acl/token":
+		return c.readToken(r, name)
+	case "PUT acl/token":
+		return c.putToken(r, name)
+	case "DELETE acl/token":
+		return c.deleteToken(r, name)
+	case "GET acl/auth-methods":
+		return c.listAuthMethods(r)
+	case "GET acl/auth-method":
+		return c.readAuthMethod(r, name)
+	case "PUT acl/auth-method":
+		return c.putAuthMethod(r, name)
+	case "GET partitions":
+		return c.listPartitions(), nil
+	case "PUT partition":
+		return c.putPartition(r, name)
+	case "GET namespaces":
+		return c.listNamespaces(r)
+	case "PUT namespace":
+		return c.putNamespace(r, name)
+	}
+	return nil, notFound("no handler for %s %s", r.Method, path)
+}
+
+// next returns the next Raft index, as every write advances it.
+func (c *Consul) next() uint64 {
+	c.index++
+	return c.index
+}
+
+// hash fingerprints a resource, as Consul's Hash field changes with every
+// new version of one.
+func hash(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest("Request decode failed: %v", err)
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	return secrets.NewUUID()
+}
@@ -0,0 +1,77 @@
+package consultest
+
+import (
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+func TestSyncExample(t *testing.T) {
+	srv := NewServer(t)
+	cfg := Load(t, "../../example.yaml")
+	if plan := srv.Sync(t, cfg); !plan.HasChanges() {
+		t.Fatal("the first plan has no changes")
+	}
+
+	tokens := srv.Tokens()
+	if len(tokens) != 2 || tokens[1].AccessorID != cfg.Tokens[0].AccessorID {
+		t.Fatalf("tokens = %+v, want the anonymous and the example token", tokens)
+	}
+	if got := tokens[1].RoleNames(); len(got) != 1 || got[0] != "web" {
+		t.Errorf("token roles = %v, want [web]", got)
+	}
+
+	cfg.Policies[0].Rules = `key_prefix "web/" { policy = "write" }`
+	if plan := srv.Sync(t, cfg); len(plan.PoliciesToUpdate) != 1 {
+		t.Errorf("PoliciesToUpdate = %v, want the changed policy", plan.PoliciesToUpdate)
+	}
+}
+
+func TestSyncTenancy(t *testing.T) {
+	srv := NewServer(t)
+	cfg, err := config.Parse([]byte(`
+partitions:
+  - name: team-a
+namespaces:
+  - name: web
+    partition: team-a
+    policy_defaults: [web-base]
+policies:
+  - name: web-base
+    partition: team-a
+    rules: 'service_prefix "" { policy = "read" }'
+  - name: web-app
+    partition: team-a
+    namespace: web
+    rules: 'key_prefix "web/" { policy = "read" }'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Sync(t, cfg)
+	if n := len(srv.Policies()); n != 3 {
+		t.Errorf("%d policies, want global-management and the two of the config", n)
+	}
+}
+
+func TestRejects(t *testing.T) {
+	srv := NewServer(t)
+	cfg, err := config.Parse([]byte(`
+policies:
+  - name: web
+    rules: 'key_prefix "web/" { policy = "read" }'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := srv.Client(t, cfg)
+	if _, err := client.CreatePolicy(config.Policy{Name: "bad", Rules: `key "a" {}`}); err == nil {
+		t.Error("created a policy with rules that do not parse")
+	}
+	if err := client.CreateToken(config.Token{Description: "x", Policies: []string{"missing"}}); err == nil {
+		t.Error("created a token linking a missing policy")
+	}
+	if _, err := client.CreatePolicy(config.Policy{Name: "web", Tenancy: config.Tenancy{Namespace: "nowhere"}}); err == nil {
+		t.Error("created a policy in a missing namespace")
+	}
+}
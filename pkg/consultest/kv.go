@@ -0,0 +1,55 @@
+package consultest
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// serveKV answers the KV store requests of the run history and the pre-apply
+// backups: puts of raw values, and reads and deletes of a key or, with
+// ?recurse, of every key under a prefix.
+func (c *Consul) serveKV(r *http.Request, key string) (interface{}, error) {
+	_, recurse := r.URL.Query()["recurse"]
+	match := func(k string) bool {
+		if recurse {
+			return strings.HasPrefix(k, key)
+		}
+		return k == key
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var pairs []consul.KVPair
+		for k, v := range c.kv {
+			if match(k) {
+				pairs = append(pairs, consul.KVPair{Key: k, Value: v})
+			}
+		}
+		if len(pairs) == 0 {
+			return nil, notFound("")
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		return pairs, nil
+	case http.MethodPut:
+		value, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		c.kv[key] = value
+		c.next()
+		return true, nil
+	case http.MethodDelete:
+		for k := range c.kv {
+			if match(k) {
+				delete(c.kv, k)
+			}
+		}
+		c.next()
+		return true, nil
+	}
+	return nil, &apiError{http.StatusMethodNotAllowed, "method not allowed"}
+}
@@ -0,0 +1,90 @@
+package consultest
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/apply"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// Server is an in-memory Consul served over HTTP for the length of a test.
+type Server struct {
+	*Consul
+	// URL is the address to give consul.NewClient or -consul-addr.
+	URL string
+}
+
+// NewServer starts a new in-memory Consul, stopped when t ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	c := New()
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return &Server{Consul: c, URL: srv.URL}
+}
+
+// Client returns a client of s that spans the partitions cfg uses, as the
+// CLI's does.
+func (s *Server) Client(t testing.TB, cfg *config.Config) *consul.Client {
+	t.Helper()
+	client := consul.NewClientWithOptions(s.URL, "", consul.Options{Partitions: cfg.Partitions()})
+	if len(cfg.AdminPartitions) > 0 {
+		if _, err := client.ListPartitions(); err != nil {
+			t.Fatalf("list partitions: %v", err)
+		}
+	}
+	return client
+}
+
+// Load loads the config at path, failing t when it does not load.
+func Load(t testing.TB, path string) *config.Config {
+	t.Helper()
+	cfg, err := config.Load(path, config.SignatureCheck{})
+	if err != nil {
+		t.Fatalf("load %s: %v", path, err)
+	}
+	return cfg
+}
+
+// Plan plans cfg against s, failing t on errors.
+func (s *Server) Plan(t testing.TB, cfg *config.Config) *diff.Plan {
+	t.Helper()
+	plan, err := diff.Calculate(s.Client(t, cfg), cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	return plan
+}
+
+// Sync plans cfg against s, applies and verifies the plan, and plans again,
+// failing t on errors or when the second plan still has changes: a config
+// that never converges would change Consul on every run. It returns the plan
+// it applied. Configs with secret_path need their secrets resolved first, as
+// the CLI does with secrets.New and secrets.Resolve.
+func (s *Server) Sync(t testing.TB, cfg *config.Config) *diff.Plan {
+	t.Helper()
+	// The plan and apply share a client, as in the CLI: it remembers the
+	// partition and namespace each listed resource was found in.
+	client := s.Client(t, cfg)
+	plan, err := diff.Calculate(client, cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if _, err := apply.Apply(client, nil, secrets.NewRedactor(cfg, false), plan, 1, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := apply.Verify(client, plan, nil); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if again := s.Plan(t, cfg); again.HasChanges() {
+		var b strings.Builder
+		diff.PrintText(&b, again)
+		t.Fatalf("the config does not converge; a second plan still has changes:\n%s", b.String())
+	}
+	return plan
+}
@@ -0,0 +1,110 @@
+package consultest
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+func (c *Consul) listPartitions() []consul.Partition {
+	partitions := make([]consul.Partition, 0, len(c.partitions))
+	for _, p := range c.partitions {
+		partitions = append(partitions, *p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Name < partitions[j].Name })
+	return partitions
+}
+
+// putPartition creates a partition, with its default namespace, or with a
+// name in the path replaces its description.
+func (c *Consul) putPartition(r *http.Request, name string) (interface{}, error) {
+	var body consul.Partition
+	if err := decode(r, &body); err != nil {
+		return nil, err
+	}
+	if body.Name == "" || (name != "" && name != body.Name) {
+		return nil, badRequest("Invalid Partition: the Name is missing or differs from the path")
+	}
+	_, ok := c.partitions[body.Name]
+	switch {
+	case name == "" && ok:
+		return nil, badRequest("Partition %q already exists", body.Name)
+	case name != "" && !ok:
+		return nil, notFound("Partition %q not found", name)
+	}
+	p := &consul.Partition{Name: body.Name, Description: body.Description, ModifyIndex: c.next()}
+	c.partitions[p.Name] = p
+	if !ok {
+		c.namespaces[p.Name+"/default"] = &consul.Namespace{Name: "default", Description: "Builtin Default Namespace",
+			Partition: p.Name, ModifyIndex: c.next()}
+	}
+	return p, nil
+}
+
+// namespace returns n as read, the links of its defaults current.
+func (c *Consul) namespace(n *consul.Namespace) consul.Namespace {
+	read := *n
+	if n.ACLs != nil {
+		read.ACLs = &consul.NamespaceACLConfig{
+			PolicyDefaults: c.policyLinks(n.ACLs.PolicyDefaults),
+			RoleDefaults:   c.roleLinks(n.ACLs.RoleDefaults),
+		}
+	}
+	return read
+}
+
+func (c *Consul) listNamespaces(r *http.Request) (interface{}, error) {
+	sc := queryScope(r)
+	if err := c.exists(scope{sc.partition, "*"}); err != nil {
+		return nil, err
+	}
+	namespaces := []consul.Namespace{}
+	for _, n := range c.namespaces {
+		if n.Partition == sc.partition {
+			namespaces = append(namespaces, c.namespace(n))
+		}
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces, nil
+}
+
+// putNamespace creates a namespace, or with a name in the path replaces it.
+// Its default policies and roles are those of the default namespace of its
+// partition.
+func (c *Consul) putNamespace(r *http.Request, name string) (interface{}, error) {
+	var body consul.Namespace
+	if err := decode(r, &body); err != nil {
+		return nil, err
+	}
+	sc := bodyScope(r, body.Partition, "default")
+	if err := c.exists(sc); err != nil {
+		return nil, err
+	}
+	if body.Name == "" || (name != "" && name != body.Name) {
+		return nil, badRequest("Invalid Namespace: the Name is missing or differs from the path")
+	}
+	key := sc.partition + "/" + body.Name
+	_, ok := c.namespaces[key]
+	switch {
+	case name == "" && ok:
+		return nil, badRequest("Namespace %q already exists", body.Name)
+	case name != "" && !ok:
+		return nil, notFound("Namespace %q not found", name)
+	}
+
+	n := &consul.Namespace{Name: body.Name, Description: body.Description, Meta: body.Meta, Partition: sc.partition,
+		ACLs: &consul.NamespaceACLConfig{PolicyDefaults: []consul.PolicyLink{}, RoleDefaults: []consul.RoleLink{}}}
+	if body.ACLs != nil {
+		var err error
+		if n.ACLs.PolicyDefaults, err = c.resolvePolicies(body.ACLs.PolicyDefaults, sc); err != nil {
+			return nil, err
+		}
+		if n.ACLs.RoleDefaults, err = c.resolveRoles(body.ACLs.RoleDefaults, sc); err != nil {
+			return nil, err
+		}
+	}
+	n.ModifyIndex = c.next()
+	c.namespaces[key] = n
+	return c.namespace(n), nil
+}
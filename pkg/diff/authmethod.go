@@ -0,0 +1,356 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// authMethodKind manages ACL auth methods, keyed by name.
+type authMethodKind struct{}
+
+func (authMethodKind) Name() string   { return "auth method" }
+func (authMethodKind) Plural() string { return "auth methods" }
+
+// optional leaves auth methods out of the summary of plans that change none.
+func (authMethodKind) optional() {}
+
+func (authMethodKind) Plan(api consul.API, cfg *config.Config, _ *State, plan *Plan, progress Progress) error {
+	if len(cfg.AuthMethods) == 0 {
+		return nil
+	}
+	live, err := api.ListAuthMethods()
+	if err != nil {
+		return fmt.Errorf("failed to list auth methods: %w", err)
+	}
+	byKey := make(map[string]consul.AuthMethod, len(live))
+	for _, m := range live {
+		byKey[liveAuthMethodKey(m)] = m
+	}
+
+	for i, desired := range cfg.AuthMethods {
+		progress.Report("planning auth methods", i, len(cfg.AuthMethods))
+		current, ok := byKey[desired.Key()]
+		if !ok {
+			plan.AuthMethodsToCreate = append(plan.AuthMethodsToCreate, desired)
+			continue
+		}
+		if current.Type != desired.Type {
+			return fmt.Errorf("auth method %q is of type %s in Consul, and its type cannot change to %s", desired.Key(), current.Type, desired.Type)
+		}
+		// Config is absent from the list response, so fetch the full method.
+		full, err := api.ReadAuthMethod(current)
+		if err != nil {
+			return fmt.Errorf("failed to read auth method %q: %w", desired.Key(), err)
+		}
+		desired = ignoreAuthMethodFields(cfg.IgnoreFields, full, desired)
+		if AuthMethodNeedsUpdate(full, desired) {
+			plan.AuthMethodsToUpdate = append(plan.AuthMethodsToUpdate, AuthMethodUpdate{Current: full, Desired: desired})
+		}
+	}
+	progress.Report("planning auth methods", len(cfg.AuthMethods), len(cfg.AuthMethods))
+	return nil
+}
+
+func (authMethodKind) Steps(plan *Plan) []Step {
+	tenanted := plan.Tenanted()
+	var steps []Step
+	for _, m := range plan.AuthMethodsToCreate {
+		name := authMethodName(m, tenanted)
+		after := desiredAuthMethodValues(m)
+		detail := []string{"type: " + m.Type}
+		if m.DisplayName != "" {
+			detail = append(detail, "display name: "+quote(m.DisplayName))
+		}
+		detail = append(detail, "description: "+quote(m.Description),
+			"max token ttl: "+ttlText(after.MaxTokenTTL), "token locality: "+after.TokenLocality)
+		for _, k := range configKeys(after.Config) {
+			value := configText(after.Config[k])
+			if config.CredentialKey(k) && !plan.ShowSecrets {
+				value = config.Redacted
+			}
+			detail = append(detail, fmt.Sprintf("config.%s: %s", k, value))
+		}
+		steps = append(steps, Step{
+			Kind:   "auth method",
+			Node:   config.AuthMethodNode(m),
+			Action: "create",
+			Label:  quote(name),
+			Item:   Item{Title: fmt.Sprintf("+ auth method %q", name), Detail: detail, Group: group(m.Tenancy, tenanted)},
+			Change: Change{Action: "create", Type: "auth-method", Name: name, After: after.masked()},
+			Do:     func(api consul.API, _ secrets.Store) error { return api.CreateAuthMethod(m) },
+		})
+	}
+
+	for _, u := range plan.AuthMethodsToUpdate {
+		name := authMethodName(u.Desired, tenanted)
+		before, after := liveAuthMethodValues(u.Current, u.Desired), desiredAuthMethodValues(u.Desired)
+		detail := authMethodDetail(before, after, plan.ShowSecrets)
+		steps = append(steps, Step{
+			Kind:   "auth method",
+			Node:   config.AuthMethodNode(u.Desired),
+			Action: "update",
+			Label:  quote(name),
+			Item: Item{Title: fmt.Sprintf("~ auth method %q", name), Detail: append(detail, droppedConfigKeys(u)...),
+				Group: group(u.Desired.Tenancy, tenanted)},
+			Change: Change{Action: "update", Type: "auth-method", Name: name, Before: before.masked(), After: after.masked(),
+				Reasons: reasons(authMethodDetail(before, after, false))},
+			Do: func(api consul.API, _ secrets.Store) error { return api.UpdateAuthMethod(u.Desired) },
+		})
+	}
+	return steps
+}
+
+func (authMethodKind) Verify(api consul.API, plan *Plan, progress Progress) ([]string, error) {
+	methods := append([]config.AuthMethod(nil), plan.AuthMethodsToCreate...)
+	for _, u := range plan.AuthMethodsToUpdate {
+		methods = append(methods, u.Desired)
+	}
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	live, err := api.ListAuthMethods()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list auth methods: %w", err)
+	}
+	byKey := make(map[string]consul.AuthMethod, len(live))
+	for _, m := range live {
+		byKey[liveAuthMethodKey(m)] = m
+	}
+	var differ []string
+	for i, desired := range methods {
+		progress.Report("verifying auth methods", i, len(methods))
+		current, ok := byKey[desired.Key()]
+		if !ok {
+			differ = append(differ, fmt.Sprintf("auth method %q is missing", desired.Key()))
+			continue
+		}
+		full, err := api.ReadAuthMethod(current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth method %q: %w", desired.Key(), err)
+		}
+		if AuthMethodNeedsUpdate(full, desired) {
+			differ = append(differ, fmt.Sprintf("auth method %q still differs", desired.Key()))
+		}
+	}
+	progress.Report("verifying auth methods", len(methods), len(methods))
+	return differ, nil
+}
+
+// AuthMethodUpdate pairs the desired auth method with the current one it
+// replaces. Auth methods are addressed by name, so no ID is needed.
+type AuthMethodUpdate struct {
+	Current consul.AuthMethod
+	Desired config.AuthMethod
+}
+
+// AuthMethodNeedsUpdate reports whether the live auth method differs from the
+// config in its display name, description, token TTL or locality, or in a key
+// of Config the config sets. Keys only Consul has, such as defaults it fills
+// in, are left alone.
+func AuthMethodNeedsUpdate(current consul.AuthMethod, desired config.AuthMethod) bool {
+	return len(authMethodDetail(liveAuthMethodValues(current, desired), desiredAuthMethodValues(desired), false)) > 0
+}
+
+// authMethodValues are the compared fields of an auth method. MaxTokenTTL is
+// normalized, e.g. "8h0m0s", and TokenLocality defaults to "local", as Consul
+// assumes. Config values are normalized to how JSON decodes them.
+type authMethodValues struct {
+	Type          string                 `json:"type"`
+	DisplayName   string                 `json:"display_name,omitempty"`
+	Description   string                 `json:"description"`
+	MaxTokenTTL   string                 `json:"max_token_ttl,omitempty"`
+	TokenLocality string                 `json:"token_locality"`
+	Config        map[string]interface{} `json:"config,omitempty"`
+}
+
+func desiredAuthMethodValues(m config.AuthMethod) authMethodValues {
+	return authMethodValues{
+		Type:          m.Type,
+		DisplayName:   m.DisplayName,
+		Description:   m.Description,
+		MaxTokenTTL:   normalizeTTL(m.MaxTokenTTL),
+		TokenLocality: normalizeLocality(m.TokenLocality),
+		Config:        normalizeConfig(m.Config),
+	}
+}
+
+// liveAuthMethodValues takes from the Config of m only the keys desired sets.
+func liveAuthMethodValues(m consul.AuthMethod, desired config.AuthMethod) authMethodValues {
+	live := normalizeConfig(m.Config)
+	var cfg map[string]interface{}
+	for k := range desired.Config {
+		if v, ok := live[k]; ok {
+			if cfg == nil {
+				cfg = make(map[string]interface{})
+			}
+			cfg[k] = v
+		}
+	}
+	return authMethodValues{
+		Type:          m.Type,
+		DisplayName:   m.DisplayName,
+		Description:   m.Description,
+		MaxTokenTTL:   normalizeTTL(m.MaxTokenTTL),
+		TokenLocality: normalizeLocality(m.TokenLocality),
+		Config:        cfg,
+	}
+}
+
+// masked returns v with its sensitive Config values redacted, as changes
+// record it whatever -show-secrets says, since they end up in audit logs and
+// backups.
+func (v authMethodValues) masked() authMethodValues {
+	if v.Config == nil {
+		return v
+	}
+	cfg := make(map[string]interface{}, len(v.Config))
+	for k, value := range v.Config {
+		if config.CredentialKey(k) {
+			value = config.Redacted
+		}
+		cfg[k] = value
+	}
+	v.Config = cfg
+	return v
+}
+
+// authMethodDetail describes the compared fields that differ between two
+// versions of an auth method. Sensitive Config values are redacted unless
+// show is set.
+func authMethodDetail(before, after authMethodValues, show bool) []string {
+	var detail []string
+	if before.DisplayName != after.DisplayName {
+		detail = append(detail, fmt.Sprintf("display name: %s -> %s", quote(before.DisplayName), quote(after.DisplayName)))
+	}
+	if before.Description != after.Description {
+		detail = append(detail, fmt.Sprintf("description: %s -> %s", quote(before.Description), quote(after.Description)))
+	}
+	if before.MaxTokenTTL != after.MaxTokenTTL {
+		detail = append(detail, fmt.Sprintf("max token ttl: %s -> %s", ttlText(before.MaxTokenTTL), ttlText(after.MaxTokenTTL)))
+	}
+	if before.TokenLocality != after.TokenLocality {
+		detail = append(detail, fmt.Sprintf("token locality: %s -> %s", before.TokenLocality, after.TokenLocality))
+	}
+	for _, k := range configKeys(after.Config) {
+		b, ok := before.Config[k]
+		bj, _ := json.Marshal(b)
+		aj, _ := json.Marshal(after.Config[k])
+		switch {
+		case ok && string(bj) == string(aj):
+		case config.CredentialKey(k) && !show:
+			from := config.Redacted
+			if !ok {
+				from = "(unset)"
+			}
+			detail = append(detail, fmt.Sprintf("config.%s: %s -> %s", k, from, config.Redacted))
+		case !ok:
+			detail = append(detail, fmt.Sprintf("config.%s: (unset) -> %s", k, configText(after.Config[k])))
+		default:
+			detail = append(detail, fmt.Sprintf("config.%s: %s -> %s", k, configText(b), configText(after.Config[k])))
+		}
+	}
+	return detail
+}
+
+// normalizeTTL renders a duration as time.Duration does, "" when unset or
+// unparsable, which validation has already ruled out for the config.
+func normalizeTTL(s string) string {
+	d, err := time.ParseDuration(s)
+	if err != nil || d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func normalizeLocality(s string) string {
+	if s == "" {
+		return "local"
+	}
+	return s
+}
+
+// normalizeConfig round-trips cfg through JSON, so values decoded from YAML
+// compare equal to the same values decoded from Consul's response.
+func normalizeConfig(cfg map[string]interface{}) map[string]interface{} {
+	if len(cfg) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return cfg
+	}
+	var out map[string]interface{}
+	if json.Unmarshal(b, &out) != nil {
+		return cfg
+	}
+	return out
+}
+
+// configText renders a Config value on one line, a PEM block or other
+// multi-line string by its length.
+func configText(v interface{}) string {
+	if s, ok := v.(string); ok && strings.Contains(s, "\n") {
+		if n := strings.Count(strings.TrimSpace(s), "\n") + 1; n > 1 {
+			return fmt.Sprintf("(%d lines)", n)
+		}
+		return "(1 line)"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func ttlText(ttl string) string {
+	if ttl == "" {
+		return "none"
+	}
+	return ttl
+}
+
+// droppedConfigKeys warns about the keys of Config only Consul has. They are
+// not compared, but the update writes Config whole, without them.
+func droppedConfigKeys(u AuthMethodUpdate) []string {
+	var dropped []string
+	for _, k := range configKeys(u.Current.Config) {
+		if _, ok := u.Desired.Config[k]; !ok {
+			dropped = append(dropped, k)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("warning: config %s set in Consul but not in the config is removed by the update, unless Consul sets it again",
+		strings.Join(dropped, ", "))}
+}
+
+func configKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// authMethodName names m in plan output: fully qualified in a tenanted plan.
+func authMethodName(m config.AuthMethod, tenanted bool) string {
+	if tenanted {
+		return m.Tenancy.Qualify(m.Name)
+	}
+	return m.Name
+}
+
+// liveAuthMethodKey is the config.AuthMethod Key a live auth method matches.
+func liveAuthMethodKey(m consul.AuthMethod) string {
+	return config.AuthMethod{Name: m.Name, Tenancy: m.Tenancy()}.Key()
+}
@@ -0,0 +1,682 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+func TestNormalizeRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{"crlf vs lf", "key \"x\" {\r\n  policy = \"read\"\r\n}", "key \"x\" {\n  policy = \"read\"\n}", true},
+		{"trailing whitespace", "key \"x\" {  \n  policy = \"read\"  \n}  ", "key \"x\" {\n  policy = \"read\"\n}", true},
+		{"internal whitespace differs", "key \"x\" { policy = \"read\" }", "key \"x\" {  policy = \"read\"  }", false},
+		{"content differs", "policy = \"read\"", "policy = \"write\"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeRules(tt.a) == normalizeRules(tt.b); got != tt.equal {
+				t.Errorf("normalizeRules equality = %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestStringSetEqual(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []string
+		equal bool
+	}{
+		{"same order", []string{"a", "b"}, []string{"a", "b"}, true},
+		{"different order", []string{"a", "b"}, []string{"b", "a"}, true},
+		{"different length", []string{"a"}, []string{"a", "b"}, false},
+		{"different content", []string{"a"}, []string{"b"}, false},
+		{"empty vs nil", []string{}, nil, true},
+		{"duplicates matter", []string{"a", "a"}, []string{"a", "b"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringSetEqual(tt.a, tt.b); got != tt.equal {
+				t.Errorf("stringSetEqual = %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestPolicyNeedsUpdate(t *testing.T) {
+	desired := config.Policy{
+		Name:        "p",
+		Description: "d",
+		Rules:       "key \"x\" {\n  policy = \"read\"\n}",
+		Datacenters: []string{"dc1"},
+	}
+	current := consul.Policy{
+		Name:        "p",
+		Description: "d",
+		Rules:       "key \"x\" {\r\n  policy = \"read\"\r\n}",
+		Datacenters: []string{"dc1"},
+	}
+
+	if PolicyNeedsUpdate(current, desired) {
+		t.Error("identical policy (crlf only) should not need update")
+	}
+
+	changedDesc := current
+	changedDesc.Description = "different"
+	if !PolicyNeedsUpdate(changedDesc, desired) {
+		t.Error("description change should need update")
+	}
+
+	changedRules := current
+	changedRules.Rules = "key \"x\" {\n  policy = \"write\"\n}"
+	if !PolicyNeedsUpdate(changedRules, desired) {
+		t.Error("rules change should need update")
+	}
+
+	changedDC := current
+	changedDC.Datacenters = []string{"dc2"}
+	if !PolicyNeedsUpdate(changedDC, desired) {
+		t.Error("datacenter change should need update")
+	}
+}
+
+func TestTokenNeedsUpdate(t *testing.T) {
+	desired := config.Token{AccessorID: "a", Description: "web", Policies: []string{"p1", "p2"}}
+	current := consul.Token{
+		AccessorID:  "a",
+		Description: "web",
+		Policies:    []consul.PolicyLink{{Name: "p2"}, {Name: "p1"}},
+	}
+
+	if TokenNeedsUpdate(current, desired) {
+		t.Error("same policy set in different order should not need update")
+	}
+
+	changedDesc := current
+	changedDesc.Description = "different"
+	if !TokenNeedsUpdate(changedDesc, desired) {
+		t.Error("description change should need update")
+	}
+
+	changedPolicies := current
+	changedPolicies.Policies = []consul.PolicyLink{{Name: "p1"}}
+	if !TokenNeedsUpdate(changedPolicies, desired) {
+		t.Error("policy set change should need update")
+	}
+}
+
+func TestCanonicalRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{"reindented block", "key \"x\" { policy = \"read\" }", "key \"x\" {\n  policy = \"read\"\n}", true},
+		{"comments and blank lines", "# web\nkey \"x\" {\n\n  policy = \"read\" // ro\n}", "key \"x\" {\n  policy = \"read\"\n}", true},
+		{"trailing comma", "service \"web\" {\n  policy = \"read\"\n  intentions = [\"a\",]\n}", "service \"web\" { policy = \"read\" intentions = [\"a\"] }", true},
+		{"string content differs", "key \"x\" { policy = \"read\" }", "key \"y\" { policy = \"read\" }", false},
+		{"whitespace inside string", "key \"x \" { policy = \"read\" }", "key \"x\" { policy = \"read\" }", false},
+		{"policy differs", "key \"x\" { policy = \"read\" }", "key \"x\" { policy = \"write\" }", false},
+		{"heredoc", "key \"x\" {\n  policy = <<EOF\nread\nEOF\n}", "key \"x\" { policy = \"read\" }", true},
+		{"sentinel heredoc", "key \"x\" {\n  policy = \"write\"\n  sentinel {\n    code = <<EOF\n    import \"strings\"\n    main = rule { true }\n    EOF\n    enforcementlevel = \"advisory\"\n  }\n}",
+			"key \"x\" { policy = \"write\" sentinel { code = \"import \\\"strings\\\"\\nmain = rule { true }\\n\" enforcementlevel = \"advisory\" } }", true},
+		{"sentinel code differs", "key \"x\" { policy = \"write\" sentinel { code = \"main = rule { true }\" enforcementlevel = \"advisory\" } }",
+			"key \"x\" { policy = \"write\" sentinel { code = \"main = rule { false }\" enforcementlevel = \"advisory\" } }", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canonicalRules(tt.a) == canonicalRules(tt.b); got != tt.equal {
+				t.Errorf("canonicalRules equality = %v, want %v (%q vs %q)", got, tt.equal, canonicalRules(tt.a), canonicalRules(tt.b))
+			}
+		})
+	}
+}
+
+// fakeConsul serves a fixed ACL state. Writes are not expected while planning.
+type fakeConsul struct {
+	policies []consul.Policy
+	roles    []consul.Role
+	tokens   []consul.Token
+	methods  []consul.AuthMethod
+	spaces   []consul.Namespace
+	parts    []consul.Partition
+}
+
+func (f *fakeConsul) ListPolicies() ([]consul.Policy, error) { return f.policies, nil }
+func (f *fakeConsul) ListTokens() ([]consul.Token, error)    { return f.tokens, nil }
+func (f *fakeConsul) ListRoles() ([]consul.Role, error)      { return f.roles, nil }
+
+func (f *fakeConsul) ListPartitions() ([]consul.Partition, error)   { return f.parts, nil }
+func (f *fakeConsul) ListNamespaces() ([]consul.Namespace, error)   { return f.spaces, nil }
+func (f *fakeConsul) ListAuthMethods() ([]consul.AuthMethod, error) { return f.methods, nil }
+
+func (f *fakeConsul) ReadAuthMethod(m consul.AuthMethod) (consul.AuthMethod, error) {
+	for _, e := range f.methods {
+		if e.Name == m.Name && e.Tenancy() == m.Tenancy() {
+			return e, nil
+		}
+	}
+	return consul.AuthMethod{}, fmt.Errorf("auth method %s not found", m.Name)
+}
+
+func (f *fakeConsul) ReadToken(accessorID string) (consul.Token, bool, error) {
+	for _, t := range f.tokens {
+		if t.AccessorID == accessorID {
+			return t, true, nil
+		}
+	}
+	return consul.Token{}, false, nil
+}
+
+func (f *fakeConsul) PolicyRules(id string) (consul.Policy, error) {
+	for _, p := range f.policies {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return consul.Policy{}, fmt.Errorf("policy %s not found", id)
+}
+
+func (f *fakeConsul) CreatePolicy(config.Policy) (string, error) { return "", errUnexpectedWrite }
+func (f *fakeConsul) UpdatePolicy(string, config.Policy) error   { return errUnexpectedWrite }
+func (f *fakeConsul) CreateRole(config.Role) (string, error)     { return "", errUnexpectedWrite }
+func (f *fakeConsul) UpdateRole(string, config.Role) error       { return errUnexpectedWrite }
+func (f *fakeConsul) CreatePartition(config.Partition) error     { return errUnexpectedWrite }
+func (f *fakeConsul) UpdatePartition(config.Partition) error     { return errUnexpectedWrite }
+func (f *fakeConsul) CreateNamespace(config.Namespace) error     { return errUnexpectedWrite }
+func (f *fakeConsul) UpdateNamespace(config.Namespace) error     { return errUnexpectedWrite }
+func (f *fakeConsul) CreateAuthMethod(config.AuthMethod) error   { return errUnexpectedWrite }
+func (f *fakeConsul) UpdateAuthMethod(config.AuthMethod) error   { return errUnexpectedWrite }
+func (f *fakeConsul) CreateToken(config.Token) error             { return errUnexpectedWrite }
+func (f *fakeConsul) UpdateToken(config.Token) error             { return errUnexpectedWrite }
+func (f *fakeConsul) DeleteToken(string) error                   { return errUnexpectedWrite }
+
+var errUnexpectedWrite = errors.New("unexpected write")
+
+func TestCalculate(t *testing.T) {
+	api := &fakeConsul{
+		policies: []consul.Policy{
+			{ID: "1", Name: "same", Rules: `key "a" { policy = "read" }`},
+			{ID: "2", Name: "changed", Rules: `key "b" { policy = "read" }`},
+		},
+		tokens: []consul.Token{
+			{AccessorID: "t1", Description: "old", Policies: []consul.PolicyLink{{Name: "same"}}},
+		},
+	}
+	cfg := &config.Config{
+		Policies: []config.Policy{
+			{Name: "same", Rules: `key "a" { policy = "read" }`},
+			{Name: "changed", Rules: `key "b" { policy = "write" }`},
+			{Name: "new", Rules: `key "c" { policy = "read" }`},
+		},
+		Tokens: []config.Token{
+			{AccessorID: "t1", Description: "new", Policies: []string{"same"}},
+			{AccessorID: "t2", Policies: []string{"new"}},
+		},
+	}
+
+	plan, err := Calculate(api, cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.PoliciesToCreate) != 1 || plan.PoliciesToCreate[0].Name != "new" {
+		t.Errorf("PoliciesToCreate = %v, want [new]", plan.PoliciesToCreate)
+	}
+	if len(plan.PoliciesToUpdate) != 1 || plan.PoliciesToUpdate[0].ID != "2" {
+		t.Errorf("PoliciesToUpdate = %v, want policy 2", plan.PoliciesToUpdate)
+	}
+	if len(plan.TokensToCreate) != 1 || plan.TokensToCreate[0].AccessorID != "t2" {
+		t.Errorf("TokensToCreate = %v, want [t2]", plan.TokensToCreate)
+	}
+	if len(plan.TokensToUpdate) != 1 || plan.TokensToUpdate[0].Desired.AccessorID != "t1" {
+		t.Errorf("TokensToUpdate = %v, want [t1]", plan.TokensToUpdate)
+	}
+}
+
+func TestCalculateRoles(t *testing.T) {
+	api := &fakeConsul{
+		roles: []consul.Role{
+			{ID: "r1", Name: "same", Policies: []consul.PolicyLink{{Name: "a"}},
+				ServiceIdentities: []consul.ServiceIdentity{{ServiceName: "web", Datacenters: []string{"dc1"}}}},
+			{ID: "r2", Name: "changed", TemplatedPolicies: []consul.TemplatedPolicy{
+				{TemplateName: "builtin/service", TemplateVariables: &consul.TemplateVariables{Name: "api"}}}},
+		},
+	}
+	cfg := &config.Config{
+		Roles: []config.Role{
+			{Name: "same", Policies: []string{"a"},
+				ServiceIdentities: []config.ServiceIdentity{{ServiceName: "web", Datacenters: []string{"dc1"}}}},
+			{Name: "changed", TemplatedPolicies: []config.TemplatedPolicy{
+				{TemplateName: "builtin/service", TemplateVariables: config.TemplateVariables{Name: "db"}}}},
+			{Name: "new", NodeIdentities: []config.NodeIdentity{{NodeName: "node-1", Datacenter: "dc1"}}},
+		},
+	}
+
+	plan, err := Calculate(api, cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.RolesToCreate) != 1 || plan.RolesToCreate[0].Name != "new" {
+		t.Errorf("RolesToCreate = %v, want [new]", plan.RolesToCreate)
+	}
+	if len(plan.RolesToUpdate) != 1 || plan.RolesToUpdate[0].ID != "r2" {
+		t.Errorf("RolesToUpdate = %v, want role r2", plan.RolesToUpdate)
+	}
+}
+
+func TestCalculateNamespaces(t *testing.T) {
+	deleted := time.Now()
+	api := &fakeConsul{
+		spaces: []consul.Namespace{
+			{Name: "same", Partition: "default", ACLs: &consul.NamespaceACLConfig{
+				PolicyDefaults: []consul.PolicyLink{{ID: "1", Name: "b"}, {ID: "2", Name: "a"}}}},
+			{Name: "changed", Partition: "default", Meta: map[string]string{"team": "web"}},
+			{Name: "deleting", Partition: "default", DeletedAt: &deleted},
+		},
+	}
+	cfg := &config.Config{
+		Namespaces: []config.Namespace{
+			{Name: "same", PolicyDefaults: []string{"a", "b"}},
+			{Name: "changed", Meta: map[string]string{"team": "api"}},
+			{Name: "deleting"},
+		},
+	}
+
+	plan, err := Calculate(api, cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.NamespacesToCreate) != 1 || plan.NamespacesToCreate[0].Name != "deleting" {
+		t.Errorf("NamespacesToCreate = %v, want [deleting]", plan.NamespacesToCreate)
+	}
+	if len(plan.NamespacesToUpdate) != 1 || plan.NamespacesToUpdate[0].Desired.Name != "changed" {
+		t.Errorf("NamespacesToUpdate = %v, want namespace changed", plan.NamespacesToUpdate)
+	}
+}
+
+func TestAuthMethodNeedsUpdate(t *testing.T) {
+	// Consul reports durations normalized and numbers as JSON numbers, and
+	// fills in Config keys the config leaves out.
+	current := consul.AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "8h0m0s",
+		Config: map[string]interface{}{"Host": "https://k8s", "Port": float64(443), "MapNamespaces": false}}
+	desired := config.AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "8h", TokenLocality: "local",
+		Config: map[string]interface{}{"Host": "https://k8s", "Port": uint64(443)}}
+	if AuthMethodNeedsUpdate(current, desired) {
+		t.Errorf("AuthMethodNeedsUpdate = true for equal methods")
+	}
+	desired.TokenLocality = "global"
+	if !AuthMethodNeedsUpdate(current, desired) {
+		t.Errorf("AuthMethodNeedsUpdate = false for a changed token locality")
+	}
+}
+
+func TestCalculateTenancy(t *testing.T) {
+	api := &fakeConsul{
+		policies: []consul.Policy{
+			{ID: "1", Name: "web", Rules: `key "a" { policy = "read" }`, Partition: "default", Namespace: "default"},
+			{ID: "2", Name: "web", Rules: `key "b" { policy = "read" }`, Partition: "default", Namespace: "team-a"},
+		},
+	}
+	cfg := &config.Config{
+		Policies: []config.Policy{
+			{Name: "web", Rules: `key "a" { policy = "read" }`},
+			{Name: "web", Rules: `key "b" { policy = "write" }`, Tenancy: config.Tenancy{Namespace: "team-a"}},
+			{Name: "web", Rules: `key "c" { policy = "read" }`, Tenancy: config.Tenancy{Namespace: "team-b"}},
+		},
+	}
+
+	plan, err := Calculate(api, cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.PoliciesToUpdate) != 1 || plan.PoliciesToUpdate[0].ID != "2" {
+		t.Errorf("PoliciesToUpdate = %v, want policy 2", plan.PoliciesToUpdate)
+	}
+	if len(plan.PoliciesToCreate) != 1 || plan.PoliciesToCreate[0].Namespace != "team-b" {
+		t.Errorf("PoliciesToCreate = %v, want web in team-b", plan.PoliciesToCreate)
+	}
+	if !plan.Tenanted() {
+		t.Fatal("Tenanted = false, want true")
+	}
+	items := grouped(Items(plan))
+	if items[0].Title != `~ policy "default/team-a/web"` || items[1].Group != "partition default, namespace team-b" {
+		t.Errorf("items = %+v, want team-a's update then team-b's create", items)
+	}
+}
+
+func TestPolicyUpdateDatacenters(t *testing.T) {
+	tests := []struct {
+		current, desired []string
+		want             string
+	}{
+		{[]string{"dc1"}, []string{"dc2", "dc1"}, "datacenters: [dc1] -> [dc1 dc2]"},
+		{[]string{"dc1"}, nil, "datacenters: [dc1] -> all"},
+		{nil, []string{"dc1"}, "datacenters: all -> [dc1]"},
+	}
+	for _, tt := range tests {
+		plan := &Plan{PoliciesToUpdate: []PolicyUpdate{{
+			Current: consul.Policy{Name: "web", Datacenters: tt.current},
+			Desired: config.Policy{Name: "web", Datacenters: tt.desired},
+		}}}
+		steps := policyKind{}.Steps(plan)
+		if len(steps) != 1 || len(steps[0].Item.Detail) != 1 || steps[0].Item.Detail[0] != tt.want {
+			t.Errorf("%v -> %v: detail = %v, want [%s]", tt.current, tt.desired, steps[0].Item.Detail, tt.want)
+		}
+	}
+}
+
+func TestIgnoreFields(t *testing.T) {
+	api := &fakeConsul{
+		policies: []consul.Policy{{ID: "p1", Hash: "h1", Name: "web", Description: "edited elsewhere",
+			Rules: `key "web" { policy = "read" }`, Datacenters: []string{"dc1"}}},
+		tokens: []consul.Token{{AccessorID: "a1", Hash: "h2", Description: "edited elsewhere",
+			Policies: []consul.PolicyLink{{Name: "web"}}}},
+	}
+	cfg := &config.Config{
+		IgnoreFields: config.IgnoreFields{Policies: []string{"description"}, Tokens: []string{"description"}},
+		Policies:     []config.Policy{{Name: "web", Description: "web", Rules: `key "web" { policy = "write" }`, Datacenters: []string{"dc1"}}},
+		Tokens:       []config.Token{{AccessorID: "a1", Description: "web", Policies: []string{"web"}}},
+	}
+	plan, err := Calculate(api, cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.TokensToUpdate) != 0 {
+		t.Errorf("TokensToUpdate = %v, want none: only the ignored description differs", plan.TokensToUpdate)
+	}
+	if len(plan.PoliciesToUpdate) != 1 {
+		t.Fatalf("PoliciesToUpdate = %v, want the policy whose rules differ", plan.PoliciesToUpdate)
+	}
+	if got := plan.PoliciesToUpdate[0].Desired.Description; got != "edited elsewhere" {
+		t.Errorf("updated description = %q, want the live one kept", got)
+	}
+	if detail := (policyKind{}).Steps(plan)[0].Item.Detail; len(detail) == 0 || detail[0] != "rules:" {
+		t.Errorf("detail = %v, want only the rules", detail)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	api := &fakeConsul{
+		policies: []consul.Policy{
+			{ID: "1", Name: "same", Hash: "h1", Rules: `key "a" { policy = "read" }`},
+			{ID: "2", Name: "edited", Hash: "h2", Rules: `key "b" { policy = "write" }`},
+		},
+		tokens: []consul.Token{
+			{AccessorID: "t1", Hash: "h3", Description: "web", Policies: []consul.PolicyLink{{Name: "same"}}},
+		},
+	}
+	cfg := &config.Config{
+		Policies: []config.Policy{
+			{Name: "same", Rules: `key "a" { policy = "read" }`},
+			{Name: "edited", Rules: `key "b" { policy = "read" }`},
+		},
+		Tokens: []config.Token{
+			{AccessorID: "t1", Description: "web", Policies: []string{"same"}},
+			{AccessorID: "t2", Description: "db", Policies: []string{"same"}},
+		},
+	}
+	// The last run found everything in sync; since then "edited" was edited
+	// and t2 deleted in Consul.
+	state := &State{Policies: map[string]stateEntry{}, Tokens: map[string]stateEntry{}}
+	state.recordPolicy("h1", cfg.Policies[0])
+	state.recordPolicy("h2-old", cfg.Policies[1])
+	state.recordToken(api.tokens[0], cfg.Tokens[0])
+	state.recordToken(consul.Token{Hash: "h4"}, cfg.Tokens[1])
+
+	items, err := Drift(api, cfg, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, item := range items {
+		titles = append(titles, item.Title)
+	}
+	want := []string{`~ policy "edited" changed in Consul`, `- token t2 "db" deleted in Consul`}
+	if strings.Join(titles, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Drift titles = %q, want %q", titles, want)
+	}
+	if got := strings.Join(items[0].Detail, "\n"); !strings.Contains(got, `+ key "b" { policy = "write" }`) {
+		t.Errorf("policy drift detail = %q, want the rules diff to the live version", got)
+	}
+}
+
+func TestStateRechecksRecreatedLinks(t *testing.T) {
+	token := consul.Token{AccessorID: "t1", Hash: "h1", Description: "web",
+		Policies: []consul.PolicyLink{{ID: "p1", Name: "web"}}}
+	api := &fakeConsul{
+		policies: []consul.Policy{{ID: "p1", Name: "web"}},
+		tokens:   []consul.Token{token},
+	}
+	cfg := &config.Config{
+		Policies: []config.Policy{{Name: "web"}},
+		Tokens:   []config.Token{{AccessorID: "t1", Description: "web", Policies: []string{"web"}}},
+	}
+	state := &State{Policies: map[string]stateEntry{}, Tokens: map[string]stateEntry{}}
+	if _, err := Calculate(api, cfg, state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Tokens["t1"]; !ok {
+		t.Fatal("the token in sync was not recorded")
+	}
+
+	// The policy was deleted and created again under a new ID. Consul drops
+	// the dangling link from the token but keeps its Hash.
+	api.policies = []consul.Policy{{ID: "p2", Name: "web"}}
+	api.tokens[0].Policies = nil
+	plan, err := Calculate(api, cfg, state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.TokensToUpdate) != 1 {
+		t.Errorf("TokensToUpdate = %v, want the token whose policy link was lost", plan.TokensToUpdate)
+	}
+	items, err := Drift(api, cfg, &State{Policies: map[string]stateEntry{},
+		Tokens: map[string]stateEntry{"t1": {Hash: "h1", Desired: tokenFingerprint(cfg.Tokens[0]), Links: linkFingerprint(token)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || !strings.Contains(items[0].Title, "token t1") {
+		t.Errorf("Drift = %+v, want the token's lost link", items)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	api := &fakeConsul{tokens: []consul.Token{
+		{AccessorID: "t1", Description: "old"},
+		{AccessorID: "t3", Description: "same"},
+	}}
+	t1 := config.Token{AccessorID: "t1", Description: "new"}
+	t2 := config.Token{AccessorID: "t2"}
+	t3 := config.Token{AccessorID: "t3", Description: "same"}
+	plan := &Plan{
+		TokensToCreate: []config.Token{t2},
+		TokensToUpdate: []TokenUpdate{{Current: api.tokens[0], Desired: t1}},
+	}
+
+	if err := Replace(api, plan, []config.Token{t1, t2, t3}); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.TokensToCreate) != 1 || len(plan.TokensToUpdate) != 0 {
+		t.Errorf("creates %d and updates %d tokens, want 1 and 0", len(plan.TokensToCreate), len(plan.TokensToUpdate))
+	}
+	if len(plan.TokensToReplace) != 2 ||
+		plan.TokensToReplace[0].Current.Description != "old" || plan.TokensToReplace[0].Desired.Description != "new" ||
+		plan.TokensToReplace[1].Current.AccessorID != "t3" {
+		t.Errorf("TokensToReplace = %+v, want t1 (old -> new) and t3", plan.TokensToReplace)
+	}
+	if got := Summary(plan); got != "Plan: policies 0 to create, 0 to update; tokens 1 to create, 0 to update, 2 to replace." {
+		t.Errorf("Summary = %q", got)
+	}
+}
+
+func TestCalculateExpired(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	api := &fakeConsul{tokens: []consul.Token{
+		{AccessorID: "t1", Description: "ci", ExpirationTime: &past},
+		{AccessorID: "t2", Description: "web", ExpirationTime: &future},
+	}}
+	cfg := &config.Config{Tokens: []config.Token{
+		{AccessorID: "t1", Description: "ci"},
+		{AccessorID: "t2", Description: "web"},
+	}}
+
+	plan, err := Calculate(api, cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.TokensToReplace) != 1 || plan.TokensToReplace[0].Desired.AccessorID != "t1" {
+		t.Fatalf("TokensToReplace = %+v, want the expired t1", plan.TokensToReplace)
+	}
+	if len(plan.TokensToCreate) != 0 || len(plan.TokensToUpdate) != 0 {
+		t.Errorf("plan creates %d and updates %d tokens, want none", len(plan.TokensToCreate), len(plan.TokensToUpdate))
+	}
+}
+
+func TestReplaceWarnsOfDroppedFields(t *testing.T) {
+	exp := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	plan := &Plan{TokensToReplace: []TokenUpdate{{
+		Current: consul.Token{AccessorID: "t1", Description: "web", Local: true, ExpirationTime: &exp,
+			ServiceIdentities: []consul.ServiceIdentity{{ServiceName: "web"}}},
+		Desired: config.Token{AccessorID: "t1", Description: "web"},
+		Reason:  onRequest,
+	}}}
+	detail := tokenKind{}.Steps(plan)[0].Item.Detail
+	want := "warning: created again, the token loses what the config does not model: service identities [web]; expiration at 2030-01-01T00:00:00Z; local to its datacenter"
+	if got := detail[len(detail)-1]; got != want {
+		t.Errorf("last detail line = %q, want %q", got, want)
+	}
+}
+
+func TestChangeReasons(t *testing.T) {
+	plan := &Plan{
+		PoliciesToUpdate: []PolicyUpdate{{
+			Current: consul.Policy{Name: "web", Description: "old", Rules: `key "a" { policy = "read" }`},
+			Desired: config.Policy{Name: "web", Description: "new", Rules: `key "a" { policy = "write" }`},
+		}},
+		AuthMethodsToUpdate: []AuthMethodUpdate{{
+			Current: consul.AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "1h0m0s", Config: map[string]interface{}{"Host": "a"}},
+			Desired: config.AuthMethod{Name: "k8s", Type: "kubernetes", MaxTokenTTL: "8h", Config: map[string]interface{}{"Host": "b"}},
+		}},
+	}
+	want := map[string]string{"policy": "[description rules]", "auth-method": "[max_token_ttl config.Host]"}
+	for _, c := range Changes(plan) {
+		if got := fmt.Sprint(c.Reasons); got != want[c.Type] {
+			t.Errorf("%s reasons = %s, want %s", c.Type, got, want[c.Type])
+		}
+	}
+}
+
+func TestSideBySide(t *testing.T) {
+	got := sideBySide("a\nb\nc", "a\nB\nc\nd", 49)
+	want := []string{
+		"  a                      a",
+		"  b                    | B",
+		"  c                      c",
+		"                       > d",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("sideBySide =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := sideBySide("", strings.Repeat("x", 30), 49); len(got) != 2 || !strings.HasSuffix(got[1], "| xxxxxxxxxx") {
+		t.Errorf("a line longer than its column does not wrap: %q", got)
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	plan := &Plan{
+		PoliciesToCreate: []config.Policy{{Name: "a"}, {Name: "b"}},
+		RolesToUpdate:    []RoleUpdate{{Current: consul.Role{Name: "r"}, Desired: config.Role{Name: "r", Description: "new"}}},
+	}
+	var buf bytes.Buffer
+	PrintSummary(&buf, plan)
+	want := `Resource  Create  Update
+policies  2       0
+roles     0       1
+tokens    0       0
+total     2       1
+`
+	if buf.String() != want {
+		t.Errorf("PrintSummary =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// TestPlanSchema keeps plan.schema.json in step with the types it describes:
+// a field added to one must be added to the other.
+func TestPlanSchema(t *testing.T) {
+	data, err := os.ReadFile("plan.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type object struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	var schema struct {
+		object
+		Defs map[string]object `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	fields := func(v interface{}) []string {
+		var names []string
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			names = append(names, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+		}
+		sort.Strings(names)
+		return names
+	}
+	properties := func(o object) []string {
+		var names []string
+		for name := range o.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	for name, v := range map[string]interface{}{
+		"":           Document{},
+		"change":     Change{},
+		"policy":     policyValues{},
+		"role":       roleValues{},
+		"token":      tokenValues{},
+		"authMethod": authMethodValues{},
+		"namespace":  namespaceValues{},
+		"partition":  partitionValues{},
+	} {
+		o := schema.object
+		if name != "" {
+			o = schema.Defs[name]
+		}
+		if got, want := properties(o), fields(v); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("schema %q has properties %v, the type has fields %v", name, got, want)
+		}
+	}
+
+	var doc map[string]interface{}
+	var buf bytes.Buffer
+	if err := PrintJSON(&buf, &Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["format_version"] != FormatVersion || doc["changes"] == nil {
+		t.Errorf("empty plan document = %s", buf.String())
+	}
+}
@@ -0,0 +1,133 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// Drift describes the out-of-band changes made in Consul to the resources
+// state records as in sync: those whose Hash changed since, and those
+// deleted. Resources state does not record are not looked at. Where the
+// config of a changed resource is also what it was then, it still stands for
+// the recorded version, so the changed fields are shown. Nothing is planned
+// and state is left as it is.
+func Drift(api consul.API, cfg *config.Config, state *State) ([]Item, error) {
+	if state == nil {
+		return nil, nil
+	}
+	var items []Item
+
+	livePolicies, err := api.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	policyByKey := make(map[string]consul.Policy, len(livePolicies))
+	for _, p := range livePolicies {
+		policyByKey[livePolicyKey(p)] = p
+	}
+	desiredPolicies := make(map[string]config.Policy, len(cfg.Policies))
+	for _, p := range cfg.Policies {
+		desiredPolicies[p.Key()] = p
+	}
+	for _, key := range sortedKeys(state.Policies) {
+		e := state.Policies[key]
+		live, ok := policyByKey[key]
+		if !ok {
+			items = append(items, Item{Title: fmt.Sprintf("- policy %q deleted in Consul", key)})
+			continue
+		}
+		if live.Hash == e.Hash {
+			continue
+		}
+		item := Item{Title: fmt.Sprintf("~ policy %q changed in Consul", key), Detail: []string{unknownDrift}}
+		if desired, ok := desiredPolicies[key]; ok && policyFingerprint(desired) == e.Desired {
+			full, err := api.PolicyRules(live.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read policy %q: %w", key, err)
+			}
+			item.Detail = orUnmanaged(policyDetail(
+				policyValues{desired.Description, desired.Rules, desired.Datacenters},
+				policyValues{full.Description, full.Rules, full.Datacenters}, 0))
+		}
+		items = append(items, item)
+	}
+
+	liveTokens, err := api.ListTokens()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	tokenByAccessor := make(map[string]consul.Token, len(liveTokens))
+	for _, t := range liveTokens {
+		tokenByAccessor[t.AccessorID] = t
+	}
+	desiredTokens := make(map[string]config.Token, len(cfg.Tokens))
+	for _, t := range cfg.Tokens {
+		desiredTokens[t.AccessorID] = t
+	}
+	for _, accessor := range sortedKeys(state.Tokens) {
+		e := state.Tokens[accessor]
+		desired, inConfig := desiredTokens[accessor]
+		label := fmt.Sprintf("%q", accessor)
+		if inConfig {
+			label = desired.Label()
+		}
+		live, ok := tokenByAccessor[accessor]
+		if !ok {
+			items = append(items, Item{Title: "- token " + label + " deleted in Consul"})
+			continue
+		}
+		// A state written before links were recorded has none to compare.
+		if live.Hash == e.Hash && (e.Links == "" || e.Links == linkFingerprint(live)) {
+			continue
+		}
+		item := Item{Title: "~ token " + label + " changed in Consul", Detail: []string{unknownDrift}}
+		if inConfig && tokenFingerprint(desired) == e.Desired {
+			item.Detail = orUnmanaged(tokenDetail(
+				desiredTokenValues(desired),
+				liveTokenValues(live)))
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// PrintDrift writes the changes Drift found as reviewable text.
+func PrintDrift(w io.Writer, items []Item) {
+	if len(items) == 0 {
+		fmt.Fprintln(w, "No out-of-band changes since the state was recorded.")
+		return
+	}
+	fmt.Fprintf(w, "Drift: %d resources changed in Consul since the state recorded them in sync.\n", len(items))
+	for _, item := range items {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, item.Title)
+		for _, line := range item.Detail {
+			fmt.Fprintln(w, "    "+line)
+		}
+	}
+}
+
+// unknownDrift explains a change Drift cannot show field by field: the
+// config no longer holds the version state recorded.
+const unknownDrift = "the config changed since it was recorded, so the recorded version is unknown"
+
+// orUnmanaged explains a change to none of the fields compared.
+func orUnmanaged(detail []string) []string {
+	if len(detail) == 0 {
+		return []string{"only fields consul-acl-sync does not manage changed"}
+	}
+	return detail
+}
+
+func sortedKeys(m map[string]stateEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,67 @@
+package diff
+
+import (
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// The ignore functions return desired with the fields ignore_fields ignores
+// taken from current, the live resource. They then compare equal, and an
+// update made for another field writes them back as Consul has them.
+
+func ignorePolicyFields(f config.IgnoreFields, current consul.Policy, desired config.Policy) config.Policy {
+	if f.Policy("description") {
+		desired.Description = current.Description
+	}
+	if f.Policy("datacenters") {
+		desired.Datacenters = current.Datacenters
+	}
+	return desired
+}
+
+func ignoreRoleFields(f config.IgnoreFields, current consul.Role, desired config.Role) config.Role {
+	if f.Role("description") {
+		desired.Description = current.Description
+	}
+	return desired
+}
+
+func ignoreTokenFields(f config.IgnoreFields, current consul.Token, desired config.Token) config.Token {
+	if f.Token("description") {
+		desired.Description = current.Description
+	}
+	return desired
+}
+
+func ignoreAuthMethodFields(f config.IgnoreFields, current consul.AuthMethod, desired config.AuthMethod) config.AuthMethod {
+	if f.AuthMethod("display_name") {
+		desired.DisplayName = current.DisplayName
+	}
+	if f.AuthMethod("description") {
+		desired.Description = current.Description
+	}
+	if f.AuthMethod("max_token_ttl") {
+		desired.MaxTokenTTL = current.MaxTokenTTL
+	}
+	if f.AuthMethod("token_locality") {
+		desired.TokenLocality = current.TokenLocality
+	}
+	return desired
+}
+
+func ignoreNamespaceFields(f config.IgnoreFields, current consul.Namespace, desired config.Namespace) config.Namespace {
+	if f.Namespace("description") {
+		desired.Description = current.Description
+	}
+	if f.Namespace("meta") {
+		desired.Meta = current.Meta
+	}
+	return desired
+}
+
+func ignorePartitionFields(f config.IgnoreFields, current consul.Partition, desired config.Partition) config.Partition {
+	if f.Partition("description") {
+		desired.Description = current.Description
+	}
+	return desired
+}
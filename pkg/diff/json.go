@@ -0,0 +1,42 @@
+package diff
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// FormatVersion is the version of Document, described by plan.schema.json.
+// Its minor version goes up when fields or values are added, and its major
+// version when a field is removed, renamed or changes meaning.
+const FormatVersion = "1.0"
+
+// Document is the plan as JSON, as plan -output=json prints it and hooks
+// read it on stdin.
+type Document struct {
+	FormatVersion string   `json:"format_version"`
+	Datacenter    string   `json:"datacenter,omitempty"`
+	PlanHash      string   `json:"plan_hash"`
+	Changes       []Change `json:"changes"`
+}
+
+// NewDocument returns the JSON document of plan. Changes is empty rather than
+// null when there are none.
+func NewDocument(plan *Plan) Document {
+	changes := Changes(plan)
+	if changes == nil {
+		changes = []Change{}
+	}
+	return Document{
+		FormatVersion: FormatVersion,
+		Datacenter:    plan.Datacenter,
+		PlanHash:      Hash(plan),
+		Changes:       changes,
+	}
+}
+
+// PrintJSON writes the JSON document of plan.
+func PrintJSON(w io.Writer, plan *Plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(NewDocument(plan))
+}
@@ -0,0 +1,101 @@
+package diff
+
+import (
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// ResourceKind is one type of ACL resource. Planning, applying, verifying,
+// rendering and auditing all go through the registered kinds, so supporting
+// a new type means implementing this interface and adding it to Kinds; none
+// of those loops change.
+type ResourceKind interface {
+	// Name is the singular noun used in output, e.g. "policy".
+	Name() string
+	// Plural is the plural noun used in summaries, e.g. "policies".
+	Plural() string
+	// Plan lists the kind in Consul, compares it with the desired resources
+	// in cfg and records the changes in plan. It reports to progress as it
+	// reads resources one by one.
+	Plan(api consul.API, cfg *config.Config, state *State, plan *Plan, progress Progress) error
+	// Steps returns the kind's planned changes, creates before updates.
+	Steps(plan *Plan) []Step
+	// Verify re-reads the resources the plan changed and describes those
+	// that still differ from the config, reporting to progress likewise.
+	Verify(api consul.API, plan *Plan, progress Progress) ([]string, error)
+}
+
+// Progress is told how far a long phase of a run is, e.g. "planning
+// policies": done of its total items are finished. A nil Progress is not
+// told anything.
+type Progress func(phase string, done, total int)
+
+// Report calls p, unless it is nil.
+func (p Progress) Report(phase string, done, total int) {
+	if p != nil {
+		p(phase, done, total)
+	}
+}
+
+// Kinds are the managed resource kinds, in the order their changes are
+// listed. Apply order follows the plan's dependency graph instead.
+var Kinds = []ResourceKind{partitionKind{}, namespaceKind{}, policyKind{}, roleKind{}, tokenKind{}, authMethodKind{}}
+
+// optionalKind is a kind summaries only list when the plan changes some of
+// its resources.
+type optionalKind interface {
+	optional()
+}
+
+// listed reports whether summaries of plan list kind k.
+func listed(plan *Plan, k ResourceKind) bool {
+	if _, ok := k.(optionalKind); ok {
+		return len(k.Steps(plan)) > 0
+	}
+	return true
+}
+
+// Step is one planned change of one resource.
+type Step struct {
+	Kind   string      // the kind's Name
+	Node   config.Node // the resource in the plan's dependency graph
+	Action string      // create, update or, on request, replace
+	// Label identifies the resource in progress output.
+	Label string
+	// Secret, when set, is the credential the step writes, shown in progress
+	// output only if the operator asked to see secrets.
+	Secret string
+	// Item renders the step for review; Change records it for the audit log
+	// and the plan hash.
+	Item   Item
+	Change Change
+	// Do performs the step. store receives generated token secrets, and is
+	// nil when no secrets backend is configured.
+	Do func(api consul.API, store secrets.Store) error
+}
+
+// Steps returns every planned change, kind by kind.
+func Steps(plan *Plan) []Step {
+	var steps []Step
+	for _, k := range Kinds {
+		steps = append(steps, k.Steps(plan)...)
+	}
+	return steps
+}
+
+// counts returns how many resources of kind k the plan creates, updates and
+// replaces.
+func counts(plan *Plan, k ResourceKind) (create, update, replace int) {
+	for _, s := range k.Steps(plan) {
+		switch s.Action {
+		case "create":
+			create++
+		case "replace":
+			replace++
+		default:
+			update++
+		}
+	}
+	return create, update, replace
+}
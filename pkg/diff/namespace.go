@@ -0,0 +1,209 @@
+package diff
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// namespaceKind manages Consul Enterprise namespaces, keyed by name within
+// their partition. Community Edition has no namespace API, so it is only
+// called when the config declares namespaces.
+type namespaceKind struct{}
+
+func (namespaceKind) Name() string   { return "namespace" }
+func (namespaceKind) Plural() string { return "namespaces" }
+
+// optional leaves namespaces out of the summary of plans that change none.
+func (namespaceKind) optional() {}
+
+func (namespaceKind) Plan(api consul.API, cfg *config.Config, _ *State, plan *Plan, _ Progress) error {
+	if len(cfg.Namespaces) == 0 {
+		return nil
+	}
+	byKey, err := liveNamespaces(api)
+	if err != nil {
+		return err
+	}
+	for _, desired := range cfg.Namespaces {
+		current, ok := byKey[desired.Key()]
+		if ok {
+			desired = ignoreNamespaceFields(cfg.IgnoreFields, current, desired)
+		}
+		switch {
+		case !ok:
+			plan.NamespacesToCreate = append(plan.NamespacesToCreate, desired)
+		case NamespaceNeedsUpdate(current, desired):
+			plan.NamespacesToUpdate = append(plan.NamespacesToUpdate, NamespaceUpdate{Current: current, Desired: desired})
+		}
+	}
+	return nil
+}
+
+func (namespaceKind) Steps(plan *Plan) []Step {
+	tenanted := plan.Tenanted()
+	var steps []Step
+	for _, n := range plan.NamespacesToCreate {
+		after := desiredNamespaceValues(n)
+		detail := []string{"description: " + quote(n.Description),
+			fmt.Sprintf("policy defaults: %v", after.PolicyDefaults), fmt.Sprintf("role defaults: %v", after.RoleDefaults)}
+		for _, k := range metaKeys(after.Meta) {
+			detail = append(detail, fmt.Sprintf("meta.%s: %s", k, quote(after.Meta[k])))
+		}
+		steps = append(steps, Step{
+			Kind:   "namespace",
+			Node:   config.NamespaceNode(n),
+			Action: "create",
+			Label:  quote(n.Key()),
+			Item:   Item{Title: fmt.Sprintf("+ namespace %q", n.Key()), Detail: detail, Group: group(n.Defaults(), tenanted)},
+			Change: Change{Action: "create", Type: "namespace", Name: n.Key(), After: after},
+			Do:     func(api consul.API, _ secrets.Store) error { return api.CreateNamespace(n) },
+		})
+	}
+
+	for _, u := range plan.NamespacesToUpdate {
+		before, after := liveNamespaceValues(u.Current), desiredNamespaceValues(u.Desired)
+		detail := namespaceDetail(before, after)
+		steps = append(steps, Step{
+			Kind:   "namespace",
+			Node:   config.NamespaceNode(u.Desired),
+			Action: "update",
+			Label:  quote(u.Desired.Key()),
+			Item:   Item{Title: fmt.Sprintf("~ namespace %q", u.Desired.Key()), Detail: detail, Group: group(u.Desired.Defaults(), tenanted)},
+			Change: Change{Action: "update", Type: "namespace", Name: u.Desired.Key(), Before: before, After: after, Reasons: reasons(detail)},
+			Do:     func(api consul.API, _ secrets.Store) error { return api.UpdateNamespace(u.Desired) },
+		})
+	}
+	return steps
+}
+
+func (namespaceKind) Verify(api consul.API, plan *Plan, _ Progress) ([]string, error) {
+	namespaces := append([]config.Namespace(nil), plan.NamespacesToCreate...)
+	for _, u := range plan.NamespacesToUpdate {
+		namespaces = append(namespaces, u.Desired)
+	}
+	if len(namespaces) == 0 {
+		return nil, nil
+	}
+
+	byKey, err := liveNamespaces(api)
+	if err != nil {
+		return nil, err
+	}
+	var differ []string
+	for _, desired := range namespaces {
+		current, ok := byKey[desired.Key()]
+		if !ok {
+			differ = append(differ, fmt.Sprintf("namespace %q is missing", desired.Key()))
+			continue
+		}
+		if NamespaceNeedsUpdate(current, desired) {
+			differ = append(differ, fmt.Sprintf("namespace %q still differs", desired.Key()))
+		}
+	}
+	return differ, nil
+}
+
+// NamespaceUpdate pairs the desired namespace with the current one it
+// replaces. Namespaces are addressed by name, so no ID is needed.
+type NamespaceUpdate struct {
+	Current consul.Namespace
+	Desired config.Namespace
+}
+
+// NamespaceNeedsUpdate reports whether the live namespace differs from the
+// config in its description, policy or role defaults, or meta. The defaults
+// compare as sets.
+func NamespaceNeedsUpdate(current consul.Namespace, desired config.Namespace) bool {
+	return len(namespaceDetail(liveNamespaceValues(current), desiredNamespaceValues(desired))) > 0
+}
+
+type namespaceValues struct {
+	Description    string            `json:"description"`
+	PolicyDefaults []string          `json:"policy_defaults"`
+	RoleDefaults   []string          `json:"role_defaults"`
+	Meta           map[string]string `json:"meta,omitempty"`
+}
+
+func desiredNamespaceValues(n config.Namespace) namespaceValues {
+	return namespaceValues{Description: n.Description, PolicyDefaults: sortedCopy(n.PolicyDefaults),
+		RoleDefaults: sortedCopy(n.RoleDefaults), Meta: nonEmpty(n.Meta)}
+}
+
+func liveNamespaceValues(n consul.Namespace) namespaceValues {
+	return namespaceValues{Description: n.Description, PolicyDefaults: sortedCopy(n.PolicyDefaultNames()),
+		RoleDefaults: sortedCopy(n.RoleDefaultNames()), Meta: nonEmpty(n.Meta)}
+}
+
+// namespaceDetail describes the compared fields that differ between two
+// versions of a namespace.
+func namespaceDetail(before, after namespaceValues) []string {
+	var detail []string
+	if before.Description != after.Description {
+		detail = append(detail, fmt.Sprintf("description: %s -> %s", quote(before.Description), quote(after.Description)))
+	}
+	if !stringSetEqual(before.PolicyDefaults, after.PolicyDefaults) {
+		detail = append(detail, fmt.Sprintf("policy defaults: %v -> %v", before.PolicyDefaults, after.PolicyDefaults))
+	}
+	if !stringSetEqual(before.RoleDefaults, after.RoleDefaults) {
+		detail = append(detail, fmt.Sprintf("role defaults: %v -> %v", before.RoleDefaults, after.RoleDefaults))
+	}
+	keys := metaKeys(after.Meta)
+	for k := range before.Meta {
+		if _, ok := after.Meta[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, bok := before.Meta[k]
+		a, aok := after.Meta[k]
+		switch {
+		case bok && aok && a == b:
+		case !bok:
+			detail = append(detail, fmt.Sprintf("meta.%s: (unset) -> %s", k, quote(a)))
+		case !aok:
+			detail = append(detail, fmt.Sprintf("meta.%s: %s -> (unset)", k, quote(b)))
+		default:
+			detail = append(detail, fmt.Sprintf("meta.%s: %s -> %s", k, quote(b), quote(a)))
+		}
+	}
+	return detail
+}
+
+// liveNamespaces lists the namespaces Consul has, keyed by the
+// config.Namespace Key they match. Namespaces still being deleted are left
+// out: they cannot be updated, and are created again once gone.
+func liveNamespaces(api consul.API) (map[string]consul.Namespace, error) {
+	live, err := api.ListNamespaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	byKey := make(map[string]consul.Namespace, len(live))
+	for _, n := range live {
+		if n.DeletedAt != nil {
+			continue
+		}
+		byKey[config.Namespace{Name: n.Name, Partition: n.Partition}.Key()] = n
+	}
+	return byKey, nil
+}
+
+func metaKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func nonEmpty(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,129 @@
+package diff
+
+import (
+	"fmt"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// partitionKind manages Consul Enterprise admin partitions, keyed by name.
+// Like namespaces, they are only listed when the config declares some.
+type partitionKind struct{}
+
+func (partitionKind) Name() string   { return "partition" }
+func (partitionKind) Plural() string { return "partitions" }
+
+// optional leaves partitions out of the summary of plans that change none.
+func (partitionKind) optional() {}
+
+func (partitionKind) Plan(api consul.API, cfg *config.Config, _ *State, plan *Plan, _ Progress) error {
+	if len(cfg.AdminPartitions) == 0 {
+		return nil
+	}
+	byName, err := livePartitions(api)
+	if err != nil {
+		return err
+	}
+	for _, desired := range cfg.AdminPartitions {
+		current, ok := byName[desired.Name]
+		if ok {
+			desired = ignorePartitionFields(cfg.IgnoreFields, current, desired)
+		}
+		switch {
+		case !ok:
+			plan.PartitionsToCreate = append(plan.PartitionsToCreate, desired)
+		case current.Description != desired.Description:
+			plan.PartitionsToUpdate = append(plan.PartitionsToUpdate, PartitionUpdate{Current: current, Desired: desired})
+		}
+	}
+	return nil
+}
+
+func (partitionKind) Steps(plan *Plan) []Step {
+	tenanted := plan.Tenanted()
+	var steps []Step
+	for _, p := range plan.PartitionsToCreate {
+		steps = append(steps, Step{
+			Kind:   "partition",
+			Node:   config.PartitionNode(p),
+			Action: "create",
+			Label:  quote(p.Name),
+			Item:   Item{Title: fmt.Sprintf("+ partition %q", p.Name), Detail: []string{"description: " + quote(p.Description)}, Group: group(config.Tenancy{}, tenanted)},
+			Change: Change{Action: "create", Type: "partition", Name: p.Name, After: partitionValues{Description: p.Description}},
+			Do:     func(api consul.API, _ secrets.Store) error { return api.CreatePartition(p) },
+		})
+	}
+
+	for _, u := range plan.PartitionsToUpdate {
+		before, after := partitionValues{Description: u.Current.Description}, partitionValues{Description: u.Desired.Description}
+		steps = append(steps, Step{
+			Kind:   "partition",
+			Node:   config.PartitionNode(u.Desired),
+			Action: "update",
+			Label:  quote(u.Desired.Name),
+			Item: Item{Title: fmt.Sprintf("~ partition %q", u.Desired.Name),
+				Detail: []string{fmt.Sprintf("description: %s -> %s", quote(before.Description), quote(after.Description))},
+				Group:  group(config.Tenancy{}, tenanted)},
+			Change: Change{Action: "update", Type: "partition", Name: u.Desired.Name, Before: before, After: after,
+				Reasons: []string{"description"}},
+			Do: func(api consul.API, _ secrets.Store) error { return api.UpdatePartition(u.Desired) },
+		})
+	}
+	return steps
+}
+
+func (partitionKind) Verify(api consul.API, plan *Plan, _ Progress) ([]string, error) {
+	partitions := append([]config.Partition(nil), plan.PartitionsToCreate...)
+	for _, u := range plan.PartitionsToUpdate {
+		partitions = append(partitions, u.Desired)
+	}
+	if len(partitions) == 0 {
+		return nil, nil
+	}
+
+	byName, err := livePartitions(api)
+	if err != nil {
+		return nil, err
+	}
+	var differ []string
+	for _, desired := range partitions {
+		current, ok := byName[desired.Name]
+		if !ok {
+			differ = append(differ, fmt.Sprintf("partition %q is missing", desired.Name))
+			continue
+		}
+		if current.Description != desired.Description {
+			differ = append(differ, fmt.Sprintf("partition %q still differs", desired.Name))
+		}
+	}
+	return differ, nil
+}
+
+// PartitionUpdate pairs the desired partition with the current one it
+// replaces. Only the description of a partition can change.
+type PartitionUpdate struct {
+	Current consul.Partition
+	Desired config.Partition
+}
+
+type partitionValues struct {
+	Description string `json:"description"`
+}
+
+// livePartitions lists the partitions Consul has by name, leaving out those
+// still being deleted, as liveNamespaces does.
+func livePartitions(api consul.API) (map[string]consul.Partition, error) {
+	live, err := api.ListPartitions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	byName := make(map[string]consul.Partition, len(live))
+	for _, p := range live {
+		if p.DeletedAt == nil {
+			byName[p.Name] = p
+		}
+	}
+	return byName, nil
+}
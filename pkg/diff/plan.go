@@ -0,0 +1,241 @@
+// Package diff compares a config against live Consul state and renders the
+// resulting plan.
+package diff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// Plan is the set of changes to apply. It creates and updates, and deletes
+// only the tokens in TokensToReplace, each to create it again at once.
+// Resources present only in Consul are left untouched. Surface them with
+// consul-acl-diff and remove them by runbook.
+type Plan struct {
+	PoliciesToCreate []config.Policy
+	PoliciesToUpdate []PolicyUpdate
+	RolesToCreate    []config.Role
+	RolesToUpdate    []RoleUpdate
+	TokensToCreate   []config.Token
+	TokensToUpdate   []TokenUpdate
+
+	AuthMethodsToCreate []config.AuthMethod
+	AuthMethodsToUpdate []AuthMethodUpdate
+
+	PartitionsToCreate []config.Partition
+	PartitionsToUpdate []PartitionUpdate
+	NamespacesToCreate []config.Namespace
+	NamespacesToUpdate []NamespaceUpdate
+
+	// TokensToReplace are deleted and created again: expired tokens, and
+	// those named in Replace.
+	TokensToReplace []TokenUpdate
+
+	// Datacenter is the datacenter the plan was calculated against, shown
+	// in its header; "" is the agent's own.
+	Datacenter string
+
+	// ShowSecrets shows the credentials of auth method configs in the
+	// plan's output, as -show-secrets asks. Changes redact them regardless.
+	ShowSecrets bool
+
+	// SideBySide, when above 0, is the width of the output rule changes are
+	// shown side by side in, the rules in Consul on the left. At 0 they are
+	// shown as a unified diff.
+	SideBySide int
+
+	// Graph holds the dependencies between the resources of the config,
+	// which order the apply.
+	Graph *config.Graph
+}
+
+// PolicyUpdate pairs the desired policy with the existing Consul ID that the
+// update endpoint addresses, and the current policy it replaces.
+type PolicyUpdate struct {
+	ID      string
+	Current consul.Policy
+	Desired config.Policy
+}
+
+// TokenUpdate pairs the desired token with the current one it replaces.
+type TokenUpdate struct {
+	Current consul.Token
+	Desired config.Token
+	// Reason says why a token in TokensToReplace is recreated.
+	Reason string
+}
+
+// Tenanted reports whether the plan changes a resource outside the default
+// partition and namespace (Consul Enterprise). Its output then groups the
+// changes by partition and namespace and names resources by their fully
+// qualified partition/namespace/name address, so identically named resources
+// of different tenants can be told apart.
+func (p *Plan) Tenanted() bool {
+	for _, q := range p.PoliciesToCreate {
+		if !q.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.PoliciesToUpdate {
+		if !u.Desired.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, r := range p.RolesToCreate {
+		if !r.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.RolesToUpdate {
+		if !u.Desired.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, t := range p.TokensToCreate {
+		if !t.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.TokensToUpdate {
+		if !u.Desired.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.TokensToReplace {
+		if !u.Desired.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, m := range p.AuthMethodsToCreate {
+		if !m.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.AuthMethodsToUpdate {
+		if !u.Desired.Tenancy.IsDefault() {
+			return true
+		}
+	}
+	for _, q := range p.PartitionsToCreate {
+		if !(config.Tenancy{Partition: q.Name}).IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.PartitionsToUpdate {
+		if !(config.Tenancy{Partition: u.Desired.Name}).IsDefault() {
+			return true
+		}
+	}
+	for _, n := range p.NamespacesToCreate {
+		if !n.Defaults().IsDefault() {
+			return true
+		}
+	}
+	for _, u := range p.NamespacesToUpdate {
+		if !u.Desired.Defaults().IsDefault() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasChanges reports whether the plan would modify anything.
+func (p *Plan) HasChanges() bool {
+	return len(p.PoliciesToCreate) > 0 ||
+		len(p.PoliciesToUpdate) > 0 ||
+		len(p.RolesToCreate) > 0 ||
+		len(p.RolesToUpdate) > 0 ||
+		len(p.TokensToCreate) > 0 ||
+		len(p.TokensToUpdate) > 0 ||
+		len(p.TokensToReplace) > 0 ||
+		len(p.AuthMethodsToCreate) > 0 ||
+		len(p.AuthMethodsToUpdate) > 0 ||
+		len(p.PartitionsToCreate) > 0 ||
+		len(p.PartitionsToUpdate) > 0 ||
+		len(p.NamespacesToCreate) > 0 ||
+		len(p.NamespacesToUpdate) > 0
+}
+
+// Change is one planned change with the before and after values of the
+// compared fields. Token secrets are never part of it.
+type Change struct {
+	Action string      `json:"action"` // create, update or replace
+	Type   string      `json:"type"`   // policy, role, token, auth-method, namespace or partition
+	Name   string      `json:"name"`   // token accessor ID, or the name of others
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after"`
+	// Reasons lists the attributes that differ, for updates and replaces,
+	// named as in the config, e.g. "rules", "policies" or "config.Host".
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// reasons names the attributes detail describes. Each line of a detail
+// function starts with the attribute it is about, as shown, e.g. "max token
+// ttl: 1h -> 8h"; indented lines continue the one before.
+func reasons(detail []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, line := range detail {
+		i := strings.Index(line, ":")
+		if i <= 0 || strings.HasPrefix(line, " ") {
+			continue
+		}
+		name := strings.ReplaceAll(line[:i], " ", "_")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type policyValues struct {
+	Description string   `json:"description"`
+	Rules       string   `json:"rules"`
+	Datacenters []string `json:"datacenters,omitempty"`
+}
+
+type tokenValues struct {
+	Description string   `json:"description"`
+	Policies    []string `json:"policies"`
+	Roles       []string `json:"roles,omitempty"`
+}
+
+// sorted returns v with its links sorted, as changes record them.
+func (v tokenValues) sorted() tokenValues {
+	v.Policies, v.Roles = sortedCopy(v.Policies), sortedCopy(v.Roles)
+	if len(v.Roles) == 0 {
+		v.Roles = nil
+	}
+	return v
+}
+
+// Changes lists the plan's changes in apply order with their before and
+// after values.
+func Changes(plan *Plan) []Change {
+	var changes []Change
+	for _, step := range Steps(plan) {
+		changes = append(changes, step.Change)
+	}
+	return changes
+}
+
+// Hash identifies a plan by the changes it makes, so the same change set
+// hashes the same on every machine.
+func Hash(plan *Plan) string {
+	b, _ := json.Marshal(Changes(plan))
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortedCopy(s []string) []string {
+	out := append([]string{}, s...)
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,46 @@
+package diff
+
+import (
+	"context"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/trace"
+)
+
+// Calculate compares the config against the live Consul state and returns
+// the additive changes needed. It never plans a deletion. With a non-nil
+// state, resources whose Consul Hash and config are unchanged since they were
+// last found in sync are skipped without a deep comparison, and state is
+// updated with what this run finds. progress, when set, follows the reads.
+func Calculate(client consul.API, cfg *config.Config, state *State, progress Progress) (_ *Plan, err error) {
+	ctx, sp := consul.TracerOf(client).Start(context.Background(), "plan", trace.KindInternal)
+	client = consul.WithContext(client, ctx)
+	defer func() { sp.Finish(err) }()
+
+	plan := &Plan{Graph: config.BuildGraph(cfg)}
+	for _, k := range Kinds {
+		if err := k.Plan(client, cfg, state, plan, progress); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// stringSetEqual reports whether two slices hold the same multiset of strings,
+// ignoring order.
+func stringSetEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+		if counts[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// policyKind manages ACL policies, keyed by name.
+type policyKind struct{}
+
+func (policyKind) Name() string   { return "policy" }
+func (policyKind) Plural() string { return "policies" }
+
+func (policyKind) Plan(api consul.API, cfg *config.Config, state *State, plan *Plan, progress Progress) error {
+	consulPolicies, err := api.ListPolicies()
+	if err != nil {
+		return fmt.Errorf("failed to list policies: %w", err)
+	}
+	byKey := make(map[string]consul.Policy, len(consulPolicies))
+	for _, p := range consulPolicies {
+		byKey[livePolicyKey(p)] = p
+	}
+
+	for i, desired := range cfg.Policies {
+		progress.Report("planning policies", i, len(cfg.Policies))
+		current, ok := byKey[desired.Key()]
+		if !ok {
+			state.recordPolicy("", desired)
+			plan.PoliciesToCreate = append(plan.PoliciesToCreate, desired)
+			continue
+		}
+		desired = ignorePolicyFields(cfg.IgnoreFields, current, desired)
+		if state.policyUnchanged(current.Hash, desired) {
+			continue
+		}
+
+		// Rules are absent from the list response, so fetch the full policy.
+		full, err := api.PolicyRules(current.ID)
+		if err != nil {
+			return fmt.Errorf("failed to read policy %q: %w", desired.Key(), err)
+		}
+		if PolicyNeedsUpdate(full, desired) {
+			state.recordPolicy("", desired)
+			plan.PoliciesToUpdate = append(plan.PoliciesToUpdate, PolicyUpdate{ID: current.ID, Current: full, Desired: desired})
+			continue
+		}
+		state.recordPolicy(current.Hash, desired)
+	}
+	progress.Report("planning policies", len(cfg.Policies), len(cfg.Policies))
+	return nil
+}
+
+func (policyKind) Steps(plan *Plan) []Step {
+	tenanted := plan.Tenanted()
+	var steps []Step
+	for _, p := range plan.PoliciesToCreate {
+		name := policyName(p, tenanted)
+		detail := []string{"description: " + quote(p.Description)}
+		if len(p.Datacenters) > 0 {
+			detail = append(detail, "datacenters: "+datacenters(p.Datacenters))
+		}
+		detail = append(detail, "rules:")
+		for _, line := range strings.Split(normalizeRules(p.Rules), "\n") {
+			detail = append(detail, "  + "+line)
+		}
+		steps = append(steps, Step{
+			Kind:   "policy",
+			Node:   config.PolicyNode(p),
+			Action: "create",
+			Label:  quote(name),
+			Item:   Item{Title: fmt.Sprintf("+ policy %q", name), Detail: detail, Group: group(p.Tenancy, tenanted)},
+			Change: Change{Action: "create", Type: "policy", Name: name,
+				After: policyValues{p.Description, p.Rules, p.Datacenters}},
+			Do: func(api consul.API, _ secrets.Store) error { _, err := api.CreatePolicy(p); return err },
+		})
+	}
+
+	for _, u := range plan.PoliciesToUpdate {
+		name := policyName(u.Desired, tenanted)
+		detail := policyDetail(
+			policyValues{u.Current.Description, u.Current.Rules, u.Current.Datacenters},
+			policyValues{u.Desired.Description, u.Desired.Rules, u.Desired.Datacenters},
+			plan.SideBySide)
+		steps = append(steps, Step{
+			Kind:   "policy",
+			Node:   config.PolicyNode(u.Desired),
+			Action: "update",
+			Label:  quote(name),
+			Item:   Item{Title: fmt.Sprintf("~ policy %q", name), Detail: detail, Group: group(u.Desired.Tenancy, tenanted)},
+			Change: Change{Action: "update", Type: "policy", Name: name,
+				Before:  policyValues{u.Current.Description, u.Current.Rules, u.Current.Datacenters},
+				After:   policyValues{u.Desired.Description, u.Desired.Rules, u.Desired.Datacenters},
+				Reasons: reasons(detail)},
+			Do: func(api consul.API, _ secrets.Store) error {
+				// The update addresses the ID found at plan time. A policy
+				// renamed or edited since would be silently overwritten.
+				live, err := api.PolicyRules(u.ID)
+				if err != nil {
+					return fmt.Errorf("failed to re-read policy %q: %w", name, err)
+				}
+				if live.Name != u.Current.Name || live.Hash != u.Current.Hash {
+					return fmt.Errorf("policy %q changed in Consul since it was planned; plan again", name)
+				}
+				return api.UpdatePolicy(u.ID, u.Desired)
+			},
+		})
+	}
+	return steps
+}
+
+// policyDetail describes the managed fields that differ between two versions
+// of a policy, with the rules side by side in width columns when width is
+// above 0.
+func policyDetail(before, after policyValues, width int) []string {
+	var detail []string
+	if before.Description != after.Description {
+		detail = append(detail, fmt.Sprintf("description: %s -> %s", quote(before.Description), quote(after.Description)))
+	}
+	if !stringSetEqual(before.Datacenters, after.Datacenters) {
+		detail = append(detail, fmt.Sprintf("datacenters: %s -> %s", datacenters(before.Datacenters), datacenters(after.Datacenters)))
+	}
+	if canonicalRules(before.Rules) != canonicalRules(after.Rules) {
+		detail = append(detail, "rules:")
+		if width > 0 {
+			return append(detail, sideBySide(normalizeRules(before.Rules), normalizeRules(after.Rules), width)...)
+		}
+		for _, d := range diffLines(normalizeRules(before.Rules), normalizeRules(after.Rules)) {
+			detail = append(detail, "  "+d)
+		}
+	}
+	return detail
+}
+
+// policyName names p in plan output: fully qualified in a tenanted plan.
+func policyName(p config.Policy, tenanted bool) string {
+	if tenanted {
+		return p.Tenancy.Qualify(p.Name)
+	}
+	return p.Name
+}
+
+func (policyKind) Verify(api consul.API, plan *Plan, progress Progress) ([]string, error) {
+	policies := append([]config.Policy(nil), plan.PoliciesToCreate...)
+	for _, u := range plan.PoliciesToUpdate {
+		policies = append(policies, u.Desired)
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	live, err := api.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	byKey := make(map[string]consul.Policy, len(live))
+	for _, p := range live {
+		byKey[livePolicyKey(p)] = p
+	}
+	var differ []string
+	for i, desired := range policies {
+		progress.Report("verifying policies", i, len(policies))
+		current, ok := byKey[desired.Key()]
+		if !ok {
+			differ = append(differ, fmt.Sprintf("policy %q is missing", desired.Key()))
+			continue
+		}
+		full, err := api.PolicyRules(current.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy %q: %w", desired.Key(), err)
+		}
+		if PolicyNeedsUpdate(full, desired) {
+			differ = append(differ, fmt.Sprintf("policy %q still differs", desired.Key()))
+		}
+	}
+	progress.Report("verifying policies", len(policies), len(policies))
+	return differ, nil
+}
+
+// livePolicyKey is the config.Policy Key a live policy matches.
+func livePolicyKey(p consul.Policy) string {
+	return config.Policy{Name: p.Name, Tenancy: p.Tenancy()}.Key()
+}
+
+// PolicyNeedsUpdate reports whether the live policy differs from the config in
+// any field consul-acl-sync manages.
+func PolicyNeedsUpdate(current consul.Policy, desired config.Policy) bool {
+	if current.Description != desired.Description {
+		return true
+	}
+	if canonicalRules(current.Rules) != canonicalRules(desired.Rules) {
+		return true
+	}
+	return !stringSetEqual(current.Datacenters, desired.Datacenters)
+}
@@ -0,0 +1,332 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// Item is one change rendered for review: a one-line title and the
+// attribute lines that explain it.
+type Item struct {
+	Title  string
+	Detail []string
+	// Group is the partition and namespace of the resource in a tenanted
+	// plan, and empty otherwise.
+	Group string
+}
+
+func group(t config.Tenancy, tenanted bool) string {
+	if !tenanted {
+		return ""
+	}
+	return fmt.Sprintf("partition %s, namespace %s", orDefault(t.Partition), orDefault(t.Namespace))
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
+
+// grouped orders items by Group, keeping apply order within each group.
+func grouped(items []Item) []Item {
+	out := append([]Item(nil), items...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Group < out[j].Group })
+	return out
+}
+
+// Items renders the plan in apply order.
+func Items(plan *Plan) []Item {
+	var items []Item
+	for _, step := range Steps(plan) {
+		items = append(items, step.Item)
+	}
+	return items
+}
+
+// PrintText writes the plan as reviewable text.
+func PrintText(w io.Writer, plan *Plan) {
+	if plan.Datacenter != "" {
+		fmt.Fprintf(w, "Datacenter: %s\n", plan.Datacenter)
+	}
+	if !plan.HasChanges() {
+		fmt.Fprintln(w, "No changes. Consul is up to date.")
+		return
+	}
+	fmt.Fprintln(w, Summary(plan))
+	var last string
+	for _, item := range grouped(Items(plan)) {
+		if item.Group != last {
+			fmt.Fprintf(w, "\n== %s ==\n", item.Group)
+			last = item.Group
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, item.Title)
+		for _, line := range item.Detail {
+			fmt.Fprintln(w, "    "+line)
+		}
+	}
+}
+
+// Summary is the one-line count of planned changes.
+func Summary(plan *Plan) string {
+	parts := make([]string, 0, len(Kinds))
+	for _, k := range Kinds {
+		if !listed(plan, k) {
+			continue
+		}
+		create, update, replace := counts(plan, k)
+		part := fmt.Sprintf("%s %d to create, %d to update", k.Plural(), create, update)
+		if replace > 0 {
+			part += fmt.Sprintf(", %d to replace", replace)
+		}
+		parts = append(parts, part)
+	}
+	return "Plan: " + strings.Join(parts, "; ") + "."
+}
+
+// PrintSummary writes only the number of changes per resource type and
+// action, with their totals, for a drift check that the full plan would bury.
+func PrintSummary(w io.Writer, plan *Plan) {
+	if plan.Datacenter != "" {
+		fmt.Fprintf(w, "Datacenter: %s\n", plan.Datacenter)
+	}
+	if !plan.HasChanges() {
+		fmt.Fprintln(w, "No changes. Consul is up to date.")
+		return
+	}
+	replaces := len(plan.TokensToReplace) > 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "Resource\tCreate\tUpdate"
+	if replaces {
+		header += "\tReplace"
+	}
+	fmt.Fprintln(tw, header)
+	var total [3]int
+	row := func(name string, create, update, replace int) {
+		line := fmt.Sprintf("%s\t%d\t%d", name, create, update)
+		if replaces {
+			line += fmt.Sprintf("\t%d", replace)
+		}
+		fmt.Fprintln(tw, line)
+	}
+	for _, k := range Kinds {
+		if !listed(plan, k) {
+			continue
+		}
+		create, update, replace := counts(plan, k)
+		row(k.Plural(), create, update, replace)
+		total[0] += create
+		total[1] += update
+		total[2] += replace
+	}
+	row("total", total[0], total[1], total[2])
+	tw.Flush()
+}
+
+func quote(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+// datacenters renders the datacenters a policy is valid in, sorted since
+// their order does not matter. No restriction is shown as all.
+func datacenters(dcs []string) string {
+	if len(dcs) == 0 {
+		return "all"
+	}
+	return fmt.Sprint(sortedCopy(dcs))
+}
+
+// diffLines returns a unified line diff of a and b: unchanged lines prefixed
+// with two spaces, removals with "- " and additions with "+ ".
+func diffLines(a, b string) []string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:]
+	// and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			out = append(out, "  "+x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+x[i])
+			i++
+		default:
+			out = append(out, "+ "+y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		out = append(out, "- "+x[i])
+	}
+	for ; j < len(y); j++ {
+		out = append(out, "+ "+y[j])
+	}
+	return out
+}
+
+// PrintMarkdown renders the plan for a merge request comment: a summary
+// table, then every change in a collapsible section with its rule diff fenced
+// as a diff block. Replaced tokens, the only resources a plan deletes, are
+// counted in a Replace column of their own.
+func PrintMarkdown(w io.Writer, plan *Plan) {
+	if !printMarkdownTable(w, plan) {
+		return
+	}
+
+	items := grouped(Items(plan))
+	fmt.Fprintf(w, "<details><summary>%d changes</summary>\n\n", len(items))
+	var last string
+	for _, item := range items {
+		if item.Group != last {
+			fmt.Fprintf(w, "**%s**\n\n", item.Group)
+			last = item.Group
+		}
+		fmt.Fprintf(w, "#### `%s`\n\n", item.Title)
+		fmt.Fprintln(w, "```diff")
+		for _, line := range item.Detail {
+			// diff highlighting keys on the first column, so rule lines
+			// carrying +/- are outdented to put the marker there.
+			if trimmed := strings.TrimPrefix(line, "  "); strings.HasPrefix(trimmed, "+ ") || strings.HasPrefix(trimmed, "- ") {
+				line = trimmed
+			}
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintln(w, "```")
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "</details>")
+}
+
+// PrintMarkdownSummary renders only the summary table of PrintMarkdown.
+func PrintMarkdownSummary(w io.Writer, plan *Plan) {
+	printMarkdownTable(w, plan)
+}
+
+// printMarkdownTable writes the heading and summary table of a markdown plan,
+// and reports whether the plan has changes to list below it.
+func printMarkdownTable(w io.Writer, plan *Plan) bool {
+	fmt.Fprintln(w, "### consul-acl-sync plan")
+	fmt.Fprintln(w)
+	if plan.Datacenter != "" {
+		fmt.Fprintf(w, "Datacenter: `%s`\n\n", plan.Datacenter)
+	}
+	if !plan.HasChanges() {
+		fmt.Fprintln(w, "No changes. Consul is up to date.")
+		return false
+	}
+
+	// The Replace column only shows when a token is replaced, on request or
+	// for having expired; each is deleted before it is created again.
+	replaces := len(plan.TokensToReplace) > 0
+	if replaces {
+		fmt.Fprintln(w, "| Resource | Create | Update | Replace |")
+		fmt.Fprintln(w, "|---|---:|---:|---:|")
+	} else {
+		fmt.Fprintln(w, "| Resource | Create | Update |")
+		fmt.Fprintln(w, "|---|---:|---:|")
+	}
+	for _, k := range Kinds {
+		if !listed(plan, k) {
+			continue
+		}
+		create, update, replace := counts(plan, k)
+		row := fmt.Sprintf("| %s | %d | %d |", strings.ToUpper(k.Plural()[:1])+k.Plural()[1:], create, update)
+		if replaces {
+			row += fmt.Sprintf(" %d |", replace)
+		}
+		fmt.Fprintln(w, row)
+	}
+	fmt.Fprintln(w)
+	return true
+}
+
+// sideBySide renders the line diff of a and b in two columns that fit width
+// once indented as PrintText indents rule lines. The gutter marks changed
+// rows with "|", removals with "<" and additions with ">", as sdiff does.
+// Lines too long for their column wrap onto the rows below.
+func sideBySide(a, b string, width int) []string {
+	col := max((width-6-3)/2, 20)
+	type row struct {
+		left, right string
+		mark        byte
+	}
+	var rows []row
+	var removed, added []string
+	flush := func() {
+		for i := 0; i < len(removed) || i < len(added); i++ {
+			switch {
+			case i >= len(added):
+				rows = append(rows, row{removed[i], "", '<'})
+			case i >= len(removed):
+				rows = append(rows, row{"", added[i], '>'})
+			default:
+				rows = append(rows, row{removed[i], added[i], '|'})
+			}
+		}
+		removed, added = nil, nil
+	}
+	for _, d := range diffLines(a, b) {
+		switch d[:2] {
+		case "- ":
+			removed = append(removed, d[2:])
+		case "+ ":
+			added = append(added, d[2:])
+		default:
+			flush()
+			rows = append(rows, row{d[2:], d[2:], ' '})
+		}
+	}
+	flush()
+
+	var out []string
+	for _, r := range rows {
+		left, right := wrap(r.left, col), wrap(r.right, col)
+		for i := 0; i < len(left) || i < len(right); i++ {
+			var l, rt string
+			if i < len(left) {
+				l = left[i]
+			}
+			if i < len(right) {
+				rt = right[i]
+			}
+			line := fmt.Sprintf("  %-*s %c %s", col, l, r.mark, rt)
+			out = append(out, strings.TrimRight(line, " "))
+		}
+	}
+	return out
+}
+
+// wrap splits s into lines of at most width runes.
+func wrap(s string, width int) []string {
+	r := []rune(s)
+	lines := []string{string(r[:min(len(r), width)])}
+	for r = r[min(len(r), width):]; len(r) > 0; r = r[min(len(r), width):] {
+		lines = append(lines, string(r[:min(len(r), width)]))
+	}
+	return lines
+}
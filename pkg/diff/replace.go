@@ -0,0 +1,73 @@
+package diff
+
+import (
+	"fmt"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// Replace makes the plan delete each of tokens and create it again with the
+// SecretID it carries, whether or not it differs from the config. It is the
+// one way to rotate the secret of a token, which Consul never changes once
+// the token exists, e.g. after a leak. A token the plan already creates is
+// left to that; one it updates is replaced instead, which updates it too, and
+// one it already replaces for having expired gets the SecretID given.
+func Replace(api consul.API, plan *Plan, tokens []config.Token) error {
+	for _, t := range tokens {
+		if creates(plan, t.AccessorID) {
+			continue
+		}
+		if i := replaces(plan, t.AccessorID); i >= 0 {
+			// Already replaced, being expired: with the secret asked for.
+			plan.TokensToReplace[i].Desired, plan.TokensToReplace[i].Reason = t, onRequest
+			continue
+		}
+		var current consul.Token
+		if i := updates(plan, t.AccessorID); i >= 0 {
+			current = plan.TokensToUpdate[i].Current
+			plan.TokensToUpdate = append(plan.TokensToUpdate[:i], plan.TokensToUpdate[i+1:]...)
+		} else {
+			live, ok, err := api.ReadToken(t.AccessorID)
+			if err != nil {
+				return fmt.Errorf("failed to read token %s: %w", t.AccessorID, err)
+			}
+			if !ok {
+				return fmt.Errorf("token %s to replace is not in Consul", t.Label())
+			}
+			current = live
+		}
+		plan.TokensToReplace = append(plan.TokensToReplace, TokenUpdate{Current: current, Desired: t, Reason: onRequest})
+	}
+	return nil
+}
+
+const onRequest = "replaced on request"
+
+func creates(plan *Plan, accessorID string) bool {
+	for _, t := range plan.TokensToCreate {
+		if t.AccessorID == accessorID {
+			return true
+		}
+	}
+	return false
+}
+
+// updates returns the index of the token in plan.TokensToUpdate, or -1.
+func updates(plan *Plan, accessorID string) int {
+	return indexOf(plan.TokensToUpdate, accessorID)
+}
+
+// replaces returns the index of the token in plan.TokensToReplace, or -1.
+func replaces(plan *Plan, accessorID string) int {
+	return indexOf(plan.TokensToReplace, accessorID)
+}
+
+func indexOf(updates []TokenUpdate, accessorID string) int {
+	for i, u := range updates {
+		if u.Desired.AccessorID == accessorID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,249 @@
+package diff
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// roleKind manages ACL roles, keyed by name.
+type roleKind struct{}
+
+func (roleKind) Name() string   { return "role" }
+func (roleKind) Plural() string { return "roles" }
+
+// optional leaves roles out of the summary of plans that change none, most
+// configs having none.
+func (roleKind) optional() {}
+
+func (roleKind) Plan(api consul.API, cfg *config.Config, _ *State, plan *Plan, _ Progress) error {
+	if len(cfg.Roles) == 0 {
+		return nil
+	}
+	// The list entries carry every compared field, so roles take one
+	// request however many there are.
+	live, err := api.ListRoles()
+	if err != nil {
+		return fmt.Errorf("failed to list roles: %w", err)
+	}
+	byKey := make(map[string]consul.Role, len(live))
+	for _, r := range live {
+		byKey[liveRoleKey(r)] = r
+	}
+	for _, desired := range cfg.Roles {
+		current, ok := byKey[desired.Key()]
+		if ok {
+			desired = ignoreRoleFields(cfg.IgnoreFields, current, desired)
+		}
+		switch {
+		case !ok:
+			plan.RolesToCreate = append(plan.RolesToCreate, desired)
+		case RoleNeedsUpdate(current, desired):
+			plan.RolesToUpdate = append(plan.RolesToUpdate, RoleUpdate{ID: current.ID, Current: current, Desired: desired})
+		}
+	}
+	return nil
+}
+
+func (roleKind) Steps(plan *Plan) []Step {
+	tenanted := plan.Tenanted()
+	var steps []Step
+	for _, r := range plan.RolesToCreate {
+		name := roleName(r, tenanted)
+		after := desiredRoleValues(r)
+		detail := []string{"description: " + quote(r.Description), fmt.Sprintf("policies: %v", r.Policies)}
+		for _, attr := range after.identities() {
+			if len(attr.values) > 0 {
+				detail = append(detail, fmt.Sprintf("%s: %v", attr.name, attr.values))
+			}
+		}
+		steps = append(steps, Step{
+			Kind:   "role",
+			Node:   config.RoleNode(r),
+			Action: "create",
+			Label:  quote(name),
+			Item:   Item{Title: fmt.Sprintf("+ role %q", name), Detail: detail, Group: group(r.Tenancy, tenanted)},
+			Change: Change{Action: "create", Type: "role", Name: name, After: after},
+			Do:     func(api consul.API, _ secrets.Store) error { _, err := api.CreateRole(r); return err },
+		})
+	}
+
+	for _, u := range plan.RolesToUpdate {
+		name := roleName(u.Desired, tenanted)
+		before, after := liveRoleValues(u.Current), desiredRoleValues(u.Desired)
+		detail := roleDetail(before, after)
+		steps = append(steps, Step{
+			Kind:   "role",
+			Node:   config.RoleNode(u.Desired),
+			Action: "update",
+			Label:  quote(name),
+			Item:   Item{Title: fmt.Sprintf("~ role %q", name), Detail: detail, Group: group(u.Desired.Tenancy, tenanted)},
+			Change: Change{Action: "update", Type: "role", Name: name, Before: before, After: after, Reasons: reasons(detail)},
+			Do:     func(api consul.API, _ secrets.Store) error { return api.UpdateRole(u.ID, u.Desired) },
+		})
+	}
+	return steps
+}
+
+func (roleKind) Verify(api consul.API, plan *Plan, _ Progress) ([]string, error) {
+	roles := append([]config.Role(nil), plan.RolesToCreate...)
+	for _, u := range plan.RolesToUpdate {
+		roles = append(roles, u.Desired)
+	}
+	if len(roles) == 0 {
+		return nil, nil
+	}
+
+	live, err := api.ListRoles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles: %w", err)
+	}
+	byKey := make(map[string]consul.Role, len(live))
+	for _, r := range live {
+		byKey[liveRoleKey(r)] = r
+	}
+	var differ []string
+	for _, desired := range roles {
+		current, ok := byKey[desired.Key()]
+		if !ok {
+			differ = append(differ, fmt.Sprintf("role %q is missing", desired.Key()))
+			continue
+		}
+		if RoleNeedsUpdate(current, desired) {
+			differ = append(differ, fmt.Sprintf("role %q still differs", desired.Key()))
+		}
+	}
+	return differ, nil
+}
+
+// RoleUpdate pairs the desired role with the existing Consul ID that the
+// update endpoint addresses, and the current role it replaces.
+type RoleUpdate struct {
+	ID      string
+	Current consul.Role
+	Desired config.Role
+}
+
+// RoleNeedsUpdate reports whether the live role differs from the config in
+// its description, policy links, identities or templated policies. Each list
+// compares as a set.
+func RoleNeedsUpdate(current consul.Role, desired config.Role) bool {
+	return len(roleDetail(liveRoleValues(current), desiredRoleValues(desired))) > 0
+}
+
+// roleValues are the compared fields of a role. Identities and templated
+// policies are rendered as text, e.g. "web in [dc1]", which is how they are
+// shown and how they compare.
+type roleValues struct {
+	Description       string   `json:"description"`
+	Policies          []string `json:"policies"`
+	ServiceIdentities []string `json:"service_identities,omitempty"`
+	NodeIdentities    []string `json:"node_identities,omitempty"`
+	TemplatedPolicies []string `json:"templated_policies,omitempty"`
+}
+
+type roleAttr struct {
+	name   string
+	values []string
+}
+
+// identities lists the identity and template attributes of v, in the order
+// they are shown.
+func (v roleValues) identities() []roleAttr {
+	return []roleAttr{
+		{"service identities", v.ServiceIdentities},
+		{"node identities", v.NodeIdentities},
+		{"templated policies", v.TemplatedPolicies},
+	}
+}
+
+func desiredRoleValues(r config.Role) roleValues {
+	v := roleValues{Description: r.Description, Policies: sortedCopy(r.Policies)}
+	for _, si := range r.ServiceIdentities {
+		v.ServiceIdentities = append(v.ServiceIdentities, withDatacenters(si.ServiceName, si.Datacenters))
+	}
+	for _, ni := range r.NodeIdentities {
+		v.NodeIdentities = append(v.NodeIdentities, ni.NodeName+" in "+ni.Datacenter)
+	}
+	for _, tp := range r.TemplatedPolicies {
+		v.TemplatedPolicies = append(v.TemplatedPolicies, templatedPolicy(tp.TemplateName, tp.TemplateVariables.Name, tp.Datacenters))
+	}
+	return v.sorted()
+}
+
+func liveRoleValues(r consul.Role) roleValues {
+	v := roleValues{Description: r.Description, Policies: sortedCopy(r.PolicyNames())}
+	for _, si := range r.ServiceIdentities {
+		v.ServiceIdentities = append(v.ServiceIdentities, withDatacenters(si.ServiceName, si.Datacenters))
+	}
+	for _, ni := range r.NodeIdentities {
+		v.NodeIdentities = append(v.NodeIdentities, ni.NodeName+" in "+ni.Datacenter)
+	}
+	for _, tp := range r.TemplatedPolicies {
+		var name string
+		if tp.TemplateVariables != nil {
+			name = tp.TemplateVariables.Name
+		}
+		v.TemplatedPolicies = append(v.TemplatedPolicies, templatedPolicy(tp.TemplateName, name, tp.Datacenters))
+	}
+	return v.sorted()
+}
+
+func (v roleValues) sorted() roleValues {
+	sort.Strings(v.ServiceIdentities)
+	sort.Strings(v.NodeIdentities)
+	sort.Strings(v.TemplatedPolicies)
+	return v
+}
+
+// withDatacenters renders name restricted to dcs, e.g. "web in [dc1 dc2]",
+// or plain name when valid in all datacenters.
+func withDatacenters(name string, dcs []string) string {
+	if len(dcs) == 0 {
+		return name
+	}
+	return name + " in " + datacenters(dcs)
+}
+
+// templatedPolicy renders a templated policy, e.g. "builtin/service(web)".
+func templatedPolicy(template, name string, dcs []string) string {
+	if name != "" {
+		template += "(" + name + ")"
+	}
+	return withDatacenters(template, dcs)
+}
+
+// roleDetail describes the compared fields that differ between two versions
+// of a role.
+func roleDetail(before, after roleValues) []string {
+	var detail []string
+	if before.Description != after.Description {
+		detail = append(detail, fmt.Sprintf("description: %s -> %s", quote(before.Description), quote(after.Description)))
+	}
+	if !stringSetEqual(before.Policies, after.Policies) {
+		detail = append(detail, fmt.Sprintf("policies: %v -> %v", before.Policies, after.Policies))
+	}
+	b, a := before.identities(), after.identities()
+	for i := range b {
+		if !stringSetEqual(b[i].values, a[i].values) {
+			detail = append(detail, fmt.Sprintf("%s: %v -> %v", b[i].name, b[i].values, a[i].values))
+		}
+	}
+	return detail
+}
+
+// roleName names r in plan output: fully qualified in a tenanted plan.
+func roleName(r config.Role, tenanted bool) string {
+	if tenanted {
+		return r.Tenancy.Qualify(r.Name)
+	}
+	return r.Name
+}
+
+// liveRoleKey is the config.Role Key a live role matches.
+func liveRoleKey(r consul.Role) string {
+	return config.Role{Name: r.Name, Tenancy: r.Tenancy()}.Key()
+}
@@ -0,0 +1,59 @@
+package diff
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+)
+
+// canonicalRules reduces HCL rules to their token stream so that layout the
+// Consul HCL printer changes on the way in (indentation, line breaks, blank
+// lines, comments, trailing commas) compares equal. Rules that do not
+// tokenize fall back to normalizeRules.
+func canonicalRules(rules string) string {
+	tokens, ok := acl.Tokens(normalizeRules(rules))
+	if !ok {
+		return normalizeRules(rules)
+	}
+	// A trailing comma before a closing bracket or brace is optional.
+	out := tokens[:0]
+	for i, tok := range tokens {
+		if tok == "," && i+1 < len(tokens) && (tokens[i+1] == "]" || tokens[i+1] == "}") {
+			continue
+		}
+		out = append(out, canonicalString(tok))
+	}
+	return strings.Join(out, " ")
+}
+
+// canonicalString escapes a quoted token the same way however the source
+// quoted it, so Sentinel code written as a heredoc compares equal to the
+// quoted string Consul may return it as. The lines of a multi-line string
+// are trimmed, as heredocs are.
+func canonicalString(tok string) string {
+	s, err := strconv.Unquote(tok)
+	if !strings.HasPrefix(tok, `"`) || err != nil {
+		return tok
+	}
+	if strings.Contains(s, "\n") {
+		lines := strings.Split(strings.Trim(s, "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimSpace(line)
+		}
+		s = strings.Join(lines, "\n")
+	}
+	return strconv.Quote(s)
+}
+
+// normalizeRules strips cosmetic whitespace so rule comparison does not report
+// false drift. consul-acl-diff uses the same normalization.
+func normalizeRules(rules string) string {
+	rules = strings.TrimSpace(rules)
+	rules = strings.ReplaceAll(rules, "\r\n", "\n")
+	lines := strings.Split(rules, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
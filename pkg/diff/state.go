@@ -0,0 +1,276 @@
+package diff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// State is the optional local record of what the last run found in sync. For
+// each resource it keeps the Hash Consul reported and a fingerprint of the
+// desired config. When both still match, the resource cannot have changed on
+// either side and the planner skips fetching and comparing it.
+type State struct {
+	Policies map[string]stateEntry `json:"policies"` // keyed by config.Policy Key
+	Tokens   map[string]stateEntry `json:"tokens"`   // keyed by accessor ID
+
+	// Synced is the whole config and live state the last run left in sync,
+	// for apply -skip-unchanged.
+	Synced *syncedEntry `json:"synced,omitempty"`
+
+	// Encryption, when it has recipients, encrypts the file Save writes.
+	Encryption config.Encryption `json:"-"`
+}
+
+type stateEntry struct {
+	Hash    string `json:"hash"`
+	Desired string `json:"desired"`
+	// Links fingerprints the policy and role links of a token as Consul
+	// resolved them, IDs and names. Its Hash covers the links by name only,
+	// so it stays the same when a linked policy is deleted and recreated.
+	Links string `json:"links,omitempty"`
+}
+
+type syncedEntry struct {
+	Config string `json:"config"`
+	Live   string `json:"live"`
+}
+
+// LoadState reads the state file. A missing file is an empty state.
+func LoadState(path string) (*State, error) {
+	s := &State{Policies: map[string]stateEntry{}, Tokens: map[string]stateEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	if data, err = config.Decrypt("state "+path, data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state %s: %w", path, err)
+	}
+	if s.Policies == nil {
+		s.Policies = map[string]stateEntry{}
+	}
+	if s.Tokens == nil {
+		s.Tokens = map[string]stateEntry{}
+	}
+	return s, nil
+}
+
+// Save writes the state atomically, so an interrupted run never leaves a
+// truncated file behind, readable by the current user only, and encrypted if
+// s.Encryption says so.
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = s.Encryption.Encrypt(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	if err := secrets.WriteFile(path, data); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	return nil
+}
+
+// policyUnchanged reports whether the policy was in sync at hash last run and
+// its config has not changed since. A nil state or empty hash never matches.
+func (s *State) policyUnchanged(hash string, desired config.Policy) bool {
+	if s == nil || hash == "" {
+		return false
+	}
+	e, ok := s.Policies[desired.Key()]
+	return ok && e.Hash == hash && e.Desired == policyFingerprint(desired)
+}
+
+// tokenUnchanged is policyUnchanged for tokens, which must also still link
+// the same policies and roles, by ID, as last run.
+func (s *State) tokenUnchanged(current consul.Token, desired config.Token) bool {
+	if s == nil || current.Hash == "" {
+		return false
+	}
+	e, ok := s.Tokens[desired.AccessorID]
+	return ok && e.Hash == current.Hash && e.Desired == tokenFingerprint(desired) && e.Links == linkFingerprint(current)
+}
+
+// recordPolicy marks the policy in sync at hash, or forgets it when hash is
+// empty because it is about to change.
+func (s *State) recordPolicy(hash string, desired config.Policy) {
+	if s == nil {
+		return
+	}
+	if hash == "" {
+		delete(s.Policies, desired.Key())
+		return
+	}
+	s.Policies[desired.Key()] = stateEntry{Hash: hash, Desired: policyFingerprint(desired)}
+}
+
+// recordToken marks the token in sync as current, or forgets it when current
+// has no hash because it is missing or about to change.
+func (s *State) recordToken(current consul.Token, desired config.Token) {
+	if s == nil {
+		return
+	}
+	if current.Hash == "" {
+		delete(s.Tokens, desired.AccessorID)
+		return
+	}
+	s.Tokens[desired.AccessorID] = stateEntry{Hash: current.Hash, Desired: tokenFingerprint(desired), Links: linkFingerprint(current)}
+}
+
+// Unchanged reports whether the config and the live state, as fingerprinted
+// by LiveFingerprint, are both what they were when RecordSynced was last
+// called, in which case there is nothing to do.
+func (s *State) Unchanged(cfg *config.Config, live string) bool {
+	return s != nil && s.Synced != nil && s.Synced.Live == live && s.Synced.Config == configFingerprint(cfg)
+}
+
+// RecordSynced marks the config in sync with the live state live.
+func (s *State) RecordSynced(cfg *config.Config, live string) {
+	if s == nil {
+		return
+	}
+	s.Synced = &syncedEntry{Config: configFingerprint(cfg), Live: live}
+}
+
+// LiveFingerprint hashes the ID and Hash of every policy, role and token, and
+// the modify index of every auth method, managed or not, from the list
+// endpoints. Consul changes them whenever it stores a new version, so any
+// change in the cluster changes it. Partitions and namespaces are only
+// included when cfg declares some, Community Edition having no API for them.
+func LiveFingerprint(api consul.API, cfg *config.Config) (string, error) {
+	var partitions []consul.Partition
+	if len(cfg.AdminPartitions) > 0 {
+		var err error
+		if partitions, err = api.ListPartitions(); err != nil {
+			return "", fmt.Errorf("failed to list partitions: %w", err)
+		}
+	}
+	policies, err := api.ListPolicies()
+	if err != nil {
+		return "", fmt.Errorf("failed to list policies: %w", err)
+	}
+	roles, err := api.ListRoles()
+	if err != nil {
+		return "", fmt.Errorf("failed to list roles: %w", err)
+	}
+	tokens, err := api.ListTokens()
+	if err != nil {
+		return "", fmt.Errorf("failed to list tokens: %w", err)
+	}
+	methods, err := api.ListAuthMethods()
+	if err != nil {
+		return "", fmt.Errorf("failed to list auth methods: %w", err)
+	}
+	entries := make([]string, 0, len(policies)+len(roles)+len(tokens)+len(methods))
+	for _, p := range policies {
+		entries = append(entries, "policy "+p.ID+" "+p.Hash)
+	}
+	for _, r := range roles {
+		entries = append(entries, "role "+r.ID+" "+r.Hash)
+	}
+	for _, t := range tokens {
+		entries = append(entries, "token "+t.AccessorID+" "+t.Hash)
+	}
+	for _, m := range methods {
+		entries = append(entries, fmt.Sprintf("auth-method %s %d", liveAuthMethodKey(m), m.ModifyIndex))
+	}
+	for _, p := range partitions {
+		entries = append(entries, fmt.Sprintf("partition %s %d", p.Name, p.ModifyIndex))
+	}
+	if len(cfg.Namespaces) > 0 {
+		namespaces, err := api.ListNamespaces()
+		if err != nil {
+			return "", fmt.Errorf("failed to list namespaces: %w", err)
+		}
+		for _, n := range namespaces {
+			entries = append(entries, fmt.Sprintf("namespace %s %d", config.Namespace{Name: n.Name, Partition: n.Partition}.Key(), n.ModifyIndex))
+		}
+	}
+	sort.Strings(entries)
+	return fingerprint(entries), nil
+}
+
+// configFingerprint combines the fingerprints of every desired resource.
+func configFingerprint(cfg *config.Config) string {
+	entries := make([]string, 0, len(cfg.AdminPartitions)+len(cfg.Namespaces)+len(cfg.Policies)+len(cfg.Roles)+len(cfg.Tokens)+len(cfg.AuthMethods))
+	for _, p := range cfg.AdminPartitions {
+		entries = append(entries, "partition "+fingerprint(p.Name, partitionValues{Description: p.Description}))
+	}
+	for _, n := range cfg.Namespaces {
+		entries = append(entries, "namespace "+fingerprint(n.Key(), desiredNamespaceValues(n)))
+	}
+	for _, p := range cfg.Policies {
+		entries = append(entries, "policy "+policyFingerprint(p))
+	}
+	for _, r := range cfg.Roles {
+		v := desiredRoleValues(r)
+		entries = append(entries, "role "+fingerprint(r.Key(), v))
+	}
+	for _, t := range cfg.Tokens {
+		entries = append(entries, "token "+tokenFingerprint(t))
+	}
+	for _, m := range cfg.AuthMethods {
+		entries = append(entries, "auth-method "+fingerprint(m.Key(), desiredAuthMethodValues(m)))
+	}
+	// Fields no longer ignored may differ, so changing them is a change.
+	if f := cfg.IgnoreFields; len(f.Policies)+len(f.Roles)+len(f.Tokens)+len(f.AuthMethods)+len(f.Namespaces)+len(f.Partitions) > 0 {
+		entries = append(entries, "ignore_fields "+fingerprint(f))
+	}
+	sort.Strings(entries)
+	return fingerprint(entries)
+}
+
+// policyFingerprint hashes the compared fields of a desired policy in the same
+// normalized form the planner compares them in.
+func policyFingerprint(p config.Policy) string {
+	dcs := append([]string(nil), p.Datacenters...)
+	sort.Strings(dcs)
+	return fingerprint(p.Name, p.Description, canonicalRules(p.Rules), dcs)
+}
+
+// tokenFingerprint leaves out the SecretID: it is only sent on create, and it
+// must not be written to disk. Role links only count when there are any, so
+// tokens without keep the fingerprint they had before roles were managed.
+func tokenFingerprint(t config.Token) string {
+	policies := append([]string(nil), t.Policies...)
+	sort.Strings(policies)
+	if len(t.Roles) == 0 {
+		return fingerprint(t.AccessorID, t.Description, policies)
+	}
+	return fingerprint(t.AccessorID, t.Description, policies, sortedCopy(t.Roles))
+}
+
+// linkFingerprint fingerprints the resolved policy and role links of t.
+func linkFingerprint(t consul.Token) string {
+	var policies, roles []string
+	for _, l := range t.Policies {
+		policies = append(policies, l.ID+" "+l.Name)
+	}
+	for _, l := range t.Roles {
+		roles = append(roles, l.ID+" "+l.Name)
+	}
+	sort.Strings(policies)
+	sort.Strings(roles)
+	return fingerprint(policies, roles)
+}
+
+func fingerprint(fields ...interface{}) string {
+	b, _ := json.Marshal(fields)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
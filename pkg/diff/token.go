@@ -0,0 +1,259 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// tokenKind manages ACL tokens, keyed by accessor ID.
+type tokenKind struct{}
+
+func (tokenKind) Name() string   { return "token" }
+func (tokenKind) Plural() string { return "tokens" }
+
+func (tokenKind) Plan(api consul.API, cfg *config.Config, state *State, plan *Plan, _ Progress) error {
+	// The list entries carry the description and policy links, everything
+	// compared, so tokens take one request however many there are.
+	consulTokens, err := api.ListTokens()
+	if err != nil {
+		return fmt.Errorf("failed to list tokens: %w", err)
+	}
+	byAccessor := make(map[string]consul.Token, len(consulTokens))
+	for _, t := range consulTokens {
+		byAccessor[t.AccessorID] = t
+	}
+
+	now := time.Now()
+	for _, desired := range cfg.Tokens {
+		current, ok := byAccessor[desired.AccessorID]
+		if !ok {
+			state.recordToken(consul.Token{}, desired)
+			plan.TokensToCreate = append(plan.TokensToCreate, desired)
+			continue
+		}
+		if exp := current.ExpirationTime; exp != nil && !exp.After(now) {
+			// Consul reaps expired tokens only eventually; until then one
+			// is listed but no longer works, as good as missing. It is
+			// recreated, without an expiration, as a missing one would be.
+			state.recordToken(consul.Token{}, desired)
+			plan.TokensToReplace = append(plan.TokensToReplace, TokenUpdate{Current: current, Desired: desired,
+				Reason: "expired at " + exp.UTC().Format(time.RFC3339)})
+			continue
+		}
+		if desired.SecretGenerated {
+			// The token exists but its secret was never stored, so it cannot
+			// be recovered. Minting a new one would not change the token.
+			return fmt.Errorf("token %s exists in Consul but has no secret at %s", desired.AccessorID, desired.SecretPath)
+		}
+		desired = ignoreTokenFields(cfg.IgnoreFields, current, desired)
+		if state.tokenUnchanged(current, desired) {
+			continue
+		}
+		if TokenNeedsUpdate(current, desired) {
+			state.recordToken(consul.Token{}, desired)
+			plan.TokensToUpdate = append(plan.TokensToUpdate, TokenUpdate{Current: current, Desired: desired})
+			continue
+		}
+		state.recordToken(current, desired)
+	}
+	return nil
+}
+
+func (tokenKind) Steps(plan *Plan) []Step {
+	tenanted := plan.Tenanted()
+	var steps []Step
+	for _, t := range plan.TokensToCreate {
+		detail := []string{
+			"description: " + quote(t.Description),
+			fmt.Sprintf("policies: %v", t.Policies),
+		}
+		if len(t.Roles) > 0 {
+			detail = append(detail, fmt.Sprintf("roles: %v", t.Roles))
+		}
+		steps = append(steps, Step{
+			Kind:   "token",
+			Node:   config.TokenNode(t),
+			Action: "create",
+			Label:  tokenLabel(t, tenanted),
+			Secret: t.SecretID,
+			Item:   Item{Title: "+ token " + tokenLabel(t, tenanted), Detail: detail, Group: group(t.Tenancy, tenanted)},
+			Change: Change{Action: "create", Type: "token", Name: t.AccessorID,
+				After: desiredTokenValues(t).sorted()},
+			Do: func(api consul.API, store secrets.Store) error {
+				if err := secrets.StoreSecret(store, t); err != nil {
+					return fmt.Errorf("failed to store secret for token %s: %w", t.AccessorID, err)
+				}
+				return api.CreateToken(t)
+			},
+		})
+	}
+
+	for _, u := range plan.TokensToUpdate {
+		detail := tokenDetail(
+			liveTokenValues(u.Current),
+			desiredTokenValues(u.Desired))
+		steps = append(steps, Step{
+			Kind:   "token",
+			Node:   config.TokenNode(u.Desired),
+			Action: "update",
+			Label:  tokenLabel(u.Desired, tenanted),
+			Item:   Item{Title: "~ token " + tokenLabel(u.Desired, tenanted), Detail: detail, Group: group(u.Desired.Tenancy, tenanted)},
+			Change: Change{Action: "update", Type: "token", Name: u.Desired.AccessorID,
+				Before:  liveTokenValues(u.Current).sorted(),
+				After:   desiredTokenValues(u.Desired).sorted(),
+				Reasons: reasons(detail)},
+			Do: func(api consul.API, _ secrets.Store) error { return api.UpdateToken(u.Desired) },
+		})
+	}
+
+	for _, u := range plan.TokensToReplace {
+		t := u.Desired
+		secret := "secret: the secret_id of the config"
+		switch {
+		case t.SecretGenerated:
+			secret = "secret: newly generated, stored at " + t.SecretPath
+		case t.SecretPath != "":
+			secret = "secret: the one stored at " + t.SecretPath
+		}
+		differ := tokenDetail(liveTokenValues(u.Current), desiredTokenValues(t))
+		detail := append(append([]string(nil), differ...), u.Reason+": deleted and created again", secret)
+		detail = append(detail, droppedTokenFields(u)...)
+		steps = append(steps, Step{
+			Kind:   "token",
+			Node:   config.TokenNode(t),
+			Action: "replace",
+			Label:  tokenLabel(t, tenanted),
+			Secret: t.SecretID,
+			Item:   Item{Title: "-/+ token " + tokenLabel(t, tenanted), Detail: detail, Group: group(t.Tenancy, tenanted)},
+			Change: Change{Action: "replace", Type: "token", Name: t.AccessorID,
+				Before:  liveTokenValues(u.Current).sorted(),
+				After:   desiredTokenValues(t).sorted(),
+				Reasons: reasons(differ)},
+			Do: func(api consul.API, store secrets.Store) error {
+				// Store the new secret first: should the create fail after
+				// the delete, the next run creates the token with it.
+				if err := secrets.StoreSecret(store, t); err != nil {
+					return fmt.Errorf("failed to store secret for token %s: %w", t.AccessorID, err)
+				}
+				if err := api.DeleteToken(t.AccessorID); err != nil {
+					return err
+				}
+				return api.CreateToken(t)
+			},
+		})
+	}
+	return steps
+}
+
+// tokenDetail describes the managed fields that differ between two versions
+// of a token.
+func tokenDetail(before, after tokenValues) []string {
+	var detail []string
+	if before.Description != after.Description {
+		detail = append(detail, fmt.Sprintf("description: %s -> %s", quote(before.Description), quote(after.Description)))
+	}
+	if !stringSetEqual(before.Policies, after.Policies) {
+		detail = append(detail, fmt.Sprintf("policies: %v -> %v", before.Policies, after.Policies))
+	}
+	if !stringSetEqual(before.Roles, after.Roles) {
+		detail = append(detail, fmt.Sprintf("roles: %v -> %v", before.Roles, after.Roles))
+	}
+	return detail
+}
+
+// droppedTokenFields warns about what the live token has that the config
+// does not model. Updates keep it, but a replaced token is created again
+// from the config alone.
+func droppedTokenFields(u TokenUpdate) []string {
+	var lost []string
+	var si, ni, tp []string
+	for _, s := range u.Current.ServiceIdentities {
+		si = append(si, withDatacenters(s.ServiceName, s.Datacenters))
+	}
+	for _, n := range u.Current.NodeIdentities {
+		ni = append(ni, n.NodeName+" in "+n.Datacenter)
+	}
+	for _, p := range u.Current.TemplatedPolicies {
+		var name string
+		if p.TemplateVariables != nil {
+			name = p.TemplateVariables.Name
+		}
+		tp = append(tp, templatedPolicy(p.TemplateName, name, p.Datacenters))
+	}
+	for _, attr := range (roleValues{ServiceIdentities: si, NodeIdentities: ni, TemplatedPolicies: tp}).identities() {
+		if len(attr.values) > 0 {
+			lost = append(lost, fmt.Sprintf("%s %v", attr.name, attr.values))
+		}
+	}
+	if exp := u.Current.ExpirationTime; exp != nil && u.Reason == onRequest {
+		lost = append(lost, "expiration at "+exp.UTC().Format(time.RFC3339))
+	}
+	if u.Current.Local {
+		lost = append(lost, "local to its datacenter")
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	return []string{"warning: created again, the token loses what the config does not model: " + strings.Join(lost, "; ")}
+}
+
+func desiredTokenValues(t config.Token) tokenValues {
+	return tokenValues{Description: t.Description, Policies: t.Policies, Roles: t.Roles}
+}
+
+func liveTokenValues(t consul.Token) tokenValues {
+	return tokenValues{Description: t.Description, Policies: t.PolicyNames(), Roles: t.RoleNames()}
+}
+
+// tokenLabel names t in plan output: fully qualified in a tenanted plan.
+func tokenLabel(t config.Token, tenanted bool) string {
+	if tenanted {
+		return t.Tenancy.Qualify(t.Label())
+	}
+	return t.Label()
+}
+
+func (tokenKind) Verify(api consul.API, plan *Plan, _ Progress) ([]string, error) {
+	tokens := append([]config.Token(nil), plan.TokensToCreate...)
+	for _, u := range plan.TokensToUpdate {
+		tokens = append(tokens, u.Desired)
+	}
+	for _, u := range plan.TokensToReplace {
+		tokens = append(tokens, u.Desired)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	live, err := api.ListTokens()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	byAccessor := make(map[string]consul.Token, len(live))
+	for _, t := range live {
+		byAccessor[t.AccessorID] = t
+	}
+	var differ []string
+	for _, desired := range tokens {
+		current, ok := byAccessor[desired.AccessorID]
+		if !ok {
+			differ = append(differ, fmt.Sprintf("token %s is missing", desired.Label()))
+			continue
+		}
+		if TokenNeedsUpdate(current, desired) {
+			differ = append(differ, fmt.Sprintf("token %s still differs", desired.Label()))
+		}
+	}
+	return differ, nil
+}
+
+// TokenNeedsUpdate reports whether the live token differs from the config in
+// its description, policy links or role links.
+func TokenNeedsUpdate(current consul.Token, desired config.Token) bool {
+	return len(tokenDetail(liveTokenValues(current), desiredTokenValues(desired))) > 0
+}
@@ -0,0 +1,297 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// awsStore keeps secrets in AWS Secrets Manager or SSM Parameter Store. Each
+// path holds a JSON object of fields; a plain string value is returned for any
+// field, so an existing secret holding just the management token works as is.
+type awsStore struct {
+	service  string // "secretsmanager" or "ssm"
+	region   string
+	endpoint string
+	creds    func() (awsCredentials, error)
+	client   *http.Client
+}
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+func newAWSStore(cfg config.AWSConfig) (*awsStore, error) {
+	service := cfg.Service
+	if service == "" {
+		service = "secretsmanager"
+	}
+	if service != "secretsmanager" && service != "ssm" {
+		return nil, fmt.Errorf("aws.service must be secretsmanager or ssm, got %q", service)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("aws region is not set; use aws.region or AWS_REGION")
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	return &awsStore{
+		service:  service,
+		region:   region,
+		endpoint: strings.TrimRight(endpoint, "/"),
+		creds:    func() (awsCredentials, error) { return loadAWSCredentials(client) },
+		client:   client,
+	}, nil
+}
+
+func (a *awsStore) Get(path, field string) (string, bool, error) {
+	var value string
+	switch a.service {
+	case "secretsmanager":
+		var out struct {
+			SecretString string `json:"SecretString"`
+		}
+		found, err := a.call("secretsmanager.GetSecretValue", map[string]interface{}{"SecretId": path}, &out)
+		if err != nil || !found {
+			return "", false, err
+		}
+		value = out.SecretString
+	case "ssm":
+		var out struct {
+			Parameter struct {
+				Value string `json:"Value"`
+			} `json:"Parameter"`
+		}
+		found, err := a.call("AmazonSSM.GetParameter", map[string]interface{}{"Name": path, "WithDecryption": true}, &out)
+		if err != nil || !found {
+			return "", false, err
+		}
+		value = out.Parameter.Value
+	}
+
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return value, true, nil
+	}
+	v, ok := fields[field]
+	return v, ok, nil
+}
+
+func (a *awsStore) Put(path string, fields map[string]string) error {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	value := string(b)
+
+	switch a.service {
+	case "secretsmanager":
+		found, err := a.call("secretsmanager.PutSecretValue", map[string]interface{}{"SecretId": path, "SecretString": value}, nil)
+		if err != nil || found {
+			return err
+		}
+		_, err = a.call("secretsmanager.CreateSecret", map[string]interface{}{"Name": path, "SecretString": value}, nil)
+		return err
+	default:
+		_, err := a.call("AmazonSSM.PutParameter", map[string]interface{}{
+			"Name": path, "Value": value, "Type": "SecureString", "Overwrite": true,
+		}, nil)
+		return err
+	}
+}
+
+// call invokes an AWS JSON 1.1 API action. found is false when AWS reports the
+// secret or parameter does not exist.
+func (a *awsStore) call(target string, body, out interface{}) (found bool, err error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+
+	creds, err := a.creds()
+	if err != nil {
+		return false, err
+	}
+	signAWSRequest(req, payload, creds, a.region, a.service, time.Now().UTC())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("aws request %s failed: %w", target, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(b, &apiErr)
+		if strings.HasSuffix(apiErr.Type, "ResourceNotFoundException") || strings.HasSuffix(apiErr.Type, "ParameterNotFound") {
+			return false, nil
+		}
+		return false, fmt.Errorf("aws %s returned %d: %s", target, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return true, json.Unmarshal(b, out)
+	}
+	return true, nil
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header.
+func signAWSRequest(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// loadAWSCredentials follows the usual lookup order for the environments this
+// backend targets: static environment variables, then the ECS task role, then
+// the EC2 instance profile via IMDSv2.
+func loadAWSCredentials(client *http.Client) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		var creds awsCredentials
+		err := getJSON(client, "http://169.254.170.2"+uri, nil, &creds)
+		return creds, err
+	}
+
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials in the environment and instance metadata is unreachable: %w", err)
+	}
+	tokenBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(tokenBytes)}}
+
+	roleURL := imds + "/meta-data/iam/security-credentials/"
+	role, err := getText(client, roleURL, header)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsCredentials
+	err = getJSON(client, roleURL+url.PathEscape(strings.TrimSpace(role)), header, &creds)
+	return creds, err
+}
+
+func getText(client *http.Client, u string, header http.Header) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s returned %d", u, resp.StatusCode)
+	}
+	return string(b), nil
+}
+
+func getJSON(client *http.Client, u string, header http.Header, out interface{}) error {
+	text, err := getText(client, u, header)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(text), out)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data, which holds secrets or what leads to them, to path
+// so that only the current user can read it: mode 0600 on Unix, and on
+// Windows an access list granting that user alone. A regular file is
+// replaced through a temporary file in the same directory, so it is never
+// left half written and never keeps the wider permissions of an older copy.
+// A named pipe or a device, such as /dev/stdout or \\.\pipe\name on Windows,
+// is written in place, its access being the business of whoever made it.
+func WriteFile(path string, data []byte) error {
+	if isPipe(path) {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// Restricted before anything is written, so the data is never readable
+	// by others, even for a moment.
+	if err := Restrict(tmp.Name()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// isPipe reports whether path is a named pipe or a device rather than a file
+// that can be replaced.
+func isPipe(path string) bool {
+	if isPipePath(path) {
+		return true
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&(os.ModeNamedPipe|os.ModeCharDevice) != 0
+}
+
+func restrictError(path string, err error) error {
+	return fmt.Errorf("failed to restrict access to %s: %w", path, err)
+}
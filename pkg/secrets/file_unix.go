@@ -0,0 +1,15 @@
+//go:build !windows
+
+package secrets
+
+import "os"
+
+// Restrict makes path readable and writable by its owner only.
+func Restrict(path string) error {
+	if err := os.Chmod(path, 0o600); err != nil {
+		return restrictError(path, err)
+	}
+	return nil
+}
+
+func isPipePath(string) bool { return false }
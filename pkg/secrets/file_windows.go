@@ -0,0 +1,29 @@
+package secrets
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+// Restrict makes path accessible to the current user only. Windows ignores
+// Unix modes, so icacls replaces the inherited access list with one entry
+// granting the user, named by SID, full control.
+func Restrict(path string) error {
+	u, err := user.Current()
+	if err != nil {
+		return restrictError(path, err)
+	}
+	out, err := exec.Command("icacls", path, "/inheritance:r", "/grant:r", "*"+u.Uid+":(F)").CombinedOutput()
+	if err != nil {
+		return restrictError(path, fmt.Errorf("icacls: %w: %s", err, strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// isPipePath reports whether path names a named pipe, which Stat cannot
+// always tell.
+func isPipePath(path string) bool {
+	return strings.HasPrefix(path, `\\.\pipe\`) || strings.HasPrefix(path, `//./pipe/`)
+}
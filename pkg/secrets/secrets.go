@@ -0,0 +1,189 @@
+// Package secrets reads and writes token secrets in an external backend and
+// keeps them out of output.
+package secrets
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// Store is an external secrets backend. It supplies the management
+// token and holds token SecretIDs so they never have to be written into the
+// config file.
+type Store interface {
+	// Get returns the named field at path. ok is false when the path or the
+	// field does not exist.
+	Get(path, field string) (value string, ok bool, err error)
+	// Put writes fields to path, replacing what was there.
+	Put(path string, fields map[string]string) error
+}
+
+// New returns the backend selected by secrets_backend, or nil when
+// none is configured.
+func New(cfg *config.Config) (Store, error) {
+	switch cfg.SecretsBackend {
+	case "":
+		return nil, nil
+	case "vault":
+		return newVaultStore(cfg.Vault)
+	case "aws":
+		return newAWSStore(cfg.AWS)
+	default:
+		return nil, fmt.Errorf("unknown secrets_backend %q", cfg.SecretsBackend)
+	}
+}
+
+// ManagementToken reads the Consul token the tool itself runs with from the
+// secrets backend.
+func ManagementToken(store Store, path string) (string, error) {
+	token, ok, err := store.Get(path, "token")
+	if err != nil {
+		return "", fmt.Errorf("failed to read management token: %w", err)
+	}
+	if !ok {
+		return "", fmt.Errorf("management token not found at %s", path)
+	}
+	return token, nil
+}
+
+// Resolve fills in the SecretID of every token that keeps it in the
+// secrets backend. A token whose secret is not stored yet gets a fresh one,
+// which apply writes back before creating the token.
+func Resolve(store Store, cfg *config.Config) error {
+	for i := range cfg.Tokens {
+		t := &cfg.Tokens[i]
+		if t.SecretPath == "" {
+			continue
+		}
+		secret, ok, err := store.Get(t.SecretPath, "secret_id")
+		if err != nil {
+			return fmt.Errorf("failed to read secret for token %s: %w", t.AccessorID, err)
+		}
+		if ok {
+			t.SecretID = secret
+			continue
+		}
+		if t.SecretID, err = NewUUID(); err != nil {
+			return err
+		}
+		t.SecretGenerated = true
+	}
+	return nil
+}
+
+// Regenerate gives a token that keeps its secret in the backend a fresh one,
+// for apply -replace to recreate it with. Like a secret Resolve generates, it
+// is written back before the token is created. A token with an inline
+// secret_id keeps it: the config is where it is rotated.
+func Regenerate(t *config.Token) error {
+	if t.SecretPath == "" {
+		return nil
+	}
+	secret, err := NewUUID()
+	if err != nil {
+		return err
+	}
+	t.SecretID, t.SecretGenerated = secret, true
+	return nil
+}
+
+// StoreSecret writes a generated SecretID to the backend. It runs before the
+// token is created, so a failed create leaves the secret in place for the
+// next run to reuse instead of minting a token nobody can recover.
+func StoreSecret(store Store, t config.Token) error {
+	if !t.SecretGenerated {
+		return nil
+	}
+	return store.Put(t.SecretPath, map[string]string{
+		"accessor_id": t.AccessorID,
+		"secret_id":   t.SecretID,
+	})
+}
+
+// NewUUID returns a random version 4 UUID, the format Consul expects for
+// AccessorID and SecretID.
+func NewUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Redactor masks every known secret in text bound for the terminal, so a
+// SecretID echoed back in a Consul error never reaches CI logs. show disables
+// masking for -show-secrets.
+type Redactor struct {
+	secrets []string
+	show    bool
+}
+
+// NewRedactor collects the token SecretIDs and auth method credentials from
+// cfg plus any extra secrets, such as the management token.
+func NewRedactor(cfg *config.Config, show bool, extra ...string) *Redactor {
+	r := &Redactor{show: show}
+	for _, t := range cfg.Tokens {
+		r.Add(t.SecretID)
+	}
+	for _, m := range cfg.AuthMethods {
+		for k, v := range m.Config {
+			if s, ok := v.(string); ok && config.CredentialKey(k) {
+				r.Add(s)
+			}
+		}
+	}
+	for _, s := range extra {
+		r.Add(s)
+	}
+	return r
+}
+
+// Add masks secret too, e.g. one generated after the redactor was made.
+func (r *Redactor) Add(secret string) {
+	if secret != "" {
+		r.secrets = append(r.secrets, secret)
+	}
+}
+
+// String masks secrets in s.
+func (r *Redactor) String(s string) string {
+	if r == nil || r.show {
+		return s
+	}
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, config.Redacted)
+	}
+	return s
+}
+
+// Error masks secrets in err's message. The chain is not preserved, so it is
+// meant for errors about to be printed.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
+
+// Shows reports whether the operator asked to see secrets.
+func (r *Redactor) Shows() bool {
+	return r != nil && r.show
+}
+
+// SecretLabel shows a SecretID only when the operator asked for it.
+func (r *Redactor) SecretLabel(secret string) string {
+	if r.Shows() {
+		return secret
+	}
+	return config.Redacted
+}
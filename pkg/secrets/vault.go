@@ -0,0 +1,179 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// vaultStore reads and writes secrets through the Vault HTTP API. Paths are
+// full API paths without the /v1 prefix, so both KV engines and the Consul
+// secrets engine work: secret/data/consul/web (KV v2), kv/consul/web (KV v1),
+// consul/creds/acl-sync (Consul secrets engine, read only).
+type vaultStore struct {
+	addr      string
+	token     string
+	namespace string
+	// kvVersion is the KV engine version of every path, or 0 to look up
+	// the engine of each mount.
+	kvVersion int
+	client    *http.Client
+
+	mu sync.Mutex
+	// mounts caches the KV version of the mounts looked up, by their path
+	// with a trailing slash.
+	mounts map[string]int
+}
+
+// newVaultStore builds a client from the vault config block, falling back to
+// the VAULT_ADDR, VAULT_TOKEN and VAULT_NAMESPACE variables the vault CLI uses.
+// The Vault token is only ever read from the environment.
+func newVaultStore(cfg config.VaultConfig) (*vaultStore, error) {
+	addr := cfg.Address
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("vault address is not set; use vault.address or VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is not set")
+	}
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if cfg.KVVersion != 0 && cfg.KVVersion != 1 && cfg.KVVersion != 2 {
+		return nil, fmt.Errorf("vault.kv_version must be 1 or 2, got %d", cfg.KVVersion)
+	}
+	return &vaultStore{
+		addr:      strings.TrimRight(addr, "/"),
+		token:     token,
+		namespace: namespace,
+		kvVersion: cfg.KVVersion,
+		client:    &http.Client{},
+		mounts:    make(map[string]int),
+	}, nil
+}
+
+func (v *vaultStore) Get(path, field string) (string, bool, error) {
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	found, err := v.do(http.MethodGet, path, nil, &resp)
+	if err != nil || !found {
+		return "", false, err
+	}
+
+	data := resp.Data
+	version, err := v.version(path)
+	if err != nil {
+		return "", false, err
+	}
+	// KV v2 nests the secret one level deeper, next to its metadata.
+	if version == 2 {
+		data, _ = data["data"].(map[string]interface{})
+	}
+	value, ok := data[field].(string)
+	return value, ok, nil
+}
+
+func (v *vaultStore) Put(path string, fields map[string]string) error {
+	version, err := v.version(path)
+	if err != nil {
+		return err
+	}
+	var body interface{} = fields
+	if version == 2 {
+		body = map[string]interface{}{"data": fields}
+	}
+	_, err = v.do(http.MethodPost, path, body, nil)
+	return err
+}
+
+// version returns the KV engine version of path: vault.kv_version when it is
+// set, and otherwise that of its mount, as Vault describes it. Engines other
+// than KV take and return the fields as they are, like KV v1.
+func (v *vaultStore) version(path string) (int, error) {
+	if v.kvVersion != 0 {
+		return v.kvVersion, nil
+	}
+	path = strings.TrimLeft(path, "/")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for mount, version := range v.mounts {
+		if strings.HasPrefix(path, mount) {
+			return version, nil
+		}
+	}
+	var resp struct {
+		Data struct {
+			Path    string            `json:"path"`
+			Type    string            `json:"type"`
+			Options map[string]string `json:"options"`
+		} `json:"data"`
+	}
+	found, err := v.do(http.MethodGet, "sys/internal/ui/mounts/"+path, nil, &resp)
+	if err == nil && !found {
+		err = errors.New("no secrets engine is mounted there")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up the secrets engine of %s, which vault.kv_version would skip: %w", path, err)
+	}
+	version := 1
+	if resp.Data.Type == "kv" && resp.Data.Options["version"] == "2" {
+		version = 2
+	}
+	v.mounts[strings.TrimSuffix(resp.Data.Path, "/")+"/"] = version
+	return version, nil
+}
+
+// do calls the Vault API. found is false on 404, which Vault returns for a
+// path with no secret.
+func (v *vaultStore) do(method, path string, body, out interface{}) (found bool, err error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, v.addr+"/v1/"+strings.TrimLeft(path, "/"), reader)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("vault request to %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("vault %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return true, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return true, nil
+}
@@ -0,0 +1,175 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// fakeVault serves a KV v2 engine at secret/, a KV v1 engine at kv/ and a
+// Consul secrets engine at consul/, keeping what is written in memory.
+type fakeVault struct {
+	mu       sync.Mutex
+	secrets  map[string]map[string]interface{}
+	requests []string
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *vaultStore) {
+	f := &fakeVault{secrets: map[string]map[string]interface{}{
+		"consul/creds/acl-sync": {"token": "management"},
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("VAULT_TOKEN", "vault-token")
+	t.Setenv("VAULT_NAMESPACE", "")
+	v, err := newVaultStore(config.VaultConfig{Address: srv.URL + "/", Namespace: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, v
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("X-Vault-Token") != "vault-token" || r.Header.Get("X-Vault-Namespace") != "team" {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if mount, ok := strings.CutPrefix(path, "sys/internal/ui/mounts/"); ok {
+		for prefix, engine := range map[string]string{
+			"secret/": `{"path":"secret/","type":"kv","options":{"version":"2"}}`,
+			"kv/":     `{"path":"kv/","type":"kv","options":{"version":"1"}}`,
+			"consul/": `{"path":"consul/","type":"consul","options":null}`,
+		} {
+			if strings.HasPrefix(mount, prefix) {
+				_, _ = w.Write([]byte(`{"data":` + engine + `}`))
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := f.secrets[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	case http.MethodPost:
+		var data map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(path, "secret/data/") {
+			// KV v2 keeps the fields next to the version's metadata.
+			data = map[string]interface{}{"data": data["data"], "metadata": map[string]interface{}{"version": 1}}
+		}
+		f.secrets[path] = data
+	}
+}
+
+// count returns how many times request, e.g. "GET /v1/kv/x", was sent.
+func (f *fakeVault) count(request string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func TestVaultStore(t *testing.T) {
+	f, v := newFakeVault(t)
+
+	for _, path := range []string{
+		"secret/data/consul/web",
+		"secret/data/consul/db",
+		"kv/consul/web",
+		// A KV v1 path that happens to have a data segment.
+		"kv/data/consul/web",
+	} {
+		if err := v.Put(path, map[string]string{"secret_id": "id of " + path}); err != nil {
+			t.Fatalf("Put %s: %v", path, err)
+		}
+		got, ok, err := v.Get(path, "secret_id")
+		if err != nil || !ok || got != "id of "+path {
+			t.Errorf("Get %s = %q, %v, %v; want %q", path, got, ok, err, "id of "+path)
+		}
+	}
+	if _, wrapped := f.secrets["secret/data/consul/web"]["data"]; !wrapped {
+		t.Errorf("KV v2 secret stored as %v, want its fields under data", f.secrets["secret/data/consul/web"])
+	}
+	if _, wrapped := f.secrets["kv/data/consul/web"]["data"]; wrapped {
+		t.Errorf("KV v1 secret stored as %v, want its fields as they are", f.secrets["kv/data/consul/web"])
+	}
+
+	token, err := ManagementToken(v, "consul/creds/acl-sync")
+	if err != nil || token != "management" {
+		t.Errorf("ManagementToken = %q, %v; want %q", token, err, "management")
+	}
+
+	// Each mount is looked up once.
+	for _, mount := range []string{"secret/data/consul/web", "kv/consul/web", "consul/creds/acl-sync"} {
+		if n := f.count("GET /v1/sys/internal/ui/mounts/" + mount); n != 1 {
+			t.Errorf("looked up the mount of %s %d times, want once", mount, n)
+		}
+	}
+	if n := f.count("GET /v1/sys/internal/ui/mounts/secret/data/consul/db"); n != 0 {
+		t.Errorf("looked up the mount of secret/data/consul/db %d times, want none, as secret/ is known", n)
+	}
+
+	if _, ok, err := v.Get("secret/data/consul/missing", "secret_id"); ok || err != nil {
+		t.Errorf("Get of a missing secret = %v, %v; want not found", ok, err)
+	}
+	if err := v.Put("nowhere/x", map[string]string{"secret_id": "x"}); err == nil || !strings.Contains(err.Error(), "vault.kv_version") {
+		t.Errorf("Put to an unmounted path = %v, want an error pointing at vault.kv_version", err)
+	}
+}
+
+func TestVaultStoreKVVersion(t *testing.T) {
+	f, _ := newFakeVault(t)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	v, err := newVaultStore(config.VaultConfig{Address: srv.URL, Namespace: "team", KVVersion: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Put("secret/data/consul/web", map[string]string{"secret_id": "s"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, err := v.Get("secret/data/consul/web", "secret_id"); err != nil || !ok || got != "s" {
+		t.Errorf("Get = %q, %v, %v; want %q", got, ok, err, "s")
+	}
+	for _, r := range f.requests {
+		if strings.Contains(r, "/sys/") {
+			t.Errorf("sent %s with vault.kv_version set", r)
+		}
+	}
+
+	if _, err := newVaultStore(config.VaultConfig{Address: srv.URL, KVVersion: 3}); err == nil {
+		t.Error("accepted vault.kv_version 3")
+	}
+}
+
+func TestVaultStoreError(t *testing.T) {
+	_, v := newFakeVault(t)
+	v.token = "wrong"
+	_, _, err := v.Get("secret/data/consul/web", "secret_id")
+	if err == nil || !strings.Contains(err.Error(), "returned 403") {
+		t.Errorf("Get with a rejected token = %v, want the 403", err)
+	}
+}
@@ -0,0 +1,229 @@
+// Package trace records OpenTelemetry spans and exports them over OTLP/HTTP
+// without pulling in the OpenTelemetry SDK.
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer records OpenTelemetry spans for one run and exports them over
+// OTLP/HTTP (JSON encoding) when the run ends. It is configured with the
+// standard OTEL_EXPORTER_OTLP_* variables and is nil, with every method a
+// no-op, when no endpoint is set.
+//
+// Spans nest by context: a span is the child of the span in the context it
+// is started with, so changes applied in parallel each get the right parent.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	version  string
+	traceID  string
+	parentID string // from TRACEPARENT, when the run is itself traced
+
+	mu   sync.Mutex
+	done []*Span
+}
+
+// Span is one timed operation.
+type Span struct {
+	t        *Tracer
+	id       string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// OTLP span kinds.
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// New returns a tracer when an OTLP endpoint is configured. version is
+// reported as the service and scope version.
+func New(version string) *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  map[string]string{},
+		service:  "consul-acl-sync",
+		version:  version,
+		traceID:  randomHex(16),
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		t.service = name
+	}
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			t.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	// Join the caller's trace, e.g. a CI pipeline's, when it passes one.
+	if parts := strings.Split(os.Getenv("TRACEPARENT"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		t.traceID, t.parentID = parts[1], parts[2]
+	}
+	return t
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying s, the parent of the spans
+// started with it.
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the span ctx carries, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start opens a span as a child of the span in ctx, or of the run's parent
+// when ctx has none, and returns a copy of ctx carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := &Span{t: t, id: randomHex(8), parentID: t.parentID, name: name, kind: kind, start: time.Now(), attrs: map[string]string{}}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.parentID = parent.id
+	}
+	return ContextWithSpan(ctx, s), s
+}
+
+// Set records an attribute on the span.
+func (s *Span) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = fmt.Sprint(value)
+}
+
+// Finish closes the span, marking it failed when err is non-nil.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.end, s.err = time.Now(), err
+	t.done = append(t.done, s)
+}
+
+// Traceparent is the W3C header value that lets Consul-side tracing join
+// this trace.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.t.traceID + "-" + s.id + "-01"
+}
+
+// Export sends the finished spans to the collector.
+func (t *Tracer) Export() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.done
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	type kv = map[string]interface{}
+	attr := func(k, v string) kv { return kv{"key": k, "value": kv{"stringValue": v}} }
+
+	var out []kv
+	for _, s := range spans {
+		var attrs []kv
+		for k, v := range s.attrs {
+			attrs = append(attrs, attr(k, v))
+		}
+		status := kv{"code": 1}
+		if s.err != nil {
+			status = kv{"code": 2, "message": s.err.Error()}
+		}
+		out = append(out, kv{
+			"traceId":           t.traceID,
+			"spanId":            s.id,
+			"parentSpanId":      s.parentID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		})
+	}
+	body, err := json.Marshal(kv{"resourceSpans": []kv{{
+		"resource": kv{"attributes": []kv{
+			attr("service.name", t.service),
+			attr("service.version", t.version),
+		}},
+		"scopeSpans": []kv{{
+			"scope": kv{"name": "consul-acl-sync", "version": t.version},
+			"spans": out,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export traces: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to export traces: collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
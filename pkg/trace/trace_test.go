@@ -0,0 +1,201 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// exported is the part of an OTLP/JSON request the tests check.
+type exported struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []attribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID      string      `json:"traceId"`
+				SpanID       string      `json:"spanId"`
+				ParentSpanID string      `json:"parentSpanId"`
+				Name         string      `json:"name"`
+				Kind         int         `json:"kind"`
+				Attributes   []attribute `json:"attributes"`
+				Status       struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type attribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// collect starts a collector answering status, and returns its base URL and
+// the requests it received.
+func collect(t *testing.T, status int) (string, *[]*http.Request, *[]exported) {
+	var (
+		reqs []*http.Request
+		docs []exported
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var doc exported
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			t.Errorf("export: %v", err)
+		}
+		reqs, docs = append(reqs, r), append(docs, doc)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &reqs, &docs
+}
+
+func setenv(t *testing.T, env map[string]string) {
+	for _, k := range []string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT",
+		"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_SERVICE_NAME", "TRACEPARENT"} {
+		t.Setenv(k, env[k])
+	}
+}
+
+func TestNewWithoutEndpoint(t *testing.T) {
+	setenv(t, nil)
+	tr := New("v1")
+	if tr != nil {
+		t.Fatalf("New = %+v, want nil without an endpoint", tr)
+	}
+	// Every method of a nil tracer and its spans does nothing.
+	ctx, sp := tr.Start(context.Background(), "run", KindInternal)
+	if sp != nil || SpanFromContext(ctx) != nil {
+		t.Errorf("Start on a nil tracer = %v, %v; want no span", ctx, sp)
+	}
+	sp.Set("k", "v")
+	sp.Finish(errors.New("failed"))
+	if tp := sp.Traceparent(); tp != "" {
+		t.Errorf("Traceparent of a nil span = %q, want empty", tp)
+	}
+	if err := tr.Export(); err != nil {
+		t.Errorf("Export of a nil tracer = %v", err)
+	}
+}
+
+func TestSpanParents(t *testing.T) {
+	url, reqs, docs := collect(t, http.StatusOK)
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		caller  = "00f067aa0ba902b7"
+	)
+	setenv(t, map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": url + "/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "authorization=Bearer abc, x-team = acl",
+		"OTEL_SERVICE_NAME":           "acl-sync-ci",
+		"TRACEPARENT":                 "00-" + traceID + "-" + caller + "-01",
+	})
+	tr := New("v1.2.3")
+
+	ctx, run := tr.Start(context.Background(), "apply", KindInternal)
+	_, first := tr.Start(ctx, "PUT /v1/acl/policy", KindClient)
+	_, second := tr.Start(ctx, "PUT /v1/acl/token", KindClient)
+	_, other := tr.Start(context.Background(), "export", KindInternal)
+	first.Set("http.response.status_code", 200)
+	first.Finish(nil)
+	second.Finish(errors.New("returned 403"))
+	other.Finish(nil)
+	run.Finish(nil)
+
+	if err := tr.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reqs) != 1 {
+		t.Fatalf("exported %d times, want once", len(*reqs))
+	}
+	req := (*reqs)[0]
+	if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("exported to %s as %q, want /v1/traces as JSON", req.URL.Path, req.Header.Get("Content-Type"))
+	}
+	if req.Header.Get("Authorization") != "Bearer abc" || req.Header.Get("X-Team") != "acl" {
+		t.Errorf("exported with headers %v, want those of OTEL_EXPORTER_OTLP_HEADERS", req.Header)
+	}
+
+	doc := (*docs)[0]
+	if got := doc.ResourceSpans[0].Resource.Attributes; got[0].Value.StringValue != "acl-sync-ci" || got[1].Value.StringValue != "v1.2.3" {
+		t.Errorf("resource attributes = %+v, want the service name and version", got)
+	}
+	parents := map[string]string{}
+	ids := map[string]string{}
+	for _, s := range doc.ResourceSpans[0].ScopeSpans[0].Spans {
+		if s.TraceID != traceID {
+			t.Errorf("span %s is in trace %s, want the caller's %s", s.Name, s.TraceID, traceID)
+		}
+		parents[s.Name], ids[s.Name] = s.ParentSpanID, s.SpanID
+		switch s.Name {
+		case "PUT /v1/acl/policy":
+			if s.Status.Code != 1 || s.Kind != KindClient || len(s.Attributes) != 1 || s.Attributes[0].Value.StringValue != "200" {
+				t.Errorf("span %s = %+v, want it ok with its status code", s.Name, s)
+			}
+		case "PUT /v1/acl/token":
+			if s.Status.Code != 2 || s.Status.Message != "returned 403" {
+				t.Errorf("span %s has status %+v, want the error", s.Name, s.Status)
+			}
+		}
+	}
+	for name, want := range map[string]string{
+		"apply":              caller,
+		"export":             caller,
+		"PUT /v1/acl/policy": ids["apply"],
+		"PUT /v1/acl/token":  ids["apply"],
+	} {
+		if parents[name] != want {
+			t.Errorf("span %s has parent %q, want %q", name, parents[name], want)
+		}
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	url, _, _ := collect(t, http.StatusOK)
+	// A malformed TRACEPARENT starts a trace of the run's own.
+	setenv(t, map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": url, "TRACEPARENT": "00-abc-def-01"})
+	tr := New("v1")
+	if tr.parentID != "" || tr.traceID == "abc" {
+		t.Errorf("joined the malformed trace: %+v", tr)
+	}
+	_, sp := tr.Start(context.Background(), "apply", KindInternal)
+	tp := sp.Traceparent()
+	if !regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`).MatchString(tp) {
+		t.Fatalf("Traceparent = %q, want version-trace-span-flags", tp)
+	}
+	if want := "00-" + tr.traceID + "-" + sp.id + "-01"; tp != want {
+		t.Errorf("Traceparent = %q, want %q", tp, want)
+	}
+}
+
+func TestExportError(t *testing.T) {
+	url, reqs, _ := collect(t, http.StatusServiceUnavailable)
+	setenv(t, map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": url})
+	tr := New("v1")
+	// Nothing finished, nothing sent.
+	if err := tr.Export(); err != nil || len(*reqs) != 0 {
+		t.Errorf("Export without spans = %v after %d requests, want nothing sent", err, len(*reqs))
+	}
+
+	_, sp := tr.Start(context.Background(), "apply", KindInternal)
+	sp.Finish(nil)
+	err := tr.Export()
+	if err == nil || !strings.Contains(err.Error(), "collector returned 503") {
+		t.Errorf("Export to a failing collector = %v, want its status", err)
+	}
+
+	tr.endpoint = "http://127.0.0.1:1/v1/traces"
+	if err := tr.Export(); err == nil || !strings.HasPrefix(err.Error(), "failed to export traces: ") {
+		t.Errorf("Export to an unreachable collector = %v, want it to fail", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// policyCheckPackage is the Rego package -policy-check evaluates. Its deny
+// rules fail the plan and its warn rules are printed, as with conftest.
+const policyCheckPackage = "consul_acl_sync"
+
+// opaResult is the part of `opa eval --format json` output the check reads.
+// Rego sets come out as arrays.
+type opaResult struct {
+	Result []struct {
+		Expressions []struct {
+			Value struct {
+				Deny []interface{} `json:"deny"`
+				Warn []interface{} `json:"warn"`
+			} `json:"value"`
+		} `json:"expressions"`
+	} `json:"result"`
+}
+
+// checkPolicies evaluates the plan, as hooks receive it, against the Rego
+// policies in the -policy-check directory with the opa binary, so
+// organizational rules such as naming conventions or forbidden grants fail
+// the plan before anything is applied.
+func (s *session) checkPolicies(plan *diff.Plan) error {
+	if s.policyCheck == "" {
+		return nil
+	}
+	input, err := json.Marshal(diff.NewDocument(plan))
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("opa", "eval", "--format", "json", "--data", s.policyCheck, "--stdin-input", "data."+policyCheckPackage)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fmt.Errorf("policy check: %w; -policy-check needs opa on the PATH", err)
+	}
+	if err != nil {
+		return fmt.Errorf("policy check: opa eval failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var res opaResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		return fmt.Errorf("policy check: failed to read the output of opa eval: %w", err)
+	}
+	if len(res.Result) == 0 || len(res.Result[0].Expressions) == 0 {
+		return fmt.Errorf("policy check: the policies in %s define no package %s", s.policyCheck, policyCheckPackage)
+	}
+
+	value := res.Result[0].Expressions[0].Value
+	for _, w := range value.Warn {
+		fmt.Fprintf(os.Stderr, "warning: policy check: %s\n", policyMessage(w))
+	}
+	var errs []error
+	for _, d := range value.Deny {
+		errs = append(errs, fmt.Errorf("policy check: %s", policyMessage(d)))
+	}
+	return errors.Join(errs...)
+}
+
+// policyMessage renders a deny or warn result: a string, or an object with a
+// msg, else its JSON.
+func policyMessage(v interface{}) string {
+	switch m := v.(type) {
+	case string:
+		return m
+	case map[string]interface{}:
+		if msg, ok := m["msg"].(string); ok {
+			return msg
+		}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
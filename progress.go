@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// progressThreshold is the number of items from which -progress auto shows a
+// phase. Smaller ones end before a pause looks like a hang.
+const progressThreshold = 100
+
+// progressMeter shows how far the long phases of a run are on stderr, with
+// an estimate of when each ends. On a terminal a phase the run is otherwise
+// silent in redraws one status line; elsewhere, and during an apply, which
+// prints a line per change anyway, it prints a line every tenth of the way.
+type progressMeter struct {
+	w        io.Writer
+	terminal bool
+	bar      bool // -progress bar: every phase, drawn with a bar
+
+	phase   string
+	started time.Time
+	tenth   int  // the last tenth printed as a line
+	drawn   bool // a status line is on screen
+}
+
+// newProgressMeter returns the meter of a -progress mode: auto, bar or off.
+// It is nil when off.
+func newProgressMeter(mode string) (*progressMeter, error) {
+	switch mode {
+	case "auto", "bar":
+	case "off":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown -progress %q (want auto, bar or off)", mode)
+	}
+	return &progressMeter{w: os.Stderr, terminal: isTerminal(os.Stderr), bar: mode == "bar"}, nil
+}
+
+// status follows a phase that prints nothing else: planning or verifying.
+func (m *progressMeter) status() diff.Progress {
+	if m == nil {
+		return nil
+	}
+	return func(phase string, done, total int) { m.report(phase, done, total, m.terminal) }
+}
+
+// lines follows an apply, whose output a redrawn line would garble.
+func (m *progressMeter) lines() diff.Progress {
+	if m == nil {
+		return nil
+	}
+	return func(phase string, done, total int) { m.report(phase, done, total, false) }
+}
+
+func (m *progressMeter) report(phase string, done, total int, redraw bool) {
+	if phase != m.phase {
+		m.phase, m.started, m.tenth = phase, time.Now(), 0
+	}
+	if total == 0 || (!m.bar && total < progressThreshold) {
+		return
+	}
+	if redraw {
+		m.clear()
+		if done < total {
+			fmt.Fprint(m.w, m.line(done, total))
+			m.drawn = true
+		}
+		return
+	}
+	if tenth := done * 10 / total; tenth > m.tenth {
+		m.tenth = tenth
+		fmt.Fprintln(m.w, m.line(done, total))
+	}
+}
+
+// clear erases the status line, if one is drawn, e.g. before an error is
+// printed in the middle of a phase.
+func (m *progressMeter) clear() {
+	if m != nil && m.drawn {
+		fmt.Fprint(m.w, "\r\033[K")
+		m.drawn = false
+	}
+}
+
+// line renders the state of the phase, e.g.
+// "planning policies 120/400 (30%), about 12s left".
+func (m *progressMeter) line(done, total int) string {
+	s := fmt.Sprintf("%s %d/%d", m.phase, done, total)
+	if m.bar {
+		const width = 30
+		filled := done * width / total
+		s += " [" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+	}
+	s += fmt.Sprintf(" (%d%%)", done*100/total)
+	if done > 0 && done < total {
+		if left := time.Since(m.started) / time.Duration(done) * time.Duration(total-done); left >= time.Second {
+			s += fmt.Sprintf(", about %s left", left.Round(time.Second))
+		}
+	}
+	return s
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// pullRequestEvent is the part of a GitHub pull_request webhook payload the
+// PR webhook uses.
+type pullRequestEvent struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Merged bool `json:"merged"`
+		Base   struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// githubComments posts comments on the pull requests of one repository.
+type githubComments struct {
+	api   string // API base URL
+	repo  string // owner/name
+	token string
+}
+
+func (g githubComments) post(number int, body string) error {
+	payload, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/repos/%s/issues/%d/comments", strings.TrimRight(g.api, "/"), g.repo, number)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to comment on pull request #%d: %w", number, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to comment on pull request #%d: returned %d: %s", number, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// prWebhook plans pull requests against the branch it follows and applies
+// the branch when one is merged. Events are handled one at a time, in the
+// background, since GitHub gives up on a webhook after ten seconds.
+type prWebhook struct {
+	opts     *options
+	checkout *gitCheckout
+	relPath  string
+	secret   string
+	comments githubComments
+
+	mu sync.Mutex
+}
+
+func (h *prWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/webhook" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !verifyWebhook(r, body, h.secret) {
+		http.Error(w, "bad webhook signature", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-GitHub-Event") != "pull_request" {
+		w.WriteHeader(http.StatusNoContent) // ping and other events
+		return
+	}
+	var ev pullRequestEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ev.Repository.FullName != h.comments.repo || ev.PullRequest.Base.Ref != h.checkout.branch {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch {
+	case ev.Action == "opened" || ev.Action == "synchronize" || ev.Action == "reopened":
+		go h.handle(ev.Number, h.plan)
+	case ev.Action == "closed" && ev.PullRequest.Merged:
+		go h.handle(ev.Number, h.apply)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handle runs one event and posts its result as a comment.
+func (h *prWebhook) handle(number int, run func(number int) string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.comments.post(number, run(number)); err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+}
+
+// plan checks out the head of the pull request and plans its config. The
+// change is not reviewed yet, so the config is held to what serve accepts.
+func (h *prWebhook) plan(number int) string {
+	sha, err := h.checkout.update(fmt.Sprintf("pull/%d/head", number))
+	if err != nil {
+		return checkoutFailureComment("plan", number, err)
+	}
+	fmt.Fprintf(os.Stderr, "planning pull request #%d at %s\n", number, sha)
+	plan, err := h.planCheckout()
+	if err != nil {
+		return failureComment("plan", sha, err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Planned `%s` at %s.\n\n", h.relPath, sha)
+	diff.PrintMarkdown(&b, plan)
+	if plan.HasChanges() {
+		fmt.Fprintf(&b, "\nThese changes are applied when the pull request is merged into `%s`.\n", h.checkout.branch)
+	}
+	return b.String()
+}
+
+func (h *prWebhook) planCheckout() (_ *diff.Plan, err error) {
+	cfg, err := h.opts.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUntrustedConfig(cfg, "the config of an unmerged pull request"); err != nil {
+		return nil, err
+	}
+	// The state records what the followed branch has in sync, not a pull
+	// request. -check-oidc would fetch URLs the pull request names, and
+	// -validate-rules write its policies to Consul, so both wait for the
+	// merge.
+	opts := *h.opts
+	opts.statePath, opts.checkOIDC, opts.validate = "", false, false
+	// The plan is posted on the pull request, where no secret belongs.
+	opts.showSecrets = false
+	s, err := opts.connect("plan", opts.configPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.close(err) }()
+	defer func() { err = s.red.Error(err) }()
+	return s.plan("")
+}
+
+// apply checks out the branch the pull request was merged into and applies
+// it like reconcile would.
+func (h *prWebhook) apply(number int) string {
+	sha, err := h.checkout.update(h.checkout.branch)
+	if err != nil {
+		return checkoutFailureComment("apply", number, err)
+	}
+	fmt.Fprintf(os.Stderr, "applying %s at %s after pull request #%d\n", h.checkout.branch, sha, number)
+	h.opts.commit = sha
+	// The merge is the approval, as for reconcile.
+	if err := runApply(h.opts, nil, "", true, 0, true, false, 1, nil); err != nil {
+		return failureComment("apply", sha, err)
+	}
+	return fmt.Sprintf("**consul-acl-sync** applied `%s` at %s.\n", h.relPath, sha)
+}
+
+// checkoutFailureComment logs why the checkout for a pull request failed and
+// returns a comment without the detail, as git errors carry remote URLs and
+// paths of the server.
+func checkoutFailureComment(action string, number int, err error) string {
+	fmt.Fprintf(os.Stderr, "warning: checkout for pull request #%d failed: %v\n", number, err)
+	return fmt.Sprintf("**consul-acl-sync %s failed**: the repository could not be checked out. The server log has the details.\n", action)
+}
+
+func failureComment(action, sha string, err error) string {
+	at := ""
+	if sha != "" {
+		at = " at " + sha
+	}
+	return fmt.Sprintf("**consul-acl-sync %s failed**%s:\n\n```\n%s\n```\n", action, at, strings.ReplaceAll(err.Error(), "```", "'''"))
+}
+
+// prWebhookCommand receives GitHub pull_request webhooks: it comments the
+// plan of each pull request against the followed branch, and applies the
+// branch when one is merged.
+func prWebhookCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts     options
+		checkout gitCheckout
+		comments githubComments
+		listen   string
+	)
+	opts.register(fs)
+	fs.StringVar(&checkout.repo, "repo", "", "Git repository URL to clone (required); -config is the path within it")
+	fs.StringVar(&checkout.branch, "branch", "main", "branch that pull requests are planned against and applied from")
+	fs.StringVar(&checkout.dir, "workdir", "", "directory for the working copy (default: a new temporary directory)")
+	fs.StringVar(&comments.repo, "github-repo", "", "GitHub repository as owner/name (required); events for others are ignored")
+	fs.StringVar(&comments.api, "github-api", "https://api.github.com", "GitHub API base URL")
+	fs.StringVar(&listen, "listen", "127.0.0.1:8080", "address to receive webhooks on at POST /webhook")
+	return func([]string) error {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if checkout.repo == "" || comments.repo == "" || opts.configPath == "" {
+			return fmt.Errorf("pr-webhook needs -repo, -github-repo and -config, the path of the config within the repository")
+		}
+		if filepath.IsAbs(opts.configPath) {
+			return fmt.Errorf("-config must be relative to the repository root")
+		}
+		secret := os.Getenv(webhookSecretEnv)
+		if secret == "" {
+			return fmt.Errorf("pr-webhook needs a webhook secret in %s", webhookSecretEnv)
+		}
+		if comments.token = os.Getenv("GITHUB_TOKEN"); comments.token == "" {
+			return fmt.Errorf("pr-webhook needs a GitHub token in GITHUB_TOKEN to comment")
+		}
+		if checkout.dir == "" {
+			dir, err := os.MkdirTemp("", "consul-acl-sync-pr-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			checkout.dir = dir
+		}
+		relPath := opts.configPath
+		opts.configPath = filepath.Join(checkout.dir, relPath)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		h := &prWebhook{opts: &opts, checkout: &checkout, relPath: relPath, secret: secret, comments: comments}
+		hs := &http.Server{Addr: listen, Handler: h, ReadHeaderTimeout: 10 * time.Second}
+		errc := make(chan error, 1)
+		go func() { errc <- hs.ListenAndServe() }()
+		fmt.Fprintf(os.Stderr, "receiving webhooks on %s\n", listen)
+
+		select {
+		case err := <-errc:
+			if !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		case <-ctx.Done():
+		}
+		if err := hs.Shutdown(context.Background()); err != nil {
+			return err
+		}
+		// Wait for an event being handled.
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return nil
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// webhookSecretEnv holds the secret webhook senders sign or authenticate
+// their requests with.
+const webhookSecretEnv = "CONSUL_ACL_SYNC_WEBHOOK_SECRET"
+
+// gitCheckout is a working copy of a repository, moved between refs with the
+// git binary, so the user's credential helpers and SSH keys apply.
+type gitCheckout struct {
+	repo   string
+	branch string
+	dir    string
+}
+
+// update fetches ref, a branch or another ref such as pull/1/head, and checks
+// it out, cloning first if dir is not a repository yet. It returns the commit
+// SHA.
+func (g *gitCheckout) update(ref string) (string, error) {
+	if _, err := os.Stat(filepath.Join(g.dir, ".git")); errors.Is(err, os.ErrNotExist) {
+		if _, err := runGit("", "clone", "--no-checkout", "--", g.repo, g.dir); err != nil {
+			return "", err
+		}
+	}
+	if _, err := runGit(g.dir, "fetch", "--quiet", "origin", ref); err != nil {
+		return "", err
+	}
+	if _, err := runGit(g.dir, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	return runGit(g.dir, "rev-parse", "HEAD")
+}
+
+// runGit runs git in dir and returns its trimmed output.
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// verifyWebhook checks that a webhook request comes from the holder of
+// secret: a GitHub X-Hub-Signature-256 over the body, or a GitLab
+// X-Gitlab-Token.
+func verifyWebhook(r *http.Request, body []byte, secret string) bool {
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(sig), []byte(want))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+// triggerHandler wakes the reconcile loop on an authenticated POST /trigger,
+// typically a push webhook. The payload is not read: the loop fetches the
+// branch either way.
+func triggerHandler(secret string, trigger chan<- struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/trigger" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !verifyWebhook(r, body, secret) {
+			http.Error(w, "bad webhook signature", http.StatusUnauthorized)
+			return
+		}
+		select {
+		case trigger <- struct{}{}:
+		default: // a reconcile is already pending
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// reconcileCommand keeps Consul in sync with a config in a Git repository:
+// it polls the branch, or is woken by a push webhook, and applies each new
+// commit, recording its SHA in the audit log.
+func reconcileCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts     options
+		checkout gitCheckout
+		interval time.Duration
+		listen   string
+	)
+	opts.register(fs)
+	fs.StringVar(&checkout.repo, "repo", "", "Git repository URL holding the config (required); -config is the path within it")
+	fs.StringVar(&checkout.branch, "branch", "main", "branch to follow")
+	fs.StringVar(&checkout.dir, "workdir", "", "directory for the working copy (default: a new temporary directory)")
+	fs.DurationVar(&interval, "interval", time.Minute, "how often to poll the branch")
+	fs.StringVar(&listen, "listen", "", "address to accept push webhooks on at POST /trigger, authenticated with "+webhookSecretEnv)
+	return func([]string) error {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if checkout.repo == "" || opts.configPath == "" {
+			return fmt.Errorf("reconcile needs -repo and -config, the path of the config within the repository")
+		}
+		if filepath.IsAbs(opts.configPath) {
+			return fmt.Errorf("-config must be relative to the repository root")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("-interval must be positive")
+		}
+		if checkout.dir == "" {
+			dir, err := os.MkdirTemp("", "consul-acl-sync-reconcile-")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			checkout.dir = dir
+		}
+		relPath := opts.configPath
+		opts.configPath = filepath.Join(checkout.dir, relPath)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		trigger := make(chan struct{}, 1)
+		if listen != "" {
+			secret := os.Getenv(webhookSecretEnv)
+			if secret == "" {
+				return fmt.Errorf("-listen needs a webhook secret in %s", webhookSecretEnv)
+			}
+			hs := &http.Server{Addr: listen, Handler: triggerHandler(secret, trigger), ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				if err := hs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					fmt.Fprintln(os.Stderr, "warning: webhook listener:", err)
+				}
+			}()
+			defer hs.Close()
+		}
+
+		// applied is the last commit applied successfully; a failed commit
+		// is retried on every poll until it applies or is superseded.
+		var applied string
+		for {
+			sha, err := checkout.update(checkout.branch)
+			switch {
+			case err != nil:
+				fmt.Fprintln(os.Stderr, "warning:", err)
+			case sha != applied:
+				fmt.Fprintf(os.Stderr, "reconciling %s at %s\n", relPath, sha)
+				opts.commit = sha
+				// A commit on the branch is the approval: nobody is there
+				// to type one, including for expired tokens to recreate.
+				if err := runApply(&opts, nil, "", true, 0, true, false, 1, nil); err != nil {
+					fmt.Fprintln(os.Stderr, "consul-acl-sync:", err)
+				} else {
+					applied = sha
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-trigger:
+			case <-time.After(interval):
+			}
+		}
+	}
+}
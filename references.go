@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// checkReferences looks at the tokens referencing a policy the config does
+// not define: apply does not create it, so it must already exist in Consul.
+// By default they are only warned about. With -strict, each is looked up in
+// Consul and the plan fails if any does not exist there either.
+func (s *session) checkReferences() error {
+	undefined := config.BuildGraph(s.cfg).Undefined()
+	if len(undefined) == 0 {
+		return nil
+	}
+	if !s.strict {
+		for _, r := range undefined {
+			fmt.Fprintf(os.Stderr, "warning: %s references %s, which the config does not define; it must already exist in Consul\n", r.From, r.To)
+		}
+		return nil
+	}
+
+	live, err := s.client.ListPolicies()
+	if err != nil {
+		return fmt.Errorf("failed to list policies: %w", err)
+	}
+	exists := make(map[config.Node]bool, len(live))
+	for _, p := range live {
+		exists[config.PolicyNode(config.Policy{Name: p.Name, Tenancy: p.Tenancy()})] = true
+	}
+	for _, r := range undefined {
+		if r.To.Kind != "role" {
+			continue
+		}
+		roles, err := s.client.ListRoles()
+		if err != nil {
+			return fmt.Errorf("failed to list roles: %w", err)
+		}
+		for _, role := range roles {
+			exists[config.RoleNode(config.Role{Name: role.Name, Tenancy: role.Tenancy()})] = true
+		}
+		break
+	}
+	var missing []string
+	for _, r := range undefined {
+		if !exists[r.To] {
+			missing = append(missing, fmt.Sprintf("%s references %s, which neither the config nor Consul defines", r.From, r.To))
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New(strings.Join(missing, "; "))
+	}
+	return nil
+}
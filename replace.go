@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+	"github.com/zinrai/consul-acl-sync/pkg/secrets"
+)
+
+// listFlag collects the values of a flag given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ", ") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+// replaceTargets resolves the -replace targets to the tokens of the config.
+// A target is token: followed by an accessor ID or a description, which must
+// name a single token.
+func replaceTargets(cfg *config.Config, targets []string) ([]config.Token, error) {
+	var tokens []config.Token
+	for _, target := range targets {
+		ref, ok := strings.CutPrefix(target, "token:")
+		if !ok {
+			return nil, fmt.Errorf("invalid -replace %q: want token:<accessor ID or description>; only tokens can be replaced", target)
+		}
+		ref = strings.Trim(ref, `"'`)
+		var matches []config.Token
+		for _, t := range cfg.Tokens {
+			if t.AccessorID == ref || t.Description == ref {
+				matches = append(matches, t)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("-replace %q: no token in the config has that accessor ID or description", target)
+		case 1:
+			tokens = append(tokens, matches[0])
+		default:
+			return nil, fmt.Errorf("-replace %q: %d tokens have that description; name one by accessor ID", target, len(matches))
+		}
+	}
+	return tokens, nil
+}
+
+// replace makes the plan recreate the tokens of -replace. Those that keep
+// their secret in the backend get a new one; those with an inline secret_id
+// must have had it changed in the config, or the leaked secret would be
+// recreated.
+func (s *session) replace(plan *diff.Plan, tokens []config.Token) error {
+	for i := range tokens {
+		if err := secrets.Regenerate(&tokens[i]); err != nil {
+			return err
+		}
+		s.red.Add(tokens[i].SecretID)
+	}
+	if err := diff.Replace(s.client, plan, tokens); err != nil {
+		return err
+	}
+	return s.checkNewSecrets(plan, tokens)
+}
+
+// checkNewSecrets fails when a token of -replace with an inline secret_id
+// would be recreated with the secret it has in Consul.
+func (s *session) checkNewSecrets(plan *diff.Plan, tokens []config.Token) error {
+	r, ok := s.client.(consul.SecretReader)
+	for _, t := range tokens {
+		if t.SecretGenerated {
+			continue
+		}
+		replaced := false
+		for _, u := range plan.TokensToReplace {
+			replaced = replaced || u.Desired.AccessorID == t.AccessorID
+		}
+		if !replaced {
+			continue
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "warning: cannot check that token %s gets a new secret_id; -replace recreates it with the one in the config\n", t.Label())
+			continue
+		}
+		live, err := r.TokenSecret(t.AccessorID)
+		if err != nil {
+			return fmt.Errorf("failed to read the secret of token %s: %w", t.Label(), err)
+		}
+		if live == t.SecretID {
+			return fmt.Errorf("-replace token %s: its secret_id in the config is the one it has in Consul, so it would be recreated with the same secret; set a new secret_id first", t.Label())
+		}
+	}
+	return nil
+}
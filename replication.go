@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// replicationProblems lists what is wrong with the ACL replication of dc:
+// writes to a secondary that does not replicate from the primary are not
+// seen by the rest of the federation, or are overwritten by the next round.
+func replicationProblems(dc string, st consul.ReplicationStatus, maxLag time.Duration, now time.Time) []string {
+	if !st.Enabled {
+		return []string{fmt.Sprintf("ACL replication is disabled in %s; unless it is the primary datacenter, it does not receive the primary's ACLs", dc)}
+	}
+	var problems []string
+	if !st.Running {
+		problems = append(problems, fmt.Sprintf("ACL replication is enabled but not running in %s", dc))
+	}
+	if st.LastError.After(st.LastSuccess) {
+		msg := fmt.Sprintf("ACL replication from %s to %s has failed since %s", st.SourceDatacenter, dc, st.LastError.UTC().Format(time.RFC3339))
+		if st.LastErrorMessage != "" {
+			msg += ": " + st.LastErrorMessage
+		}
+		problems = append(problems, msg)
+	}
+	if lag := now.Sub(st.LastSuccess); maxLag > 0 && lag > maxLag {
+		if st.LastSuccess.IsZero() {
+			problems = append(problems, fmt.Sprintf("ACL replication to %s has never succeeded", dc))
+		} else {
+			problems = append(problems, fmt.Sprintf("ACL replication to %s last succeeded %s ago, more than -max-replication-lag %s", dc, lag.Round(time.Second), maxLag))
+		}
+	}
+	return problems
+}
+
+// checkReplication is the preflight of a plan against a datacenter named
+// with -datacenter: it warns about, or with -replication-check fail refuses,
+// a datacenter whose ACL replication is off, failing or lagging.
+func (s *session) checkReplication() error {
+	if s.datacenter == "" || s.replicationCheck == "off" {
+		return nil
+	}
+	r, ok := s.client.(consul.Replication)
+	if !ok {
+		return nil
+	}
+	st, err := r.ReplicationStatus()
+	if err != nil {
+		return fmt.Errorf("failed to read the ACL replication status of %s: %w", s.datacenter, err)
+	}
+	problems := replicationProblems(s.datacenter, st, s.maxReplicationLag, time.Now())
+	if len(problems) == 0 {
+		return nil
+	}
+	if s.replicationCheck == "fail" {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "warning:", p)
+	}
+	return nil
+}
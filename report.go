@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// table is a header row and data rows, rendered as CSV or Markdown.
+type table struct {
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// rulesSummary shortens policy rules to one line, one grant per rule.
+func rulesSummary(src string) string {
+	rules, err := acl.Parse(src)
+	if err != nil {
+		return "(rules do not parse)"
+	}
+	parts := make([]string, 0, len(rules))
+	for _, r := range rules {
+		switch {
+		case r.Scalar():
+			parts = append(parts, r.Resource+": "+r.Policy)
+		case r.Prefix:
+			parts = append(parts, fmt.Sprintf("%s_prefix %q: %s", r.Resource, r.Name, r.Policy))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %q: %s", r.Resource, r.Name, r.Policy))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func policyTable(inv *inventory, roles []consul.Role, rules map[string]string) table {
+	t := table{
+		title:  "Policies",
+		header: []string{"name", "managed", "description", "datacenters", "rules", "tokens", "roles", "create_index", "modify_index"},
+	}
+	usages := policyUsages(inv, roles)
+	for i, p := range inv.policies {
+		t.rows = append(t.rows, []string{
+			p.Name,
+			strconv.FormatBool(inv.managedPolicies[p.Name]),
+			p.Description,
+			strings.Join(p.Datacenters, " "),
+			rulesSummary(rules[p.ID]),
+			strconv.Itoa(len(usages[i].Tokens)),
+			strconv.Itoa(len(usages[i].Roles)),
+			strconv.FormatUint(p.CreateIndex, 10),
+			strconv.FormatUint(p.ModifyIndex, 10),
+		})
+	}
+	return t
+}
+
+func tokenTable(inv *inventory) table {
+	t := table{
+		title:  "Tokens",
+		header: []string{"accessor_id", "managed", "description", "policies", "roles", "local", "create_time", "expiration_time", "create_index", "modify_index"},
+	}
+	for _, tok := range inv.tokens {
+		roles := make([]string, 0, len(tok.Roles))
+		for _, l := range tok.Roles {
+			roles = append(roles, l.Name)
+		}
+		created, expires := "", ""
+		if !tok.CreateTime.IsZero() {
+			created = tok.CreateTime.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		if tok.ExpirationTime != nil {
+			expires = tok.ExpirationTime.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		t.rows = append(t.rows, []string{
+			tok.AccessorID,
+			strconv.FormatBool(inv.managedTokens[tok.AccessorID]),
+			tok.Description,
+			strings.Join(tok.PolicyNames(), " "),
+			strings.Join(roles, " "),
+			strconv.FormatBool(tok.Local),
+			created,
+			expires,
+			strconv.FormatUint(tok.CreateIndex, 10),
+			strconv.FormatUint(tok.ModifyIndex, 10),
+		})
+	}
+	return t
+}
+
+func writeCSV(w io.Writer, t table) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(t.header); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(t.rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func writeMarkdownTable(w io.Writer, t table) {
+	cell := strings.NewReplacer("|", `\|`, "\n", " ")
+	fmt.Fprintf(w, "### %s (%d)\n\n", t.title, len(t.rows))
+	fmt.Fprintf(w, "| %s |\n", strings.Join(t.header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat("---|", len(t.header)))
+	for _, row := range t.rows {
+		cells := make([]string, len(row))
+		for i, c := range row {
+			cells[i] = cell.Replace(c)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+}
+
+// reportCommand prints an inventory of the live policies and tokens as
+// Markdown or CSV, for periodic security reviews. CSV holds one table, so it
+// needs -table.
+func reportCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		format string
+		which  string
+	)
+	opts.register(fs)
+	fs.StringVar(&format, "format", "markdown", "report format: markdown or csv")
+	fs.StringVar(&which, "table", "", "only this table: policies or tokens (required for csv)")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if format != "markdown" && format != "csv" {
+			return fmt.Errorf("unknown -format %q (want markdown or csv)", format)
+		}
+		if which != "" && which != "policies" && which != "tokens" {
+			return fmt.Errorf("unknown -table %q (want policies or tokens)", which)
+		}
+		if format == "csv" && which == "" {
+			return fmt.Errorf("csv holds one table; pass -table policies or -table tokens")
+		}
+		s, err := opts.open("report")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		var tables []table
+		if which != "tokens" {
+			roles, err := s.client.ListRoles()
+			if err != nil {
+				return fmt.Errorf("failed to list roles: %w", err)
+			}
+			rules, err := loadPolicyRules(s.client, inv)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, policyTable(inv, roles, rules))
+		}
+		if which != "policies" {
+			tables = append(tables, tokenTable(inv))
+		}
+
+		if format == "csv" {
+			return writeCSV(os.Stdout, tables[0])
+		}
+		for i, t := range tables {
+			if i > 0 {
+				fmt.Println()
+			}
+			writeMarkdownTable(os.Stdout, t)
+		}
+		return nil
+	}
+}
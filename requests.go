@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/zinrai/consul-acl-sync/pkg/apply"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// request is a write apply would send to Consul, or to the secrets backend.
+type request struct {
+	method, path string
+	body         []byte
+}
+
+// previewStore stands in for the secrets backend, recording the secrets apply
+// would store instead of storing them.
+type previewStore struct{ requests *[]request }
+
+func (p previewStore) Get(path, field string) (string, bool, error) { return "", false, nil }
+
+func (p previewStore) Put(path string, fields map[string]string) error {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	*p.requests = append(*p.requests, request{method: "STORE", path: path, body: b})
+	return nil
+}
+
+// previewRequests runs the steps of plan, in apply order, against a client
+// that records its writes instead of sending them, and returns the writes.
+// Reads, such as the check that a policy did not change since the plan, are
+// still sent.
+func (s *session) previewRequests(plan *diff.Plan) ([]request, error) {
+	c, ok := s.client.(*consul.Client)
+	if !ok {
+		return nil, fmt.Errorf("-show-requests needs -consul-client http")
+	}
+	var requests []request
+	c.Preview = func(method, path string, body []byte) {
+		requests = append(requests, request{method: method, path: path, body: body})
+	}
+	defer func() { c.Preview = nil }()
+
+	store := previewStore{&requests}
+	for _, step := range apply.Order(plan) {
+		if err := step.Do(c, store); err != nil {
+			return nil, err
+		}
+	}
+	return requests, nil
+}
+
+// printRequests lists requests with their bodies indented, secrets redacted,
+// e.g.
+//
+//	PUT /v1/acl/policy
+//	{
+//	  "Name": "web",
+//	  ...
+//	}
+//
+// A STORE entry is a secret written to the secrets backend at that path.
+func (s *session) printRequests(w io.Writer, requests []request, markdown bool) {
+	if markdown {
+		fmt.Fprintf(w, "\n### Requests\n\n```http\n")
+	} else {
+		fmt.Fprintf(w, "\nRequests apply would make (%d):\n\n", len(requests))
+	}
+	for i, r := range requests {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s %s\n", r.method, r.path)
+		if r.body != nil {
+			var body bytes.Buffer
+			if json.Indent(&body, r.body, "", "  ") != nil {
+				body.Reset()
+				body.Write(r.body)
+			}
+			fmt.Fprintln(w, s.red.String(body.String()))
+		}
+	}
+	if markdown {
+		fmt.Fprintln(w, "```")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// runRecord is the one-line JSON summary of a run that -run-record writes,
+// for log aggregators to index without parsing the text output.
+type runRecord struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Version    string    `json:"version"`
+	Config     string    `json:"config,omitempty"`
+	Datacenter string    `json:"datacenter,omitempty"`
+	// Changes and PlanHash are only set by a run that got as far as a plan.
+	Changes  *int    `json:"changes,omitempty"`
+	PlanHash string  `json:"plan_hash,omitempty"`
+	Applied  int     `json:"applied"`
+	Requests int     `json:"requests"`
+	Duration float64 `json:"duration_seconds"`
+	ExitCode int     `json:"exit_code"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// writeRunRecord appends the record of the run to path, or writes it to
+// stderr when path is "-". runErr is already redacted.
+func (s *session) writeRunRecord(path string, runErr error) error {
+	r := runRecord{
+		Time:       time.Now().UTC(),
+		Command:    s.command,
+		Version:    version,
+		Config:     s.configPath,
+		Datacenter: s.datacenter,
+		Applied:    s.applied,
+		Duration:   time.Since(s.started).Seconds(),
+	}
+	r.Requests, _ = s.stats.Requests()
+	if s.lastPlan != nil {
+		n := len(diff.Changes(s.lastPlan))
+		r.Changes = &n
+		r.PlanHash = diff.Hash(s.lastPlan)
+	}
+	if runErr != nil {
+		r.ExitCode, _ = classifyError(runErr)
+		r.Error = runErr.Error()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if path == "-" {
+		_, err := os.Stderr.Write(line)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
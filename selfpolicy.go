@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// selfRule is a rule the tool's own token needs, with why.
+type selfRule struct {
+	reason string
+	rule   string
+}
+
+// selfPolicy returns the rules a token running mode, plan or apply, needs for
+// cfg, and nothing more. A plan only reads ACLs and writes nothing to Consul
+// with such a token; an apply writes ACLs and the audit and history records
+// the config keeps in Consul KV.
+func selfPolicy(cfg *config.Config, mode string) []selfRule {
+	access := "read"
+	if mode == "apply" {
+		access = "write"
+	}
+	rules := []selfRule{{"list and read policies, roles, tokens and auth methods", acl.Rule{Resource: "acl", Policy: access}.String()}}
+	if mode == "apply" {
+		rules[0].reason = "create and update policies, roles, tokens and auth methods, and recreate those replaced"
+	}
+	for _, p := range cfg.Partitions() {
+		if p != "default" {
+			rules = append(rules, selfRule{"the same in admin partition " + p, fmt.Sprintf("partition %q { acl = %q }", p, access)})
+		}
+	}
+	var tenants []string
+	if len(cfg.AdminPartitions) > 0 {
+		tenants = append(tenants, "partitions")
+	}
+	if len(cfg.Namespaces) > 0 {
+		tenants = append(tenants, "namespaces")
+	}
+	if len(tenants) > 0 {
+		reason := "list and read " + strings.Join(tenants, " and ")
+		if mode == "apply" {
+			reason = "create and update " + strings.Join(tenants, " and ")
+		}
+		rules = append(rules, selfRule{reason, acl.Rule{Resource: "operator", Policy: access}.String()})
+	}
+	if mode != "apply" {
+		return rules
+	}
+	kv := func(reason, prefix string) {
+		if prefix != "" {
+			rule := acl.Rule{Resource: "key", Name: strings.TrimSuffix(prefix, "/") + "/", Prefix: true, Policy: "write"}
+			rules = append(rules, selfRule{reason, rule.String()})
+		}
+	}
+	kv("audit records (audit.consul_kv_prefix)", cfg.Audit.ConsulKVPrefix)
+	kv("run history (history.consul_kv_prefix)", cfg.History.ConsulKVPrefix)
+	return rules
+}
+
+// printSelfPolicy renders rules as HCL policy rules, a comment above each.
+func printSelfPolicy(w io.Writer, mode string, rules []selfRule) {
+	fmt.Fprintf(w, "# Rules of the token consul-acl-sync %s runs with.\n", mode)
+	for _, r := range rules {
+		fmt.Fprintf(w, "\n# %s\n%s\n", strings.ToUpper(r.reason[:1])+r.reason[1:], r.rule)
+	}
+}
+
+func selfPolicyCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts configOptions
+		mode string
+	)
+	opts.register(fs)
+	fs.StringVar(&mode, "mode", "apply", "the command the token is for: plan or apply")
+	return func([]string) error {
+		if mode != "plan" && mode != "apply" {
+			return fmt.Errorf("unknown -mode %q (want plan or apply)", mode)
+		}
+		cfg, err := opts.load()
+		if err != nil {
+			return err
+		}
+		printSelfPolicy(os.Stdout, mode, selfPolicy(cfg, mode))
+		return nil
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// serveTokenEnv holds the bearer token clients of serve must present.
+const serveTokenEnv = "CONSUL_ACL_SYNC_SERVE_TOKEN"
+
+// maxConfigSize caps the config a serve request may send.
+const maxConfigSize = 10 << 20
+
+// serveResult is the response to POST /plan and POST /apply.
+type serveResult struct {
+	Changes  bool          `json:"changes"`
+	PlanHash string        `json:"plan_hash,omitempty"`
+	Summary  string        `json:"summary,omitempty"`
+	Plan     []diff.Change `json:"plan,omitempty"`
+	Applied  int           `json:"applied,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// server plans and applies configs sent over HTTP. Runs are serialized, as
+// two applies at once would race each other's plans.
+type server struct {
+	opts  *options
+	token string
+
+	mu sync.Mutex
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var command string
+	switch r.URL.Path {
+	case "/plan":
+		command = "plan"
+	case "/apply":
+		command = "apply"
+	default:
+		writeServeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeServeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(srv.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeServeError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		writeServeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	cfg, err := config.Parse(data)
+	if err == nil {
+		err = checkUntrustedConfig(cfg, "a config sent to serve")
+	}
+	if err != nil {
+		writeServeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	res, err := srv.run(command, "serve:"+r.RemoteAddr, cfg)
+	status := http.StatusOK
+	if err != nil {
+		res.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+	writeServeJSON(w, status, res)
+}
+
+// run plans the config and, for apply, applies the plan. The result carries
+// what was done before any failure.
+func (srv *server) run(command, source string, cfg *config.Config) (res serveResult, err error) {
+	s, err := srv.opts.connect(command, source, cfg)
+	if err != nil {
+		return res, err
+	}
+	defer func() { s.close(err) }()
+	defer func() { err = s.red.Error(err) }()
+
+	plan, err := s.plan("")
+	if err != nil {
+		return res, err
+	}
+	res = serveResult{
+		Changes:  plan.HasChanges(),
+		PlanHash: diff.Hash(plan),
+		Summary:  diff.Summary(plan),
+		Plan:     diff.Changes(plan),
+	}
+	if command == "plan" || !plan.HasChanges() {
+		return res, nil
+	}
+
+	if err := s.backupBeforeApply(plan, "pre-apply"); err != nil {
+		return res, err
+	}
+	applyErr := s.apply(plan, "", true, 1)
+	res.Applied = s.applied
+	if err := writeAudit(s.cfg.Audit, s.kv, source, s.commit, plan, s.red.Error(applyErr)); err != nil && applyErr == nil {
+		return res, err
+	}
+	if err := notify(s.cfg.Notifications, newRunReport(source, plan, s.red.Error(applyErr))); err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", s.red.String(err.Error()))
+	}
+	return res, applyErr
+}
+
+// checkUntrustedConfig refuses the settings of a config nobody has reviewed
+// that would let its author act with the server's privileges: run commands,
+// read or write files, send its credentials or environment elsewhere, reach
+// other hosts from it, write Consul KV, or pick the tokens it uses. where
+// names the source of the config in the error.
+func checkUntrustedConfig(cfg *config.Config, where string) error {
+	var field string
+	switch {
+	case len(cfg.Hooks.PrePlan)+len(cfg.Hooks.PreApply)+len(cfg.Hooks.PostApply) > 0:
+		field = "hooks"
+	case cfg.Audit.Path != "":
+		field = "audit.path"
+	case cfg.Audit.ConsulKVPrefix != "":
+		field = "audit.consul_kv_prefix"
+	case cfg.Backup.Dir != "":
+		field = "backup.dir"
+	case cfg.History.ConsulKVPrefix != "":
+		field = "history.consul_kv_prefix"
+	case cfg.ManagementTokenPath != "":
+		field = "management_token_path"
+	case cfg.SecretsBackend != "":
+		field = "secrets_backend"
+	case cfg.Vault != (config.VaultConfig{}):
+		field = "vault"
+	case cfg.AWS != (config.AWSConfig{}):
+		field = "aws"
+	case len(cfg.Consul.HeadersEnv) > 0:
+		field = "consul.headers_env"
+	case len(cfg.Notifications) > 0:
+		field = "notifications"
+	case cfg.Metrics.Pushgateway != "" || cfg.Metrics.StatsD != "":
+		field = "metrics"
+	}
+	if field != "" {
+		return fmt.Errorf("%s is not allowed in %s", field, where)
+	}
+	for _, t := range cfg.Tokens {
+		if t.KubernetesSecret != nil {
+			return fmt.Errorf("token %s: kubernetes_secret is not allowed in %s", t.AccessorID, where)
+		}
+	}
+	for _, m := range cfg.AuthMethods {
+		if m.Kubernetes != nil {
+			return fmt.Errorf("auth method %s: kubernetes is not allowed in %s", m.Name, where)
+		}
+	}
+	return nil
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeServeError(w http.ResponseWriter, status int, msg string) {
+	writeServeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// serveCommand runs an HTTP server that plans and applies configs sent to it,
+// for platforms that drive syncs without shelling out to the CLI. Clients
+// authenticate with the bearer token in CONSUL_ACL_SYNC_SERVE_TOKEN.
+func serveCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		listen string
+	)
+	opts.registerConnection(fs)
+	fs.BoolVar(&opts.showVersion, "version", false, "print version and exit")
+	fs.StringVar(&listen, "listen", "127.0.0.1:8080", "address to listen on")
+	return func([]string) error {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		token := os.Getenv(serveTokenEnv)
+		if token == "" {
+			return fmt.Errorf("serve needs a client token in %s", serveTokenEnv)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		hs := &http.Server{
+			Addr:              listen,
+			Handler:           &server{opts: &opts, token: token},
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- hs.ListenAndServe() }()
+		fmt.Fprintf(os.Stderr, "serving on %s\n", listen)
+
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+		}
+		// Let a running apply finish.
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		return hs.Shutdown(shutdown)
+	}
+}
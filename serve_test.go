@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeRefusesUntrustedSettings(t *testing.T) {
+	const policy = `
+policies:
+  - name: web
+    description: web
+    rules: 'service "web" { policy = "read" }'
+`
+	tests := []struct {
+		field  string
+		config string
+	}{
+		{"hooks", "hooks:\n  pre_plan: [\"true\"]\n"},
+		{"audit.path", "audit:\n  path: /tmp/audit.jsonl\n"},
+		{"audit.consul_kv_prefix", "audit:\n  consul_kv_prefix: audit/acl\n"},
+		{"backup.dir", "backup:\n  dir: /tmp\n"},
+		{"history.consul_kv_prefix", "history:\n  consul_kv_prefix: any/path\n"},
+		{"management_token_path", "secrets_backend: vault\nmanagement_token_path: secret/consul\n"},
+		{"secrets_backend", "secrets_backend: aws\n"},
+		{"vault", "vault:\n  address: https://vault.example.com\n"},
+		{"aws", "aws:\n  endpoint: https://aws.example.com\n"},
+		{"consul.headers_env", "consul:\n  headers_env:\n    X-Leak: AWS_SECRET_ACCESS_KEY\n"},
+		{"notifications", "notifications:\n  - url: http://169.254.169.254/\n"},
+		{"metrics", "metrics:\n  pushgateway: http://169.254.169.254/\n"},
+		{"metrics", "metrics:\n  statsd: 10.0.0.1:8125\n"},
+		{"kubernetes_secret", `
+tokens:
+  - accessor_id: 3b2a1c00-0000-4000-8000-000000000001
+    secret_id: 9f1c7d00-0000-4000-8000-000000000001
+    description: web
+    policies: [web]
+    kubernetes_secret:
+      name: web
+`},
+		{"kubernetes", `
+auth_methods:
+  - name: k8s
+    type: kubernetes
+    kubernetes:
+      in_cluster: true
+`},
+		{"kubernetes", `
+auth_methods:
+  - name: k8s
+    type: kubernetes
+    kubernetes:
+      kubeconfig: /root/.kube/config
+`},
+	}
+	srv := &server{opts: &options{}, token: "secret"}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/plan", strings.NewReader(policy+tt.config))
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+
+			var res struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.field + " is not allowed in a config sent to serve"
+			if rec.Code != http.StatusBadRequest || !strings.Contains(res.Error, want) {
+				t.Errorf("got %d %q, want %d and an error containing %q", rec.Code, res.Error, http.StatusBadRequest, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// shownPolicy is a live policy as show prints it.
+type shownPolicy struct {
+	ID          string   `json:"id" yaml:"id"`
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description" yaml:"description"`
+	Datacenters []string `json:"datacenters,omitempty" yaml:"datacenters,omitempty"`
+	Rules       string   `json:"rules" yaml:"rules"`
+	Managed     bool     `json:"managed" yaml:"managed"`
+	Builtin     bool     `json:"builtin,omitempty" yaml:"builtin,omitempty"`
+}
+
+// shownToken is a live token as show prints it. The SecretID is never part of
+// it.
+type shownToken struct {
+	AccessorID     string     `json:"accessor_id" yaml:"accessor_id"`
+	Description    string     `json:"description" yaml:"description"`
+	Policies       []string   `json:"policies" yaml:"policies"`
+	Local          bool       `json:"local" yaml:"local"`
+	CreateTime     time.Time  `json:"create_time" yaml:"create_time"`
+	ExpirationTime *time.Time `json:"expiration_time,omitempty" yaml:"expiration_time,omitempty"`
+	Managed        bool       `json:"managed" yaml:"managed"`
+	Builtin        bool       `json:"builtin,omitempty" yaml:"builtin,omitempty"`
+}
+
+// showCommand prints one live resource: show policy <name> or show token
+// <accessor ID or description>.
+func showCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		output string
+	)
+	opts.register(fs)
+	fs.StringVar(&output, "output", "yaml", "output format: yaml or json")
+	return func(args []string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if len(args) != 2 || (args[0] != "policy" && args[0] != "token") {
+			return fmt.Errorf("usage: consul-acl-sync show [flags] policy <name> | token <accessor ID or description>")
+		}
+		if output != "yaml" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want yaml or json)", output)
+		}
+
+		s, err := opts.open("show")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		var v interface{}
+		if args[0] == "policy" {
+			v, err = showPolicy(s, args[1])
+		} else {
+			v, err = showToken(s, args[1])
+		}
+		if err != nil {
+			return err
+		}
+		return writeShown(os.Stdout, v, output)
+	}
+}
+
+func showPolicy(s *session, name string) (*shownPolicy, error) {
+	policies, err := s.client.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+	for _, p := range policies {
+		if p.Name != name {
+			continue
+		}
+		full, err := s.client.PolicyRules(p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy %q: %w", name, err)
+		}
+		managed := false
+		for _, d := range s.cfg.Policies {
+			managed = managed || d.Name == name
+		}
+		return &shownPolicy{
+			ID:          full.ID,
+			Name:        full.Name,
+			Description: full.Description,
+			Datacenters: full.Datacenters,
+			Rules:       full.Rules,
+			Managed:     managed,
+			Builtin:     full.Builtin(),
+		}, nil
+	}
+	return nil, fmt.Errorf("policy %q not found", name)
+}
+
+// showToken finds the token by accessor ID, or else by exact description,
+// which must then be unique.
+func showToken(s *session, ref string) (*shownToken, error) {
+	var (
+		t  consul.Token
+		ok bool
+	)
+	if config.IsUUID(ref) {
+		var err error
+		if t, ok, err = s.client.ReadToken(ref); err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+	}
+	if !ok {
+		tokens, err := s.client.ListTokens()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tokens: %w", err)
+		}
+		var matches []consul.Token
+		for _, c := range tokens {
+			if c.Description == ref {
+				matches = append(matches, c)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("no token with accessor ID or description %q", ref)
+		case 1:
+			t = matches[0]
+		default:
+			ids := make([]string, 0, len(matches))
+			for _, m := range matches {
+				ids = append(ids, m.AccessorID)
+			}
+			return nil, fmt.Errorf("%d tokens have description %q; pass the accessor ID: %s", len(matches), ref, strings.Join(ids, ", "))
+		}
+	}
+
+	managed := false
+	for _, d := range s.cfg.Tokens {
+		managed = managed || d.AccessorID == t.AccessorID
+	}
+	return &shownToken{
+		AccessorID:     t.AccessorID,
+		Description:    t.Description,
+		Policies:       t.PolicyNames(),
+		Local:          t.Local,
+		CreateTime:     t.CreateTime,
+		ExpirationTime: t.ExpirationTime,
+		Managed:        managed,
+		Builtin:        t.Builtin(),
+	}, nil
+}
+
+func writeShown(w io.Writer, v interface{}, output string) error {
+	if output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	b, err := yaml.MarshalWithOptions(v, yaml.UseLiteralStyleIfMultiline(true))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
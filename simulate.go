@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+)
+
+// stringsFlag is a flag that may be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// operation is one -op: resource:access[:name], e.g. service:write:web or
+// operator:read.
+type operation struct {
+	resource, access, name string
+}
+
+func parseOperation(s string) (operation, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 {
+		return operation{}, fmt.Errorf("operation %q: want resource:access[:name]", s)
+	}
+	op := operation{resource: parts[0], access: parts[1]}
+	if len(parts) == 3 {
+		op.name = parts[2]
+	}
+	if op.access != "read" && op.access != "list" && op.access != "write" {
+		return operation{}, fmt.Errorf("operation %q: unknown access %q (want read, list or write)", s, op.access)
+	}
+	known := false
+	for _, res := range whoCanResources {
+		known = known || res == op.resource
+	}
+	if !known {
+		return operation{}, fmt.Errorf("operation %q: unknown resource %q (want one of %s)", s, op.resource, strings.Join(whoCanResources, ", "))
+	}
+	if scalar := (acl.Rule{Resource: op.resource}).Scalar(); scalar && len(parts) == 3 {
+		return operation{}, fmt.Errorf("operation %q: %s takes no name", s, op.resource)
+	} else if !scalar && len(parts) != 3 {
+		return operation{}, fmt.Errorf("operation %q: %s needs a name", s, op.resource)
+	}
+	return op, nil
+}
+
+func (op operation) String() string {
+	if (acl.Rule{Resource: op.resource}).Scalar() {
+		return op.access + " " + op.resource
+	}
+	return fmt.Sprintf("%s %s %q", op.access, op.resource, op.name)
+}
+
+// simulateCommand evaluates a token as the config declares it, with all of its
+// policies combined, against operations. It reads only the config, so
+// least privilege can be checked before anything is applied.
+func simulateCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts        configOptions
+		accessorID  string
+		description string
+		ops         stringsFlag
+	)
+	opts.register(fs)
+	fs.StringVar(&accessorID, "token", "", "accessor ID of the token to simulate")
+	fs.StringVar(&description, "token-description", "", "description of the token to simulate")
+	fs.Var(&ops, "op", "operation to evaluate as resource:access[:name], e.g. service:write:web (repeatable)")
+	return func([]string) error {
+		if (accessorID == "") == (description == "") {
+			return fmt.Errorf("pass one of -token or -token-description")
+		}
+		if len(ops) == 0 {
+			return fmt.Errorf("-op is required")
+		}
+		parsedOps := make([]operation, 0, len(ops))
+		for _, s := range ops {
+			op, err := parseOperation(s)
+			if err != nil {
+				return err
+			}
+			parsedOps = append(parsedOps, op)
+		}
+
+		cfg, err := opts.load()
+		if err != nil {
+			return err
+		}
+		var token *config.Token
+		for i, t := range cfg.Tokens {
+			if (accessorID != "" && t.AccessorID == accessorID) || (description != "" && t.Description == description) {
+				if token != nil {
+					return fmt.Errorf("several tokens have description %q; pass -token", description)
+				}
+				token = &cfg.Tokens[i]
+			}
+		}
+		if token == nil {
+			return fmt.Errorf("no token in the config matches")
+		}
+
+		src, missing, err := tokenRules(cfg, token)
+		if err != nil {
+			return err
+		}
+		printSimulation(os.Stdout, token, parsedOps, src, missing)
+		return nil
+	}
+}
+
+// tokenRules merges the rules of the policies a token of the config has,
+// directly and through its roles. The rules Consul derives from the
+// identities and templated policies of roles are not included. missing lists
+// the roles and policies the config does not define.
+func tokenRules(cfg *config.Config, token *config.Token) (src sourcedRules, missing []string, err error) {
+	policies := append([]string(nil), token.Policies...)
+	for _, name := range token.Roles {
+		var r *config.Role
+		for i := range cfg.Roles {
+			if cfg.Roles[i].Name == name {
+				r = &cfg.Roles[i]
+			}
+		}
+		if r == nil {
+			missing = append(missing, "role "+name)
+			continue
+		}
+		policies = append(policies, r.Policies...)
+	}
+	for _, name := range policies {
+		var p *config.Policy
+		for i := range cfg.Policies {
+			if cfg.Policies[i].Name == name {
+				p = &cfg.Policies[i]
+			}
+		}
+		if p == nil {
+			missing = append(missing, name)
+			continue
+		}
+		rules, err := acl.Parse(p.Rules)
+		if err != nil {
+			return sourcedRules{}, nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		src.add(name, rules)
+	}
+	return src, missing, nil
+}
+
+func printSimulation(w io.Writer, token *config.Token, ops []operation, src sourcedRules, missing []string) {
+	fmt.Fprintf(w, "Token %s with policies %s:\n", token.Label(), strings.Join(token.Policies, ", "))
+	for _, op := range ops {
+		i := acl.Decide(src.rules, op.resource, op.name)
+		switch {
+		case i < 0:
+			fmt.Fprintf(w, "  default %s: no rule matches; the agent's default_policy decides\n", op)
+		case acl.Allows(src.rules[i].Policy, op.access):
+			fmt.Fprintf(w, "  allow   %s: %q %s\n", op, src.policy[i], src.rules[i])
+		default:
+			fmt.Fprintf(w, "  deny    %s: %q %s\n", op, src.policy[i], src.rules[i])
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "\nNot in the config, not evaluated: %s\n", strings.Join(missing, ", "))
+	}
+}
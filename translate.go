@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// warnLegacyRules warns about the policies whose rules look written in the
+// legacy syntax, where named rules matched by prefix. Consul reads them in
+// the current syntax, as exact rules, so they likely grant less than meant.
+func (s *session) warnLegacyRules() {
+	for _, p := range s.cfg.Policies {
+		legacy := acl.Legacy(p.Rules)
+		if len(legacy) == 0 {
+			continue
+		}
+		rules := make([]string, len(legacy))
+		for i, r := range legacy {
+			rules[i] = r.String()
+		}
+		fmt.Fprintf(os.Stderr, "warning: policy %q looks written in the legacy rule syntax, which matched by prefix: %s; translate-rules rewrites it\n",
+			p.Key(), strings.Join(rules, ", "))
+	}
+}
+
+// translateRulesCommand prints the rules of the policies that look written in
+// the legacy syntax, or of those named with -policy, rewritten in the current
+// one, ready to replace the rules of the config.
+func translateRulesCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts       options
+		translator string
+		policies   listFlag
+	)
+	opts.register(fs)
+	fs.StringVar(&translator, "translator", "local", "local, or consul to use the rules translate endpoint of Consul before 1.11")
+	fs.Var(&policies, "policy", "translate this policy even if it does not look legacy (repeatable)")
+	return func([]string) (err error) {
+		if translator != "local" && translator != "consul" {
+			return fmt.Errorf("unknown -translator %q (want local or consul)", translator)
+		}
+		cfg, err := opts.load()
+		if err != nil {
+			return err
+		}
+		named := make(map[string]bool, len(policies))
+		for _, name := range policies {
+			named[name] = true
+		}
+		var chosen []config.Policy
+		for _, p := range cfg.Policies {
+			if named[p.Key()] || len(acl.Legacy(p.Rules)) > 0 {
+				chosen = append(chosen, p)
+			}
+			delete(named, p.Key())
+		}
+		for name := range named {
+			return fmt.Errorf("policy %q is not in the config", name)
+		}
+		if len(chosen) == 0 {
+			fmt.Println("No policy looks written in the legacy rule syntax.")
+			return nil
+		}
+
+		translate := func(rules string) (string, error) {
+			out, _, err := acl.Translate(rules)
+			return out, err
+		}
+		if translator == "consul" {
+			s, err := opts.connect("translate-rules", opts.configPath, cfg)
+			if err != nil {
+				return err
+			}
+			defer func() { s.close(err) }()
+			defer func() { err = s.red.Error(err) }()
+			t, ok := s.client.(consul.Translator)
+			if !ok {
+				return fmt.Errorf("-consul-client %s cannot translate rules; use -consul-client http", opts.consulClient)
+			}
+			translate = t.TranslateRules
+		}
+
+		for i, p := range chosen {
+			out, err := translate(p.Rules)
+			if err != nil {
+				return fmt.Errorf("policy %q: %w", p.Key(), err)
+			}
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# policy %q\nrules: |\n", p.Key())
+			for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+				fmt.Println(strings.TrimRight("  "+line, " "))
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// reviewPlan shows the plan in a full-screen terminal UI: the changes on the
+// left, the selected change's full detail on the right. It needs a Unix
+// terminal, since raw mode is set through stty.
+//
+// Keys: j/k or arrows move the selection, J/K or PgDn/PgUp scroll the
+// detail, q or Esc quits.
+func reviewPlan(plan *diff.Plan) error {
+	items := diff.Items(plan)
+	if len(items) == 0 {
+		fmt.Println("No changes. Consul is up to date.")
+		return nil
+	}
+
+	saved, err := stty("-g")
+	if err != nil {
+		return fmt.Errorf("-ui needs an interactive terminal: %w", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = stty(strings.TrimSpace(saved))
+		fmt.Print("\x1b[?25h\x1b[2J\x1b[H")
+	}()
+	fmt.Print("\x1b[?25l")
+
+	ui := &planUI{items: items, summary: diff.Summary(plan)}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		ui.rows, ui.cols = terminalSize()
+		ui.draw(os.Stdout)
+		key, err := readKey(in)
+		if err != nil {
+			return err
+		}
+		if !ui.handle(key) {
+			return nil
+		}
+	}
+}
+
+type planUI struct {
+	items      []diff.Item
+	summary    string
+	selected   int
+	listTop    int
+	scroll     int
+	rows, cols int
+}
+
+// handle applies a key press and reports whether the UI should keep running.
+func (u *planUI) handle(key string) bool {
+	page := max(u.rows-3, 1)
+	switch key {
+	case "q", "esc", "ctrl-c":
+		return false
+	case "j", "down":
+		if u.selected < len(u.items)-1 {
+			u.selected++
+			u.scroll = 0
+		}
+	case "k", "up":
+		if u.selected > 0 {
+			u.selected--
+			u.scroll = 0
+		}
+	case "J", "pgdn":
+		if u.scroll+page < len(u.items[u.selected].Detail) {
+			u.scroll += page
+		}
+	case "K", "pgup":
+		u.scroll = max(u.scroll-page, 0)
+	}
+	return true
+}
+
+func (u *planUI) draw(w io.Writer) {
+	body := max(u.rows-2, 1)
+	listWidth := min(max(u.cols/3, 20), u.cols/2)
+	detailWidth := max(u.cols-listWidth-3, 1)
+
+	if u.selected < u.listTop {
+		u.listTop = u.selected
+	}
+	if u.selected >= u.listTop+body {
+		u.listTop = u.selected - body + 1
+	}
+	item := u.items[u.selected]
+
+	var b strings.Builder
+	b.WriteString("\x1b[2J\x1b[H")
+	b.WriteString("\x1b[1m" + fit(u.summary, u.cols) + "\x1b[0m\r\n")
+	for row := 0; row < body; row++ {
+		left := ""
+		if i := u.listTop + row; i < len(u.items) {
+			left = fit(u.items[i].Title, listWidth)
+			if i == u.selected {
+				left = "\x1b[7m" + left + "\x1b[0m"
+			}
+		}
+		right := ""
+		if row == 0 {
+			right = "\x1b[1m" + fit(item.Title, detailWidth) + "\x1b[0m"
+		} else if i := u.scroll + row - 1; i < len(item.Detail) {
+			right = colorDiffLine(fit(item.Detail[i], detailWidth))
+		}
+		b.WriteString(left + fmt.Sprintf("\x1b[%dG", listWidth+1) + " | " + right + "\r\n")
+	}
+	b.WriteString("\x1b[2m" + fit(fmt.Sprintf("%d/%d  j/k move  J/K scroll  q quit", u.selected+1, len(u.items)), u.cols) + "\x1b[0m")
+	fmt.Fprint(w, b.String())
+}
+
+// colorDiffLine colors rule diff lines: additions green, removals red.
+func colorDiffLine(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	switch {
+	case strings.HasPrefix(trimmed, "+ "):
+		return "\x1b[32m" + line + "\x1b[0m"
+	case strings.HasPrefix(trimmed, "- "):
+		return "\x1b[31m" + line + "\x1b[0m"
+	}
+	return line
+}
+
+// fit truncates s to width runes.
+func fit(s string, width int) string {
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	if width < 1 {
+		return ""
+	}
+	return string(r[:width-1]) + "~"
+}
+
+// readKey reads one key press, decoding the escape sequences of the keys the
+// UI uses.
+func readKey(in *bufio.Reader) (string, error) {
+	c, err := in.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch c {
+	case 3:
+		return "ctrl-c", nil
+	case 0x1b:
+		if in.Buffered() == 0 {
+			return "esc", nil
+		}
+		// A CSI sequence ends at its first letter or tilde.
+		var seq []byte
+		for in.Buffered() > 0 && len(seq) < 4 {
+			b, _ := in.ReadByte()
+			seq = append(seq, b)
+			if len(seq) > 1 && (b == '~' || ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z')) {
+				break
+			}
+		}
+		switch string(seq) {
+		case "[A":
+			return "up", nil
+		case "[B":
+			return "down", nil
+		case "[5~":
+			return "pgup", nil
+		case "[6~":
+			return "pgdn", nil
+		}
+		return "", nil
+	}
+	return string(c), nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// outputWidth is the width text output fits: $COLUMNS, else the terminal's,
+// else a wide 160 columns when there is no terminal, as in CI logs.
+func outputWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	out, err := stty("size")
+	if err != nil {
+		return 160
+	}
+	if fields := strings.Fields(out); len(fields) == 2 {
+		if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 160
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalSize returns the terminal's rows and columns, or 24x80 when unknown.
+func terminalSize() (rows, cols int) {
+	out, err := stty("size")
+	if err != nil {
+		return 24, 80
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return 24, 80
+	}
+	rows, err1 := strconv.Atoi(fields[0])
+	cols, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || rows == 0 || cols == 0 {
+		return 24, 80
+	}
+	return rows, cols
+}
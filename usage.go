@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// policyUsage is one live policy with everything that references it.
+type policyUsage struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Managed bool         `json:"managed"`
+	Builtin bool         `json:"builtin,omitempty"`
+	Tokens  []usageToken `json:"tokens"`
+	Roles   []string     `json:"roles"`
+	Unused  bool         `json:"unused"`
+}
+
+// usageToken is a token that grants a policy, directly or through a role.
+type usageToken struct {
+	AccessorID  string `json:"accessor_id"`
+	Description string `json:"description"`
+	// Role names the role the policy comes from, empty when the token links
+	// the policy itself.
+	Role string `json:"role,omitempty"`
+}
+
+// policyUsages resolves every token's policies, direct and through its roles,
+// back to the policies. Links are matched by ID, as names may have changed
+// since the link was made.
+func policyUsages(inv *inventory, roles []consul.Role) []policyUsage {
+	byID := make(map[string]*policyUsage, len(inv.policies))
+	usages := make([]policyUsage, len(inv.policies))
+	for i, p := range inv.policies {
+		usages[i] = policyUsage{
+			ID:      p.ID,
+			Name:    p.Name,
+			Managed: inv.managedPolicies[p.Name],
+			Builtin: p.Builtin(),
+			Tokens:  []usageToken{},
+			Roles:   []string{},
+		}
+		byID[p.ID] = &usages[i]
+	}
+
+	rolePolicies := make(map[string][]consul.PolicyLink, len(roles))
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	for _, r := range roles {
+		rolePolicies[r.ID] = r.Policies
+		for _, l := range r.Policies {
+			if u := byID[l.ID]; u != nil {
+				u.Roles = append(u.Roles, r.Name)
+			}
+		}
+	}
+
+	for _, t := range inv.tokens {
+		for _, l := range t.Policies {
+			if u := byID[l.ID]; u != nil {
+				u.Tokens = append(u.Tokens, usageToken{AccessorID: t.AccessorID, Description: t.Description})
+			}
+		}
+		for _, rl := range t.Roles {
+			for _, l := range rolePolicies[rl.ID] {
+				if u := byID[l.ID]; u != nil {
+					u.Tokens = append(u.Tokens, usageToken{AccessorID: t.AccessorID, Description: t.Description, Role: rl.Name})
+				}
+			}
+		}
+	}
+
+	for i := range usages {
+		usages[i].Unused = len(usages[i].Tokens) == 0 && len(usages[i].Roles) == 0
+	}
+	return usages
+}
+
+// usageCommand reports which tokens and roles reference each policy and flags
+// the policies nothing references.
+func usageCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts       options
+		output     string
+		unusedOnly bool
+	)
+	opts.register(fs)
+	fs.StringVar(&output, "output", "text", "report format: text or json")
+	fs.BoolVar(&unusedOnly, "unused", false, "only report policies nothing references")
+	return func([]string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want text or json)", output)
+		}
+		s, err := opts.open("usage")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		roles, err := s.client.ListRoles()
+		if err != nil {
+			return fmt.Errorf("failed to list roles: %w", err)
+		}
+		usages := policyUsages(inv, roles)
+		if unusedOnly {
+			kept := usages[:0]
+			for _, u := range usages {
+				if u.Unused {
+					kept = append(kept, u)
+				}
+			}
+			usages = kept
+		}
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(usages)
+		}
+		printUsage(os.Stdout, usages)
+		return nil
+	}
+}
+
+func printUsage(w io.Writer, usages []policyUsage) {
+	unused, unusedManaged := 0, 0
+	for _, u := range usages {
+		state := managedLabel(u.Managed) + builtinLabel(u.Builtin)
+		if !u.Unused {
+			fmt.Fprintf(w, "%q (%s): %d tokens, %d roles\n", u.Name, state, len(u.Tokens), len(u.Roles))
+		} else {
+			fmt.Fprintf(w, "%q (%s): unused\n", u.Name, state)
+			unused++
+			if u.Managed {
+				unusedManaged++
+			}
+		}
+		for _, t := range u.Tokens {
+			label := t.AccessorID
+			if t.Description != "" {
+				label += fmt.Sprintf(" %q", t.Description)
+			}
+			if t.Role != "" {
+				label += fmt.Sprintf(" via role %q", t.Role)
+			}
+			fmt.Fprintf(w, "  token %s\n", label)
+		}
+		for _, r := range u.Roles {
+			fmt.Fprintf(w, "  role  %q\n", r)
+		}
+	}
+	fmt.Fprintf(w, "\n%d of %d policies unused (%d managed).\n", unused, len(usages), unusedManaged)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zinrai/consul-acl-sync/pkg/config"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+	"github.com/zinrai/consul-acl-sync/pkg/diff"
+)
+
+// validateRules has Consul check the rules of every policy the plan creates
+// or changes the rules of, so rules the local parser accepts but Consul rejects fail the
+// plan rather than the apply. Consul has no endpoint that only parses rules,
+// so each is written to a scratch policy that is deleted again: it is only
+// done with -validate-rules, and needs a token that can write ACLs.
+func (s *session) validateRules(plan *diff.Plan) error {
+	if !s.validateRulesInConsul {
+		return nil
+	}
+	policies := append([]config.Policy(nil), plan.PoliciesToCreate...)
+	for _, u := range plan.PoliciesToUpdate {
+		if u.Current.Rules != u.Desired.Rules {
+			policies = append(policies, u.Desired)
+		}
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	if s.readOnly {
+		return fmt.Errorf("-validate-rules writes scratch policies to Consul and needs a token with acl = \"write\"")
+	}
+	v, ok := s.client.(consul.RulesValidator)
+	if !ok {
+		return fmt.Errorf("the Consul client cannot validate rules; leave out -validate-rules")
+	}
+	var errs []error
+	for _, p := range policies {
+		if err := v.ValidateRules(p); err != nil {
+			errs = append(errs, fmt.Errorf("policy %q: Consul rejects its rules: %w", p.Key(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
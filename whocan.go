@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zinrai/consul-acl-sync/pkg/acl"
+	"github.com/zinrai/consul-acl-sync/pkg/consul"
+)
+
+// whoCanResources are the resources who-can evaluates. The scalar ones take
+// no name.
+var whoCanResources = []string{"acl", "agent", "event", "identity", "key", "keyring", "mesh", "node", "operator", "peering", "query", "service", "session"}
+
+// grant is a policy or token that has the access asked about, with the rule
+// that decides it.
+type grant struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Policy string `json:"policy,omitempty"` // for tokens, the policy the rule is in
+	Rule   string `json:"rule"`
+}
+
+type whoCanReport struct {
+	Access   string   `json:"access"`
+	Resource string   `json:"resource"`
+	Name     string   `json:"name,omitempty"`
+	Policies []grant  `json:"policies"`
+	Tokens   []grant  `json:"tokens"`
+	Skipped  []string `json:"skipped,omitempty"` // policies whose rules do not parse
+}
+
+// sourcedRules is rules with the policy each one came from.
+type sourcedRules struct {
+	rules  []acl.Rule
+	policy []string
+}
+
+func (s *sourcedRules) add(policy string, rules []acl.Rule) {
+	s.rules = append(s.rules, rules...)
+	for range rules {
+		s.policy = append(s.policy, policy)
+	}
+}
+
+// whoCan evaluates access to resource name for every policy on its own and
+// for every token with all of its policies, direct and through roles, merged.
+// A token no rule applies to falls to the agent's default policy and is not
+// reported.
+func whoCan(inv *inventory, roles []consul.Role, rules map[string]string, access, resource, name string) whoCanReport {
+	r := whoCanReport{Access: access, Resource: resource, Name: name, Policies: []grant{}, Tokens: []grant{}}
+
+	parsed := make(map[string][]acl.Rule, len(inv.policies))
+	names := make(map[string]string, len(inv.policies))
+	for _, p := range inv.policies {
+		got, err := acl.Parse(rules[p.ID])
+		if err != nil {
+			r.Skipped = append(r.Skipped, p.Name)
+			continue
+		}
+		parsed[p.ID], names[p.ID] = got, p.Name
+		if i := acl.Decide(got, resource, name); i >= 0 && acl.Allows(got[i].Policy, access) {
+			r.Policies = append(r.Policies, grant{ID: p.ID, Name: p.Name, Rule: got[i].String()})
+		}
+	}
+
+	rolePolicies := make(map[string][]consul.PolicyLink, len(roles))
+	for _, role := range roles {
+		rolePolicies[role.ID] = role.Policies
+	}
+	for _, t := range inv.tokens {
+		var src sourcedRules
+		links := append([]consul.PolicyLink(nil), t.Policies...)
+		for _, rl := range t.Roles {
+			links = append(links, rolePolicies[rl.ID]...)
+		}
+		for _, l := range links {
+			src.add(names[l.ID], parsed[l.ID])
+		}
+		if i := acl.Decide(src.rules, resource, name); i >= 0 && acl.Allows(src.rules[i].Policy, access) {
+			r.Tokens = append(r.Tokens, grant{ID: t.AccessorID, Name: t.Description, Policy: src.policy[i], Rule: src.rules[i].String()})
+		}
+	}
+	return r
+}
+
+// whoCanCommand answers "who can <access> <resource> [name]" against the
+// live policies and tokens, e.g. who-can write key myapp/config.
+func whoCanCommand(fs *flag.FlagSet) func([]string) error {
+	var (
+		opts   options
+		output string
+	)
+	opts.register(fs)
+	fs.StringVar(&output, "output", "text", "report format: text or json")
+	return func(args []string) (err error) {
+		if opts.showVersion {
+			printVersion()
+			return nil
+		}
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("usage: consul-acl-sync who-can [flags] read|list|write <resource> [name]")
+		}
+		access, resource, name := args[0], args[1], ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		if access != "read" && access != "list" && access != "write" {
+			return fmt.Errorf("unknown access %q (want read, list or write)", access)
+		}
+		known := false
+		for _, res := range whoCanResources {
+			known = known || res == resource
+		}
+		if !known {
+			return fmt.Errorf("unknown resource %q (want one of %s)", resource, strings.Join(whoCanResources, ", "))
+		}
+		if scalar := (acl.Rule{Resource: resource}).Scalar(); scalar && name != "" {
+			return fmt.Errorf("%s takes no name", resource)
+		} else if !scalar && len(args) != 3 {
+			return fmt.Errorf("%s needs a name", resource)
+		}
+		if output != "text" && output != "json" {
+			return fmt.Errorf("unknown -output %q (want text or json)", output)
+		}
+
+		s, err := opts.open("who-can")
+		if err != nil {
+			return err
+		}
+		defer func() { s.close(err) }()
+		defer func() { err = s.red.Error(err) }()
+
+		inv, err := loadInventory(s.client, s.cfg)
+		if err != nil {
+			return err
+		}
+		roles, err := s.client.ListRoles()
+		if err != nil {
+			return fmt.Errorf("failed to list roles: %w", err)
+		}
+		rules, err := loadPolicyRules(s.client, inv)
+		if err != nil {
+			return err
+		}
+		r := whoCan(inv, roles, rules, access, resource, name)
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(r)
+		}
+		printWhoCan(os.Stdout, r)
+		return nil
+	}
+}
+
+func printWhoCan(w io.Writer, r whoCanReport) {
+	subject := r.Access + " " + r.Resource
+	if !(acl.Rule{Resource: r.Resource}).Scalar() {
+		subject += fmt.Sprintf(" %q", r.Name)
+	}
+	fmt.Fprintf(w, "Policies that grant %s (%d):\n", subject, len(r.Policies))
+	for _, g := range r.Policies {
+		fmt.Fprintf(w, "  %q: %s\n", g.Name, g.Rule)
+	}
+	fmt.Fprintf(w, "\nTokens that can %s (%d):\n", subject, len(r.Tokens))
+	for _, g := range r.Tokens {
+		label := g.ID
+		if g.Name != "" {
+			label += fmt.Sprintf(" %q", g.Name)
+		}
+		fmt.Fprintf(w, "  %s via %q: %s\n", label, g.Policy, g.Rule)
+	}
+	if len(r.Skipped) > 0 {
+		fmt.Fprintf(w, "\nNot evaluated, rules do not parse: %s\n", strings.Join(r.Skipped, ", "))
+	}
+	fmt.Fprintln(w, "\nTokens no rule covers get the agent's default_policy, which is not known here.")
+}